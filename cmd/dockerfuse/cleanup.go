@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/dguerri/dockerfuse/cmd/dockerfuse/client"
+)
+
+// cleanup implements `dockerfuse cleanup`, removing the helper containers of image mounts, and with
+// -i terminating satellites, left behind by crashed sessions
+func cleanup(args []string) int {
+	var (
+		containerID string
+		all         bool
+		satDirs     string
+		debug       bool
+		backend     string
+		docker      client.DockerConfig
+		containerd  client.ContainerdConfig
+	)
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s cleanup [-i <container>] [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&containerID, "id", "", "Docker container ID (or name) whose satellites are terminated, or target of -backend")
+	flags.StringVar(&containerID, "i", "", "Docker container ID (or name) whose satellites are terminated, or target of -backend")
+	flags.StringVar(&backend, "backend", client.BackendDocker, fmt.Sprintf("Runtime backend of -id: %s or %s", client.BackendDocker, client.BackendContainerd))
+	flags.BoolVar(&all, "all", false, "Terminate every satellite and remove every helper container, including those serving mounts from other hosts")
+	flags.StringVar(&satDirs, "satellite-dirs", strings.Join(client.DefaultSatelliteDirs, ","), "Comma separated container directories where the satellite may be copied, in order of preference")
+	addDockerFlags(flags, &docker)
+	addContainerdFlags(flags, &containerd)
+	flags.BoolVar(&debug, "debug", false, "Log debug messages")
+	flags.Parse(args)
+
+	setupLogger(debug, false)
+
+	opts := []client.ClientOption{client.WithSatelliteDirs(splitList(satDirs)), client.WithDocker(docker)}
+	switch backend {
+	case client.BackendDocker:
+		if containerd.Namespace != "" {
+			slog.Error("-namespace needs -backend " + client.BackendContainerd + ".\n")
+			flags.Usage()
+			return errorArgs
+		}
+	case client.BackendContainerd:
+		containerd.Address = docker.Host
+		opts = append(opts, client.WithContainerd(containerd))
+	default:
+		slog.Error(fmt.Sprintf("unknown backend %q (supported: %s, %s).\n", backend, client.BackendDocker, client.BackendContainerd))
+		flags.Usage()
+		return errorArgs
+	}
+
+	// Helper containers only exist with the Docker API
+	if backend == client.BackendDocker {
+		removed, err := client.CleanupImageHelpers(all, client.WithDocker(docker))
+		if err != nil {
+			slog.Error("cleanup failed", "error", err)
+			return errorCleanup
+		}
+		if len(removed) == 0 {
+			slog.Info("no orphaned helper containers found")
+		} else {
+			slog.Info("removed orphaned helper containers", "ids", strings.Join(removed, ","))
+		}
+	}
+	if containerID == "" {
+		return errorNone
+	}
+
+	killed, err := client.CleanupSatellites(containerID, all, opts...)
+	if err != nil {
+		slog.Error("cleanup failed", "error", err)
+		return errorCleanup
+	}
+	if len(killed) == 0 {
+		slog.Info("no orphaned satellites found")
+	} else {
+		slog.Info("terminated orphaned satellites", "pids", strings.Join(killed, ","))
+	}
+	return errorNone
+}
@@ -0,0 +1,834 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ByIDDir lists containers by ID, in mounts of all containers
+const ByIDDir = "by-id"
+
+// DefaultIdleTimeout is how long connections to containers are kept while unused
+const DefaultIdleTimeout = 5 * time.Minute
+
+// newContainerClient connects to a container of mounts of all containers
+var newContainerClient = NewClient
+
+// AllConfig selects the containers mounted by NewAllContainers, and how they are accessed
+type AllConfig struct {
+	// Access mode of each container, as in NewClient
+	Access string
+	// Container path shown for each container
+	Path string
+	// Docker filters restricting containers, as key=value (e.g. label=env=dev, name=web)
+	Filters []string
+	// How long unused connections are kept
+	IdleTimeout time.Duration
+	// Forward changes made inside connected containers to watchChanges
+	Watch bool
+	// Name names containers, after their Docker name by default. Containers named "" are left out.
+	Name func(c container.Summary) string
+	// Root, if set, names the only container served, at the root of the mount
+	Root string
+}
+
+// AllContainers serves all running containers, each in a directory named after it, and symbolic
+// links to them in ByIDDir. Containers are connected on first access, and disconnected when idle.
+// The list follows Docker events. With AllConfig.Root, a single container is served at the root
+// instead, whichever container carries its name at the time.
+type AllContainers struct {
+	docker  dockerClient
+	opts    []ClientOption
+	config  AllConfig
+	filters filters.Args
+
+	mu         sync.Mutex
+	containers map[string]*lazyContainer // By name
+	// Receives changes of the list, and of connected containers, while watched
+	changes  func(events []rpccommon.ChangeEvent, overflow bool)
+	watching atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// lazyContainer is a container of AllContainers, connected while in use
+type lazyContainer struct {
+	id   string
+	name string
+
+	mu     sync.Mutex
+	client DockerFuseClientInterface
+	// Closed when the connection in progress, if any, is made or fails
+	connecting chan struct{}
+	// Operations in progress and open handles
+	users    int
+	lastUsed time.Time
+	removed  bool
+	// Stops forwarding changes
+	stopWatch context.CancelFunc
+}
+
+// containerHandle is a file handle of a container
+type containerHandle struct {
+	c  *lazyContainer
+	fh fusefs.FileHandle
+}
+
+// NewAllContainers returns a client serving all running containers matching config.Filters
+func NewAllContainers(config AllConfig, opts ...ClientOption) (*AllContainers, error) {
+	docker, err := newDockerAPI("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newAllContainers(docker, config, opts)
+}
+
+func newAllContainers(docker dockerClient, config AllConfig, opts []ClientOption) (*AllContainers, error) {
+	a := &AllContainers{
+		docker:     docker,
+		opts:       opts,
+		config:     config,
+		filters:    filters.NewArgs(),
+		containers: make(map[string]*lazyContainer),
+	}
+	if a.config.Path == "" {
+		a.config.Path = "/"
+	}
+	if a.config.Name == nil {
+		a.config.Name = containerName
+	}
+	for _, f := range config.Filters {
+		key, value, ok := cutFilter(f)
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q (expected label=<key>[=<value>] or name=<name>)", f)
+		}
+		a.filters.Add(key, value)
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	if err := a.refresh(a.ctx); err != nil {
+		a.cancel()
+		return nil, fmt.Errorf("cannot list containers: %s", err)
+	}
+	go a.followEvents()
+	if config.IdleTimeout > 0 {
+		go a.closeIdle()
+	}
+	return a, nil
+}
+
+// Close disconnects from all containers
+func (a *AllContainers) Close() {
+	a.cancel()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.containers {
+		c.mu.Lock()
+		c.disconnect()
+		c.mu.Unlock()
+	}
+}
+
+// CacheStats adds up metadata cache counters of connected containers
+func (a *AllContainers) CacheStats() (stats CacheStats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.containers {
+		c.mu.Lock()
+		if c.client != nil {
+			s := c.client.CacheStats()
+			stats.AttrHits += s.AttrHits
+			stats.AttrMisses += s.AttrMisses
+			stats.DirHits += s.DirHits
+			stats.DirMisses += s.DirMisses
+			stats.NegativeHits += s.NegativeHits
+			stats.NegativeMisses += s.NegativeMisses
+		}
+		c.mu.Unlock()
+	}
+	return
+}
+
+// Single tells whether a single container is served, at the root of the mount
+func (a *AllContainers) Single() bool {
+	return a.config.Root != ""
+}
+
+func (a *AllContainers) disconnect() {}
+
+func (a *AllContainers) connectSatellite(ctx context.Context) error { return nil }
+
+// refresh lists running containers again, disconnecting from those that went away
+func (a *AllContainers) refresh(ctx context.Context) error {
+	list, err := a.docker.ContainerList(ctx, container.ListOptions{Filters: a.filters})
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string) // Name to ID
+	for _, s := range list {
+		if name := a.config.Name(s); name != "" && (a.config.Root == "" || name == a.config.Root) {
+			current[name] = s.ID
+		}
+	}
+
+	var changes []rpccommon.ChangeEvent
+	a.mu.Lock()
+	for name, c := range a.containers {
+		if current[name] != c.id {
+			slog.Info("container went away", "name", name, "id", c.id)
+			c.remove()
+			delete(a.containers, name)
+			changes = append(changes,
+				rpccommon.ChangeEvent{FullPath: "/" + name, Op: rpccommon.CHANGE_DELETE, IsDir: true},
+				rpccommon.ChangeEvent{FullPath: path.Join("/", ByIDDir, c.id), Op: rpccommon.CHANGE_DELETE})
+		}
+	}
+	for name, id := range current {
+		if _, ok := a.containers[name]; !ok {
+			slog.Info("container appeared", "name", name, "id", id)
+			a.containers[name] = &lazyContainer{id: id, name: name}
+			changes = append(changes,
+				rpccommon.ChangeEvent{FullPath: "/" + name, Op: rpccommon.CHANGE_CREATE, IsDir: true},
+				rpccommon.ChangeEvent{FullPath: path.Join("/", ByIDDir, id), Op: rpccommon.CHANGE_CREATE})
+		}
+	}
+	handler := a.changes
+	a.mu.Unlock()
+	switch {
+	case handler == nil || len(changes) == 0:
+	case a.config.Root != "":
+		// The whole mount changes with its container
+		handler(nil, true)
+	default:
+		handler(changes, false)
+	}
+	return nil
+}
+
+// cutFilter splits a filter supported by AllConfig into its key and value
+func cutFilter(f string) (key string, value string, ok bool) {
+	key, value, ok = strings.Cut(f, "=")
+	return key, value, ok && (key == "label" || key == "name")
+}
+
+// containerName returns the Docker name of a container
+func containerName(c container.Summary) string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// followEvents keeps the list of containers in sync with Docker
+func (a *AllContainers) followEvents() {
+	options := events.ListOptions{Filters: filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionStart)),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("event", string(events.ActionDestroy)),
+		filters.Arg("event", string(events.ActionRename)),
+	)}
+	for a.ctx.Err() == nil {
+		ctx, cancel := context.WithCancel(a.ctx)
+		messages, errs := a.docker.Events(ctx, options)
+		// Containers may have changed while not subscribed
+		err := a.refresh(ctx)
+		for err == nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case err = <-errs:
+			case <-messages:
+				if err = a.refresh(ctx); err != nil {
+					err = fmt.Errorf("cannot list containers: %s", err)
+				}
+			}
+		}
+		cancel()
+		if a.ctx.Err() != nil {
+			return
+		}
+		slog.Warn("error following containers, trying again", "error", err)
+		select {
+		case <-a.ctx.Done():
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+// closeIdle disconnects from containers unused for longer than the idle timeout
+func (a *AllContainers) closeIdle() {
+	ticker := time.NewTicker(a.config.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		containers := slices.Collect(maps.Values(a.containers))
+		a.mu.Unlock()
+		// Closing connections waits for satellites to exit: no lock is held meanwhile
+		for _, c := range containers {
+			c.mu.Lock()
+			if c.client != nil && c.users == 0 && time.Since(c.lastUsed) > a.config.IdleTimeout {
+				slog.Info("disconnecting from idle container", "name", c.name)
+				closeConn := c.detach()
+				c.mu.Unlock()
+				closeConn()
+				continue
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// detach forgets the connection to the container, and returns the function closing it. c.mu must
+// be held.
+func (c *lazyContainer) detach() func() {
+	stopWatch, client := c.stopWatch, c.client
+	c.stopWatch, c.client = nil, nil
+	return func() {
+		if stopWatch != nil {
+			stopWatch()
+		}
+		if client != nil {
+			client.Close()
+		}
+	}
+}
+
+// disconnect closes the connection to the container. c.mu must be held.
+func (c *lazyContainer) disconnect() {
+	c.detach()()
+}
+
+// remove disconnects from a container that went away
+func (c *lazyContainer) remove() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removed = true
+	c.disconnect()
+}
+
+// acquire returns the client of the container, connecting to it if needed. Callers release it
+// when done. Connecting (uploading and starting the satellite) happens without holding c.mu, so
+// that it does not hold up other users of c; concurrent callers wait for the same connection.
+func (a *AllContainers) acquire(c *lazyContainer) (DockerFuseClientInterface, syscall.Errno) {
+	c.mu.Lock()
+	for c.client == nil && c.connecting != nil && !c.removed {
+		connecting := c.connecting
+		c.mu.Unlock()
+		<-connecting
+		c.mu.Lock()
+	}
+	if c.removed {
+		c.mu.Unlock()
+		return nil, syscall.ENOENT
+	}
+	if c.client == nil {
+		connecting := make(chan struct{})
+		c.connecting = connecting
+		c.mu.Unlock()
+		slog.Info("connecting to container", "name", c.name, "id", c.id)
+		client, err := newContainerClient(c.id, a.config.Access, a.opts...)
+		c.mu.Lock()
+		c.connecting = nil
+		close(connecting)
+		if err != nil {
+			c.mu.Unlock()
+			slog.Error("cannot connect to container", "name", c.name, "error", err)
+			return nil, syscall.EIO
+		}
+		// The container went away, or the mount is closing
+		if c.removed || a.ctx.Err() != nil {
+			c.mu.Unlock()
+			client.Close()
+			return nil, syscall.ENOENT
+		}
+		c.client = client
+		if a.watching.Load() {
+			a.forwardChanges(c)
+		}
+	}
+	c.users++
+	c.lastUsed = time.Now()
+	client := c.client
+	c.mu.Unlock()
+	return client, 0
+}
+
+func (c *lazyContainer) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users--
+	c.lastUsed = time.Now()
+}
+
+// forwardChanges starts forwarding changes made inside c, while connected. c.mu must be held.
+func (a *AllContainers) forwardChanges(c *lazyContainer) {
+	if !a.config.Watch || c.client == nil || c.stopWatch != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	c.stopWatch = cancel
+	go func(client DockerFuseClientInterface) {
+		err := client.watchChanges(ctx, func(events []rpccommon.ChangeEvent, overflow bool) {
+			var moved []rpccommon.ChangeEvent
+			for _, e := range events {
+				if p, ok := a.mountPath(c.name, e.FullPath); ok {
+					e.FullPath = p
+					moved = append(moved, e)
+				}
+			}
+			a.mu.Lock()
+			handler := a.changes
+			a.mu.Unlock()
+			if handler != nil {
+				handler(moved, overflow)
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("stopped watching for changes", "name", c.name, "error", err)
+		}
+	}(c.client)
+}
+
+// watchChanges reports containers appearing and going away, and changes made inside connected
+// containers with AllConfig.Watch, until ctx is done
+func (a *AllContainers) watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) error {
+	a.mu.Lock()
+	a.changes = handler
+	a.watching.Store(true)
+	for _, c := range a.containers {
+		c.mu.Lock()
+		a.forwardChanges(c)
+		c.mu.Unlock()
+	}
+	a.mu.Unlock()
+
+	<-ctx.Done()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.changes = nil
+	a.watching.Store(false)
+	for _, c := range a.containers {
+		c.mu.Lock()
+		if c.stopWatch != nil {
+			c.stopWatch()
+			c.stopWatch = nil
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// mountPath returns where a path of the named container is in the mount, if it is below
+// AllConfig.Path
+func (a *AllContainers) mountPath(name string, containerPath string) (string, bool) {
+	if a.config.Root != "" {
+		name = ""
+	}
+	if containerPath == a.config.Path {
+		return path.Join("/", name), true
+	}
+	rest, ok := strings.CutPrefix(containerPath, strings.TrimSuffix(a.config.Path, "/")+"/")
+	if !ok {
+		return "", false
+	}
+	return path.Join("/", name, rest), true
+}
+
+// route returns the container serving fullPath, and the container path. c is nil for paths
+// outside containers.
+func (a *AllContainers) route(fullPath string) (c *lazyContainer, containerPath string) {
+	if a.config.Root != "" {
+		a.mu.Lock()
+		c = a.containers[a.config.Root]
+		a.mu.Unlock()
+		return c, path.Join(a.config.Path, fullPath)
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(fullPath, "/"), "/")
+	if name == ByIDDir {
+		return nil, ""
+	}
+	a.mu.Lock()
+	c = a.containers[name]
+	a.mu.Unlock()
+	return c, path.Join(a.config.Path, rest)
+}
+
+// container returns the named container, if any
+func (a *AllContainers) container(name string) *lazyContainer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.containers[name]
+}
+
+// byID returns the container whose ID starts with id
+func (a *AllContainers) byID(id string) (found *lazyContainer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.containers {
+		if strings.HasPrefix(c.id, id) {
+			if found != nil {
+				return nil // Ambiguous
+			}
+			found = c
+		}
+	}
+	return
+}
+
+// containerIno maps inode numbers of a container to inode numbers unique across containers,
+// apart from those of views
+func containerIno(id string, ino uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	binary.Write(h, binary.LittleEndian, ino)
+	return max(h.Sum64()&^(1<<63), 2)
+}
+
+// topLevel serves paths outside containers: the root, container directories and ByIDDir
+func (a *AllContainers) topLevel(fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	dir, name := path.Split(fullPath)
+	switch {
+	case a.config.Root != "" && fullPath != "/":
+		// The container is being replaced
+		return syscall.ENOENT
+	case fullPath == "/" || fullPath == "/"+ByIDDir:
+		*attr = dirAttr(fullPath)
+		attr.FuseAttr.Mode = syscall.S_IFDIR | 0555
+	case dir == "/" && a.container(name) != nil:
+		// Served without connecting to the container
+		*attr = dirAttr(fullPath)
+	case dir == "/"+ByIDDir+"/":
+		c := a.byID(name)
+		if c == nil {
+			return syscall.ENOENT
+		}
+		*attr = dirAttr(fullPath)
+		attr.FuseAttr.Mode = syscall.S_IFLNK | 0777
+		attr.LinkTarget = "../" + c.name
+		attr.FuseAttr.Size = uint64(len(attr.LinkTarget))
+	default:
+		return syscall.ENOENT
+	}
+	attr.FuseAttr.Ino = archiveIno(fullPath) &^ (1 << 63)
+	return 0
+}
+
+func (a *AllContainers) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	c, containerPath := a.route(fullPath)
+	if c == nil || (a.config.Root == "" && path.Dir(fullPath) == "/") {
+		return a.topLevel(fullPath, attr)
+	}
+	client, syserr := a.acquire(c)
+	if syserr != 0 {
+		return
+	}
+	defer c.release()
+	if syserr = client.stat(ctx, containerPath, attr); syserr == 0 {
+		attr.FuseAttr.Ino = containerIno(c.id, attr.FuseAttr.Ino)
+	}
+	return
+}
+
+func (a *AllContainers) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	var entries []fuse.DirEntry
+	c, containerPath := a.route(fullPath)
+	switch {
+	case c == nil && a.config.Root != "":
+		if fullPath != "/" {
+			return nil, syscall.ENOENT
+		}
+	case c == nil && fullPath == "/":
+		a.mu.Lock()
+		for name := range a.containers {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+		}
+		a.mu.Unlock()
+		slices.SortFunc(entries, func(a, b fuse.DirEntry) int { return strings.Compare(a.Name, b.Name) })
+		entries = append(entries, fuse.DirEntry{Name: ByIDDir, Mode: syscall.S_IFDIR})
+	case c == nil && fullPath == "/"+ByIDDir:
+		a.mu.Lock()
+		for _, c := range a.containers {
+			entries = append(entries, fuse.DirEntry{Name: c.id, Mode: syscall.S_IFLNK})
+		}
+		a.mu.Unlock()
+		slices.SortFunc(entries, func(a, b fuse.DirEntry) int { return strings.Compare(a.Name, b.Name) })
+	case c == nil:
+		var attr statAttr
+		if syserr = a.topLevel(fullPath, &attr); syserr != 0 {
+			return nil, syserr
+		}
+		return nil, syscall.ENOTDIR
+	default:
+		client, syserr := a.acquire(c)
+		if syserr != 0 {
+			return nil, syserr
+		}
+		defer c.release()
+		if ds, syserr = client.readDir(ctx, containerPath); syserr != 0 {
+			return nil, syserr
+		}
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				return nil, errno
+			}
+			e.Ino = containerIno(c.id, e.Ino)
+			entries = append(entries, e)
+		}
+		ds.Close()
+		return fusefs.NewListDirStream(entries), 0
+	}
+	for i := range entries {
+		entries[i].Ino = archiveIno(path.Join(fullPath, entries[i].Name)) &^ (1 << 63)
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (a *AllContainers) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	c, containerPath := a.route(fullPath)
+	if c == nil {
+		var attr statAttr
+		if syserr = a.topLevel(fullPath, &attr); syserr != 0 {
+			return []byte{}, syserr
+		}
+		if attr.LinkTarget == "" {
+			return []byte{}, syscall.EINVAL
+		}
+		return []byte(attr.LinkTarget), 0
+	}
+	client, syserr := a.acquire(c)
+	if syserr != 0 {
+		return []byte{}, syserr
+	}
+	defer c.release()
+	return client.readlink(ctx, containerPath)
+}
+
+func (a *AllContainers) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	c, containerPath := a.route(fullPath)
+	if c == nil {
+		if syserr = a.topLevel(fullPath, attr); syserr != 0 {
+			return nil, 0, syserr
+		}
+		return nil, 0, syscall.EISDIR
+	}
+	client, syserr := a.acquire(c)
+	if syserr != 0 {
+		return nil, 0, syserr
+	}
+	fh, mode, syserr = client.open(ctx, containerPath, flags, modeIn, attr)
+	if syserr != 0 {
+		c.release()
+		return nil, 0, syserr
+	}
+	// The handle keeps the container in use until closed
+	attr.FuseAttr.Ino = containerIno(c.id, attr.FuseAttr.Ino)
+	return &containerHandle{c: c, fh: fh}, mode, 0
+}
+
+func (a *AllContainers) create(ctx context.Context, fullPath string, flags int, mode fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, syserr syscall.Errno) {
+	c, containerPath := a.route(fullPath)
+	if c == nil {
+		return nil, syscall.EROFS
+	}
+	client, syserr := a.acquire(c)
+	if syserr != 0 {
+		return nil, syserr
+	}
+	if fh, syserr = client.create(ctx, containerPath, flags, mode, attr); syserr != 0 {
+		c.release()
+		return nil, syserr
+	}
+	attr.FuseAttr.Ino = containerIno(c.id, attr.FuseAttr.Ino)
+	return &containerHandle{c: c, fh: fh}, 0
+}
+
+// handleClient returns the client of the container of fh, unless it was disconnected
+func handleClient(fh fusefs.FileHandle) (*containerHandle, DockerFuseClientInterface, syscall.Errno) {
+	h, ok := fh.(*containerHandle)
+	if !ok {
+		return nil, nil, syscall.EBADF
+	}
+	h.c.mu.Lock()
+	defer h.c.mu.Unlock()
+	if h.c.client == nil {
+		return nil, nil, syscall.EIO // The container went away
+	}
+	return h, h.c.client, 0
+}
+
+func (a *AllContainers) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	h, client, syserr := handleClient(fh)
+	if syserr != 0 {
+		return nil, syserr
+	}
+	return client.read(ctx, h.fh, offset, n)
+}
+
+func (a *AllContainers) write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno) {
+	h, client, syserr := handleClient(fh)
+	if syserr != 0 {
+		return 0, syserr
+	}
+	return client.write(ctx, h.fh, offset, data)
+}
+
+func (a *AllContainers) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	h, client, syserr := handleClient(fh)
+	if syserr != 0 {
+		return 0, syserr
+	}
+	return client.seek(ctx, h.fh, offset, whence)
+}
+
+func (a *AllContainers) fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno) {
+	h, client, syserr := handleClient(fh)
+	if syserr != 0 {
+		return syserr
+	}
+	return client.fsync(ctx, h.fh, flags)
+}
+
+func (a *AllContainers) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	h, client, syserr := handleClient(fh)
+	if syserr == syscall.EIO {
+		fh.(*containerHandle).c.release()
+		return 0 // Nothing left to release in the container
+	}
+	if syserr != 0 {
+		return syserr
+	}
+	defer h.c.release()
+	return client.close(ctx, h.fh)
+}
+
+// mutate runs op on the container of fullPath
+func (a *AllContainers) mutate(fullPath string, op func(client DockerFuseClientInterface, containerPath string) syscall.Errno) syscall.Errno {
+	c, containerPath := a.route(fullPath)
+	if c == nil {
+		return syscall.EROFS
+	}
+	client, syserr := a.acquire(c)
+	if syserr != 0 {
+		return syserr
+	}
+	defer c.release()
+	return op(client, containerPath)
+}
+
+// mutate2 runs op on the container of two paths, which must be the same
+func (a *AllContainers) mutate2(fullPath, otherPath string, op func(client DockerFuseClientInterface, containerPath, otherContainerPath string) syscall.Errno) syscall.Errno {
+	c, _ := a.route(fullPath)
+	other, otherContainerPath := a.route(otherPath)
+	if c != nil && other != c {
+		return syscall.EXDEV
+	}
+	return a.mutate(fullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		return op(client, containerPath, otherContainerPath)
+	})
+}
+
+func (a *AllContainers) mkdir(ctx context.Context, fullPath string, mode fs.FileMode, attr *statAttr) (syserr syscall.Errno) {
+	if a.containerDir(fullPath) {
+		return syscall.EROFS
+	}
+	c, _ := a.route(fullPath)
+	return a.mutate(fullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		if syserr := client.mkdir(ctx, containerPath, mode, attr); syserr != 0 {
+			return syserr
+		}
+		attr.FuseAttr.Ino = containerIno(c.id, attr.FuseAttr.Ino)
+		return 0
+	})
+}
+
+func (a *AllContainers) setAttr(ctx context.Context, fullPath string, in *fuse.SetAttrIn, out *statAttr) (syserr syscall.Errno) {
+	c, _ := a.route(fullPath)
+	return a.mutate(fullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		if syserr := client.setAttr(ctx, containerPath, in, out); syserr != 0 {
+			return syserr
+		}
+		out.FuseAttr.Ino = containerIno(c.id, out.FuseAttr.Ino)
+		return 0
+	})
+}
+
+// containerDir tells whether any of paths is the directory of a container, which can't be removed
+// nor replaced
+func (a *AllContainers) containerDir(paths ...string) bool {
+	if a.config.Root != "" {
+		return false
+	}
+	return slices.ContainsFunc(paths, func(p string) bool { return strings.Count(p, "/") == 1 })
+}
+
+func (a *AllContainers) unlink(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	if a.containerDir(fullPath) {
+		return syscall.EROFS
+	}
+	return a.mutate(fullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		return client.unlink(ctx, containerPath)
+	})
+}
+
+func (a *AllContainers) rmdir(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	if a.containerDir(fullPath) {
+		return syscall.EROFS
+	}
+	return a.mutate(fullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		return client.rmdir(ctx, containerPath)
+	})
+}
+
+func (a *AllContainers) symlink(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	if a.containerDir(newFullPath) {
+		return syscall.EROFS
+	}
+	return a.mutate(newFullPath, func(client DockerFuseClientInterface, containerPath string) syscall.Errno {
+		return client.symlink(ctx, oldFullPath, containerPath)
+	})
+}
+
+func (a *AllContainers) rename(ctx context.Context, fullPath string, fullNewPath string, flags uint32) (syserr syscall.Errno) {
+	if a.containerDir(fullPath, fullNewPath) {
+		return syscall.EROFS
+	}
+	return a.mutate2(fullPath, fullNewPath, func(client DockerFuseClientInterface, containerPath, newContainerPath string) syscall.Errno {
+		return client.rename(ctx, containerPath, newContainerPath, flags)
+	})
+}
+
+func (a *AllContainers) link(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	if a.containerDir(oldFullPath, newFullPath) {
+		return syscall.EROFS
+	}
+	return a.mutate2(oldFullPath, newFullPath, func(client DockerFuseClientInterface, oldContainerPath, newContainerPath string) syscall.Errno {
+		return client.link(ctx, oldContainerPath, newContainerPath)
+	})
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAllContainers(t *testing.T) {
+	var (
+		mDC     mockDockerClient
+		web, db mockFuseDockerClient
+	)
+	defer func(f func(string, string, ...ClientOption) (DockerFuseClientInterface, error)) {
+		newContainerClient = f
+	}(newContainerClient)
+	var connectionsMu sync.Mutex
+	connections := make(map[string]int)
+	newContainerClient = func(containerID string, access string, opts ...ClientOption) (DockerFuseClientInterface, error) {
+		connectionsMu.Lock()
+		defer connectionsMu.Unlock()
+		connections[containerID]++
+		assert.Equal(t, AccessArchive, access)
+		switch containerID {
+		case "aaa111":
+			return &web, nil
+		case "bbb222":
+			return &db, nil
+		}
+		return nil, fmt.Errorf("no such container")
+	}
+	connected := func(id string) int {
+		connectionsMu.Lock()
+		defer connectionsMu.Unlock()
+		return connections[id]
+	}
+	messages, errs := make(chan events.Message), make(chan error)
+	mDC.On("Events", mock.Anything, mock.Anything).Return(messages, errs)
+	list := container.ListOptions{Filters: filters.NewArgs(filters.Arg("label", "env=dev"))}
+	mDC.On("ContainerList", mock.Anything, list).Return([]container.Summary{
+		{ID: "aaa111", Names: []string{"/web"}},
+		{ID: "bbb222", Names: []string{"/db"}},
+	}, nil).Twice()
+
+	a, err := newAllContainers(&mDC, AllConfig{
+		Access: AccessArchive, Path: "/srv", Filters: []string{"label=env=dev"}, IdleTimeout: 50 * time.Millisecond,
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	var attr statAttr
+
+	// Containers are listed by name and ID, without connecting to them
+	assert.Equal(t, []string{"db", "web", "by-id"}, dirNames(t, a, "/"))
+	assert.Equal(t, []string{"aaa111", "bbb222"}, dirNames(t, a, "/by-id"))
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/by-id/aaa", &attr))
+	assert.Equal(t, uint32(syscall.S_IFLNK|0777), attr.FuseAttr.Mode)
+	target, errno := a.readlink(ctx, "/by-id/bbb222")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "../db", string(target))
+	assert.Equal(t, syscall.ENOENT, a.stat(ctx, "/by-id/ccc", &attr))
+	assert.Equal(t, syscall.ENOENT, a.stat(ctx, "/missing", &attr))
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/web", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR|0755), attr.FuseAttr.Mode)
+	assert.Equal(t, 0, connected("aaa111"))
+
+	// Containers are connected on first access, with inode numbers apart from other containers
+	web.On("stat", mock.Anything, "/srv/etc", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*statAttr).FuseAttr.Ino = 5
+	}).Return(syscall.Errno(0))
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/web/etc", &attr))
+	assert.Equal(t, containerIno("aaa111", 5), attr.FuseAttr.Ino)
+	assert.NotEqual(t, containerIno("bbb222", 5), attr.FuseAttr.Ino)
+	web.On("readDir", mock.Anything, "/srv").Return(fusefs.NewListDirStream([]fuse.DirEntry{{Name: "etc", Ino: 5}}), syscall.Errno(0))
+	ds, errno := a.readDir(ctx, "/web")
+	assert.Equal(t, syscall.Errno(0), errno)
+	e, _ := ds.Next()
+	assert.Equal(t, containerIno("aaa111", 5), e.Ino)
+	assert.Equal(t, 1, connected("aaa111"))
+	assert.Equal(t, 0, connected("bbb222"))
+
+	// Open files keep containers connected
+	handle := fusefs.FileHandle(uintptr(3))
+	web.On("open", mock.Anything, "/srv/etc/hostname", syscall.O_RDONLY, fs.FileMode(0), mock.Anything).Return(handle, fs.FileMode(0644), syscall.Errno(0))
+	web.On("read", mock.Anything, handle, int64(0), 10).Return([]byte("web"), syscall.Errno(0))
+	web.On("close", mock.Anything, handle).Return(syscall.Errno(0))
+	fh, _, errno := a.open(ctx, "/web/etc/hostname", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	time.Sleep(150 * time.Millisecond)
+	data, errno := a.read(ctx, fh, 0, 10)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "web", string(data))
+	assert.Equal(t, syscall.Errno(0), a.close(ctx, fh))
+
+	// Idle containers are disconnected, and connected again when needed
+	web.On("Close").Return()
+	assert.Eventually(t, func() bool {
+		a.containers["web"].mu.Lock()
+		defer a.containers["web"].mu.Unlock()
+		return a.containers["web"].client == nil
+	}, time.Second, 10*time.Millisecond)
+	a.stat(ctx, "/web/etc", &attr)
+	assert.Equal(t, 2, connected("aaa111"))
+
+	// Nothing is created outside containers, nor moved across them
+	assert.Equal(t, syscall.EROFS, a.mkdir(ctx, "/new", 0755, &attr))
+	assert.Equal(t, syscall.EROFS, a.unlink(ctx, "/web"))
+	assert.Equal(t, syscall.EXDEV, a.rename(ctx, "/web/a", "/db/a", 0))
+	assert.Equal(t, syscall.EXDEV, a.link(ctx, "/db/a", "/web/a"))
+	web.On("rename", mock.Anything, "/srv/a", "/srv/b", uint32(0)).Return(syscall.Errno(0))
+	assert.Equal(t, syscall.Errno(0), a.rename(ctx, "/web/a", "/web/b", 0))
+	_, _, errno = a.open(ctx, "/", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.EISDIR, errno)
+
+	// The list follows Docker, and changes are reported
+	var changes []rpccommon.ChangeEvent
+	changesMu := sync.Mutex{}
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	watching := make(chan error)
+	go func() {
+		watching <- a.watchChanges(watchCtx, func(events []rpccommon.ChangeEvent, overflow bool) {
+			changesMu.Lock()
+			defer changesMu.Unlock()
+			changes = append(changes, events...)
+		})
+	}()
+	assert.Eventually(t, a.watching.Load, time.Second, time.Millisecond)
+	mDC.On("ContainerList", mock.Anything, list).Return([]container.Summary{
+		{ID: "aaa111", Names: []string{"/web"}},
+		{ID: "ccc333", Names: []string{"/cache"}},
+	}, nil)
+	messages <- events.Message{Action: events.ActionDie}
+	assert.Eventually(t, func() bool {
+		changesMu.Lock()
+		defer changesMu.Unlock()
+		return len(changes) == 4
+	}, time.Second, time.Millisecond)
+	assert.ElementsMatch(t, []rpccommon.ChangeEvent{
+		{FullPath: "/db", Op: rpccommon.CHANGE_DELETE, IsDir: true},
+		{FullPath: "/by-id/bbb222", Op: rpccommon.CHANGE_DELETE},
+		{FullPath: "/cache", Op: rpccommon.CHANGE_CREATE, IsDir: true},
+		{FullPath: "/by-id/ccc333", Op: rpccommon.CHANGE_CREATE},
+	}, changes)
+	assert.Equal(t, []string{"cache", "web", "by-id"}, dirNames(t, a, "/"))
+	assert.Equal(t, syscall.EIO, a.stat(ctx, "/cache/etc", &attr))
+	stopWatching()
+	assert.NoError(t, <-watching)
+
+	a.Close()
+	web.AssertExpectations(t)
+	mDC.AssertExpectations(t)
+
+	_, err = newAllContainers(&mDC, AllConfig{Filters: []string{"status=running"}}, nil)
+	assert.EqualError(t, err, `invalid filter "status=running" (expected label=<key>[=<value>] or name=<name>)`)
+}
+
+func TestAllContainersSlowConnect(t *testing.T) {
+	var (
+		mDC     mockDockerClient
+		web, db mockFuseDockerClient
+	)
+	defer func(f func(string, string, ...ClientOption) (DockerFuseClientInterface, error)) {
+		newContainerClient = f
+	}(newContainerClient)
+	var connections atomic.Int32
+	webReady := make(chan struct{})
+	newContainerClient = func(containerID string, access string, opts ...ClientOption) (DockerFuseClientInterface, error) {
+		if containerID == "bbb222" {
+			return &db, nil
+		}
+		connections.Add(1)
+		<-webReady
+		return &web, nil
+	}
+	mDC.On("Events", mock.Anything, mock.Anything).Return(make(chan events.Message), make(chan error))
+	mDC.On("ContainerList", mock.Anything, mock.Anything).Return([]container.Summary{
+		{ID: "aaa111", Names: []string{"/web"}},
+		{ID: "bbb222", Names: []string{"/db"}},
+	}, nil)
+	a, err := newAllContainers(&mDC, AllConfig{Path: "/", IdleTimeout: 50 * time.Millisecond}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close()
+	ctx := context.Background()
+
+	// Operations on a container share the connection in progress
+	web.On("stat", mock.Anything, "/etc", mock.Anything).Return(syscall.Errno(0))
+	web.On("Close").Return()
+	stats := make(chan syscall.Errno)
+	for range 2 {
+		go func() {
+			var attr statAttr
+			stats <- a.stat(ctx, "/web/etc", &attr)
+		}()
+	}
+	assert.Eventually(t, func() bool { return connections.Load() == 1 }, time.Second, time.Millisecond)
+
+	// Meanwhile, the mount and other containers are served, and idle ones closed
+	var attr statAttr
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/web", &attr))
+	assert.Equal(t, []string{"db", "web", "by-id"}, dirNames(t, a, "/"))
+	db.On("stat", mock.Anything, "/etc", mock.Anything).Return(syscall.Errno(0))
+	db.On("Close").Return()
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/db/etc", &attr))
+	assert.Eventually(t, func() bool {
+		c := a.container("db")
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.client == nil
+	}, time.Second, 10*time.Millisecond)
+
+	close(webReady)
+	assert.Equal(t, syscall.Errno(0), <-stats)
+	assert.Equal(t, syscall.Errno(0), <-stats)
+	assert.Equal(t, int32(1), connections.Load())
+}
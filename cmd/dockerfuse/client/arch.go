@@ -0,0 +1,124 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// satelliteArch maps an OCI platform architecture and variant to the satellite to use. ARM images
+// without a variant get the v6 satellite, which also runs on v7 CPUs.
+func satelliteArch(arch string, variant string) (string, error) {
+	switch arch {
+	case "amd64", "arm64", "386", "ppc64le", "s390x", "riscv64":
+		return arch, nil
+	case "arm":
+		switch variant {
+		case "", "v6":
+			return "armv6", nil
+		case "v7", "v8":
+			return "armv7", nil
+		}
+		return "", fmt.Errorf("unsupported architecture: arm/%s (use arm/v6 or arm/v7)", variant)
+	}
+	return "", fmt.Errorf("unsupported architecture: %s (supported: amd64, arm64, 386, arm/v6, arm/v7, ppc64le, s390x, riscv64)", arch)
+}
+
+// unameArchs maps `uname -m` outputs to OCI architectures and variants
+var unameArchs = map[string][2]string{
+	"x86_64":  {"amd64", ""},
+	"i386":    {"386", ""},
+	"i486":    {"386", ""},
+	"i586":    {"386", ""},
+	"i686":    {"386", ""},
+	"aarch64": {"arm64", ""},
+	"arm64":   {"arm64", ""},
+	"armv6l":  {"arm", "v6"},
+	"armv7l":  {"arm", "v7"},
+	"armv8l":  {"arm", "v7"}, // 32-bit userland on a 64-bit CPU
+	"ppc64le": {"ppc64le", ""},
+	"s390x":   {"s390x", ""},
+	"riscv64": {"riscv64", ""},
+}
+
+// detectArch returns the architecture processes in the container actually run on, which can differ
+// from the image metadata (e.g., under qemu emulation). It runs `uname -m` in the container and, if
+// that is not available, reads the ELF header of the container entrypoint.
+func (d *dockerBackend) detectArch(ctx context.Context, entrypoint string) (arch string, variant string, err error) {
+	machine, err := d.execUname(ctx)
+	if err == nil {
+		if a, ok := unameArchs[machine]; ok {
+			return a[0], a[1], nil
+		}
+		return "", "", fmt.Errorf("unknown machine: %s", machine)
+	}
+	if entrypoint == "" {
+		return "", "", err
+	}
+	return d.elfArch(ctx, entrypoint)
+}
+
+func (d *dockerBackend) execUname(ctx context.Context) (machine string, err error) {
+	stdout, err := d.output(ctx, "uname", "-m")
+	if err != nil {
+		return
+	}
+	machine = strings.TrimSpace(stdout)
+	if machine == "" {
+		return "", fmt.Errorf("uname unavailable in the container")
+	}
+	return
+}
+
+// elfArch reads the architecture from the ELF header of an executable in the container. ARM
+// variants cannot be told apart this way, and are left empty.
+func (d *dockerBackend) elfArch(ctx context.Context, fullPath string) (arch string, variant string, err error) {
+	rc, _, err := d.dockerClient.CopyFromContainer(ctx, d.containerID, fullPath)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	if _, err = tr.Next(); err != nil {
+		return
+	}
+	return elfMachine(tr, fullPath)
+}
+
+// elfMachine reads the architecture from the ELF header of the executable read by r
+func elfMachine(r io.Reader, fullPath string) (arch string, variant string, err error) {
+	var ident [20]byte
+	if _, err = io.ReadFull(r, ident[:]); err != nil {
+		return "", "", fmt.Errorf("%s: not an ELF executable", fullPath)
+	}
+	if string(ident[:4]) != elf.ELFMAG {
+		return "", "", fmt.Errorf("%s: not an ELF executable", fullPath)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(ident[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	class := elf.Class(ident[elf.EI_CLASS])
+	switch machine := elf.Machine(order.Uint16(ident[18:])); {
+	case machine == elf.EM_X86_64:
+		return "amd64", "", nil
+	case machine == elf.EM_386:
+		return "386", "", nil
+	case machine == elf.EM_AARCH64:
+		return "arm64", "", nil
+	case machine == elf.EM_ARM:
+		return "arm", "", nil
+	case machine == elf.EM_PPC64 && order == binary.LittleEndian:
+		return "ppc64le", "", nil
+	case machine == elf.EM_S390 && class == elf.ELFCLASS64:
+		return "s390x", "", nil
+	case machine == elf.EM_RISCV && class == elf.ELFCLASS64:
+		return "riscv64", "", nil
+	default:
+		return "", "", fmt.Errorf("%s: unsupported machine %s", fullPath, machine)
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSatelliteArch(t *testing.T) {
+	for _, tc := range []struct {
+		arch, variant, want string
+	}{
+		{"amd64", "", "amd64"},
+		{"arm64", "v8", "arm64"},
+		{"386", "", "386"},
+		{"arm", "", "armv6"},
+		{"arm", "v6", "armv6"},
+		{"arm", "v7", "armv7"},
+		{"ppc64le", "", "ppc64le"},
+		{"s390x", "", "s390x"},
+		{"riscv64", "", "riscv64"},
+	} {
+		got, err := satelliteArch(tc.arch, tc.variant)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got, "%s/%s", tc.arch, tc.variant)
+	}
+
+	_, err := satelliteArch("arm", "v5")
+	assert.Error(t, err)
+	_, err = satelliteArch("mips64", "")
+	assert.Error(t, err)
+}
+
+// elfHeader returns the first bytes of an ELF executable for the given machine
+func elfHeader(class elf.Class, order binary.ByteOrder, machine elf.Machine) []byte {
+	header := make([]byte, 64)
+	copy(header, elf.ELFMAG)
+	header[elf.EI_CLASS] = byte(class)
+	header[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	if order == binary.BigEndian {
+		header[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	order.PutUint16(header[18:], uint16(machine))
+	return header
+}
+
+func TestDetectArch(t *testing.T) {
+	unameConfig := container.ExecOptions{AttachStdout: true, AttachStderr: true, Cmd: []string{"uname", "-m"}}
+
+	// uname -m is preferred
+	var mDC mockDockerClient
+	mDC.On("ContainerExecCreate", mock.Anything, "c", unameConfig).Return(common.IDResponse{ID: "uname"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "uname", container.ExecStartOptions{}).Return(execOutput(t, "armv7l\n"), nil)
+	b := newDockerAPIBackend(&mDC, "c", BackendConfig{})
+	arch, variant, err := b.detectArch(context.Background(), "/bin/sh")
+	assert.NoError(t, err)
+	assert.Equal(t, "arm", arch)
+	assert.Equal(t, "v7", variant)
+
+	// Without uname, the ELF header of the entrypoint is used
+	for _, tc := range []struct {
+		header []byte
+		want   string
+	}{
+		{elfHeader(elf.ELFCLASS64, binary.LittleEndian, elf.EM_X86_64), "amd64"},
+		{elfHeader(elf.ELFCLASS32, binary.LittleEndian, elf.EM_386), "386"},
+		{elfHeader(elf.ELFCLASS64, binary.LittleEndian, elf.EM_AARCH64), "arm64"},
+		{elfHeader(elf.ELFCLASS32, binary.LittleEndian, elf.EM_ARM), "arm"},
+		{elfHeader(elf.ELFCLASS64, binary.LittleEndian, elf.EM_PPC64), "ppc64le"},
+		{elfHeader(elf.ELFCLASS64, binary.BigEndian, elf.EM_S390), "s390x"},
+		{elfHeader(elf.ELFCLASS64, binary.LittleEndian, elf.EM_RISCV), "riscv64"},
+	} {
+		mDC = mockDockerClient{}
+		mDC.On("ContainerExecCreate", mock.Anything, "c", unameConfig).Return(common.IDResponse{}, fmt.Errorf("exec failed"))
+		mDC.On("CopyFromContainer", mock.Anything, "c", "/app/server").Return(
+			tarArchive("server", tc.header), container.PathStat{}, nil)
+		arch, _, err = b.detectArch(context.Background(), "/app/server")
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, arch)
+	}
+
+	mDC = mockDockerClient{}
+	mDC.On("ContainerExecCreate", mock.Anything, "c", unameConfig).Return(common.IDResponse{}, fmt.Errorf("exec failed"))
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/app/script").Return(
+		tarArchive("script", []byte("#!/bin/sh\necho not an executable\n")), container.PathStat{}, nil)
+	_, _, err = b.detectArch(context.Background(), "/app/script")
+	assert.Error(t, err)
+}
+
+func TestUploadSatelliteDetectedArch(t *testing.T) {
+	var (
+		mFS mockFS
+		mDC mockDockerClient
+	)
+	dfFS = &mFS
+	remotePath := "/tmp/dockerfuse_satellite_arm64"
+
+	// The image claims amd64, but the container runs on arm64
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_arm64").Return([]byte("arm64 satellite"), nil)
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image", Path: "sleep"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+		image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{"uname", "-m"},
+	}).Return(common.IDResponse{ID: "uname"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "uname", container.ExecStartOptions{}).Return(execOutput(t, "aarch64\n"), nil)
+	mDC.On("ContainerStatPath", mock.Anything, "c", remotePath).Return(
+		container.PathStat{Size: int64(len("arm64 satellite"))}, nil)
+
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-version"},
+	}).Return(common.IDResponse{ID: "probe"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion([]byte("arm64 satellite"))), nil)
+
+	b := newDockerAPIBackend(&mDC, "c", BackendConfig{ArchDetection: true})
+	fdc := &DockerFuseClient{backend: b, containerID: "c"}
+	assert.NoError(t, fdc.uploadSatellite(context.Background()))
+	assert.Equal(t, remotePath, b.satelliteFullRemotePath)
+	mDC.AssertExpectations(t)
+}
@@ -0,0 +1,891 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Access modes, telling NewClient how the container filesystem is reached
+const (
+	// AccessAuto uses the satellite, and the archive API when the satellite can't be run
+	AccessAuto = "auto"
+	// AccessSatellite runs the satellite in the container
+	AccessSatellite = "satellite"
+	// AccessArchive uses the Docker archive API (as `docker cp` does)
+	AccessArchive = "archive"
+)
+
+// archiveListingBudget bounds the file contents streamed to list a directory. The archive API only
+// sends whole trees, file contents included: reading stops beyond it, leaving listings incomplete.
+const archiveListingBudget = 8 * 1024 * 1024
+
+// errArchiveUnsupported is returned by ArchiveClient for operations the archive API can't do
+var errArchiveUnsupported = errors.New("not supported with archive access")
+
+// NewClient returns a client for the container, accessing it as the access mode says: auto,
+// satellite or archive. The satellite is run through the backend options select (see WithBackend).
+func NewClient(containerID string, access string, opts ...ClientOption) (DockerFuseClientInterface, error) {
+	switch access {
+	case AccessSatellite:
+		return NewDockerFuseClient(containerID, opts...)
+	case AccessArchive:
+		return NewArchiveClient(containerID, opts...)
+	case AccessAuto:
+	default:
+		return nil, fmt.Errorf("unknown access mode %q (supported: %s, %s, %s)", access, AccessAuto, AccessSatellite, AccessArchive)
+	}
+
+	// Only the Docker API can tell a stopped container, and serve it through archives
+	if !hasDockerAPI(opts...) {
+		return NewDockerFuseClient(containerID, opts...)
+	}
+	docker, err := newDockerAPI(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.ContainerJSONBase != nil && inspect.State != nil && !inspect.State.Running {
+		slog.Info("container is not running, using archive access")
+		return NewArchiveClient(containerID, opts...)
+	}
+	fdc, err := NewDockerFuseClient(containerID, opts...)
+	if err != nil {
+		slog.Warn("cannot run the satellite, falling back to archive access", "error", err)
+		return NewArchiveClient(containerID, opts...)
+	}
+	return fdc, nil
+}
+
+// ArchiveClient accesses the container filesystem through the Docker archive API, without running
+// anything in the container: it works with stopped containers and where exec is not allowed.
+// Semantics are reduced: directory trees are fetched on first listing (up to archiveListingBudget
+// of file contents) and then kept, files are transferred whole on open and written back when
+// closed, while removals, renames and hard links are not supported.
+type ArchiveClient struct {
+	dockerClient dockerClient
+	containerID  string
+
+	// Attributes of known paths, and listings of directories whose tree was fetched. Listings cut
+	// short by the budget are incomplete, and truncated if their own tree was fetched.
+	mu         sync.Mutex
+	entries    map[string]statAttr
+	dirs       map[string][]fuse.DirEntry
+	incomplete map[string]bool
+	truncated  map[string]bool
+	budget     int64
+
+	handlesMu sync.Mutex
+	handles   map[fusefs.FileHandle]*archiveHandle
+	nextFH    uintptr
+
+	// Helper container created to mount an image, removed on Close
+	helper bool
+}
+
+// archiveHandle is an open file, whose content is held in memory
+type archiveHandle struct {
+	fullPath string
+	attr     statAttr
+	data     []byte
+	dirty    bool // Written back to the container on close
+}
+
+// NewArchiveClient returns a client using the Docker archive API
+func NewArchiveClient(containerID string, opts ...ClientOption) (*ArchiveClient, error) {
+	docker, err := newDockerAPI(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = docker.ContainerStatPath(context.Background(), containerID, "/"); err != nil {
+		return nil, fmt.Errorf("cannot access the container filesystem: %s", err)
+	}
+	slog.Warn("using archive access: files are transferred whole and written back on close; " +
+		"removals, renames and hard links are not supported, and changes made in the container may not be seen")
+	return newArchiveClient(docker, containerID), nil
+}
+
+func newArchiveClient(docker dockerClient, containerID string) *ArchiveClient {
+	return &ArchiveClient{
+		dockerClient: docker,
+		containerID:  containerID,
+		entries:      make(map[string]statAttr),
+		dirs:         make(map[string][]fuse.DirEntry),
+		incomplete:   make(map[string]bool),
+		truncated:    make(map[string]bool),
+		budget:       archiveListingBudget,
+		handles:      make(map[fusefs.FileHandle]*archiveHandle),
+	}
+}
+
+// WithImagePull has NewImageClient pull images missing locally, as `docker run` does. Only public
+// images can be pulled: registry credentials are not used.
+func WithImagePull() ClientOption {
+	return func(d *DockerFuseClient) {
+		d.imagePull = true
+	}
+}
+
+// NewImageClient returns a client for the filesystem of an image. A helper container is created
+// from the image, without starting it, and accessed through the archive API until Close.
+func NewImageClient(ref string, opts ...ClientOption) (*ArchiveClient, error) {
+	docker, err := newDockerAPI("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	config := &container.Config{
+		Image: ref,
+		// Never run: this only makes images without entrypoint and command acceptable
+		Entrypoint: []string{"/dockerfuse-helper-not-started"},
+		// Cleanups remove helpers whose dockerfuse process is gone
+		Labels: map[string]string{imageHelperLabel: ref, helperSessionLabel: newSessionID()},
+	}
+	hostConfig := &container.HostConfig{NetworkMode: "none"}
+	created, err := docker.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if errdefs.IsNotFound(err) && clientSettings(opts...).imagePull {
+		slog.Info("pulling image", "image", ref)
+		if err = pullImage(ctx, docker, ref); err != nil {
+			return nil, fmt.Errorf("cannot pull %s: %s", ref, err)
+		}
+		created, err = docker.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a container from %s: %s", ref, err)
+	}
+	for _, w := range created.Warnings {
+		slog.Warn("creating helper container", "warning", w)
+	}
+	slog.Debug("helper container created", "image", ref, "id", created.ID)
+
+	a := newArchiveClient(docker, created.ID)
+	a.helper = true
+	return a, nil
+}
+
+// pullImage pulls ref, waiting for the pull to complete
+func pullImage(ctx context.Context, docker dockerClient, ref string) error {
+	progress, err := docker.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+	// Errors come at the end of the progress stream
+	return jsonmessage.DisplayJSONMessagesStream(progress, io.Discard, 0, false, nil)
+}
+
+// Labels of helper containers: imageHelperLabel holds the image reference, and helperSessionLabel
+// the session of the dockerfuse process that created it (see newSessionID)
+const (
+	imageHelperLabel   = "dockerfuse.image"
+	helperSessionLabel = "dockerfuse.session"
+)
+
+// Close releases the client, removing the helper container of images. Files still open are not
+// written back.
+func (a *ArchiveClient) Close() {
+	if !a.helper {
+		return
+	}
+	err := a.dockerClient.ContainerRemove(context.Background(), a.containerID,
+		container.RemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil {
+		slog.Warn("cannot remove helper container", "id", a.containerID, "error", err)
+		return
+	}
+	a.helper = false
+	slog.Debug("helper container removed", "id", a.containerID)
+}
+
+// CacheStats returns zeroes: archive access has no metadata cache
+func (a *ArchiveClient) CacheStats() CacheStats { return CacheStats{} }
+
+func (a *ArchiveClient) disconnect() {}
+
+func (a *ArchiveClient) connectSatellite(ctx context.Context) error { return nil }
+
+// archiveIno returns a stable inode number for fullPath, as the archive API doesn't report them
+func archiveIno(fullPath string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(fullPath))
+	if ino := h.Sum64(); ino > 1 {
+		return ino
+	}
+	return 2
+}
+
+// headerAttr converts a tar header describing fullPath
+func headerAttr(h *tar.Header, fullPath string) (attr statAttr) {
+	a := &attr.FuseAttr
+	a.Mode = uint32(h.Mode) & 07777
+	a.Size = uint64(h.Size)
+	a.Nlink = 1
+	switch h.Typeflag {
+	case tar.TypeDir:
+		a.Mode |= syscall.S_IFDIR
+		a.Nlink = 2
+	case tar.TypeSymlink:
+		a.Mode |= syscall.S_IFLNK
+		a.Size = uint64(len(h.Linkname))
+		attr.LinkTarget = h.Linkname
+	case tar.TypeChar:
+		a.Mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		a.Mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		a.Mode |= syscall.S_IFIFO
+	default:
+		a.Mode |= syscall.S_IFREG
+	}
+	a.Ino = archiveIno(fullPath)
+	a.Blocks = (a.Size + 511) / 512
+	a.Owner.Uid = uint32(h.Uid)
+	a.Owner.Gid = uint32(h.Gid)
+	a.Mtime, a.Mtimensec = uint64(h.ModTime.Unix()), uint32(h.ModTime.Nanosecond())
+	atime, ctime := h.AccessTime, h.ChangeTime
+	if atime.IsZero() {
+		atime = h.ModTime
+	}
+	if ctime.IsZero() {
+		ctime = h.ModTime
+	}
+	a.Atime, a.Atimensec = uint64(atime.Unix()), uint32(atime.Nanosecond())
+	a.Ctime, a.Ctimensec = uint64(ctime.Unix()), uint32(ctime.Nanosecond())
+	return
+}
+
+// attrHeader returns a tar header creating the file described by attr, named after fullPath
+func attrHeader(fullPath string, attr *statAttr) *tar.Header {
+	a := &attr.FuseAttr
+	h := &tar.Header{
+		Name:       path.Base(fullPath),
+		Mode:       int64(a.Mode & 07777),
+		Uid:        int(a.Owner.Uid),
+		Gid:        int(a.Owner.Gid),
+		ModTime:    time.Unix(int64(a.Mtime), int64(a.Mtimensec)),
+		AccessTime: time.Unix(int64(a.Atime), int64(a.Atimensec)),
+		Format:     tar.FormatPAX,
+	}
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case syscall.S_IFLNK:
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = attr.LinkTarget
+	default:
+		h.Typeflag = tar.TypeReg
+		h.Size = int64(a.Size)
+	}
+	return h
+}
+
+// pathStatAttr converts the attributes of fullPath returned by ContainerStatPath, which has no
+// owner, link count nor access and change times
+func pathStatAttr(st container.PathStat, fullPath string) (attr statAttr) {
+	a := &attr.FuseAttr
+	a.Mode = uint32(st.Mode.Perm())
+	if st.Mode&os.ModeSetuid != 0 {
+		a.Mode |= syscall.S_ISUID
+	}
+	if st.Mode&os.ModeSetgid != 0 {
+		a.Mode |= syscall.S_ISGID
+	}
+	if st.Mode&os.ModeSticky != 0 {
+		a.Mode |= syscall.S_ISVTX
+	}
+	a.Size = uint64(st.Size)
+	a.Nlink = 1
+	switch {
+	case st.Mode.IsDir():
+		a.Mode |= syscall.S_IFDIR
+		a.Nlink = 2
+	case st.Mode&os.ModeSymlink != 0:
+		a.Mode |= syscall.S_IFLNK
+	case st.Mode&os.ModeCharDevice != 0:
+		a.Mode |= syscall.S_IFCHR
+	case st.Mode&os.ModeDevice != 0:
+		a.Mode |= syscall.S_IFBLK
+	case st.Mode&os.ModeNamedPipe != 0:
+		a.Mode |= syscall.S_IFIFO
+	case st.Mode&os.ModeSocket != 0:
+		a.Mode |= syscall.S_IFSOCK
+	default:
+		a.Mode |= syscall.S_IFREG
+	}
+	a.Ino = archiveIno(fullPath)
+	a.Blocks = (a.Size + 511) / 512
+	a.SetTimes(&st.Mtime, &st.Mtime, &st.Mtime)
+	return
+}
+
+// archivePath returns the container path of a tar entry fetched from dir
+func archivePath(dir string, name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if dir == "/" {
+		return "/" + name
+	}
+	// Entries are rooted at the base name of dir
+	_, rest, _ := strings.Cut(name, "/")
+	return path.Join(dir, rest)
+}
+
+// archiveErrno converts errors returned by the Docker archive API
+func archiveErrno(err error) syscall.Errno {
+	if errdefs.IsNotFound(err) {
+		return syscall.ENOENT
+	}
+	slog.Warn("archive API error", "error", err)
+	return syscall.EIO
+}
+
+// fetch downloads fullPath and returns its attributes, and its content if asked
+func (a *ArchiveClient) fetch(ctx context.Context, fullPath string, content bool) (attr statAttr, data []byte, syserr syscall.Errno) {
+	rc, _, err := a.dockerClient.CopyFromContainer(ctx, a.containerID, fullPath)
+	if err != nil {
+		return attr, nil, archiveErrno(err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	h, err := tr.Next()
+	if err != nil {
+		slog.Warn("invalid archive", "path", fullPath, "error", err)
+		return attr, nil, syscall.EIO
+	}
+	attr = headerAttr(h, fullPath)
+	if content && h.Typeflag == tar.TypeReg {
+		if data, err = io.ReadAll(tr); err != nil {
+			slog.Warn("error reading archive", "path", fullPath, "error", err)
+			return attr, nil, syscall.EIO
+		}
+	}
+	return attr, data, 0
+}
+
+// fetchTree downloads the tree below dir, recording attributes of every entry and directory
+// listings. Entries come depth first, with file contents: reading stops once their size exceeds
+// the budget, and the directories still being read are left incomplete.
+func (a *ArchiveClient) fetchTree(ctx context.Context, dir string) (syserr syscall.Errno) {
+	rc, _, err := a.dockerClient.CopyFromContainer(ctx, a.containerID, dir)
+	if err != nil {
+		return archiveErrno(err)
+	}
+	defer rc.Close()
+
+	entries := make(map[string]statAttr)
+	dirs := map[string][]fuse.DirEntry{dir: {}}
+	var (
+		open     []string // Directories whose entries are being read, innermost last
+		streamed int64
+	)
+	complete := make(map[string]bool)
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			for _, d := range open {
+				complete[d] = true
+			}
+			open = nil
+			break
+		}
+		if err != nil {
+			slog.Warn("invalid archive", "path", dir, "error", err)
+			return syscall.EIO
+		}
+		p := archivePath(dir, h.Name)
+		for len(open) > 0 && !isBelow(p, open[len(open)-1]) {
+			complete[open[len(open)-1]] = true
+			open = open[:len(open)-1]
+		}
+		attr := headerAttr(h, p)
+		if h.Typeflag == tar.TypeLink {
+			// Hard links refer to an earlier entry
+			if target, ok := entries[archivePath(dir, h.Linkname)]; ok {
+				attr = target
+			}
+		}
+		entries[p] = attr
+		if attr.FuseAttr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if _, ok := dirs[p]; !ok {
+				dirs[p] = []fuse.DirEntry{}
+			}
+			open = append(open, p)
+		}
+		if parent := path.Dir(p); p != dir {
+			dirs[parent] = append(dirs[parent], fuse.DirEntry{
+				Name: path.Base(p),
+				Mode: attr.FuseAttr.Mode,
+				Ino:  attr.FuseAttr.Ino,
+			})
+		}
+		// Stops before streaming the content beyond the budget
+		if h.Typeflag == tar.TypeReg {
+			if streamed += h.Size; streamed > a.budget {
+				slog.Warn("directory listing truncated: the archive API sends whole trees, file contents included",
+					"path", dir, "limit", a.budget)
+				break
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for p, attr := range entries {
+		a.entries[p] = attr
+	}
+	for p, list := range dirs {
+		if complete[p] {
+			a.dirs[p] = list
+			delete(a.incomplete, p)
+			delete(a.truncated, p)
+		} else if _, ok := a.dirs[p]; !ok || a.incomplete[p] {
+			a.dirs[p] = list
+			a.incomplete[p] = true
+		}
+	}
+	if !complete[dir] {
+		a.truncated[dir] = true
+	}
+	return 0
+}
+
+// isBelow tells whether p is in the tree below dir
+func isBelow(p string, dir string) bool {
+	return dir == "/" && p != "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// record updates the attributes of fullPath, adding it to the listing of its parent if needed
+func (a *ArchiveClient) record(fullPath string, attr statAttr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries[fullPath] = attr
+	parent := path.Dir(fullPath)
+	list, ok := a.dirs[parent]
+	if !ok || fullPath == parent {
+		return
+	}
+	name := path.Base(fullPath)
+	entry := fuse.DirEntry{Name: name, Mode: attr.FuseAttr.Mode, Ino: attr.FuseAttr.Ino}
+	if i := slices.IndexFunc(list, func(e fuse.DirEntry) bool { return e.Name == name }); i >= 0 {
+		list[i] = entry
+	} else {
+		a.dirs[parent] = append(list, entry)
+	}
+}
+
+// upload creates or replaces fullPath in the container
+func (a *ArchiveClient) upload(ctx context.Context, fullPath string, attr *statAttr, data []byte) (syserr syscall.Errno) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	h := attrHeader(fullPath, attr)
+	if h.Typeflag == tar.TypeReg {
+		h.Size = int64(len(data))
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		slog.Warn("cannot create archive", "path", fullPath, "error", err)
+		return syscall.EIO
+	}
+	if h.Typeflag == tar.TypeReg {
+		tw.Write(data)
+	}
+	tw.Close()
+
+	err := a.dockerClient.CopyToContainer(ctx, a.containerID, path.Dir(fullPath), &buf,
+		container.CopyToContainerOptions{CopyUIDGID: true})
+	if err != nil {
+		return archiveErrno(err)
+	}
+	a.record(fullPath, *attr)
+	return 0
+}
+
+// newAttr returns attributes for a file created now
+func newAttr(fullPath string, mode uint32, size int) (attr statAttr) {
+	now := time.Now()
+	attr.FuseAttr.Ino = archiveIno(fullPath)
+	attr.FuseAttr.Mode = mode
+	attr.FuseAttr.Size = uint64(size)
+	attr.FuseAttr.Nlink = 1
+	attr.FuseAttr.SetTimes(&now, &now, &now)
+	return
+}
+
+// touch records a change of content made now
+func touch(attr *statAttr, size int) {
+	now := time.Now()
+	attr.FuseAttr.Size = uint64(size)
+	attr.FuseAttr.Blocks = (attr.FuseAttr.Size + 511) / 512
+	attr.FuseAttr.SetTimes(nil, &now, &now)
+}
+
+func (a *ArchiveClient) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	a.mu.Lock()
+	cached, found := a.entries[fullPath]
+	_, parentListed := a.dirs[path.Dir(fullPath)]
+	parentListed = parentListed && !a.incomplete[path.Dir(fullPath)]
+	a.mu.Unlock()
+	if found {
+		*attr = cached
+		return 0
+	}
+	if parentListed && fullPath != "/" {
+		return syscall.ENOENT
+	}
+
+	// Fetching would have the daemon archive whole trees: the stat endpoint is used instead, but
+	// symlinks, whose archive is small, are fetched for their target as written
+	st, err := a.dockerClient.ContainerStatPath(ctx, a.containerID, fullPath)
+	if err != nil {
+		return archiveErrno(err)
+	}
+	fetched := pathStatAttr(st, fullPath)
+	if st.Mode&os.ModeSymlink != 0 {
+		if fetched, _, syserr = a.fetch(ctx, fullPath, false); syserr != 0 {
+			return
+		}
+	}
+	a.mu.Lock()
+	a.entries[fullPath] = fetched
+	a.mu.Unlock()
+	*attr = fetched
+	return 0
+}
+
+func (a *ArchiveClient) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	a.mu.Lock()
+	list, ok := a.dirs[fullPath]
+	// Listings cut short while fetching a parent are fetched again from here
+	refetch := a.incomplete[fullPath] && !a.truncated[fullPath]
+	a.mu.Unlock()
+	if !ok || refetch {
+		if syserr = a.fetchTree(ctx, fullPath); syserr != 0 {
+			return
+		}
+		a.mu.Lock()
+		list, ok = a.dirs[fullPath]
+		a.mu.Unlock()
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+	}
+	return fusefs.NewListDirStream(slices.Clone(list)), 0
+}
+
+func (a *ArchiveClient) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	var attr statAttr
+	if syserr = a.stat(ctx, fullPath, &attr); syserr != 0 {
+		return []byte{}, syserr
+	}
+	if attr.FuseAttr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return []byte{}, syscall.EINVAL
+	}
+	return []byte(attr.LinkTarget), 0
+}
+
+// newHandle registers an open file
+func (a *ArchiveClient) newHandle(h *archiveHandle) fusefs.FileHandle {
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+	a.nextFH++
+	a.handles[a.nextFH] = h
+	return a.nextFH
+}
+
+func (a *ArchiveClient) handle(fh fusefs.FileHandle) (*archiveHandle, bool) {
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+	h, ok := a.handles[fh]
+	return h, ok
+}
+
+func (a *ArchiveClient) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	fetched, data, syserr := a.fetch(ctx, fullPath, flags&syscall.O_TRUNC == 0)
+	if syserr == syscall.ENOENT && flags&syscall.O_CREAT != 0 {
+		fh, syserr = a.create(ctx, fullPath, flags, modeIn, attr)
+		return fh, fs.FileMode(attr.FuseAttr.Mode), syserr
+	}
+	if syserr != 0 {
+		return
+	}
+	if fetched.FuseAttr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, 0, syscall.EOPNOTSUPP
+	}
+
+	h := &archiveHandle{fullPath: fullPath, attr: fetched, data: data}
+	if flags&syscall.O_TRUNC != 0 && fetched.FuseAttr.Size > 0 {
+		touch(&h.attr, 0)
+		h.dirty = true
+	}
+	a.record(fullPath, h.attr)
+	*attr = h.attr
+	return a.newHandle(h), fs.FileMode(h.attr.FuseAttr.Mode), 0
+}
+
+func (a *ArchiveClient) create(ctx context.Context, fullPath string, flags int, mode fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, syserr syscall.Errno) {
+	var existing statAttr
+	switch syserr = a.stat(ctx, fullPath, &existing); syserr {
+	case 0:
+		if flags&syscall.O_EXCL != 0 {
+			return nil, syscall.EEXIST
+		}
+		fh, _, syserr = a.open(ctx, fullPath, flags&^syscall.O_CREAT, mode, attr)
+		return
+	case syscall.ENOENT:
+	default:
+		return
+	}
+
+	h := &archiveHandle{
+		fullPath: fullPath,
+		attr:     newAttr(fullPath, syscall.S_IFREG|uint32(mode.Perm()), 0),
+	}
+	// Create the file right away, so that it can be looked up
+	if syserr = a.upload(ctx, fullPath, &h.attr, nil); syserr != 0 {
+		return
+	}
+	*attr = h.attr
+	return a.newHandle(h), 0
+}
+
+func (a *ArchiveClient) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	h, ok := a.handle(fh)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+	if offset >= int64(len(h.data)) {
+		return []byte{}, 0
+	}
+	end := min(offset+int64(n), int64(len(h.data)))
+	return slices.Clone(h.data[offset:end]), 0
+}
+
+func (a *ArchiveClient) write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno) {
+	h, ok := a.handle(fh)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+	if end := offset + int64(len(data)); end > int64(len(h.data)) {
+		h.data = append(h.data, make([]byte, end-int64(len(h.data)))...)
+	}
+	copy(h.data[offset:], data)
+	touch(&h.attr, len(h.data))
+	h.dirty = true
+	a.record(h.fullPath, h.attr)
+	return len(data), 0
+}
+
+func (a *ArchiveClient) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	h, ok := a.handle(fh)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	a.handlesMu.Lock()
+	size := int64(len(h.data))
+	a.handlesMu.Unlock()
+	return seekWithin(size, offset, whence)
+}
+
+// flush writes the content of fh back to the container, if changed
+func (a *ArchiveClient) flush(ctx context.Context, h *archiveHandle) (syserr syscall.Errno) {
+	a.handlesMu.Lock()
+	if !h.dirty {
+		a.handlesMu.Unlock()
+		return 0
+	}
+	attr, data := h.attr, slices.Clone(h.data)
+	h.dirty = false
+	a.handlesMu.Unlock()
+
+	if syserr = a.upload(ctx, h.fullPath, &attr, data); syserr != 0 {
+		a.handlesMu.Lock()
+		h.dirty = true
+		a.handlesMu.Unlock()
+	}
+	return
+}
+
+func (a *ArchiveClient) fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno) {
+	h, ok := a.handle(fh)
+	if !ok {
+		return syscall.EBADF
+	}
+	return a.flush(ctx, h)
+}
+
+func (a *ArchiveClient) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	h, ok := a.handle(fh)
+	if !ok {
+		return syscall.EBADF
+	}
+	// The handle goes away even if its content cannot be written back, reporting the error
+	if syserr = a.flush(ctx, h); syserr != 0 {
+		slog.Error("cannot write file back to the container", "path", h.fullPath, "errno", syserr)
+	}
+	a.handlesMu.Lock()
+	delete(a.handles, fh)
+	a.handlesMu.Unlock()
+	return syserr
+}
+
+func (a *ArchiveClient) mkdir(ctx context.Context, fullPath string, mode fs.FileMode, attr *statAttr) (syserr syscall.Errno) {
+	var existing statAttr
+	if syserr = a.stat(ctx, fullPath, &existing); syserr == 0 {
+		return syscall.EEXIST
+	} else if syserr != syscall.ENOENT {
+		return
+	}
+	*attr = newAttr(fullPath, syscall.S_IFDIR|uint32(mode.Perm()), 0)
+	attr.FuseAttr.Nlink = 2
+	if syserr = a.upload(ctx, fullPath, attr, nil); syserr != 0 {
+		return
+	}
+	a.mu.Lock()
+	a.dirs[fullPath] = []fuse.DirEntry{}
+	a.mu.Unlock()
+	return 0
+}
+
+func (a *ArchiveClient) symlink(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	var existing statAttr
+	if syserr = a.stat(ctx, newFullPath, &existing); syserr == 0 {
+		return syscall.EEXIST
+	} else if syserr != syscall.ENOENT {
+		return
+	}
+	attr := newAttr(newFullPath, syscall.S_IFLNK|0777, len(oldFullPath))
+	attr.LinkTarget = oldFullPath
+	return a.upload(ctx, newFullPath, &attr, nil)
+}
+
+func (a *ArchiveClient) setAttr(ctx context.Context, fullPath string, in *fuse.SetAttrIn, out *statAttr) (syserr syscall.Errno) {
+	// Files being written are changed in memory, and written back on close
+	a.handlesMu.Lock()
+	var open *archiveHandle
+	for _, h := range a.handles {
+		if h.fullPath == fullPath {
+			open = h
+			break
+		}
+	}
+	a.handlesMu.Unlock()
+
+	var (
+		attr statAttr
+		data []byte
+	)
+	if open != nil {
+		a.handlesMu.Lock()
+		attr, data = open.attr, open.data
+		a.handlesMu.Unlock()
+	} else {
+		fetched, content, syserr := a.fetch(ctx, fullPath, true)
+		if syserr != 0 {
+			return syserr
+		}
+		attr, data = fetched, content
+	}
+
+	switch attr.FuseAttr.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG, syscall.S_IFDIR, syscall.S_IFLNK:
+	default:
+		slog.Warn("cannot change attributes of special files", "path", fullPath, "error", errArchiveUnsupported)
+		return syscall.ENOTSUP
+	}
+	if mode, ok := in.GetMode(); ok {
+		attr.FuseAttr.Mode = attr.FuseAttr.Mode&syscall.S_IFMT | mode&07777
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.FuseAttr.Owner.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.FuseAttr.Owner.Gid = gid
+	}
+	if size, ok := in.GetSize(); ok {
+		if attr.FuseAttr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			return syscall.EINVAL
+		}
+		resized := make([]byte, size)
+		copy(resized, data)
+		data = resized
+		touch(&attr, len(data))
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		var pa, pm *time.Time
+		if aok {
+			pa = &atime
+		}
+		if mok {
+			pm = &mtime
+		}
+		attr.FuseAttr.SetTimes(pa, pm, nil)
+	}
+
+	if open != nil {
+		a.handlesMu.Lock()
+		open.attr, open.data, open.dirty = attr, data, true
+		a.handlesMu.Unlock()
+		a.record(fullPath, attr)
+	} else if syserr = a.upload(ctx, fullPath, &attr, data); syserr != 0 {
+		return
+	}
+	*out = attr
+	return 0
+}
+
+// unsupported reports an operation the archive API can't perform
+func (a *ArchiveClient) unsupported(op string, fullPath string) syscall.Errno {
+	slog.Warn(fmt.Sprintf("%s %s", op, errArchiveUnsupported), "path", fullPath)
+	return syscall.ENOTSUP
+}
+
+func (a *ArchiveClient) link(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	return a.unsupported("hard links are", newFullPath)
+}
+
+func (a *ArchiveClient) unlink(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	return a.unsupported("removing files is", fullPath)
+}
+
+func (a *ArchiveClient) rmdir(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	return a.unsupported("removing directories is", fullPath)
+}
+
+func (a *ArchiveClient) rename(ctx context.Context, fullPath string, fullNewPath string, flags uint32) (syserr syscall.Errno) {
+	return a.unsupported("renaming is", fullPath)
+}
+
+func (a *ArchiveClient) watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) (err error) {
+	return fmt.Errorf("change notifications %s", errArchiveUnsupported)
+}
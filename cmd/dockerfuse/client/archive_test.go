@@ -0,0 +1,426 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type archiveFile struct {
+	header  tar.Header
+	content string
+}
+
+// archiveOf returns a tar stream as returned by CopyFromContainer
+func archiveOf(files ...archiveFile) io.ReadCloser {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		h := f.header
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(f.content))
+		}
+		tw.WriteHeader(&h)
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	return io.NopCloser(&buf)
+}
+
+// uploaded returns headers and contents of a tar stream passed to CopyToContainer
+func uploaded(r io.Reader) (files []archiveFile) {
+	tr := tar.NewReader(r)
+	for h, err := tr.Next(); err == nil; h, err = tr.Next() {
+		content, _ := io.ReadAll(tr)
+		files = append(files, archiveFile{header: *h, content: string(content)})
+	}
+	return
+}
+
+var archiveMtime = time.Unix(1700000000, 0)
+
+func TestArchivePath(t *testing.T) {
+	assert.Equal(t, "/", archivePath("/", "."))
+	assert.Equal(t, "/", archivePath("/", "/"))
+	assert.Equal(t, "/bin/ls", archivePath("/", "bin/ls"))
+	assert.Equal(t, "/bin/ls", archivePath("/", "./bin/ls"))
+	assert.Equal(t, "/etc", archivePath("/etc", "etc"))
+	assert.Equal(t, "/etc", archivePath("/etc", "etc/"))
+	assert.Equal(t, "/etc/ssl/certs", archivePath("/etc", "etc/ssl/certs"))
+}
+
+func TestHeaderAttr(t *testing.T) {
+	attr := headerAttr(&tar.Header{
+		Typeflag: tar.TypeReg, Name: "passwd", Mode: 04755, Size: 600, Uid: 1000, Gid: 100, ModTime: archiveMtime,
+	}, "/etc/passwd")
+	assert.Equal(t, uint32(syscall.S_IFREG|04755), attr.FuseAttr.Mode)
+	assert.Equal(t, uint64(600), attr.FuseAttr.Size)
+	assert.Equal(t, uint64(2), attr.FuseAttr.Blocks)
+	assert.Equal(t, uint32(1000), attr.FuseAttr.Owner.Uid)
+	assert.Equal(t, uint32(100), attr.FuseAttr.Owner.Gid)
+	assert.Equal(t, uint64(archiveMtime.Unix()), attr.FuseAttr.Mtime)
+	assert.Equal(t, uint64(archiveMtime.Unix()), attr.FuseAttr.Ctime)
+	assert.Equal(t, archiveIno("/etc/passwd"), attr.FuseAttr.Ino)
+
+	attr = headerAttr(&tar.Header{Typeflag: tar.TypeSymlink, Name: "sh", Linkname: "busybox", Mode: 0777}, "/bin/sh")
+	assert.Equal(t, uint32(syscall.S_IFLNK|0777), attr.FuseAttr.Mode)
+	assert.Equal(t, "busybox", attr.LinkTarget)
+	assert.Equal(t, uint64(7), attr.FuseAttr.Size)
+
+	// Headers built from attributes describe the same file
+	attr = headerAttr(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, Uid: 1, Gid: 2, ModTime: archiveMtime}, "/etc")
+	h := attrHeader("/etc", &attr)
+	assert.Equal(t, byte(tar.TypeDir), h.Typeflag)
+	assert.Equal(t, "etc/", h.Name)
+	assert.Equal(t, int64(0755), h.Mode)
+	assert.Equal(t, 1, h.Uid)
+	assert.Equal(t, 2, h.Gid)
+	assert.True(t, archiveMtime.Equal(h.ModTime))
+}
+
+func TestArchiveClientStatAndReadDir(t *testing.T) {
+	var mDC mockDockerClient
+	a := newArchiveClient(&mDC, "c")
+
+	// Stat does not archive the tree
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/etc").Return(
+		container.PathStat{Name: "etc", Mode: os.ModeDir | 0755, Mtime: archiveMtime}, nil).Once()
+	etc := func() io.ReadCloser {
+		return archiveOf(
+			archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: archiveMtime}},
+			archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, ModTime: archiveMtime}, content: "box\n"},
+			archiveFile{header: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.bak", Linkname: "etc/hostname"}},
+			archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/ssl/", Mode: 0700, ModTime: archiveMtime}},
+			archiveFile{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/ssl/cert.pem", Linkname: "/certs/ca.pem"}},
+		)
+	}
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/etc").Return(etc(), container.PathStat{}, nil).Once()
+	var attr statAttr
+	assert.Equal(t, syscall.Errno(0), a.stat(context.Background(), "/etc", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR|0755), attr.FuseAttr.Mode)
+	assert.Equal(t, uint64(archiveMtime.Unix()), attr.FuseAttr.Mtime)
+
+	// Listing fetches the whole tree
+	ds, errno := a.readDir(context.Background(), "/etc")
+	assert.Equal(t, syscall.Errno(0), errno)
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"hostname", "hostname.bak", "ssl"}, names)
+
+	// Then everything below comes from memory
+	ds, errno = a.readDir(context.Background(), "/etc/ssl")
+	assert.Equal(t, syscall.Errno(0), errno)
+	e, _ := ds.Next()
+	assert.Equal(t, "cert.pem", e.Name)
+	assert.Equal(t, syscall.Errno(0), a.stat(context.Background(), "/etc/hostname.bak", &attr))
+	assert.Equal(t, uint64(4), attr.FuseAttr.Size)
+	assert.Equal(t, archiveIno("/etc/hostname"), attr.FuseAttr.Ino)
+	link, errno := a.readlink(context.Background(), "/etc/ssl/cert.pem")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "/certs/ca.pem", string(link))
+	_, errno = a.readlink(context.Background(), "/etc/hostname")
+	assert.Equal(t, syscall.EINVAL, errno)
+	assert.Equal(t, syscall.ENOENT, a.stat(context.Background(), "/etc/missing", &attr))
+
+	// Symlinks are fetched, for their target as written
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/lib").Return(
+		container.PathStat{Name: "lib", Mode: os.ModeSymlink | 0777, LinkTarget: "/usr/lib"}, nil).Once()
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/lib").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"}},
+	), container.PathStat{}, nil).Once()
+	link, errno = a.readlink(context.Background(), "/lib")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "usr/lib", string(link))
+
+	// Docker errors
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/missing").Return(
+		container.PathStat{}, errdefs.NotFound(fmt.Errorf("no such file")))
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/broken").Return(
+		container.PathStat{}, fmt.Errorf("connection refused"))
+	assert.Equal(t, syscall.ENOENT, a.stat(context.Background(), "/missing", &attr))
+	assert.Equal(t, syscall.EIO, a.stat(context.Background(), "/broken", &attr))
+	mDC.AssertExpectations(t)
+}
+
+func TestArchiveClientListingBudget(t *testing.T) {
+	var mDC mockDockerClient
+	a := newArchiveClient(&mDC, "c")
+	a.budget = 8
+
+	// Reading stops before the content of /big/usr/lib/b, beyond the budget
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/big").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "big/", Mode: 0755}},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "big/etc/", Mode: 0755}},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "big/etc/a", Mode: 0644}, content: "aaaa"},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "big/usr/", Mode: 0755}},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "big/usr/lib/", Mode: 0755}},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "big/usr/lib/b", Mode: 0644}, content: "bbbbbbbb"},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "big/usr/lib/c", Mode: 0644}, content: "c"},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "big/var/", Mode: 0755}},
+	), container.PathStat{}, nil).Once()
+	names := func(dir string) (names []string) {
+		ds, errno := a.readDir(context.Background(), dir)
+		if assert.Equal(t, syscall.Errno(0), errno) {
+			for ds.HasNext() {
+				e, _ := ds.Next()
+				names = append(names, e.Name)
+			}
+		}
+		return
+	}
+	assert.Equal(t, []string{"etc", "usr"}, names("/big"))
+	// Listings completed before the budget ran out are kept
+	assert.Equal(t, []string{"a"}, names("/big/etc"))
+	var attr statAttr
+	assert.Equal(t, syscall.ENOENT, a.stat(context.Background(), "/big/etc/missing", &attr))
+
+	// Truncated listings are not fetched again, and don't rule entries out
+	assert.Equal(t, []string{"etc", "usr"}, names("/big"))
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/big/var").Return(
+		container.PathStat{Name: "var", Mode: os.ModeDir | 0755}, nil).Once()
+	assert.Equal(t, syscall.Errno(0), a.stat(context.Background(), "/big/var", &attr))
+
+	// Listings cut short below are fetched from their own directory
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/big/usr/lib").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeDir, Name: "lib/", Mode: 0755}},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "lib/b", Mode: 0644}, content: "bbbbbbbb"},
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "lib/c", Mode: 0644}, content: "c"},
+	), container.PathStat{}, nil).Once()
+	a.budget = archiveListingBudget
+	assert.Equal(t, []string{"b", "c"}, names("/big/usr/lib"))
+	mDC.AssertExpectations(t)
+}
+
+func TestArchiveClientReadWrite(t *testing.T) {
+	var mDC mockDockerClient
+	a := &ArchiveClient{dockerClient: &mDC, containerID: "c", entries: map[string]statAttr{},
+		dirs: map[string][]fuse.DirEntry{}, handles: map[fusefs.FileHandle]*archiveHandle{}}
+	var uploads [][]archiveFile
+	mDC.On("CopyToContainer", mock.Anything, "c", "/etc", mock.Anything, container.CopyToContainerOptions{CopyUIDGID: true}).Run(
+		func(args mock.Arguments) { uploads = append(uploads, uploaded(args.Get(3).(io.Reader))) }).Return(nil)
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/etc/motd").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "motd", Mode: 0640, Uid: 5, Gid: 6, ModTime: archiveMtime}, content: "hello world"},
+	), container.PathStat{}, nil).Once()
+
+	// Files are fetched whole on open
+	var attr statAttr
+	fh, _, errno := a.open(context.Background(), "/etc/motd", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uint64(11), attr.FuseAttr.Size)
+	data, errno := a.read(context.Background(), fh, 6, 100)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "world", string(data))
+	n, errno := a.seek(context.Background(), fh, 0, seekHole)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, int64(11), n)
+
+	// and written back on close
+	n2, errno := a.write(context.Background(), fh, 6, []byte("there!"))
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, 6, n2)
+	assert.Empty(t, uploads)
+	assert.Equal(t, syscall.Errno(0), a.stat(context.Background(), "/etc/motd", &attr))
+	assert.Equal(t, uint64(12), attr.FuseAttr.Size)
+	assert.Equal(t, syscall.Errno(0), a.close(context.Background(), fh))
+	if assert.Len(t, uploads, 1) && assert.Len(t, uploads[0], 1) {
+		assert.Equal(t, "motd", uploads[0][0].header.Name)
+		assert.Equal(t, int64(0640), uploads[0][0].header.Mode)
+		assert.Equal(t, 5, uploads[0][0].header.Uid)
+		assert.Equal(t, "hello there!", uploads[0][0].content)
+	}
+	assert.Equal(t, syscall.EBADF, a.close(context.Background(), fh))
+
+	// Unchanged files are not uploaded
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/etc/motd").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "motd", Mode: 0640}, content: "hello there!"},
+	), container.PathStat{}, nil).Once()
+	fh, _, errno = a.open(context.Background(), "/etc/motd", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, syscall.Errno(0), a.close(context.Background(), fh))
+	assert.Len(t, uploads, 1)
+
+	// New files are created right away
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/etc/new").Return(
+		container.PathStat{}, errdefs.NotFound(fmt.Errorf("no such file"))).Once()
+	fh, errno = a.create(context.Background(), "/etc/new", syscall.O_CREAT|syscall.O_WRONLY, 0600, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Len(t, uploads, 2)
+	a.write(context.Background(), fh, 0, []byte("data"))
+	assert.Equal(t, syscall.Errno(0), a.fsync(context.Background(), fh, 0))
+	assert.Equal(t, syscall.Errno(0), a.close(context.Background(), fh))
+	if assert.Len(t, uploads, 3) {
+		assert.Equal(t, "new", uploads[2][0].header.Name)
+		assert.Equal(t, int64(0600), uploads[2][0].header.Mode)
+		assert.Equal(t, "data", uploads[2][0].content)
+	}
+	_, errno = a.create(context.Background(), "/etc/new", syscall.O_CREAT|syscall.O_EXCL, 0600, &attr)
+	assert.Equal(t, syscall.EEXIST, errno)
+
+	// Attribute changes upload the file again
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/etc/new").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "new", Mode: 0600}, content: "data"},
+	), container.PathStat{}, nil).Once()
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE | fuse.FATTR_SIZE
+	in.Mode = 0755
+	in.Size = 2
+	assert.Equal(t, syscall.Errno(0), a.setAttr(context.Background(), "/etc/new", in, &attr))
+	assert.Equal(t, uint32(syscall.S_IFREG|0755), attr.FuseAttr.Mode)
+	if assert.Len(t, uploads, 4) {
+		assert.Equal(t, int64(0755), uploads[3][0].header.Mode)
+		assert.Equal(t, "da", uploads[3][0].content)
+	}
+	mDC.AssertExpectations(t)
+}
+
+func TestArchiveClientCloseFlushError(t *testing.T) {
+	var mDC mockDockerClient
+	a := &ArchiveClient{dockerClient: &mDC, containerID: "c", entries: map[string]statAttr{},
+		dirs: map[string][]fuse.DirEntry{}, handles: map[fusefs.FileHandle]*archiveHandle{}}
+	mDC.On("CopyFromContainer", mock.Anything, "c", "/etc/motd").Return(archiveOf(
+		archiveFile{header: tar.Header{Typeflag: tar.TypeReg, Name: "motd", Mode: 0640}, content: "hello"},
+	), container.PathStat{}, nil).Once()
+	mDC.On("CopyToContainer", mock.Anything, "c", "/etc", mock.Anything, mock.Anything).Return(fmt.Errorf("connection refused"))
+
+	var attr statAttr
+	fh, _, errno := a.open(context.Background(), "/etc/motd", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	a.write(context.Background(), fh, 0, []byte("HELLO"))
+
+	// The error is reported, and the handle released all the same
+	assert.Equal(t, syscall.EIO, a.close(context.Background(), fh))
+	assert.Empty(t, a.handles)
+	assert.Equal(t, syscall.EBADF, a.close(context.Background(), fh))
+	mDC.AssertExpectations(t)
+}
+
+func TestArchiveClientOtherOps(t *testing.T) {
+	var mDC mockDockerClient
+	a := &ArchiveClient{dockerClient: &mDC, containerID: "c", entries: map[string]statAttr{},
+		dirs: map[string][]fuse.DirEntry{"/": {}}, handles: map[fusefs.FileHandle]*archiveHandle{}}
+	var uploads [][]archiveFile
+	mDC.On("CopyToContainer", mock.Anything, "c", "/", mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) { uploads = append(uploads, uploaded(args.Get(3).(io.Reader))) }).Return(nil)
+
+	var attr statAttr
+	assert.Equal(t, syscall.Errno(0), a.mkdir(context.Background(), "/data", 0750, &attr))
+	assert.Equal(t, syscall.EEXIST, a.mkdir(context.Background(), "/data", 0750, &attr))
+	assert.Equal(t, syscall.Errno(0), a.symlink(context.Background(), "data", "/link"))
+	if assert.Len(t, uploads, 2) {
+		assert.Equal(t, byte(tar.TypeDir), uploads[0][0].header.Typeflag)
+		assert.Equal(t, "data/", uploads[0][0].header.Name)
+		assert.Equal(t, byte(tar.TypeSymlink), uploads[1][0].header.Typeflag)
+		assert.Equal(t, "data", uploads[1][0].header.Linkname)
+	}
+	ds, _ := a.readDir(context.Background(), "/")
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"data", "link"}, names)
+
+	// Reduced semantics
+	assert.Equal(t, syscall.ENOTSUP, a.link(context.Background(), "/data", "/hard"))
+	assert.Equal(t, syscall.ENOTSUP, a.unlink(context.Background(), "/link"))
+	assert.Equal(t, syscall.ENOTSUP, a.rmdir(context.Background(), "/data"))
+	assert.Equal(t, syscall.ENOTSUP, a.rename(context.Background(), "/data", "/other", 0))
+	assert.Error(t, a.watchChanges(context.Background(), nil))
+	mDC.AssertExpectations(t)
+}
+
+func TestNewClientBackends(t *testing.T) {
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+
+	_, err := NewClient("c", "ftp")
+	assert.EqualError(t, err, `unknown access mode "ftp" (supported: auto, satellite, archive)`)
+
+	// Stopped containers are accessed through the archive API
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{State: &container.State{Running: false}},
+	}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/").Return(container.PathStat{}, nil)
+	c, err := NewClient("c", AccessAuto)
+	assert.NoError(t, err)
+	assert.IsType(t, &ArchiveClient{}, c)
+
+	c, err = NewClient("c", AccessArchive)
+	assert.NoError(t, err)
+	assert.IsType(t, &ArchiveClient{}, c)
+
+	// The archive API must work
+	mDC = mockDockerClient{}
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/").Return(container.PathStat{}, fmt.Errorf("not supported"))
+	_, err = NewClient("c", AccessArchive)
+	assert.EqualError(t, err, "cannot access the container filesystem: not supported")
+}
+
+func TestNewImageClient(t *testing.T) {
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+
+	// A stopped helper container is created, and removed on close
+	mDC.On("ContainerCreate", mock.Anything, mock.MatchedBy(func(c *container.Config) bool {
+		return c.Image == "registry/app:1.2.3" && c.Labels[imageHelperLabel] == "registry/app:1.2.3" && c.Labels[helperSessionLabel] != ""
+	}), mock.Anything, mock.Anything, mock.Anything, "").Return(container.CreateResponse{ID: "helper"}, nil).Once()
+	a, err := NewImageClient("registry/app:1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, "helper", a.containerID)
+
+	mDC.On("ContainerRemove", mock.Anything, "helper", container.RemoveOptions{Force: true, RemoveVolumes: true}).Return(nil).Once()
+	a.Close()
+	a.Close()
+	mDC.AssertExpectations(t)
+
+	// Missing images
+	mDC.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").Return(
+		container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("No such image: registry/app:9"))).Once()
+	_, err = NewImageClient("registry/app:9")
+	assert.EqualError(t, err, "cannot create a container from registry/app:9: No such image: registry/app:9")
+
+	// Pulled if asked, failing at the end of the progress stream
+	mDC.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").Return(
+		container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("No such image: registry/app:2"))).Once()
+	mDC.On("ImagePull", mock.Anything, "registry/app:2", image.PullOptions{}).Return(io.NopCloser(strings.NewReader(
+		`{"status":"Pulling from registry/app"}`+"\n"+`{"status":"Downloaded newer image for registry/app:2"}`+"\n")), nil).Once()
+	mDC.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").Return(
+		container.CreateResponse{ID: "pulled"}, nil).Once()
+	a, err = NewImageClient("registry/app:2", WithImagePull())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "pulled", a.containerID)
+	}
+	mDC.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").Return(
+		container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("No such image: registry/app:9"))).Once()
+	mDC.On("ImagePull", mock.Anything, "registry/app:9", image.PullOptions{}).Return(io.NopCloser(strings.NewReader(
+		`{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`+"\n")), nil).Once()
+	_, err = NewImageClient("registry/app:9", WithImagePull())
+	assert.EqualError(t, err, "cannot pull registry/app:9: manifest unknown")
+	mDC.AssertExpectations(t)
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// Runtime backend names, for WithBackend
+const (
+	// BackendDocker runs the satellite through the Docker API (or an engine emulating it, see
+	// DockerConfig.Engine)
+	BackendDocker = "docker"
+	// BackendContainerd runs the satellite through the containerd API, without dockerd
+	BackendContainerd = "containerd"
+	// BackendKubernetes runs the satellite in a container of a pod, through the exec API
+	BackendKubernetes = "kubernetes"
+	// BackendProcess runs the satellite in the mount namespace of a local process
+	BackendProcess = "process"
+	// BackendSSH runs the satellite on a host reached over SSH
+	BackendSSH = "ssh"
+)
+
+// Target is what a backend serves: a container, a process or a host
+type Target struct {
+	// ID identifies the target across satellite restarts, and keys the disk cache
+	ID string
+}
+
+// Satellite is a satellite executable, built for the architecture of a target
+type Satellite struct {
+	Name   string
+	Binary []byte
+	// Where the binary comes from, for logs
+	Source string
+}
+
+// SatelliteConn carries the RPC stream of a running satellite, over its stdin and stdout
+type SatelliteConn interface {
+	io.ReadWriteCloser
+	// Stop closes the satellite input, and waits for the satellite to exit
+	Stop(ctx context.Context) error
+}
+
+// Backend is a runtime the satellite is reached through. DockerFuseClient resolves the target,
+// asks for its architecture, has the matching satellite placed and started, and then only forwards
+// operations over the returned stream, whatever the runtime.
+type Backend interface {
+	// Resolve finds the target. It is called first, and again when the target restarts.
+	Resolve(ctx context.Context) (Target, error)
+	// Arch returns the architecture and variant the satellite must be built for, as OCI names them
+	Arch(ctx context.Context) (arch string, variant string, err error)
+	// PlaceSatellite makes satellite runnable in the target
+	PlaceSatellite(ctx context.Context, satellite Satellite) error
+	// Start runs the placed satellite with args
+	Start(ctx context.Context, args []string) (SatelliteConn, error)
+	// Run runs the placed satellite with args to completion, and returns its output
+	Run(ctx context.Context, args ...string) (string, error)
+}
+
+// lifecycleBackend is a backend reporting Docker events about its target, for WatchLifecycle
+type lifecycleBackend interface {
+	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+}
+
+// BackendConfig holds the settings of backends, set by ClientOptions
+type BackendConfig struct {
+	// Docker daemon, for the docker backend
+	Docker DockerConfig
+	// containerd daemon, for the containerd backend
+	Containerd ContainerdConfig
+	// Kubernetes cluster, for the kubernetes backend
+	Kube KubeConfig
+	// Candidate directories for the satellite, DefaultSatelliteDirs when nil
+	SatelliteDirs []string
+	// Check the architecture the target runs on, rather than trusting image metadata
+	ArchDetection bool
+	// Let the satellite remove its executable when the session ends
+	RemoveSatellite bool
+}
+
+// BackendFactory returns a backend serving target, as given on the command line
+type BackendFactory func(target string, config BackendConfig) (Backend, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]BackendFactory{
+		BackendDocker:     newDockerBackend,
+		BackendContainerd: newContainerdRuntime,
+		BackendKubernetes: newKubeBackend,
+		BackendProcess:    newProcessBackend,
+		BackendSSH:        newSSHBackend,
+	}
+)
+
+// RegisterBackend makes a backend selectable by name, replacing any backend of that name
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends, sorted
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	return slices.Sorted(maps.Keys(backends))
+}
+
+// newBackend returns the backend name serving target
+func newBackend(name string, target string, config BackendConfig) (Backend, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (supported: %s)", name, strings.Join(Backends(), ", "))
+	}
+	return factory(target, config)
+}
+
+// WithBackend selects the runtime backend by name, BackendDocker by default
+func WithBackend(name string) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendName = name
+	}
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	containers "github.com/containerd/containerd/api/services/containers/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// contractSatellite stands for the satellite: it prints its version and checksum, or echoes a 4
+// bytes request
+var contractSatellite = []byte(`#!/bin/sh
+if [ "$1" = -version ]; then
+	echo "DockerFuse Satellite (contract test)"
+	echo "SHA256: $(sha256sum "$0" | cut -d ' ' -f 1)"
+	exit
+fi
+exec head -c 4
+`)
+
+// testBackendContract checks what DockerFuseClient relies on from a backend, placing the satellite
+// in a directory of the target the backend was configured with
+func testBackendContract(t *testing.T, b Backend) {
+	ctx := context.Background()
+	target, err := b.Resolve(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, target.ID)
+	again, err := b.Resolve(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, target, again, "targets must be stable")
+
+	arch, variant, err := b.Arch(ctx)
+	if assert.NoError(t, err) {
+		_, err = satelliteArch(arch, variant)
+		assert.NoError(t, err)
+	}
+
+	err = b.PlaceSatellite(ctx, Satellite{Name: "dockerfuse_satellite_contract", Binary: contractSatellite, Source: "contract"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	version, err := b.Run(ctx, "-version")
+	assert.NoError(t, err)
+	assert.Contains(t, version, "DockerFuse Satellite")
+
+	conn, err := b.Start(ctx, []string{"-session", "host:1:abcd"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "ping")
+	assert.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+	// As the RPC client does, the stream is read until the satellite exits
+	go io.Copy(io.Discard, conn)
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.NoError(t, conn.Stop(stopCtx))
+}
+
+// runLocal runs args here, as the fake targets of contract tests do, and returns its exit code
+func runLocal(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdout, c.Stderr = stdout, stderr
+	// Commands may exit before the end of their input
+	w, err := c.StdinPipe()
+	if err == nil {
+		go func() {
+			io.Copy(w, stdin)
+			w.Close()
+		}()
+		err = c.Run()
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	case err != nil:
+		io.WriteString(stderr, err.Error())
+		return 127
+	}
+	return 0
+}
+
+// contractBackend returns the backend name with config, failing the test on error
+func contractBackend(t *testing.T, name string, target string, config BackendConfig) Backend {
+	b, err := newBackend(name, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return b
+}
+
+func TestSSHBackendContract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SSH hosts must run Linux")
+	}
+	fakeSSH(t)
+	testBackendContract(t, contractBackend(t, BackendSSH, "admin@web", BackendConfig{SatelliteDirs: []string{t.TempDir()}}))
+}
+
+func TestProcessBackendContract(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("entering mount namespaces needs root on Linux")
+	}
+	if _, err := exec.LookPath(nsenterPath); err != nil {
+		t.Skipf("%s (util-linux) not found", nsenterPath)
+	}
+	cmd := exec.Command("sleep", "60")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	testBackendContract(t, contractBackend(t, BackendProcess, strconv.Itoa(cmd.Process.Pid), BackendConfig{SatelliteDirs: []string{t.TempDir()}}))
+}
+
+func TestKubernetesBackendContract(t *testing.T) {
+	// The pod runs commands here
+	kubeconfig := fakeKubeAPI(t, true, func(cmd []string, stdin io.Reader) (string, string, int) {
+		var stdout, stderr bytes.Buffer
+		exitCode := runLocal(cmd, stdin, &stdout, &stderr)
+		return stdout.String(), stderr.String(), exitCode
+	})
+	config := BackendConfig{Kube: KubeConfig{Path: kubeconfig}, SatelliteDirs: []string{t.TempDir()}}
+	testBackendContract(t, contractBackend(t, BackendKubernetes, "web-0", config))
+}
+
+func TestContainerdBackendContract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("containerd tasks are reached through /proc")
+	}
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = "/proc"
+	// The task is this process, whose exec processes run here
+	spec, _ := json.Marshal(map[string]any{"process": map[string]any{"env": []string{"PATH=/bin"}, "user": map[string]int{"uid": 1000}}})
+	ctr := &containers.Container{ID: "c0ffee", Spec: &anypb.Any{TypeUrl: "types.containerd.io/opencontainers/runtime-spec/1/Spec", Value: spec}}
+	tk := &fakeTasks{t: t, pid: uint32(os.Getpid()), run: runLocal}
+	address := fakeContainerd(t, "k8s.io", &fakeContainers{containers: map[string]*containers.Container{ctr.ID: ctr}}, tk)
+	config := BackendConfig{Containerd: ContainerdConfig{Address: address, Namespace: "k8s.io"}, SatelliteDirs: []string{t.TempDir()}}
+	testBackendContract(t, contractBackend(t, BackendContainerd, "c0ffee", config))
+}
+
+func TestDockerBackendContract(t *testing.T) {
+	defer func(f dockerClientFactoryInterface) { dockerCF = f }(dockerCF)
+	dockerCF = &dockerClientFactory{}
+	t.Setenv("DOCKER_API_VERSION", "")
+	// The container runs commands here
+	config := BackendConfig{Docker: DockerConfig{Host: fakeDockerAPI(t, "c0ffee", runLocal)}, SatelliteDirs: []string{t.TempDir()}}
+	testBackendContract(t, contractBackend(t, BackendDocker, "c0ffee", config))
+}
+
+// TestDockerBackendContractContainer runs the docker contract against the daemon, with a running
+// container named by DOCKERFUSE_TEST_CONTAINER
+func TestDockerBackendContractContainer(t *testing.T) {
+	containerID := os.Getenv("DOCKERFUSE_TEST_CONTAINER")
+	if containerID == "" {
+		t.Skip("DOCKERFUSE_TEST_CONTAINER is not set")
+	}
+	defer func(f dockerClientFactoryInterface) { dockerCF = f }(dockerCF)
+	dockerCF = &dockerClientFactory{}
+	testBackendContract(t, contractBackend(t, BackendDocker, containerID, BackendConfig{SatelliteDirs: []string{"/tmp"}}))
+}
+
+// pipeBackend serves a target of its own, for registry tests
+type pipeBackend struct {
+	target string
+	config BackendConfig
+	placed Satellite
+	args   []string
+	conn   net.Conn
+}
+
+// pipeSatellite is the client end of a pipeBackend
+type pipeSatellite struct{ net.Conn }
+
+func (s pipeSatellite) Stop(ctx context.Context) error { return nil }
+
+func (b *pipeBackend) Resolve(ctx context.Context) (Target, error) { return Target{ID: "pipe"}, nil }
+func (b *pipeBackend) Arch(ctx context.Context) (string, string, error) {
+	return "amd64", "", nil
+}
+func (b *pipeBackend) PlaceSatellite(ctx context.Context, satellite Satellite) error {
+	b.placed = satellite
+	return nil
+}
+func (b *pipeBackend) Start(ctx context.Context, args []string) (SatelliteConn, error) {
+	b.args = args
+	return pipeSatellite{b.conn}, nil
+}
+func (b *pipeBackend) Run(ctx context.Context, args ...string) (string, error) { return "", nil }
+
+func TestBackendRegistry(t *testing.T) {
+	assert.Equal(t, []string{BackendContainerd, BackendDocker, BackendKubernetes, BackendProcess, BackendSSH}, Backends())
+	_, err := newClient("c", WithBackend("ftp"))
+	assert.EqualError(t, err, `unknown backend "ftp" (supported: containerd, docker, kubernetes, process, ssh)`)
+
+	var (
+		mFS    mockFS
+		mRPCC  mockRPCClient
+		mRPCCF mockRPCClientFactory
+	)
+	dfFS = &mFS
+	rpcCF = &mRPCCF
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	b := &pipeBackend{conn: conn}
+	RegisterBackend("pipe", func(target string, config BackendConfig) (Backend, error) {
+		b.target, b.config = target, config
+		return b, nil
+	})
+	defer func() {
+		backendsMu.Lock()
+		delete(backends, "pipe")
+		backendsMu.Unlock()
+	}()
+	assert.Contains(t, Backends(), "pipe")
+
+	// DockerFuseClient only goes through the backend
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_amd64").Return([]byte("satellite"), nil)
+	mRPCCF.On("NewClient", pipeSatellite{conn}).Return(&mRPCC)
+	mRPCC.On("Close").Return(nil)
+	// Auto access runs the satellite through backends without the Docker API
+	c, err := NewClient("box", AccessAuto, WithBackend("pipe"), WithSatelliteDirs([]string{"/srv"}), WithChangeWatch())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "box", b.target)
+	assert.Equal(t, []string{"/srv"}, b.config.SatelliteDirs)
+	assert.Equal(t, "dockerfuse_satellite_amd64", b.placed.Name)
+	assert.Equal(t, []byte("satellite"), b.placed.Binary)
+	if assert.Len(t, b.args, 3) {
+		assert.Equal(t, "-session", b.args[0])
+		assert.Equal(t, "-watch", b.args[2])
+	}
+	c.Close()
+	mRPCCF.AssertExpectations(t)
+	mRPCC.AssertExpectations(t)
+
+	// Docker features need the Docker API
+	_, err = newDockerAPI("box", WithBackend("pipe"))
+	assert.EqualError(t, err, "the pipe backend has no Docker API")
+	_, err = newDockerAPI("box", WithContainerd(ContainerdConfig{}))
+	assert.EqualError(t, err, "the containerd backend has no Docker API")
+	_, err = NewClient("box", AccessArchive, WithBackend("pipe"))
+	assert.EqualError(t, err, "the pipe backend has no Docker API")
+	d, _ := newClient("box", WithBackend("pipe"))
+	err = d.WatchLifecycle(context.Background(), LifecycleConfig{OnExit: ExitStale})
+	assert.EqualError(t, err, "the pipe backend does not report lifecycle events")
+	assert.ErrorIs(t, err, ErrNoLifecycleEvents)
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	// Time given to the satellite to exit, once its session is closed
+	satelliteExitTimeout = 2 * time.Second
+	satelliteExitPoll    = 50 * time.Millisecond
+)
+
+// newSessionID returns an identifier for a satellite session: "<hostname>:<pid>:<nonce>".
+// Cleanups use it to tell whether the dockerfuse process that started a satellite is still alive.
+var newSessionID = func() string {
+	hostname, _ := os.Hostname()
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// sessionAlive tells whether the session belongs to a dockerfuse process running on this host
+var sessionAlive = func(session string) bool {
+	host, rest, ok := strings.Cut(session, ":")
+	if !ok {
+		return false
+	}
+	pidStr, _, _ := strings.Cut(rest, ":")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if hostname, _ := os.Hostname(); hostname != host {
+		// Started from another host: we can't tell
+		return true
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// orphanSatellites parses the output of `satellite -list` and returns the pids of satellites
+// whose dockerfuse process is gone, and the number of live sessions. With all, every satellite is
+// returned, live ones included.
+func orphanSatellites(list string, all bool) (orphans []string, live int) {
+	for _, line := range strings.Split(list, "\n") {
+		pid, session, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if pid == "" {
+			continue
+		}
+		// Satellites from older versions have no session: they are counted as live
+		alive := session == "" || sessionAlive(session)
+		if alive {
+			live++
+		}
+		if all || !alive {
+			orphans = append(orphans, pid)
+		}
+	}
+	return
+}
+
+// CleanupSatellites terminates satellites left running in the container by dockerfuse processes
+// that are gone, and returns their pids. With all, every satellite is terminated, including those
+// serving mounts from other hosts. The satellite executable is removed only when no live session
+// was found, and the satellite checks that no other one is running before removing it.
+func CleanupSatellites(containerID string, all bool, opts ...ClientOption) (killed []string, err error) {
+	d, err := newClient(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err = d.uploadSatellite(ctx); err != nil {
+		return nil, fmt.Errorf("error copying docker-fuse satellite to remote container: %s", err)
+	}
+	list, err := d.backend.Run(ctx, "-list")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list satellites: %s", err)
+	}
+	orphans, live := orphanSatellites(list, all)
+	slog.Debug("satellites found", "orphans", len(orphans), "live", live)
+
+	if len(orphans) == 0 && live > 0 {
+		return nil, nil
+	}
+	args := []string{"-kill", strings.Join(orphans, ",")}
+	if live == 0 {
+		args = append(args, "-remove")
+	}
+	out, err := d.backend.Run(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot terminate satellites: %s", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// CleanupImageHelpers removes the helper containers of image mounts (see NewImageClient) left
+// behind by dockerfuse processes that are gone, and returns their IDs. With all, every helper is
+// removed, including those of mounts from other hosts.
+func CleanupImageHelpers(all bool, opts ...ClientOption) (removed []string, err error) {
+	docker, err := newDockerAPI("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	helpers, err := docker.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", imageHelperLabel)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list helper containers: %s", err)
+	}
+	for _, h := range helpers {
+		session := h.Labels[helperSessionLabel]
+		if !all && (session == "" || sessionAlive(session)) {
+			// Helpers from older versions have no session: leave them alone
+			continue
+		}
+		err := docker.ContainerRemove(ctx, h.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		if err != nil {
+			return removed, fmt.Errorf("cannot remove helper container %s: %s", h.ID, err)
+		}
+		removed = append(removed, h.ID)
+	}
+	return removed, nil
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// halfCloseConn records half-closes, as TCP and unix connections support them
+type halfCloseConn struct {
+	net.Conn
+	closedWrite bool
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	c.closedWrite = true
+	return nil
+}
+
+func TestSessionAlive(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	assert.True(t, sessionAlive(newSessionID()))
+	assert.True(t, sessionAlive(fmt.Sprintf("%s:%d:abcd", hostname, os.Getpid())))
+	assert.True(t, sessionAlive("some-other-host:1:abcd"))
+	assert.False(t, sessionAlive(hostname+":x:abcd"))
+	assert.False(t, sessionAlive("garbage"))
+}
+
+func TestOrphanSatellites(t *testing.T) {
+	defer func(f func(string) bool) { sessionAlive = f }(sessionAlive)
+	sessionAlive = func(session string) bool { return session == "live" }
+
+	list := "10 live\n11 gone\n12\n\n"
+	orphans, live := orphanSatellites(list, false)
+	assert.Equal(t, []string{"11"}, orphans)
+	assert.Equal(t, 2, live)
+
+	orphans, live = orphanSatellites(list, true)
+	assert.Equal(t, []string{"10", "11", "12"}, orphans)
+	assert.Equal(t, 2, live)
+}
+
+func TestCleanupSatellites(t *testing.T) {
+	defer func(f func(string) bool) { sessionAlive = f }(sessionAlive)
+	sessionAlive = func(session string) bool { return session == "live" }
+	content := []byte("test executable content")
+	remotePath := "/tmp/dockerfuse_satellite_amd64"
+
+	setup := func(list string) (*mockDockerClient, *mockDockerClientFactory) {
+		var (
+			mFS  mockFS
+			mDC  mockDockerClient
+			mDCF mockDockerClientFactory
+		)
+		dfFS = &mFS
+		dockerCF = &mDCF
+		mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+		mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+		mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_amd64").Return(content, nil)
+		mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image"},
+		}, nil)
+		mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+			image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+		mDC.On("ContainerStatPath", mock.Anything, "c", remotePath).Return(
+			container.PathStat{Size: int64(len(content))}, nil)
+		mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+			AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-version"},
+		}).Return(common.IDResponse{ID: "probe"}, nil)
+		mDC.On("ContainerExecAttach", mock.Anything, "probe", container.ExecStartOptions{}).Return(
+			execOutput(t, satelliteVersion(content)), nil)
+		mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+			AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-list"},
+		}).Return(common.IDResponse{ID: "list"}, nil)
+		mDC.On("ContainerExecAttach", mock.Anything, "list", container.ExecStartOptions{}).Return(
+			execOutput(t, list), nil)
+		return &mDC, &mDCF
+	}
+
+	// Orphans are terminated, live satellites and their executable are left alone
+	mDC, _ := setup("10 live\n11 gone\n12 gone\n")
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-kill", "11,12"},
+	}).Return(common.IDResponse{ID: "kill"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "kill", container.ExecStartOptions{}).Return(
+		execOutput(t, "11\n12\n"), nil)
+	killed, err := CleanupSatellites("c", false, WithSatelliteDirs([]string{"/tmp"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"11", "12"}, killed)
+	mDC.AssertExpectations(t)
+
+	// Nothing to do
+	mDC, _ = setup("10 live\n")
+	killed, err = CleanupSatellites("c", false, WithSatelliteDirs([]string{"/tmp"}))
+	assert.NoError(t, err)
+	assert.Empty(t, killed)
+	mDC.AssertExpectations(t)
+
+	// With all, every satellite goes, but the executable of live sessions is left alone
+	mDC, _ = setup("10 live\n")
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-kill", "10"},
+	}).Return(common.IDResponse{ID: "kill"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "kill", container.ExecStartOptions{}).Return(
+		execOutput(t, "10\n"), nil)
+	killed, err = CleanupSatellites("c", true, WithSatelliteDirs([]string{"/tmp"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10"}, killed)
+	mDC.AssertExpectations(t)
+
+	// With all and only orphans, the executable goes too
+	mDC, _ = setup("11 gone\n")
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-kill", "11", "-remove"},
+	}).Return(common.IDResponse{ID: "kill"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "kill", container.ExecStartOptions{}).Return(
+		execOutput(t, "11\n"), nil)
+	killed, err = CleanupSatellites("c", true, WithSatelliteDirs([]string{"/tmp"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"11"}, killed)
+	mDC.AssertExpectations(t)
+
+	// No satellite running: only the executable is removed
+	mDC, _ = setup("")
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-kill", "", "-remove"},
+	}).Return(common.IDResponse{ID: "kill"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "kill", container.ExecStartOptions{}).Return(
+		execOutput(t, ""), nil)
+	killed, err = CleanupSatellites("c", false, WithSatelliteDirs([]string{"/tmp"}))
+	assert.NoError(t, err)
+	assert.Empty(t, killed)
+	mDC.AssertExpectations(t)
+
+	// Docker errors
+	var mDCF mockDockerClientFactory
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mockDockerClient{}, fmt.Errorf("no docker"))
+	_, err = CleanupSatellites("c", false)
+	assert.EqualError(t, err, "no docker")
+}
+
+func TestDockerFuseClientClose(t *testing.T) {
+	var (
+		mDC   mockDockerClient
+		mRPCC mockRPCClient
+	)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	hcConn := &halfCloseConn{Conn: conn}
+
+	// The satellite is given time to exit
+	mRPCC.On("Close").Return(nil)
+	mDC.On("ContainerExecInspect", mock.Anything, "satellite").Return(container.ExecInspect{Running: true}, nil).Once()
+	mDC.On("ContainerExecInspect", mock.Anything, "satellite").Return(container.ExecInspect{Running: false}, nil).Once()
+	fdc := &DockerFuseClient{
+		rpcClient: &mRPCC,
+		satellite: &dockerSatellite{HijackedResponse: types.HijackedResponse{Conn: hcConn}, dockerClient: &mDC, execID: "satellite"},
+	}
+	fdc.Close()
+	assert.True(t, hcConn.closedWrite)
+	assert.Nil(t, fdc.rpcClient)
+	assert.Nil(t, fdc.satellite)
+	mDC.AssertExpectations(t)
+	mRPCC.AssertExpectations(t)
+
+	// Without half-close, the connection is just closed
+	mRPCC = mockRPCClient{}
+	mRPCC.On("Close").Return(nil)
+	fdc = &DockerFuseClient{
+		rpcClient: &mRPCC,
+		satellite: &dockerSatellite{HijackedResponse: types.HijackedResponse{Conn: conn}, dockerClient: &mockDockerClient{}, execID: "satellite"},
+	}
+	fdc.Close()
+	assert.Nil(t, fdc.rpcClient)
+	mRPCC.AssertExpectations(t)
+
+	// Closing twice is harmless
+	fdc.Close()
+}
+
+func TestSatelliteCmd(t *testing.T) {
+	b := &satellitePlacement{satelliteFullRemotePath: "/tmp/dockerfuse_satellite_amd64"}
+	assert.Equal(t, []string{"/tmp/dockerfuse_satellite_amd64"}, b.satelliteCmd(nil))
+
+	session := []string{"-session", "host:1:abcd"}
+	b.removeSatellite = true
+	assert.Equal(t, []string{"/tmp/dockerfuse_satellite_amd64", "-session", "host:1:abcd", "-remove"}, b.satelliteCmd(session))
+
+	// Satellites in memory have no executable to remove
+	b.satelliteInMemory = []byte("satellite")
+	assert.Equal(t, []string{"python3", "-c", memfdBootstrap, "9", "-session", "host:1:abcd"}, b.satelliteCmd(session))
+}
+
+func TestCleanupImageHelpers(t *testing.T) {
+	defer func(f func(string) bool) { sessionAlive = f }(sessionAlive)
+	sessionAlive = func(session string) bool { return session == "live" }
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+	list := container.ListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", imageHelperLabel))}
+	mDC.On("ContainerList", mock.Anything, list).Return([]container.Summary{
+		{ID: "live", Labels: map[string]string{imageHelperLabel: "app:1", helperSessionLabel: "live"}},
+		{ID: "gone", Labels: map[string]string{imageHelperLabel: "app:1", helperSessionLabel: "gone"}},
+		{ID: "old", Labels: map[string]string{imageHelperLabel: "app:1"}},
+	}, nil)
+	remove := container.RemoveOptions{Force: true, RemoveVolumes: true}
+
+	// Helpers of dockerfuse processes still running are kept
+	mDC.On("ContainerRemove", mock.Anything, "gone", remove).Return(nil).Once()
+	removed, err := CleanupImageHelpers(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gone"}, removed)
+	mDC.AssertExpectations(t)
+
+	for _, id := range []string{"live", "gone", "old"} {
+		mDC.On("ContainerRemove", mock.Anything, id, remove).Return(nil).Once()
+	}
+	removed, err = CleanupImageHelpers(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"live", "gone", "old"}, removed)
+	mDC.AssertExpectations(t)
+
+	_, err = CleanupImageHelpers(false, WithContainerd(ContainerdConfig{}))
+	assert.EqualError(t, err, "the containerd backend has no Docker API")
+}
@@ -1,32 +1,34 @@
 package client
 
 import (
-	"archive/tar"
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
 	"io/fs"
 	"log/slog"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/dguerri/dockerfuse/pkg/rpccommon"
-	"github.com/docker/cli/cli/connhelper"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 const (
 	satelliteBinPrefix = "dockerfuse_satellite"
-	satelliteExecPath  = "/tmp"
+
+	// Change notifications are long-polled: each request waits up to watchTimeout for changes
+	watchTimeout    = 30 * time.Second
+	watchMaxEvents  = 1024
+	watchRetryDelay = time.Second
 )
 
+// DefaultSatelliteDirs are the directories where the satellite is copied, in order of preference
+var DefaultSatelliteDirs = []string{"/tmp", "/dev/shm", "/run", "/var/tmp"}
+
 type statAttr struct {
 	FuseAttr   fuse.Attr
 	LinkTarget string
@@ -34,6 +36,11 @@ type statAttr struct {
 
 // DockerFuseClientInterface can be used to write unit tests
 type DockerFuseClientInterface interface {
+	// Close ends the session with the container
+	Close()
+	// CacheStats returns metadata cache counters
+	CacheStats() CacheStats
+
 	disconnect()
 	connectSatellite(ctx context.Context) (err error)
 
@@ -42,7 +49,7 @@ type DockerFuseClientInterface interface {
 	fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno)
 	link(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno)
 	mkdir(ctx context.Context, fullPath string, mode fs.FileMode, attr *statAttr) (syserr syscall.Errno)
-	open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno)
+	open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno)
 	read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno)
 	readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno)
 	readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno)
@@ -54,126 +61,310 @@ type DockerFuseClientInterface interface {
 	symlink(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno)
 	unlink(ctx context.Context, fullPath string) (syserr syscall.Errno)
 	write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno)
+
+	watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) (err error)
 }
 
-// DockerFuseClient is used to communicate with the Docker API server
+// DockerFuseClient forwards filesystem operations to the satellite, which its backend runs in the
+// container (or whatever the backend serves)
 type DockerFuseClient struct {
-	dockerClient            dockerClient
-	rpcClient               rpcClient
-	containerID             string
-	satelliteFullRemotePath string
+	backend     Backend
+	rpcClient   rpcClient
+	containerID string
+	// Identifies the satellite started by this client, for cleanups
+	session   string
+	satellite SatelliteConn
+	// Set when changes made in the container are watched: the satellite then watches the
+	// directories looked up from its start
+	watch bool
+
+	// Metadata cache, nil when disabled
+	cache *metadataCache
+	// Block cache with readahead, nil when disabled
+	readahead *readaheadCache
+	// On-disk content cache, nil when disabled
+	disk           *diskCache
+	diskCacheDir   string
+	diskCacheLimit int64
+	// Name of the backend to create, BackendDocker by default, and its settings
+	backendName   string
+	backendConfig BackendConfig
+	// Pull images missing locally, for NewImageClient
+	imagePull bool
+	// Set when the satellite is unreachable and cached content is served read-only
+	offline       atomic.Bool
+	nextOfflineFH atomic.Uintptr
+	// Open file handles, used to invalidate and fill caches
+	handlesMu sync.Mutex
+	handles   map[fusefs.FileHandle]*openHandle
+
+	// Container state, followed by WatchLifecycle. containerReady is closed when a paused or
+	// stopped container runs again, or is gone. It also guards rpcClient replacements.
+	lifecycleMu      sync.Mutex
+	lifecycleTimeout time.Duration
+	containerState   containerState
+	containerReady   chan struct{}
+	// Incremented each time the satellite is started again
+	satelliteGeneration atomic.Uint32
+	followingLifecycle  atomic.Bool
 }
 
-// NewDockerFuseClient returns a new DockerFuseClient pointer
-func NewDockerFuseClient(containerID string) (*DockerFuseClient, error) {
-	var clientOpts []client.Opt = nil
-	if strings.HasPrefix(os.Getenv("DOCKER_HOST"), "ssh://") {
-		helper, err := connhelper.GetConnectionHelper(os.Getenv("DOCKER_HOST"))
-		if err != nil {
-			return nil, err
-		}
+type openHandle struct {
+	fullPath string
+	attr     fuse.Attr
+	dirty    bool // Written through this handle: cached content is stale
+}
 
-		httpClient := &http.Client{
-			Transport: &http.Transport{
-				DialContext: helper.Dialer,
-			},
-		}
+// ClientOption configures optional DockerFuseClient features
+type ClientOption func(*DockerFuseClient)
+
+// WithMetadataCache enables caching of attributes, directory listings and ENOENT results
+func WithMetadataCache(config CacheConfig) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.cache = newMetadataCache(config)
+	}
+}
+
+// WithReadahead enables a per-handle block cache prefetching data ahead of sequential readers
+func WithReadahead(config ReadaheadConfig) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.readahead = newReadaheadCache(config)
+	}
+}
 
-		clientOpts = append(clientOpts,
-			client.WithHTTPClient(httpClient),
-			client.WithHost(helper.Host),
-			client.WithDialContext(helper.Dialer),
-		)
-	} else {
-		clientOpts = append(clientOpts, client.FromEnv)
-	}
-	version := os.Getenv("DOCKER_API_VERSION")
-	if version != "" {
-		clientOpts = append(clientOpts, client.WithVersion(version))
-	} else {
-		clientOpts = append(clientOpts, client.WithAPIVersionNegotiation())
-	}
-	docker, err := dockerCF.NewClientWithOpts(clientOpts...)
+// WithDiskCache enables a persistent content cache below dir, also used to serve cached content
+// read-only when the satellite cannot be reached. File contents cached below dir are kept within
+// limit bytes (no limit when 0).
+func WithDiskCache(dir string, limit int64) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.diskCacheDir = dir
+		d.diskCacheLimit = limit
+	}
+}
+
+// WithArchDetection picks the satellite from the architecture the container actually runs on
+// (`uname -m` or the entrypoint ELF header), instead of the image metadata
+func WithArchDetection() ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendConfig.ArchDetection = true
+	}
+}
+
+// WithSatelliteDirs sets the directories where the satellite may be copied, in order of preference
+func WithSatelliteDirs(dirs []string) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendConfig.SatelliteDirs = dirs
+	}
+}
+
+// WithSatelliteRemoval makes the satellite delete its executable from the container when the session ends
+func WithSatelliteRemoval() ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendConfig.RemoveSatellite = true
+	}
+}
+
+// WithChangeWatch has the satellite watch the directories looked up for changes, collected with
+// watchChanges. Satellites add no inotify watches otherwise.
+func WithChangeWatch() ClientOption {
+	return func(d *DockerFuseClient) {
+		d.watch = true
+	}
+}
+
+// NewDockerFuseClient returns a new DockerFuseClient pointer
+func NewDockerFuseClient(containerID string, opts ...ClientOption) (*DockerFuseClient, error) {
+	fdc, err := newClient(containerID, opts...)
 	if err != nil {
 		return nil, err
 	}
-	fdc := &DockerFuseClient{
-		dockerClient: docker,
-		containerID:  containerID,
-	}
+	fdc.session = newSessionID()
 
 	ctx := context.Background()
 	err = fdc.uploadSatellite(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error copying docker-fuse satellite to remote container: %s", err)
+		err = fmt.Errorf("error copying docker-fuse satellite to remote container: %s", err)
+		return fdc.offlineFallback(err)
 	}
 	err = fdc.connectSatellite(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to docker-fuse satellite: %s", err)
+		err = fmt.Errorf("error connecting to docker-fuse satellite: %s", err)
+		return fdc.offlineFallback(err)
 	}
 	return fdc, nil
 }
 
+// newClient returns a DockerFuseClient with its backend, without a satellite
+func newClient(containerID string, opts ...ClientOption) (*DockerFuseClient, error) {
+	fdc := &DockerFuseClient{
+		containerID: containerID,
+		backendName: BackendDocker,
+	}
+	for _, opt := range opts {
+		opt(fdc)
+	}
+	backend, err := newBackend(fdc.backendName, containerID, fdc.backendConfig)
+	if err != nil {
+		return nil, err
+	}
+	fdc.backend = backend
+	return fdc, nil
+}
+
+// clientSettings returns the settings opts make, for clients other than DockerFuseClient
+func clientSettings(opts ...ClientOption) *DockerFuseClient {
+	d := &DockerFuseClient{backendName: BackendDocker}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// hasDockerAPI tells whether the runtime opts select talks the Docker API: the docker backend,
+// with Docker or Podman as engine
+func hasDockerAPI(opts ...ClientOption) bool {
+	return clientSettings(opts...).backendName == BackendDocker
+}
+
+// newDockerAPI returns the Docker API client configured by opts, for features only Docker has
+func newDockerAPI(containerID string, opts ...ClientOption) (dockerClient, error) {
+	d := clientSettings(opts...)
+	if d.backendName != BackendDocker {
+		return nil, fmt.Errorf("the %s backend has no Docker API", d.backendName)
+	}
+	endpoint, err := resolveDockerEndpoint(d.backendConfig.Docker)
+	if err != nil {
+		return nil, err
+	}
+	return newDockerAPIClient(endpoint)
+}
+
 func (d *DockerFuseClient) disconnect() {
 	if d.rpcClient != nil {
 		d.rpcClient.Close()
 		d.rpcClient = nil
 	}
+	d.satellite = nil
 }
 
-func (d *DockerFuseClient) uploadSatellite(ctx context.Context) (err error) {
-	containerInspect, err := d.dockerClient.ContainerInspect(ctx, d.containerID)
-	if err != nil {
-		return err
+// Close ends the satellite session. The satellite sees the end of its input, releases its
+// resources and exits: Close waits for that, up to satelliteExitTimeout.
+func (d *DockerFuseClient) Close() {
+	if d.satellite != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), satelliteExitTimeout)
+		if err := d.satellite.Stop(ctx); err != nil {
+			slog.Warn("cannot stop the satellite", "error", err)
+		}
+		cancel()
 	}
+	d.disconnect()
+}
 
-	imageInspect, _, err := d.dockerClient.ImageInspectWithRaw(ctx, containerInspect.Image)
-	if err != nil {
-		return err
+// CacheStats returns metadata cache counters. It returns zeroes when the cache is disabled.
+func (d *DockerFuseClient) CacheStats() CacheStats {
+	if d.cache == nil {
+		return CacheStats{}
+	}
+	return d.cache.stats()
+}
+
+// invalidate drops cached metadata and content of the given paths
+func (d *DockerFuseClient) invalidate(fullPaths ...string) {
+	for _, p := range fullPaths {
+		if d.cache != nil {
+			d.cache.invalidate(p)
+		}
+		if d.readahead != nil {
+			d.readahead.invalidate(p)
+		}
+		if d.disk != nil {
+			d.disk.removeAttr(p)
+		}
 	}
+}
 
-	if imageInspect.Architecture != "arm64" && imageInspect.Architecture != "amd64" {
-		return fmt.Errorf("unsupported architecture: %s (use arm64 or amd64)", imageInspect.Architecture)
+// invalidateTree drops cached metadata and content of the given paths and their descendants
+func (d *DockerFuseClient) invalidateTree(fullPaths ...string) {
+	for _, p := range fullPaths {
+		if d.cache != nil {
+			d.cache.invalidateTree(p)
+		}
+		if d.readahead != nil {
+			d.readahead.invalidateTree(p)
+		}
+		if d.disk != nil {
+			d.disk.removeTree(p)
+		}
 	}
+}
 
-	satelliteBinName := fmt.Sprintf("%s_%s", satelliteBinPrefix, imageInspect.Architecture)
-	d.satelliteFullRemotePath = filepath.Clean(filepath.Join(satelliteExecPath, satelliteBinName))
+// trackHandle remembers which file fh refers to, so that writes can invalidate cached data
+func (d *DockerFuseClient) trackHandle(fh fusefs.FileHandle, fullPath string, attr *statAttr) {
+	if d.readahead != nil {
+		d.readahead.open(fh, fullPath, &attr.FuseAttr)
+	}
+	if d.cache == nil && d.readahead == nil && d.disk == nil {
+		return
+	}
+	d.handlesMu.Lock()
+	defer d.handlesMu.Unlock()
+	if d.handles == nil {
+		d.handles = make(map[fusefs.FileHandle]*openHandle)
+	}
+	d.handles[fh] = &openHandle{fullPath: fullPath, attr: attr.FuseAttr}
+}
 
-	ex, err := dfFS.Executable()
-	if err != nil {
-		return err
+// handle returns a copy of what is known about fh
+func (d *DockerFuseClient) handle(fh fusefs.FileHandle) (h openHandle, ok bool) {
+	d.handlesMu.Lock()
+	defer d.handlesMu.Unlock()
+	if p, found := d.handles[fh]; found {
+		return *p, true
+	}
+	return
+}
+
+// markDirty records a write through fh, returning the path it refers to
+func (d *DockerFuseClient) markDirty(fh fusefs.FileHandle) (fullPath string, ok bool) {
+	d.handlesMu.Lock()
+	defer d.handlesMu.Unlock()
+	if p, found := d.handles[fh]; found {
+		p.dirty = true
+		return p.fullPath, true
 	}
-	satelliteFullLocalPath := filepath.Clean(filepath.Join(filepath.Dir(ex), satelliteBinName))
-	satelliteBin, err := dfFS.ReadFile(satelliteFullLocalPath)
+	return
+}
+
+// uploadSatellite has the backend place the satellite matching the architecture of the target
+func (d *DockerFuseClient) uploadSatellite(ctx context.Context) (err error) {
+	target, err := d.backend.Resolve(ctx)
 	if err != nil {
 		return err
 	}
+	// The disk cache outlives satellite restarts
+	if d.diskCacheDir != "" && d.disk == nil {
+		d.disk, err = newDiskCache(d.diskCacheDir, target.ID, d.containerID, d.diskCacheLimit)
+		if err != nil {
+			slog.Warn("disk cache disabled", "dir", d.diskCacheDir, "error", err)
+			d.disk = nil
+		}
+	}
 
-	// Create tar archive in memory
-	var buf bytes.Buffer
-	tw := tar.NewWriter(&buf)
-	err = tw.WriteHeader(&tar.Header{
-		Name: satelliteBinName,
-		Mode: 0700,
-		Size: int64(len(satelliteBin)),
-	})
+	arch, variant, err := d.backend.Arch(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = tw.Write([]byte(satelliteBin))
+	binArch, err := satelliteArch(arch, variant)
 	if err != nil {
 		return err
 	}
-	tw.Close()
 
-	slog.Info("copying", "source", satelliteFullLocalPath, "destination", fmt.Sprintf("%s:%s", d.containerID, d.satelliteFullRemotePath))
-	tr := bufio.NewReader(&buf)
-	err = d.dockerClient.CopyToContainer(ctx, d.containerID, satelliteExecPath, tr, container.CopyToContainerOptions{})
+	satelliteBinName := fmt.Sprintf("%s_%s", satelliteBinPrefix, binArch)
+	satelliteBin, source, err := satelliteBinary(satelliteBinName)
 	if err != nil {
 		return err
 	}
-
-	return
+	return d.backend.PlaceSatellite(ctx, Satellite{Name: satelliteBinName, Binary: satelliteBin, Source: source})
 }
 
 func (d *DockerFuseClient) connectSatellite(ctx context.Context) (err error) {
@@ -182,22 +373,19 @@ func (d *DockerFuseClient) connectSatellite(ctx context.Context) (err error) {
 		d.disconnect()
 	}
 
-	config := container.ExecOptions{
-		AttachStderr: false,
-		AttachStdout: true,
-		AttachStdin:  true,
-		Tty:          false,
-		Cmd:          []string{d.satelliteFullRemotePath},
+	var args []string
+	if d.session != "" {
+		args = append(args, "-session", d.session)
 	}
-	execID, err := d.dockerClient.ContainerExecCreate(ctx, d.containerID, config)
-	if err != nil {
-		return
+	if d.watch {
+		args = append(args, "-watch")
 	}
-	hl, err := d.dockerClient.ContainerExecAttach(ctx, execID.ID, container.ExecStartOptions{Tty: true})
+	satellite, err := d.backend.Start(ctx, args)
 	if err != nil {
 		return
 	}
-	d.rpcClient = rpcCF.NewClient(hl.Conn)
+	d.satellite = satellite
+	d.rpcClient = rpcCF.NewClient(satellite)
 	return
 }
 
@@ -208,9 +396,30 @@ func (d *DockerFuseClient) stat(ctx context.Context, fullPath string, attr *stat
 	)
 	request.FullPath = fullPath
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Stat", request, &reply)
+	if d.cache != nil {
+		if found, enoent := d.cache.getAttr(fullPath, attr); found {
+			if enoent {
+				return syscall.ENOENT
+			}
+			return 0
+		}
+	}
+	if d.isOffline() {
+		return d.offlineStat(fullPath, attr)
+	}
+
+	err := d.call("DockerFuseFSOps.Stat", request, &reply)
 	if err != nil {
+		if d.isOffline() {
+			return d.offlineStat(fullPath, attr)
+		}
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
+		if syserr == syscall.ENOENT && d.cache != nil {
+			d.cache.putNegative(fullPath)
+		}
+		if syserr == syscall.ENOENT && d.disk != nil {
+			d.disk.removeAttr(fullPath)
+		}
 		return
 	}
 
@@ -220,11 +429,25 @@ func (d *DockerFuseClient) stat(ctx context.Context, fullPath string, attr *stat
 	attr.FuseAttr.Atime = uint64(reply.Atime)
 	attr.FuseAttr.Mtime = uint64(reply.Mtime)
 	attr.FuseAttr.Ctime = uint64(reply.Ctime)
+	attr.FuseAttr.Atimensec = uint32(reply.AtimeNsec)
+	attr.FuseAttr.Mtimensec = uint32(reply.MtimeNsec)
+	attr.FuseAttr.Ctimensec = uint32(reply.CtimeNsec)
 	attr.FuseAttr.Mode = reply.Mode
 	attr.FuseAttr.Nlink = reply.Nlink
 	attr.FuseAttr.Owner.Uid = reply.UID
 	attr.FuseAttr.Owner.Gid = reply.GID
 	attr.LinkTarget = reply.LinkTarget
+	if d.cache != nil {
+		d.cache.putAttr(fullPath, attr)
+	}
+	if d.readahead != nil {
+		d.readahead.checkAttr(fullPath, &attr.FuseAttr)
+	}
+	if d.disk != nil {
+		if err := d.disk.putAttr(fullPath, attr); err != nil {
+			slog.Debug("error caching attributes on disk", "path", fullPath, "error", err)
+		}
+	}
 	return
 }
 
@@ -236,32 +459,65 @@ func (d *DockerFuseClient) create(ctx context.Context, fullPath string, flags in
 		SAFlags:  rpccommon.SystemToSAFlags(flags),
 		Mode:     mode,
 	}
-	err := d.rpcClient.Call("DockerFuseFSOps.Open", request, &reply)
+	err := d.call("DockerFuseFSOps.Open", request, &reply)
+	d.invalidate(fullPath)
 	if err != nil {
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
 	}
 
-	fh = reply.FD
+	fh = d.satelliteHandle(reply.FD)
 	attr.FuseAttr.Ino = reply.Ino
 	attr.FuseAttr.Size = uint64(reply.Size)
 	attr.FuseAttr.Blocks = uint64(reply.Blocks)
 	attr.FuseAttr.Atime = uint64(reply.Atime)
 	attr.FuseAttr.Mtime = uint64(reply.Mtime)
 	attr.FuseAttr.Ctime = uint64(reply.Ctime)
+	attr.FuseAttr.Atimensec = uint32(reply.AtimeNsec)
+	attr.FuseAttr.Mtimensec = uint32(reply.MtimeNsec)
+	attr.FuseAttr.Ctimensec = uint32(reply.CtimeNsec)
 	attr.FuseAttr.Mode = reply.Mode
 	attr.FuseAttr.Nlink = reply.Nlink
 	attr.FuseAttr.Owner.Uid = reply.UID
 	attr.FuseAttr.Owner.Gid = reply.GID
 	attr.LinkTarget = reply.LinkTarget
+	d.trackHandle(fh, fullPath, attr)
 	return
 }
 
 func (d *DockerFuseClient) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
 	var reply rpccommon.ReadDirReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.ReadDir", rpccommon.StatRequest{FullPath: fullPath}, &reply)
+	if d.cache != nil {
+		if dirEntries, ok := d.cache.getDir(fullPath); ok {
+			return fusefs.NewListDirStream(dirEntries), 0
+		}
+	}
+
+	// The on-disk listing is only used if the directory has not changed since it was stored
+	var dirKey string
+	if d.disk != nil {
+		var attr statAttr
+		if syserr = d.stat(ctx, fullPath, &attr); syserr != 0 {
+			return
+		}
+		dirKey = contentKey(&attr.FuseAttr)
+		if key, dirEntries, ok := d.disk.getDir(fullPath); ok && (key == dirKey || d.isOffline()) {
+			if d.cache != nil {
+				d.cache.putDir(fullPath, dirEntries)
+			}
+			return fusefs.NewListDirStream(dirEntries), 0
+		}
+		if d.isOffline() {
+			return nil, syscall.EIO
+		}
+	}
+
+	err := d.call("DockerFuseFSOps.ReadDir", rpccommon.StatRequest{FullPath: fullPath}, &reply)
 	if err != nil {
+		if d.isOffline() {
+			return d.readDir(ctx, fullPath)
+		}
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
 	}
@@ -276,12 +532,20 @@ func (d *DockerFuseClient) readDir(ctx context.Context, fullPath string) (ds fus
 			})
 		}
 	}
+	if d.cache != nil {
+		d.cache.putDir(fullPath, dirEntries)
+	}
+	if d.disk != nil {
+		if err := d.disk.putDir(fullPath, dirKey, dirEntries); err != nil {
+			slog.Debug("error caching directory on disk", "path", fullPath, "error", err)
+		}
+	}
 	ds = fusefs.NewListDirStream(dirEntries)
 
 	return
 }
 
-func (d *DockerFuseClient) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+func (d *DockerFuseClient) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
 	var reply rpccommon.OpenReply
 
 	request := rpccommon.OpenRequest{
@@ -289,21 +553,62 @@ func (d *DockerFuseClient) open(ctx context.Context, fullPath string, flags int,
 		SAFlags:  rpccommon.SystemToSAFlags(flags),
 		Mode:     modeIn,
 	}
-	err := d.rpcClient.Call("DockerFuseFSOps.Open", request, &reply)
+	if d.isOffline() {
+		return d.offlineOpen(fullPath, flags, attr)
+	}
+	err := d.call("DockerFuseFSOps.Open", request, &reply)
 	if err != nil {
+		if d.isOffline() {
+			return d.offlineOpen(fullPath, flags, attr)
+		}
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
 	}
 
-	fh = reply.FD
+	if flags&syscall.O_TRUNC != 0 {
+		d.invalidate(fullPath)
+	}
+	fh = d.satelliteHandle(reply.FD)
 	mode = os.FileMode(reply.Mode)
+	attr.FuseAttr.Ino = reply.Ino
+	attr.FuseAttr.Size = uint64(reply.Size)
+	attr.FuseAttr.Blocks = uint64(reply.Blocks)
+	attr.FuseAttr.Atime = uint64(reply.Atime)
+	attr.FuseAttr.Mtime = uint64(reply.Mtime)
+	attr.FuseAttr.Ctime = uint64(reply.Ctime)
+	attr.FuseAttr.Atimensec = uint32(reply.AtimeNsec)
+	attr.FuseAttr.Mtimensec = uint32(reply.MtimeNsec)
+	attr.FuseAttr.Ctimensec = uint32(reply.CtimeNsec)
+	attr.FuseAttr.Mode = reply.Mode
+	attr.FuseAttr.Nlink = reply.Nlink
+	attr.FuseAttr.Owner.Uid = reply.UID
+	attr.FuseAttr.Owner.Gid = reply.GID
+	attr.LinkTarget = reply.LinkTarget
+	d.trackHandle(fh, fullPath, attr)
 	return
 }
 
 func (d *DockerFuseClient) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
 	var reply rpccommon.CloseReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Close", rpccommon.CloseRequest{FD: fh.(uintptr)}, &reply)
+	if d.readahead != nil {
+		d.readahead.close(fh)
+	}
+	d.handlesMu.Lock()
+	delete(d.handles, fh)
+	d.handlesMu.Unlock()
+
+	if d.isOffline() {
+		return 0 // Nothing to release in the container
+	}
+	fd, syserr := d.satelliteFD(fh)
+	if syserr != 0 {
+		return
+	}
+	err := d.call("DockerFuseFSOps.Close", rpccommon.CloseRequest{FD: fd}, &reply)
+	if err != nil && d.isOffline() {
+		return 0 // The descriptor went away with the satellite
+	}
 	if err != nil {
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
@@ -313,9 +618,28 @@ func (d *DockerFuseClient) close(ctx context.Context, fh fusefs.FileHandle) (sys
 }
 
 func (d *DockerFuseClient) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	fetch := func(offset int64, n int) ([]byte, syscall.Errno) {
+		return d.remoteRead(fh, offset, n)
+	}
+	if d.disk != nil {
+		fetch = func(offset int64, n int) ([]byte, syscall.Errno) {
+			return d.cachedRead(fh, offset, n)
+		}
+	}
+	if d.readahead != nil {
+		return d.readahead.read(fh, offset, n, fetch)
+	}
+	return fetch(offset, n)
+}
+
+func (d *DockerFuseClient) remoteRead(fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
 	var reply rpccommon.ReadReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: fh.(uintptr), Offset: offset, Num: n}, &reply)
+	fd, syserr := d.satelliteFD(fh)
+	if syserr != 0 {
+		return nil, syserr
+	}
+	err := d.call("DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: fd, Offset: offset, Num: n}, &reply)
 	if err != nil {
 		if err.Error() == "EOF" {
 			data = make([]byte, 0)
@@ -332,7 +656,14 @@ func (d *DockerFuseClient) read(ctx context.Context, fh fusefs.FileHandle, offse
 func (d *DockerFuseClient) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
 	var reply rpccommon.SeekReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Seek", rpccommon.SeekRequest{FD: fh.(uintptr), Offset: offset, Whence: whence}, &reply)
+	if d.isOffline() {
+		return d.offlineSeek(fh, offset, whence)
+	}
+	fd, syserr := d.satelliteFD(fh)
+	if syserr != 0 {
+		return
+	}
+	err := d.call("DockerFuseFSOps.Seek", rpccommon.SeekRequest{FD: fd, Offset: offset, Whence: whence}, &reply)
 	if err != nil {
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
@@ -345,7 +676,14 @@ func (d *DockerFuseClient) seek(ctx context.Context, fh fusefs.FileHandle, offse
 func (d *DockerFuseClient) write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno) {
 	var reply rpccommon.WriteReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Write", rpccommon.WriteRequest{FD: fh.(uintptr), Offset: offset, Data: data}, &reply)
+	fd, syserr := d.satelliteFD(fh)
+	if syserr != 0 {
+		return
+	}
+	err := d.call("DockerFuseFSOps.Write", rpccommon.WriteRequest{FD: fd, Offset: offset, Data: data}, &reply)
+	if fullPath, ok := d.markDirty(fh); ok {
+		d.invalidate(fullPath)
+	}
 	if err != nil {
 		syserr = rpccommon.RPCErrorStringTOErrno(err)
 		return
@@ -358,7 +696,8 @@ func (d *DockerFuseClient) write(ctx context.Context, fh fusefs.FileHandle, offs
 func (d *DockerFuseClient) unlink(ctx context.Context, fullPath string) (syserr syscall.Errno) {
 	var reply rpccommon.UnlinkReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Unlink", rpccommon.UnlinkRequest{FullPath: fullPath}, &reply)
+	err := d.call("DockerFuseFSOps.Unlink", rpccommon.UnlinkRequest{FullPath: fullPath}, &reply)
+	d.invalidate(fullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -368,7 +707,14 @@ func (d *DockerFuseClient) unlink(ctx context.Context, fullPath string) (syserr
 func (d *DockerFuseClient) fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno) {
 	var reply rpccommon.FsyncReply
 
-	err := d.rpcClient.Call("DockerFuseFSOps.Fsync", rpccommon.FsyncRequest{FD: fh.(uintptr), Flags: flags}, &reply)
+	if d.isOffline() {
+		return 0 // Offline handles are read-only
+	}
+	fd, syserr := d.satelliteFD(fh)
+	if syserr != 0 {
+		return
+	}
+	err := d.call("DockerFuseFSOps.Fsync", rpccommon.FsyncRequest{FD: fd, Flags: flags}, &reply)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -382,7 +728,8 @@ func (d *DockerFuseClient) mkdir(ctx context.Context, fullPath string, mode fs.F
 		FullPath: fullPath,
 		Mode:     mode,
 	}
-	err := d.rpcClient.Call("DockerFuseFSOps.Mkdir", request, &reply)
+	err := d.call("DockerFuseFSOps.Mkdir", request, &reply)
+	d.invalidate(fullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -392,11 +739,17 @@ func (d *DockerFuseClient) mkdir(ctx context.Context, fullPath string, mode fs.F
 	attr.FuseAttr.Atime = uint64(reply.Atime)
 	attr.FuseAttr.Mtime = uint64(reply.Mtime)
 	attr.FuseAttr.Ctime = uint64(reply.Ctime)
+	attr.FuseAttr.Atimensec = uint32(reply.AtimeNsec)
+	attr.FuseAttr.Mtimensec = uint32(reply.MtimeNsec)
+	attr.FuseAttr.Ctimensec = uint32(reply.CtimeNsec)
 	attr.FuseAttr.Mode = reply.Mode
 	attr.FuseAttr.Nlink = reply.Nlink
 	attr.FuseAttr.Owner.Uid = reply.UID
 	attr.FuseAttr.Owner.Gid = reply.GID
 	attr.LinkTarget = ""
+	if d.cache != nil {
+		d.cache.putAttr(fullPath, attr)
+	}
 	return
 }
 
@@ -404,7 +757,8 @@ func (d *DockerFuseClient) rmdir(ctx context.Context, fullPath string) (syserr s
 	var reply rpccommon.RmdirReply
 
 	request := rpccommon.RmdirRequest{FullPath: fullPath}
-	err := d.rpcClient.Call("DockerFuseFSOps.Rmdir", request, &reply)
+	err := d.call("DockerFuseFSOps.Rmdir", request, &reply)
+	d.invalidateTree(fullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -415,7 +769,8 @@ func (d *DockerFuseClient) rename(ctx context.Context, fullPath string, fullNewP
 	var reply rpccommon.RenameReply
 
 	request := rpccommon.RenameRequest{FullPath: fullPath, FullNewPath: fullNewPath, Flags: flags}
-	err := d.rpcClient.Call("DockerFuseFSOps.Rename", request, &reply)
+	err := d.call("DockerFuseFSOps.Rename", request, &reply)
+	d.invalidateTree(fullPath, fullNewPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -426,8 +781,14 @@ func (d *DockerFuseClient) readlink(ctx context.Context, fullPath string) (linkT
 	var reply rpccommon.ReadlinkReply
 
 	request := rpccommon.ReadlinkRequest{FullPath: fullPath}
-	err := d.rpcClient.Call("DockerFuseFSOps.Readlink", request, &reply)
+	if d.isOffline() {
+		return d.offlineReadlink(fullPath)
+	}
+	err := d.call("DockerFuseFSOps.Readlink", request, &reply)
 	if err != nil {
+		if d.isOffline() {
+			return d.offlineReadlink(fullPath)
+		}
 		return []byte{}, rpccommon.RPCErrorStringTOErrno(err)
 	}
 	return []byte(reply.LinkTarget), 0
@@ -437,7 +798,8 @@ func (d *DockerFuseClient) link(ctx context.Context, oldFullPath string, newFull
 	var reply rpccommon.LinkReply
 
 	request := rpccommon.LinkRequest{OldFullPath: oldFullPath, NewFullPath: newFullPath}
-	err := d.rpcClient.Call("DockerFuseFSOps.Link", request, &reply)
+	err := d.call("DockerFuseFSOps.Link", request, &reply)
+	d.invalidate(oldFullPath, newFullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -448,7 +810,8 @@ func (d *DockerFuseClient) symlink(ctx context.Context, oldFullPath string, newF
 	var reply rpccommon.SymlinkReply
 
 	request := rpccommon.SymlinkRequest{OldFullPath: oldFullPath, NewFullPath: newFullPath}
-	err := d.rpcClient.Call("DockerFuseFSOps.Symlink", request, &reply)
+	err := d.call("DockerFuseFSOps.Symlink", request, &reply)
+	d.invalidate(newFullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -481,7 +844,8 @@ func (d *DockerFuseClient) setAttr(ctx context.Context, fullPath string, in *fus
 		request.SetSize(size)
 	}
 
-	err := d.rpcClient.Call("DockerFuseFSOps.SetAttr", request, &reply)
+	err := d.call("DockerFuseFSOps.SetAttr", request, &reply)
+	d.invalidate(fullPath)
 	if err != nil {
 		return rpccommon.RPCErrorStringTOErrno(err)
 	}
@@ -492,10 +856,58 @@ func (d *DockerFuseClient) setAttr(ctx context.Context, fullPath string, in *fus
 	out.FuseAttr.Atime = uint64(reply.Atime)
 	out.FuseAttr.Mtime = uint64(reply.Mtime)
 	out.FuseAttr.Ctime = uint64(reply.Ctime)
+	out.FuseAttr.Atimensec = uint32(reply.AtimeNsec)
+	out.FuseAttr.Mtimensec = uint32(reply.MtimeNsec)
+	out.FuseAttr.Ctimensec = uint32(reply.CtimeNsec)
 	out.FuseAttr.Mode = reply.Mode
 	out.FuseAttr.Nlink = reply.Nlink
 	out.FuseAttr.Owner.Uid = reply.UID
 	out.FuseAttr.Owner.Gid = reply.GID
 	out.LinkTarget = reply.LinkTarget
+	if d.cache != nil {
+		d.cache.putAttr(fullPath, out)
+	}
 	return 0
 }
+
+func (d *DockerFuseClient) watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) (err error) {
+	request := rpccommon.WaitEventsRequest{Timeout: watchTimeout, MaxEvents: watchMaxEvents}
+	for ctx.Err() == nil {
+		var reply rpccommon.WaitEventsReply
+
+		if d.isOffline() {
+			return errOffline
+		}
+		err = d.call("DockerFuseFSOps.WaitEvents", request, &reply)
+		if err != nil && !strings.HasPrefix(err.Error(), "errno: ") && !d.followingLifecycle.Load() {
+			return err // Connection to the satellite lost
+		}
+		if err != nil {
+			syserr := rpccommon.RPCErrorStringTOErrno(err)
+			if syserr == syscall.ENOSYS {
+				return fmt.Errorf("change notifications not supported by the container")
+			}
+			slog.Warn("error waiting for changes", "errno", syserr)
+			select {
+			case <-ctx.Done():
+			case <-time.After(watchRetryDelay):
+			}
+			continue
+		}
+
+		if reply.Overflow {
+			d.invalidateTree("/")
+		}
+		for _, event := range reply.Events {
+			if event.IsDir && event.Op&rpccommon.CHANGE_DELETE != 0 {
+				d.invalidateTree(event.FullPath)
+			} else {
+				d.invalidate(event.FullPath)
+			}
+		}
+		if len(reply.Events) > 0 || reply.Overflow {
+			handler(reply.Events, reply.Overflow)
+		}
+	}
+	return ctx.Err()
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -8,15 +10,20 @@ import (
 	"path/filepath"
 	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/dguerri/dockerfuse/pkg/rpccommon"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/common"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -61,6 +68,10 @@ func (m *mockDockerClientFactory) NewClientWithOpts(ops ...client.Opt) (dockerCl
 
 type mockDockerClient struct{ mock.Mock }
 
+func (dc *mockDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	args := dc.Called(ctx, config, hostConfig, networkingConfig, platform, containerName)
+	return args.Get(0).(container.CreateResponse), args.Error(1)
+}
 func (dc *mockDockerClient) ContainerExecAttach(ctx context.Context, execID string, config container.ExecStartOptions) (types.HijackedResponse, error) {
 	args := dc.Called(ctx, execID, config)
 	return args.Get(0).(types.HijackedResponse), args.Error(1)
@@ -69,18 +80,85 @@ func (dc *mockDockerClient) ContainerExecCreate(ctx context.Context, container s
 	args := dc.Called(ctx, container, config)
 	return args.Get(0).(common.IDResponse), args.Error(1)
 }
+func (dc *mockDockerClient) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	args := dc.Called(ctx, execID)
+	return args.Get(0).(container.ExecInspect), args.Error(1)
+}
 func (dc *mockDockerClient) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
 	args := dc.Called(ctx, containerID)
 	return args.Get(0).(container.InspectResponse), args.Error(1)
 }
+func (dc *mockDockerClient) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	args := dc.Called(ctx, options)
+	return args.Get(0).([]container.Summary), args.Error(1)
+}
+func (dc *mockDockerClient) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	args := dc.Called(ctx, containerID, options)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+func (dc *mockDockerClient) ContainerDiff(ctx context.Context, containerID string) ([]container.FilesystemChange, error) {
+	args := dc.Called(ctx, containerID)
+	return args.Get(0).([]container.FilesystemChange), args.Error(1)
+}
+func (dc *mockDockerClient) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	args := dc.Called(ctx, containerID, options)
+	return args.Error(0)
+}
+func (dc *mockDockerClient) ContainerStatPath(ctx context.Context, containerID, path string) (container.PathStat, error) {
+	args := dc.Called(ctx, containerID, path)
+	return args.Get(0).(container.PathStat), args.Error(1)
+}
+func (dc *mockDockerClient) ContainerTop(ctx context.Context, containerID string, arguments []string) (container.TopResponse, error) {
+	args := dc.Called(ctx, containerID, arguments)
+	return args.Get(0).(container.TopResponse), args.Error(1)
+}
+func (dc *mockDockerClient) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	args := dc.Called(ctx, containerID, srcPath)
+	return args.Get(0).(io.ReadCloser), args.Get(1).(container.PathStat), args.Error(2)
+}
 func (dc *mockDockerClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options container.CopyToContainerOptions) error {
 	args := dc.Called(ctx, containerID, dstPath, content, options)
 	return args.Error(0)
 }
+func (dc *mockDockerClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	args := dc.Called(ctx, options)
+	return args.Get(0).(chan events.Message), args.Get(1).(chan error)
+}
 func (dc *mockDockerClient) ImageInspectWithRaw(ctx context.Context, imageID string) (image.InspectResponse, []byte, error) {
 	args := dc.Called(ctx, imageID)
 	return args.Get(0).(image.InspectResponse), args.Get(1).([]byte), args.Error(2)
 }
+func (dc *mockDockerClient) ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error) {
+	args := dc.Called(ctx, refStr, options)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+func (dc *mockDockerClient) ImageSave(ctx context.Context, imageIDs []string, saveOpts ...client.ImageSaveOption) (io.ReadCloser, error) {
+	args := dc.Called(ctx, imageIDs)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+// expectSatelliteVerification sets up a container without the satellite, where uploaded
+// satellites are run to report their checksum
+func expectSatelliteVerification(t *testing.T, mDC *mockDockerClient, remotePath string, content []byte) {
+	mDC.On("ContainerStatPath", context.Background(), "test_container", remotePath).Return(
+		container.PathStat{}, fmt.Errorf("no such file"))
+	mDC.On("ContainerStatPath", context.Background(), "test_container", mock.Anything).Return(
+		container.PathStat{Mode: fs.ModeDir}, nil).Maybe()
+	mDC.On("ContainerExecCreate", context.Background(), "test_container", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-version"},
+	}).Return(common.IDResponse{ID: "probe_execid"}, nil).Maybe()
+	mDC.On("ContainerExecAttach", context.Background(), "probe_execid", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion(content)), nil).Maybe()
+}
+
+func tarArchive(name string, content []byte) io.ReadCloser {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0700, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	return io.NopCloser(&buf)
+}
 
 func TestNewFuseDockerClient(t *testing.T) {
 	// *** Setup
@@ -94,13 +172,15 @@ func TestNewFuseDockerClient(t *testing.T) {
 		config                                                            container.ExecOptions
 		err                                                               error
 	)
+	defer func(f func() string) { newSessionID = f }(newSessionID)
+	newSessionID = func() string { return "host:1:abcd" }
 	rpcCF = &mRPCCF  // Set mock RPC client factory
 	dockerCF = &mDCF // Set mock RPC client factory
 	dfFS = &mFS      // Set mock Filesystem
 
 	satelliteBinName = fmt.Sprintf("%s_%s", satelliteBinPrefix, "arm64")
 	satelliteFullLocalPath = filepath.Join("/test/pos/", satelliteBinName)
-	satelliteFullRemotePath = filepath.Join(satelliteExecPath, satelliteBinName)
+	satelliteFullRemotePath = filepath.Join("/tmp", satelliteBinName)
 
 	// *** Test happy path
 	mFS = mockFS{}
@@ -112,19 +192,20 @@ func TestNewFuseDockerClient(t *testing.T) {
 	mFS.On("ReadFile", satelliteFullLocalPath).Return([]byte("test executable content"), nil)
 	mFS.On("Executable").Return("/test/pos/executable", nil)
 	mRPCC.On("Close").Return(nil)
-	mRPCCF.On("NewClient", nil).Return(&mRPCC)
+	mRPCCF.On("NewClient", &dockerSatellite{dockerClient: &mDC, execID: "test_execid"}).Return(&mRPCC)
 	config = container.ExecOptions{
 		AttachStderr: false,
 		AttachStdout: true,
 		AttachStdin:  true,
 		Tty:          false,
-		Cmd:          []string{satelliteFullRemotePath},
+		Cmd:          []string{satelliteFullRemotePath, "-session", "host:1:abcd"},
 	}
 	mDC.On("ContainerExecCreate", context.Background(), "test_container", config).Return(
 		common.IDResponse{ID: "test_execid"}, nil)
 	mDC.On("ContainerExecAttach", context.Background(), "test_execid", container.ExecStartOptions{Tty: true}).Return(
 		types.HijackedResponse{Conn: nil}, nil)
-	mDC.On("CopyToContainer", context.Background(), "test_container", satelliteExecPath,
+	expectSatelliteVerification(t, &mDC, satelliteFullRemotePath, []byte("test executable content"))
+	mDC.On("CopyToContainer", context.Background(), "test_container", "/tmp",
 		mock.AnythingOfType("*bufio.Reader"), container.CopyToContainerOptions{}).Return(nil)
 	mDC.On("ImageInspectWithRaw", context.Background(), "test_container_image").Return(
 		image.InspectResponse{Architecture: "arm64"}, []byte{}, nil)
@@ -229,7 +310,7 @@ func TestNewFuseDockerClient(t *testing.T) {
 
 	if assert.Error(t, err) {
 		assert.Equal(t,
-			fmt.Errorf("error copying docker-fuse satellite to remote container: unsupported architecture: invalidarc64 (use arm64 or amd64)"),
+			fmt.Errorf("error copying docker-fuse satellite to remote container: unsupported architecture: invalidarc64 (supported: amd64, arm64, 386, arm/v6, arm/v7, ppc64le, s390x, riscv64)"),
 			err,
 		)
 	}
@@ -251,11 +332,15 @@ func TestNewFuseDockerClient(t *testing.T) {
 	}, nil)
 	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
 
+	// Without embedded satellites either
+	embeddedSatellites = fstest.MapFS{}
 	_, err = NewDockerFuseClient("test_container")
+	embeddedSatellites = satellitesFS
 
 	if assert.Error(t, err) {
 		assert.Equal(t,
-			fmt.Errorf("error copying docker-fuse satellite to remote container: %s", osExecutableError.Error()),
+			fmt.Errorf("error copying docker-fuse satellite to remote container: dockerfuse_satellite_arm64 not found next to the dockerfuse executable, "+
+				"and this dockerfuse was built without embedded satellites (go install is not supported: build it with make, or run go generate ./... before go build): %s", osExecutableError.Error()),
 			err,
 		)
 	}
@@ -296,8 +381,11 @@ func TestNewFuseDockerClient(t *testing.T) {
 	mDCF = mockDockerClientFactory{}
 
 	copyToContainerError := fmt.Errorf("error on CopyToContainer")
-	mDC.On("CopyToContainer", context.Background(), "test_container", satelliteExecPath,
+	expectSatelliteVerification(t, &mDC, satelliteFullRemotePath, []byte("test executable content"))
+	mDC.On("CopyToContainer", context.Background(), "test_container", mock.Anything,
 		mock.AnythingOfType("*bufio.Reader"), container.CopyToContainerOptions{}).Return(copyToContainerError)
+	mDC.On("ContainerExecCreate", context.Background(), "test_container", mock.Anything).Return(
+		common.IDResponse{}, fmt.Errorf("python3 not found"))
 	mFS.On("ReadFile", satelliteFullLocalPath).Return([]byte("test executable content"), nil)
 	mFS.On("Executable").Return("/test/pos/executable", nil)
 	mDC.On("ImageInspectWithRaw", context.Background(), "test_container_image").Return(
@@ -310,10 +398,9 @@ func TestNewFuseDockerClient(t *testing.T) {
 	_, err = NewDockerFuseClient("test_container")
 
 	if assert.Error(t, err) {
-		assert.Equal(t,
-			fmt.Errorf("error copying docker-fuse satellite to remote container: %s", copyToContainerError.Error()),
-			err,
-		)
+		assert.Contains(t, err.Error(), "error copying docker-fuse satellite to remote container: cannot place the satellite")
+		assert.Contains(t, err.Error(), "/tmp: "+copyToContainerError.Error())
+		assert.Contains(t, err.Error(), "in-memory loader, which requires python3: python3 not found")
 	}
 	mDCF.AssertExpectations(t)
 
@@ -327,7 +414,8 @@ func TestNewFuseDockerClient(t *testing.T) {
 	containerExecCreateError := fmt.Errorf("error on ContainerExecCreate")
 	mDC.On("ContainerExecCreate", context.Background(), "test_container", config).Return(
 		common.IDResponse{}, containerExecCreateError)
-	mDC.On("CopyToContainer", context.Background(), "test_container", satelliteExecPath,
+	expectSatelliteVerification(t, &mDC, satelliteFullRemotePath, []byte("test executable content"))
+	mDC.On("CopyToContainer", context.Background(), "test_container", "/tmp",
 		mock.AnythingOfType("*bufio.Reader"), container.CopyToContainerOptions{}).Return(nil)
 	mFS.On("ReadFile", satelliteFullLocalPath).Return([]byte("test executable content"), nil)
 	mFS.On("Executable").Return("/test/pos/executable", nil)
@@ -360,7 +448,8 @@ func TestNewFuseDockerClient(t *testing.T) {
 		types.HijackedResponse{}, containerExecAttachError)
 	mDC.On("ContainerExecCreate", context.Background(), "test_container", config).Return(
 		common.IDResponse{ID: "test_execid"}, nil)
-	mDC.On("CopyToContainer", context.Background(), "test_container", satelliteExecPath,
+	expectSatelliteVerification(t, &mDC, satelliteFullRemotePath, []byte("test executable content"))
+	mDC.On("CopyToContainer", context.Background(), "test_container", "/tmp",
 		mock.AnythingOfType("*bufio.Reader"), container.CopyToContainerOptions{}).Return(nil)
 	mFS.On("ReadFile", satelliteFullLocalPath).Return([]byte("test executable content"), nil)
 	mFS.On("Executable").Return("/test/pos/executable", nil)
@@ -396,6 +485,7 @@ func TestDockerFuseClientStat(t *testing.T) {
 		Atime:      1,
 		Mtime:      2,
 		Ctime:      3,
+		MtimeNsec:  4,
 		Size:       64,
 		Blocks:     1,
 		Blksize:    4096,
@@ -415,6 +505,7 @@ func TestDockerFuseClientStat(t *testing.T) {
 	assert.Equal(t, expected.Ino, attr.FuseAttr.Ino)
 	assert.Equal(t, uint64(expected.Size), attr.FuseAttr.Size)
 	assert.Equal(t, uint64(expected.Blocks), attr.FuseAttr.Blocks)
+	assert.Equal(t, uint32(expected.MtimeNsec), attr.FuseAttr.Mtimensec)
 	assert.Equal(t, expected.Mode, attr.FuseAttr.Mode)
 	assert.Equal(t, expected.Nlink, attr.FuseAttr.Nlink)
 	assert.Equal(t, expected.UID, attr.FuseAttr.Owner.Uid)
@@ -504,9 +595,11 @@ func TestDockerFuseClientOpenClose(t *testing.T) {
 		reply := args.Get(2).(*rpccommon.OpenReply)
 		*reply = rpccommon.OpenReply{FD: 2, StatReply: rpccommon.StatReply{Mode: 0600}}
 	}).Return(nil)
-	fh, mode, err := fdc.open(context.Background(), "/f", 0, 0)
+	var attr statAttr
+	fh, mode, err := fdc.open(context.Background(), "/f", 0, 0, &attr)
 	assert.Equal(t, fusefs.FileHandle(uintptr(2)), fh)
 	assert.Equal(t, fs.FileMode(0600), mode)
+	assert.Equal(t, uint32(0600), attr.FuseAttr.Mode)
 	assert.Equal(t, syscall.Errno(0), err)
 	mRPCC.On("Call", "DockerFuseFSOps.Close", rpccommon.CloseRequest{FD: fh.(uintptr)}, mock.Anything).Return(nil)
 	cerr := fdc.close(context.Background(), fh)
@@ -578,3 +671,276 @@ func TestDockerFuseClientOtherOps(t *testing.T) {
 	assert.Equal(t, syscall.Errno(0), fdc.setAttr(context.Background(), "/file", in, &out))
 	m.AssertExpectations(t)
 }
+
+func TestDockerFuseClientMetadataCache(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	WithMetadataCache(CacheConfig{AttrTTL: time.Hour, DirTTL: time.Hour, NegativeTTL: time.Hour})(fdc)
+
+	m.On("Call", "DockerFuseFSOps.Stat", rpccommon.StatRequest{FullPath: "/f"}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.StatReply)
+		*r = rpccommon.StatReply{Ino: 9, Size: 1}
+	}).Return(nil).Twice()
+	m.On("Call", "DockerFuseFSOps.Stat", rpccommon.StatRequest{FullPath: "/missing"}, mock.Anything).
+		Return(fmt.Errorf("errno: ENOENT")).Once()
+	m.On("Call", "DockerFuseFSOps.ReadDir", rpccommon.StatRequest{FullPath: "/"}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadDirReply)
+		*r = rpccommon.ReadDirReply{DirEntries: []rpccommon.DirEntry{{Ino: 9, Name: "f"}}}
+	}).Return(nil).Twice()
+
+	// Repeated lookups are served from the cache
+	for range 3 {
+		var attr statAttr
+		assert.Equal(t, syscall.Errno(0), fdc.stat(context.Background(), "/f", &attr))
+		assert.Equal(t, uint64(9), attr.FuseAttr.Ino)
+		assert.Equal(t, syscall.ENOENT, fdc.stat(context.Background(), "/missing", &attr))
+		_, errno := fdc.readDir(context.Background(), "/")
+		assert.Equal(t, syscall.Errno(0), errno)
+	}
+
+	// Writes through an open handle invalidate the file and its parent
+	m.On("Call", "DockerFuseFSOps.Open", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.OpenReply)
+		*r = rpccommon.OpenReply{FD: 3}
+	}).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Write", mock.Anything, mock.Anything).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Close", rpccommon.CloseRequest{FD: 3}, mock.Anything).Return(nil)
+	var attr statAttr
+	fh, _, errno := fdc.open(context.Background(), "/f", syscall.O_WRONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	_, errno = fdc.write(context.Background(), fh, 0, []byte("x"))
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, syscall.Errno(0), fdc.close(context.Background(), fh))
+
+	assert.Equal(t, syscall.Errno(0), fdc.stat(context.Background(), "/f", &attr))
+	_, errno = fdc.readDir(context.Background(), "/")
+	assert.Equal(t, syscall.Errno(0), errno)
+
+	stats := fdc.CacheStats()
+	assert.Equal(t, uint64(2), stats.AttrHits)
+	assert.Equal(t, uint64(2), stats.NegativeHits)
+	assert.Equal(t, uint64(2), stats.DirHits)
+	assert.Equal(t, uint64(2), stats.DirMisses)
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientMetadataCacheInvalidation(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	WithMetadataCache(CacheConfig{AttrTTL: time.Hour, NegativeTTL: time.Hour})(fdc)
+
+	m.On("Call", "DockerFuseFSOps.Stat", mock.Anything, mock.Anything).Return(fmt.Errorf("errno: ENOENT"))
+	m.On("Call", "DockerFuseFSOps.Open", mock.Anything, mock.Anything).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Unlink", mock.Anything, mock.Anything).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Rename", mock.Anything, mock.Anything).Return(nil)
+	m.On("Call", "DockerFuseFSOps.SetAttr", mock.Anything, mock.Anything).Return(fmt.Errorf("errno: EPERM"))
+
+	mutations := map[string]func(){
+		"create": func() { fdc.create(context.Background(), "/p", syscall.O_CREAT, 0644, &statAttr{}) },
+		"unlink": func() { fdc.unlink(context.Background(), "/p") },
+		"rename": func() { fdc.rename(context.Background(), "/o", "/p", 0) },
+		"setAttr": func() {
+			fdc.setAttr(context.Background(), "/p", &fuse.SetAttrIn{}, &statAttr{})
+		},
+	}
+	for name, mutate := range mutations {
+		t.Run(name, func(t *testing.T) {
+			var attr statAttr
+			assert.Equal(t, syscall.ENOENT, fdc.stat(context.Background(), "/p", &attr))
+			hits := fdc.CacheStats().NegativeHits
+			mutate()
+			assert.Equal(t, syscall.ENOENT, fdc.stat(context.Background(), "/p", &attr))
+			assert.Equal(t, hits, fdc.CacheStats().NegativeHits, "stale negative entry served")
+		})
+	}
+}
+
+func TestDockerFuseClientWatchChanges(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	WithMetadataCache(CacheConfig{AttrTTL: time.Hour})(fdc)
+	fdc.cache.putAttr("/f", &statAttr{})
+
+	events := []rpccommon.ChangeEvent{{FullPath: "/f", Op: rpccommon.CHANGE_MODIFY}}
+	request := rpccommon.WaitEventsRequest{Timeout: watchTimeout, MaxEvents: watchMaxEvents}
+	m.On("Call", "DockerFuseFSOps.WaitEvents", request, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.WaitEventsReply)
+		*r = rpccommon.WaitEventsReply{Events: events}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.WaitEvents", request, mock.Anything).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.WaitEvents", request, mock.Anything).Return(fmt.Errorf("connection is shut down")).Once()
+
+	var got []rpccommon.ChangeEvent
+	err := fdc.watchChanges(context.Background(), func(e []rpccommon.ChangeEvent, overflow bool) {
+		assert.False(t, overflow)
+		got = append(got, e...)
+	})
+
+	assert.EqualError(t, err, "connection is shut down")
+	assert.Equal(t, events, got)
+	var attr statAttr
+	found, _ := fdc.cache.getAttr("/f", &attr)
+	assert.False(t, found, "changed path should be invalidated")
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientWatchChangesUnsupported(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	m.On("Call", "DockerFuseFSOps.WaitEvents", mock.Anything, mock.Anything).Return(fmt.Errorf("errno: ENOSYS"))
+
+	err := fdc.watchChanges(context.Background(), func([]rpccommon.ChangeEvent, bool) {
+		t.Fatal("unexpected events")
+	})
+	assert.Error(t, err)
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientWatchChangesCanceled(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.On("Call", "DockerFuseFSOps.WaitEvents", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		cancel()
+	}).Return(fmt.Errorf("errno: EINTR")).Once()
+
+	err := fdc.watchChanges(ctx, func([]rpccommon.ChangeEvent, bool) {})
+	assert.Equal(t, context.Canceled, err)
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientReadahead(t *testing.T) {
+	var m mockRPCClient
+	fdc := &DockerFuseClient{rpcClient: &m}
+	WithReadahead(ReadaheadConfig{BlockSize: 4, MaxBlocks: 1})(fdc)
+
+	m.On("Call", "DockerFuseFSOps.Open", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.OpenReply)
+		*r = rpccommon.OpenReply{FD: 5}
+	}).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: 5, Offset: 0, Num: 4}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadReply)
+		*r = rpccommon.ReadReply{Data: []byte("abcd")}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: 5, Offset: 0, Num: 2}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadReply)
+		*r = rpccommon.ReadReply{Data: []byte("xb")}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: 5, Offset: 4, Num: 4}, mock.Anything).Return(fmt.Errorf("EOF")).Maybe()
+	m.On("Call", "DockerFuseFSOps.Write", mock.Anything, mock.Anything).Return(nil)
+
+	var attr statAttr
+	fh, _, errno := fdc.open(context.Background(), "/f", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+
+	// The first read fetches the block, the second one is served from memory
+	for i, want := range []string{"ab", "cd"} {
+		data, errno := fdc.read(context.Background(), fh, int64(2*i), 2)
+		assert.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, []byte(want), data)
+	}
+
+	// Writes drop cached blocks
+	_, errno = fdc.write(context.Background(), fh, 0, []byte("x"))
+	assert.Equal(t, syscall.Errno(0), errno)
+	data, errno := fdc.read(context.Background(), fh, 0, 2)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, []byte("xb"), data)
+
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientDiskCache(t *testing.T) {
+	var m mockRPCClient
+	disk, err := newDiskCache(t.TempDir(), "0123abcd", "", 0)
+	assert.NoError(t, err)
+	fdc := &DockerFuseClient{rpcClient: &m, disk: disk}
+
+	m.On("Call", "DockerFuseFSOps.Open", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.OpenReply)
+		*r = rpccommon.OpenReply{FD: 5, StatReply: rpccommon.StatReply{Ino: 9, Size: 4, Mtime: 100}}
+	}).Return(nil)
+	m.On("Call", "DockerFuseFSOps.Read", rpccommon.ReadRequest{FD: 5, Offset: 0, Num: diskCacheChunkSize}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadReply)
+		*r = rpccommon.ReadReply{Data: []byte("abcd")}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.Close", mock.Anything, mock.Anything).Return(nil)
+
+	// Content survives across handles (and sessions) as long as the file is unchanged
+	for range 2 {
+		var attr statAttr
+		fh, _, errno := fdc.open(context.Background(), "/f", syscall.O_RDONLY, 0, &attr)
+		assert.Equal(t, syscall.Errno(0), errno)
+		data, errno := fdc.read(context.Background(), fh, 1, 2)
+		assert.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, []byte("bc"), data)
+		assert.Equal(t, syscall.Errno(0), fdc.close(context.Background(), fh))
+	}
+
+	// Directory listings are reused while the directory is unchanged
+	m.On("Call", "DockerFuseFSOps.Stat", rpccommon.StatRequest{FullPath: "/"}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.StatReply)
+		*r = rpccommon.StatReply{Ino: 2, Mode: fuse.S_IFDIR, Mtime: 50}
+	}).Return(nil).Twice()
+	m.On("Call", "DockerFuseFSOps.ReadDir", rpccommon.StatRequest{FullPath: "/"}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadDirReply)
+		*r = rpccommon.ReadDirReply{DirEntries: []rpccommon.DirEntry{{Ino: 9, Name: "f"}}}
+	}).Return(nil).Once()
+	for range 2 {
+		ds, errno := fdc.readDir(context.Background(), "/")
+		assert.Equal(t, syscall.Errno(0), errno)
+		entry, _ := ds.Next()
+		assert.Equal(t, "f", entry.Name)
+	}
+	m.AssertExpectations(t)
+}
+
+func TestDockerFuseClientOfflineFallback(t *testing.T) {
+	var m mockRPCClient
+	disk, err := newDiskCache(t.TempDir(), "0123abcd", "", 0)
+	assert.NoError(t, err)
+	fdc := &DockerFuseClient{rpcClient: &m, disk: disk}
+
+	m.On("Call", "DockerFuseFSOps.Stat", rpccommon.StatRequest{FullPath: "/f"}, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.StatReply)
+		*r = rpccommon.StatReply{Ino: 9, Size: 4, Mtime: 100}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.Open", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.OpenReply)
+		*r = rpccommon.OpenReply{FD: 5, StatReply: rpccommon.StatReply{Ino: 9, Size: 4, Mtime: 100}}
+	}).Return(nil).Once()
+	m.On("Call", "DockerFuseFSOps.Read", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		r := args.Get(2).(*rpccommon.ReadReply)
+		*r = rpccommon.ReadReply{Data: []byte("abcd")}
+	}).Return(nil).Once()
+	var attr statAttr
+	assert.Equal(t, syscall.Errno(0), fdc.stat(context.Background(), "/f", &attr))
+	fh, _, errno := fdc.open(context.Background(), "/f", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	_, errno = fdc.read(context.Background(), fh, 0, 4)
+	assert.Equal(t, syscall.Errno(0), errno)
+
+	// The satellite goes away: cached content is still served, read-only
+	m.On("Call", "DockerFuseFSOps.Close", mock.Anything, mock.Anything).Return(fmt.Errorf("connection is shut down")).Once()
+	assert.Equal(t, syscall.Errno(0), fdc.close(context.Background(), fh))
+	assert.True(t, fdc.isOffline())
+
+	assert.Equal(t, syscall.Errno(0), fdc.stat(context.Background(), "/f", &attr))
+	assert.Equal(t, uint64(9), attr.FuseAttr.Ino)
+	assert.Equal(t, syscall.ENOENT, fdc.stat(context.Background(), "/other", &attr))
+
+	fh, _, errno = fdc.open(context.Background(), "/f", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	data, errno := fdc.read(context.Background(), fh, 2, 10)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, []byte("cd"), data)
+	n, errno := fdc.seek(context.Background(), fh, 0, io.SeekEnd)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, int64(4), n)
+	assert.Equal(t, syscall.Errno(0), fdc.close(context.Background(), fh))
+
+	_, _, errno = fdc.open(context.Background(), "/f", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	assert.Equal(t, syscall.EROFS, fdc.unlink(context.Background(), "/f"))
+	m.AssertExpectations(t)
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// localSatellite is a satellite whose stdio is carried by this host: through the pipes of a local
+// command bringing it where it runs (nsenter, ssh), or through the FIFOs of a containerd shim
+type localSatellite struct {
+	*fifoStream
+	// Closed once the satellite exited
+	done chan struct{}
+}
+
+// Stop closes the satellite input, and waits for it to exit, up to ctx
+func (s *localSatellite) Stop(ctx context.Context) error {
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("cannot close the satellite input: %w", err)
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("satellite did not exit: %w", ctx.Err())
+	}
+}
+
+// startCommand starts cmd, with its stdin and stdout on the returned stream
+func startCommand(cmd *exec.Cmd) (*localSatellite, error) {
+	stream, stdio, err := newPipeStream()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout = stdio[0], stdio[1]
+	err = cmd.Start()
+	for _, f := range stdio {
+		f.Close()
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	s := &localSatellite{fifoStream: stream, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// commandOutput runs cmd and returns its standard output. Errors include what the command wrote on
+// stderr, and are named after name.
+func commandOutput(cmd *exec.Cmd, name string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", name, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// newPipeStream creates the pipes of stdin and stdout. It returns our ends as a stream, and those
+// of the process.
+func newPipeStream() (*fifoStream, [2]*os.File, error) {
+	var stdio [2]*os.File
+	s := &fifoStream{}
+	var err error
+	if stdio[0], s.stdin, err = os.Pipe(); err != nil {
+		return nil, stdio, err
+	}
+	if s.stdout, stdio[1], err = os.Pipe(); err != nil {
+		s.Close()
+		stdio[0].Close()
+		return nil, stdio, err
+	}
+	return s, stdio, nil
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels set by Docker Compose on the containers it manages
+const (
+	ComposeProjectLabel   = "com.docker.compose.project"
+	ComposeServiceLabel   = "com.docker.compose.service"
+	ComposeNumberLabel    = "com.docker.compose.container-number"
+	ComposeOneOffLabel    = "com.docker.compose.oneoff"
+	composeOneOffDisabled = "False"
+)
+
+// NewComposeContainers returns a client serving the running containers of a Compose project, each
+// in a directory named <service>-<number>. With a service, only its replicas are served, each in a
+// directory named after its number, or at the root of the mount if the service has a single
+// replica. Containers recreated by Compose are followed.
+func NewComposeContainers(project string, service string, config AllConfig, opts ...ClientOption) (*AllContainers, error) {
+	docker, err := newDockerAPI("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newComposeContainers(docker, project, service, config, opts)
+}
+
+func newComposeContainers(docker dockerClient, project string, service string, config AllConfig, opts []ClientOption) (*AllContainers, error) {
+	config.Filters = append(config.Filters,
+		fmt.Sprintf("label=%s=%s", ComposeProjectLabel, project),
+		fmt.Sprintf("label=%s=%s", ComposeOneOffLabel, composeOneOffDisabled))
+	config.Name = func(c container.Summary) string {
+		number := c.Labels[ComposeNumberLabel]
+		if number == "" {
+			return ""
+		}
+		return c.Labels[ComposeServiceLabel] + "-" + number
+	}
+	if service != "" {
+		config.Filters = append(config.Filters, fmt.Sprintf("label=%s=%s", ComposeServiceLabel, service))
+		config.Name = func(c container.Summary) string { return c.Labels[ComposeNumberLabel] }
+	}
+
+	args := filters.NewArgs()
+	for _, f := range config.Filters {
+		if key, value, ok := cutFilter(f); ok {
+			args.Add(key, value)
+		}
+	}
+	list, err := docker.ContainerList(context.Background(), container.ListOptions{Filters: args})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list containers: %s", err)
+	}
+	if len(list) == 0 && service != "" {
+		return nil, fmt.Errorf("no running container for service %q of compose project %q", service, project)
+	} else if len(list) == 0 {
+		return nil, fmt.Errorf("no running container for compose project %q", project)
+	}
+	if service != "" && len(list) == 1 {
+		config.Root = config.Name(list[0])
+	}
+	return newAllContainers(docker, config, opts)
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func composeContainer(id string, service string, number string) container.Summary {
+	return container.Summary{ID: id, Names: []string{"/shop-" + service + "-" + number}, Labels: map[string]string{
+		ComposeProjectLabel: "shop", ComposeServiceLabel: service, ComposeNumberLabel: number, ComposeOneOffLabel: "False",
+	}}
+}
+
+func TestComposeContainers(t *testing.T) {
+	var mDC mockDockerClient
+	messages, errs := make(chan events.Message), make(chan error)
+	mDC.On("Events", mock.Anything, mock.Anything).Return(messages, errs)
+	projectList := container.ListOptions{Filters: filters.NewArgs(
+		filters.Arg("label", "com.docker.compose.project=shop"),
+		filters.Arg("label", "com.docker.compose.oneoff=False"),
+	)}
+	mDC.On("ContainerList", mock.Anything, projectList).Return([]container.Summary{
+		composeContainer("aaa111", "web", "1"),
+		composeContainer("bbb222", "web", "2"),
+		composeContainer("ccc333", "db", "1"),
+	}, nil)
+
+	// Containers of a project are named after their service and number
+	a, err := newComposeContainers(&mDC, "shop", "", AllConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"db-1", "web-1", "web-2", "by-id"}, dirNames(t, a, "/"))
+	a.Close()
+
+	// Replicas of a service are named after their number
+	webList := container.ListOptions{Filters: projectList.Filters.Clone()}
+	webList.Filters.Add("label", "com.docker.compose.service=web")
+	mDC.On("ContainerList", mock.Anything, webList).Return([]container.Summary{
+		composeContainer("aaa111", "web", "1"),
+		composeContainer("bbb222", "web", "2"),
+	}, nil)
+	a, err = newComposeContainers(&mDC, "shop", "web", AllConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"1", "2", "by-id"}, dirNames(t, a, "/"))
+	a.Close()
+
+	cacheList := container.ListOptions{Filters: projectList.Filters.Clone()}
+	cacheList.Filters.Add("label", "com.docker.compose.service=cache")
+	mDC.On("ContainerList", mock.Anything, cacheList).Return([]container.Summary{}, nil)
+	_, err = newComposeContainers(&mDC, "shop", "cache", AllConfig{}, nil)
+	assert.EqualError(t, err, `no running container for service "cache" of compose project "shop"`)
+}
+
+func TestComposeServiceRecreated(t *testing.T) {
+	var (
+		mDC            mockDockerClient
+		old, recreated mockFuseDockerClient
+	)
+	defer func(f func(string, string, ...ClientOption) (DockerFuseClientInterface, error)) {
+		newContainerClient = f
+	}(newContainerClient)
+	newContainerClient = func(containerID string, backend string, opts ...ClientOption) (DockerFuseClientInterface, error) {
+		switch containerID {
+		case "aaa111":
+			return &old, nil
+		case "ddd444":
+			return &recreated, nil
+		}
+		return nil, fmt.Errorf("no such container")
+	}
+	messages, errs := make(chan events.Message), make(chan error)
+	mDC.On("Events", mock.Anything, mock.Anything).Return(messages, errs)
+	list := container.ListOptions{Filters: filters.NewArgs(
+		filters.Arg("label", "com.docker.compose.project=shop"),
+		filters.Arg("label", "com.docker.compose.oneoff=False"),
+		filters.Arg("label", "com.docker.compose.service=web"),
+	)}
+	mDC.On("ContainerList", mock.Anything, list).Return([]container.Summary{composeContainer("aaa111", "web", "1")}, nil).Times(3)
+
+	// A single replica is served at the root of the mount
+	a, err := newComposeContainers(&mDC, "shop", "web", AllConfig{Path: "/srv"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	var attr statAttr
+	old.On("stat", mock.Anything, "/srv/index.html", mock.Anything).Return(syscall.Errno(0))
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/index.html", &attr))
+	old.On("unlink", mock.Anything, "/srv/by-id").Return(syscall.ENOENT)
+	assert.Equal(t, syscall.ENOENT, a.unlink(ctx, "/by-id"))
+
+	// The mount follows the container recreated by Compose
+	var overflows int
+	var overflowsMu sync.Mutex
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	watching := make(chan error)
+	go func() {
+		watching <- a.watchChanges(watchCtx, func(events []rpccommon.ChangeEvent, overflow bool) {
+			overflowsMu.Lock()
+			defer overflowsMu.Unlock()
+			if overflow {
+				overflows++
+			}
+		})
+	}()
+	assert.Eventually(t, a.watching.Load, time.Second, time.Millisecond)
+	mDC.On("ContainerList", mock.Anything, list).Return([]container.Summary{composeContainer("ddd444", "web", "1")}, nil)
+	old.On("Close").Return()
+	messages <- events.Message{Action: events.ActionStart}
+	assert.Eventually(t, func() bool {
+		overflowsMu.Lock()
+		defer overflowsMu.Unlock()
+		return overflows == 1
+	}, time.Second, time.Millisecond)
+	recreated.On("stat", mock.Anything, "/srv/index.html", mock.Anything).Return(syscall.Errno(0))
+	assert.Equal(t, syscall.Errno(0), a.stat(ctx, "/index.html", &attr))
+	stopWatching()
+	assert.NoError(t, <-watching)
+
+	recreated.On("Close").Return()
+	a.Close()
+	old.AssertExpectations(t)
+	recreated.AssertExpectations(t)
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Directories of the changes view, by kind of change
+var changeDirs = map[container.ChangeType]string{
+	container.ChangeAdd:    "added",
+	container.ChangeModify: "modified",
+	container.ChangeDelete: "deleted",
+}
+
+// Changes serves the changes a container made to its image, as listed by `docker diff`, in added,
+// modified and deleted directories. Added and modified paths are symbolic links to the files in
+// the mount, deleted ones are empty placeholder files. Links resolve when the view is served
+// right below the control directory.
+type Changes struct {
+	readOnlyClient
+
+	docker      dockerClient
+	containerID string
+	mountPath   string
+
+	mu    sync.Mutex
+	tree  *ImageFileClient
+	built time.Time
+}
+
+// changesHandle is a file handle of a placeholder, in the tree it was opened from
+type changesHandle struct {
+	tree *ImageFileClient
+	fh   fusefs.FileHandle
+}
+
+// NewContainerChanges returns the changes of a container below mountPath, the container path
+// mounted
+func NewContainerChanges(containerID string, mountPath string, opts ...ClientOption) (*Changes, error) {
+	docker, err := newDockerAPI(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Changes{docker: docker, containerID: containerID, mountPath: path.Clean(mountPath)}, nil
+}
+
+// mountRelative returns fullPath relative to the mounted path (with a leading slash), if below it
+func mountRelative(fullPath string, mountPath string) (string, bool) {
+	if mountPath == "/" {
+		return fullPath, fullPath != "/"
+	}
+	rest, ok := strings.CutPrefix(fullPath, mountPath+"/")
+	return "/" + rest, ok
+}
+
+// changesTree returns a client serving changes below mountPath
+func changesTree(changes []container.FilesystemChange, mountPath string, now time.Time) *ImageFileClient {
+	t := newImageTree()
+	for _, dir := range changeDirs {
+		t.add("/"+dir, &imageEntry{attr: dirAttr("/" + dir)})
+	}
+
+	// Paths with changes below them are directories
+	parents := make(map[string]bool)
+	for _, c := range changes {
+		rel, ok := mountRelative(path.Clean(c.Path), mountPath)
+		if !ok {
+			continue
+		}
+		for d := path.Dir(rel); d != "/"; d = path.Dir(d) {
+			parents[path.Join("/", changeDirs[c.Kind], d)] = true
+		}
+	}
+
+	for _, c := range changes {
+		rel, ok := mountRelative(path.Clean(c.Path), mountPath)
+		dir, known := changeDirs[c.Kind]
+		viewPath := path.Join("/", dir, rel)
+		if !ok || !known || parents[viewPath] {
+			continue
+		}
+		var attr statAttr
+		attr.FuseAttr.Ino = archiveIno(viewPath)
+		attr.FuseAttr.Nlink = 1
+		attr.FuseAttr.SetTimes(nil, &now, &now)
+		e := &imageEntry{attr: attr}
+		if c.Kind == container.ChangeDelete {
+			e.attr.FuseAttr.Mode = syscall.S_IFREG | 0444
+			e.data = io.NewSectionReader(strings.NewReader(""), 0, 0)
+		} else {
+			// From the directory of the link up to the mount: <kind>/<dirs>, changes, ControlDir
+			e.attr.LinkTarget = strings.Repeat("../", strings.Count(path.Dir(viewPath), "/")+2) + rel[1:]
+			e.attr.FuseAttr.Mode = syscall.S_IFLNK | 0777
+			e.attr.FuseAttr.Size = uint64(len(e.attr.LinkTarget))
+		}
+		t.add(viewPath, e)
+	}
+	return t
+}
+
+// snapshot returns the changes of the container, listing them again once they are stale
+func (c *Changes) snapshot(ctx context.Context) (*ImageFileClient, syscall.Errno) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tree != nil && time.Since(c.built) < containerDiffTTL {
+		return c.tree, 0
+	}
+	changes, err := c.docker.ContainerDiff(ctx, c.containerID)
+	if err != nil {
+		slog.Warn("cannot list the changes of the container", "error", err)
+		return nil, syscall.EIO
+	}
+	c.built = time.Now()
+	c.tree = changesTree(changes, c.mountPath, c.built)
+	return c.tree, 0
+}
+
+func (c *Changes) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	tree, syserr := c.snapshot(ctx)
+	if syserr != 0 {
+		return syserr
+	}
+	return tree.stat(ctx, fullPath, attr)
+}
+
+func (c *Changes) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	tree, syserr := c.snapshot(ctx)
+	if syserr != 0 {
+		return nil, syserr
+	}
+	return tree.readDir(ctx, fullPath)
+}
+
+func (c *Changes) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	tree, syserr := c.snapshot(ctx)
+	if syserr != 0 {
+		return []byte{}, syserr
+	}
+	return tree.readlink(ctx, fullPath)
+}
+
+func (c *Changes) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	tree, syserr := c.snapshot(ctx)
+	if syserr != 0 {
+		return nil, 0, syserr
+	}
+	if fh, mode, syserr = tree.open(ctx, fullPath, flags, modeIn, attr); syserr != 0 {
+		return nil, 0, syserr
+	}
+	return &changesHandle{tree: tree, fh: fh}, mode, 0
+}
+
+func (c *Changes) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	h, ok := fh.(*changesHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return h.tree.read(ctx, h.fh, offset, n)
+}
+
+func (c *Changes) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	h, ok := fh.(*changesHandle)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	return h.tree.seek(ctx, h.fh, offset, whence)
+}
+
+func (c *Changes) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	h, ok := fh.(*changesHandle)
+	if !ok {
+		return syscall.EBADF
+	}
+	return h.tree.close(ctx, h.fh)
+}
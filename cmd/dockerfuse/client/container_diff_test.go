@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMountRelative(t *testing.T) {
+	for _, tc := range []struct {
+		fullPath, mountPath, rel string
+		ok                       bool
+	}{
+		{"/etc/hosts", "/", "/etc/hosts", true},
+		{"/", "/", "/", false},
+		{"/app/x/y", "/app", "/x/y", true},
+		{"/app", "/app", "/", false},
+		{"/application", "/app", "/", false},
+	} {
+		rel, ok := mountRelative(tc.fullPath, tc.mountPath)
+		assert.Equal(t, tc.ok, ok, tc.fullPath)
+		if ok {
+			assert.Equal(t, tc.rel, rel, tc.fullPath)
+		}
+	}
+}
+
+func TestChangesTree(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	changes := []container.FilesystemChange{
+		{Path: "/app", Kind: container.ChangeModify},
+		{Path: "/app/conf", Kind: container.ChangeModify},
+		{Path: "/app/conf/app.yml", Kind: container.ChangeModify},
+		{Path: "/app/cache", Kind: container.ChangeAdd},
+		{Path: "/app/cache/a", Kind: container.ChangeAdd},
+		{Path: "/app/log", Kind: container.ChangeAdd},
+		{Path: "/app/old", Kind: container.ChangeDelete},
+		{Path: "/etc/passwd", Kind: container.ChangeModify},
+		{Path: "/app/unknown", Kind: container.ChangeType(9)},
+	}
+
+	tree := changesTree(changes, "/app", now)
+	assert.Equal(t, []string{"added", "deleted", "modified"}, dirNames(t, tree, "/"))
+	assert.Equal(t, []string{"cache", "log"}, dirNames(t, tree, "/added"))
+	assert.Equal(t, []string{"conf"}, dirNames(t, tree, "/modified"))
+
+	// Changed files link to the mount, with directories holding changes created
+	var attr statAttr
+	assert.Equal(t, syscall.Errno(0), tree.stat(ctx, "/added/cache", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR), attr.FuseAttr.Mode&syscall.S_IFMT)
+	for viewPath, target := range map[string]string{
+		"/added/log":             "../../../log",
+		"/added/cache/a":         "../../../../cache/a",
+		"/modified/conf/app.yml": "../../../../conf/app.yml",
+	} {
+		link, errno := tree.readlink(ctx, viewPath)
+		assert.Equal(t, syscall.Errno(0), errno, viewPath)
+		assert.Equal(t, target, string(link), viewPath)
+	}
+	assert.Equal(t, syscall.Errno(0), tree.stat(ctx, "/added/log", &attr))
+	assert.Equal(t, uint64(len("../../../log")), attr.FuseAttr.Size)
+	assert.Equal(t, uint64(now.Unix()), attr.FuseAttr.Mtime)
+
+	// Deleted files are empty placeholders
+	assert.Equal(t, syscall.Errno(0), tree.stat(ctx, "/deleted/old", &attr))
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), attr.FuseAttr.Mode)
+	assert.Equal(t, "", readImageFile(t, tree, "/deleted/old"))
+
+	// Whole containers
+	tree = changesTree(changes, "/", now)
+	link, _ := tree.readlink(ctx, "/modified/etc/passwd")
+	assert.Equal(t, "../../../../etc/passwd", string(link))
+	assert.Equal(t, syscall.Errno(0), tree.stat(ctx, "/modified/app/conf", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR), attr.FuseAttr.Mode&syscall.S_IFMT)
+}
+
+func TestContainerChanges(t *testing.T) {
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+	mDC.On("ContainerDiff", mock.Anything, "c").Return([]container.FilesystemChange{
+		{Path: "/tmp", Kind: container.ChangeModify},
+		{Path: "/tmp/x", Kind: container.ChangeAdd},
+		{Path: "/old", Kind: container.ChangeDelete},
+	}, nil).Once()
+
+	c, err := NewContainerChanges("c", "/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	var attr statAttr
+
+	// Changes are listed once for a while
+	assert.Equal(t, syscall.Errno(0), c.stat(ctx, "/added/tmp/x", &attr))
+	link, errno := c.readlink(ctx, "/added/tmp/x")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "../../../../tmp/x", string(link))
+	ds, errno := c.readDir(ctx, "/deleted")
+	assert.Equal(t, syscall.Errno(0), errno)
+	e, _ := ds.Next()
+	assert.Equal(t, "old", e.Name)
+	fh, _, errno := c.open(ctx, "/deleted/old", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	data, errno := c.read(ctx, fh, 0, 10)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Empty(t, data)
+	n, _ := c.seek(ctx, fh, 0, seekHole)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, syscall.Errno(0), c.close(ctx, fh))
+	_, errno = c.read(ctx, "bogus", 0, 10)
+	assert.Equal(t, syscall.EBADF, errno)
+	assert.Equal(t, syscall.EBADF, c.close(ctx, "bogus"))
+	mDC.AssertExpectations(t)
+
+	// Nothing changes
+	_, _, errno = c.open(ctx, "/deleted/old", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	assert.Equal(t, syscall.EROFS, c.unlink(ctx, "/deleted/old"))
+
+	// Stale changes are listed again
+	c.built = time.Time{}
+	mDC.On("ContainerDiff", mock.Anything, "c").Return([]container.FilesystemChange{}, nil).Once()
+	assert.Equal(t, syscall.ENOENT, c.stat(ctx, "/added/tmp/x", &attr))
+
+	c.built = time.Time{}
+	mDC.On("ContainerDiff", mock.Anything, "c").Return([]container.FilesystemChange{}, fmt.Errorf("gone")).Once()
+	assert.Equal(t, syscall.EIO, c.stat(ctx, "/added", &attr))
+	mDC.AssertExpectations(t)
+}
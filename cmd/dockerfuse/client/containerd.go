@@ -0,0 +1,379 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	containers "github.com/containerd/containerd/api/services/containers/v1"
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// DefaultContainerdNamespace is the containerd namespace of nerdctl. Kubernetes uses k8s.io.
+const DefaultContainerdNamespace = "default"
+
+// containerdSockets are where containerd listens by default, standalone and in k3s
+var containerdSockets = []string{"/run/containerd/containerd.sock", "/run/k3s/containerd/containerd.sock"}
+
+// containerdProcessType is the type of OCI process specs, as containerd names it
+const containerdProcessType = "types.containerd.io/opencontainers/runtime-spec/1/Process"
+
+// nerdctlNameLabel names containers created by nerdctl
+const nerdctlNameLabel = "nerdctl/name"
+
+// containerdSocket returns the address of the local containerd, from CONTAINERD_ADDRESS or the
+// first default socket found
+func containerdSocket() string {
+	if address := os.Getenv("CONTAINERD_ADDRESS"); address != "" {
+		return address
+	}
+	for _, s := range containerdSockets {
+		if fileExists(s) {
+			return s
+		}
+	}
+	return containerdSockets[0]
+}
+
+// ContainerdConfig selects the containerd daemon and namespace, as nerdctl does
+type ContainerdConfig struct {
+	// Daemon socket, by default CONTAINERD_ADDRESS or the first default socket found
+	Address string
+	// containerd namespace, by default CONTAINERD_NAMESPACE or DefaultContainerdNamespace
+	Namespace string
+}
+
+// WithContainerd serves a container of containerd, found by ID, ID prefix or nerdctl name, without
+// dockerd (e.g. k3s, nerdctl): it selects BackendContainerd
+func WithContainerd(config ContainerdConfig) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendName = BackendContainerd
+		d.backendConfig.Containerd = config
+	}
+}
+
+// containerdEndpoint returns the containerd daemon address and namespace selected by config
+func containerdEndpoint(config ContainerdConfig) (address string, namespace string) {
+	address, namespace = config.Address, config.Namespace
+	if address == "" {
+		address = containerdSocket()
+	}
+	if namespace == "" {
+		namespace = os.Getenv("CONTAINERD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	return address, namespace
+}
+
+// containerdSpec is the part of the OCI runtime spec of a container used here
+type containerdSpec struct {
+	// Kept as is, to run exec processes as the container process (user, capabilities, ...)
+	Process map[string]any
+}
+
+// containerdBackend serves a task of containerd, without dockerd.
+// Exec processes (the satellite included) are attached through FIFOs, which requires running on
+// the containerd host, and files are accessed through the root of the task (/proc/<pid>/root).
+type containerdBackend struct {
+	satellitePlacement
+	conn       *grpc.ClientConn
+	containers containers.ContainersClient
+	tasks      tasks.TasksClient
+	// Container ID, resolved from the name or ID given
+	id string
+}
+
+// newContainerdRuntime returns the backend serving the container named by target, in the
+// containerd daemon and namespace config selects
+func newContainerdRuntime(target string, config BackendConfig) (Backend, error) {
+	address, namespace := containerdEndpoint(config.Containerd)
+	slog.Debug("using the containerd API", "address", address, "namespace", namespace)
+	c, err := newContainerdBackend(address, namespace, target, config)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newContainerdBackend connects to containerd at address, and finds the container named ref (by
+// ID, ID prefix or nerdctl name) in namespace
+func newContainerdBackend(address string, namespace string, ref string, config BackendConfig) (*containerdBackend, error) {
+	address = strings.TrimPrefix(address, "unix://")
+	withNamespace := func(ctx context.Context) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "containerd-namespace", namespace)
+	}
+	conn, err := grpc.NewClient("unix://"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withNamespace(ctx), method, req, reply, cc, opts...)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c := &containerdBackend{
+		conn:       conn,
+		containers: containers.NewContainersClient(conn),
+		tasks:      tasks.NewTasksClient(conn),
+	}
+	if c.id, err = c.resolve(context.Background(), ref); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.satellitePlacement = newSatellitePlacement(c, c.id, config)
+	return c, nil
+}
+
+// containerdError converts gRPC errors of containerd, keeping them recognizable as not found
+func containerdError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	err = fmt.Errorf("containerd: %s", s.Message())
+	if s.Code() == codes.NotFound {
+		return errdefs.NotFound(err)
+	}
+	return err
+}
+
+// resolve returns the ID of the container named ref
+func (c *containerdBackend) resolve(ctx context.Context, ref string) (string, error) {
+	resp, err := c.containers.Get(ctx, &containers.GetContainerRequest{ID: ref})
+	if err == nil {
+		return resp.Container.ID, nil
+	} else if status.Code(err) != codes.NotFound {
+		return "", containerdError(err)
+	}
+	list, err := c.containers.List(ctx, &containers.ListContainersRequest{Filters: []string{
+		fmt.Sprintf("labels.%q==%s", nerdctlNameLabel, ref),
+		"id~=^" + regexp.QuoteMeta(ref),
+	}})
+	if err != nil {
+		return "", containerdError(err)
+	}
+	switch len(list.Containers) {
+	case 0:
+		return "", errdefs.NotFound(fmt.Errorf("no such container: %s", ref))
+	case 1:
+		return list.Containers[0].ID, nil
+	}
+	return "", fmt.Errorf("ambiguous container %q (%d matches)", ref, len(list.Containers))
+}
+
+func (c *containerdBackend) spec(ctr *containers.Container) (spec containerdSpec, err error) {
+	if ctr.Spec == nil {
+		return spec, errors.New("container without spec")
+	}
+	err = json.Unmarshal(ctr.Spec.Value, &spec)
+	return
+}
+
+// pid returns the PID of the task, on the containerd host
+func (c *containerdBackend) pid(ctx context.Context) (uint32, error) {
+	resp, err := c.tasks.Get(ctx, &tasks.GetRequest{ContainerID: c.id})
+	if err != nil {
+		return 0, containerdError(err)
+	}
+	if resp.Process.Status != task.Status_RUNNING && resp.Process.Status != task.Status_PAUSED {
+		return 0, fmt.Errorf("container %s is not running", c.id)
+	}
+	return resp.Process.Pid, nil
+}
+
+// Resolve checks that the container still exists
+func (c *containerdBackend) Resolve(ctx context.Context) (Target, error) {
+	resp, err := c.containers.Get(ctx, &containers.GetContainerRequest{ID: c.id})
+	if err != nil {
+		return Target{}, containerdError(err)
+	}
+	return Target{ID: resp.Container.ID}, nil
+}
+
+// Arch returns the architecture of the container, read from the executable of its init process:
+// containerd keeps no image config at hand, and the task is what the satellite must match
+func (c *containerdBackend) Arch(ctx context.Context) (arch string, variant string, err error) {
+	pid, err := c.pid(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return procArch(int(pid))
+}
+
+// statPath stats fullPath in the root of the task
+func (c *containerdBackend) statPath(ctx context.Context, fullPath string) (container.PathStat, error) {
+	pid, err := c.pid(ctx)
+	if err != nil {
+		return container.PathStat{}, err
+	}
+	return procStatPath(int(pid), fullPath)
+}
+
+// extract unpacks archive in dir, in the root of the task. This works in containers without a
+// shell or tar, but only directories and files can be extracted.
+func (c *containerdBackend) extract(ctx context.Context, dir string, archive io.Reader) error {
+	pid, err := c.pid(ctx)
+	if err != nil {
+		return err
+	}
+	return procCopyTo(int(pid), dir, archive)
+}
+
+// output runs cmd as an exec process of the task, and returns its standard output
+func (c *containerdBackend) output(ctx context.Context, cmd ...string) (string, error) {
+	s, err := c.exec(ctx, cmd, false)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	out, err := io.ReadAll(s)
+	return string(out), err
+}
+
+// start runs cmd as an exec process of the task, with its stdin and stdout on FIFOs
+func (c *containerdBackend) start(ctx context.Context, cmd []string) (SatelliteConn, error) {
+	return c.exec(ctx, cmd, true)
+}
+
+// exec starts cmd as an exec process of the task, as the init process runs (user, capabilities,
+// environment...), with its stdout and, if stdin, its stdin on FIFOs
+func (c *containerdBackend) exec(ctx context.Context, cmd []string, stdin bool) (*localSatellite, error) {
+	resp, err := c.containers.Get(ctx, &containers.GetContainerRequest{ID: c.id})
+	if err != nil {
+		return nil, containerdError(err)
+	}
+	spec, err := c.spec(resp.Container)
+	if err != nil {
+		return nil, err
+	}
+	process := spec.Process
+	process["args"], process["terminal"] = cmd, false
+	processSpec, err := json.Marshal(process)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	execID := "dockerfuse-" + hex.EncodeToString(nonce)
+	stream, err := newFIFOStream(stdin)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.tasks.Exec(ctx, &tasks.ExecProcessRequest{
+		ContainerID: c.id,
+		ExecID:      execID,
+		Stdin:       stream.stdinPath,
+		Stdout:      stream.stdoutPath,
+		Spec:        &anypb.Any{TypeUrl: containerdProcessType, Value: processSpec},
+	})
+	if err != nil {
+		stream.Close()
+		return nil, containerdError(err)
+	}
+	s := &localSatellite{fifoStream: stream, done: make(chan struct{})}
+	// Exit statuses are only kept until processes are deleted
+	waitCtx := context.WithoutCancel(ctx)
+	go func() {
+		c.tasks.Wait(waitCtx, &tasks.WaitRequest{ContainerID: c.id, ExecID: execID})
+		close(s.done)
+		c.tasks.DeleteProcess(waitCtx, &tasks.DeleteProcessRequest{ContainerID: c.id, ExecID: execID})
+	}()
+	if _, err = c.tasks.Start(ctx, &tasks.StartRequest{ContainerID: c.id, ExecID: execID}); err != nil {
+		c.tasks.DeleteProcess(waitCtx, &tasks.DeleteProcessRequest{ContainerID: c.id, ExecID: execID})
+		stream.Close()
+		return nil, containerdError(err)
+	}
+	return s, nil
+}
+
+// fifoStream is the stdin and stdout of a process, through FIFOs the containerd shim opens or
+// through pipes
+type fifoStream struct {
+	dir                   string
+	stdinPath, stdoutPath string
+	stdin, stdout         *os.File
+}
+
+// newFIFOStream creates the FIFOs of stdout and, if attachStdin, stdin, and opens our ends. The
+// stdout FIFO is opened without blocking, before the shim opens it: it only returns data once the
+// process starts.
+func newFIFOStream(attachStdin bool) (s *fifoStream, err error) {
+	s = &fifoStream{}
+	if s.dir, err = os.MkdirTemp("", "dockerfuse-fifo-"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+	open := func(name string, flag int) (string, *os.File, error) {
+		p := filepath.Join(s.dir, name)
+		if err := syscall.Mkfifo(p, 0600); err != nil {
+			return "", nil, err
+		}
+		f, err := os.OpenFile(p, flag, 0)
+		return p, f, err
+	}
+	// Reading and writing, as opening the write end alone blocks until the shim opens the other
+	if attachStdin {
+		if s.stdinPath, s.stdin, err = open("stdin", os.O_RDWR); err != nil {
+			return nil, err
+		}
+	}
+	if s.stdoutPath, s.stdout, err = open("stdout", os.O_RDONLY|syscall.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fifoStream) Read(p []byte) (int, error) { return s.stdout.Read(p) }
+
+func (s *fifoStream) Write(p []byte) (int, error) {
+	if s.stdin == nil {
+		return 0, errors.New("stdin not attached")
+	}
+	return s.stdin.Write(p)
+}
+
+// CloseWrite closes stdin
+func (s *fifoStream) CloseWrite() error {
+	if s.stdin == nil {
+		return nil
+	}
+	return s.stdin.Close()
+}
+
+func (s *fifoStream) Close() error {
+	for _, f := range []*os.File{s.stdin, s.stdout} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
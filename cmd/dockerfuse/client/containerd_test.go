@@ -0,0 +1,299 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	containers "github.com/containerd/containerd/api/services/containers/v1"
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeContainers serves containers
+type fakeContainers struct {
+	containers.UnimplementedContainersServer
+	containers map[string]*containers.Container
+}
+
+// fakeTasks serves a running task for each container, as the process pid, and runs exec
+// processes with run, attached to their FIFOs as the shim would
+type fakeTasks struct {
+	tasks.UnimplementedTasksServer
+	t   *testing.T
+	pid uint32
+	run func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+
+	mu      sync.Mutex
+	execs   map[string]*tasks.ExecProcessRequest
+	exited  map[string]chan uint32
+	deleted []string
+}
+
+// fakeContainerd serves c and tk on a unix socket, accepting requests in namespace only, and
+// returns its address
+func fakeContainerd(t *testing.T, namespace string, c *fakeContainers, tk *fakeTasks) string {
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	l, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if got := md.Get("containerd-namespace"); len(got) != 1 || got[0] != namespace {
+			return nil, status.Errorf(codes.FailedPrecondition, "namespace %v", got)
+		}
+		return handler(ctx, req)
+	}))
+	containers.RegisterContainersServer(server, c)
+	tasks.RegisterTasksServer(server, tk)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	tk.execs, tk.exited = make(map[string]*tasks.ExecProcessRequest), make(map[string]chan uint32)
+	return "unix://" + socket
+}
+
+func (f *fakeContainers) Get(ctx context.Context, req *containers.GetContainerRequest) (*containers.GetContainerResponse, error) {
+	c, ok := f.containers[req.ID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q in namespace: not found", req.ID)
+	}
+	return &containers.GetContainerResponse{Container: c}, nil
+}
+
+func (f *fakeContainers) List(ctx context.Context, req *containers.ListContainersRequest) (*containers.ListContainersResponse, error) {
+	resp := &containers.ListContainersResponse{}
+	for _, c := range f.containers {
+		for _, filter := range req.Filters {
+			label, byLabel := strings.CutPrefix(filter, `labels."nerdctl/name"==`)
+			prefix, byID := strings.CutPrefix(filter, "id~=^")
+			if (byLabel && c.Labels[nerdctlNameLabel] == label) || (byID && strings.HasPrefix(c.ID, prefix)) {
+				resp.Containers = append(resp.Containers, c)
+				break
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeTasks) Get(ctx context.Context, req *tasks.GetRequest) (*tasks.GetResponse, error) {
+	return &tasks.GetResponse{Process: &task.Process{ContainerID: req.ContainerID, Pid: f.pid, Status: task.Status_RUNNING}}, nil
+}
+
+func (f *fakeTasks) Exec(ctx context.Context, req *tasks.ExecProcessRequest) (*emptypb.Empty, error) {
+	assert.Equal(f.t, containerdProcessType, req.Spec.TypeUrl)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.execs[req.ExecID] = req
+	f.exited[req.ExecID] = make(chan uint32, 1)
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeTasks) Start(ctx context.Context, req *tasks.StartRequest) (*tasks.StartResponse, error) {
+	f.mu.Lock()
+	exec, exited := f.execs[req.ExecID], f.exited[req.ExecID]
+	f.mu.Unlock()
+	var process struct {
+		Args []string
+		Env  []string
+		User struct{ UID int }
+	}
+	assert.NoError(f.t, json.Unmarshal(exec.Spec.Value, &process))
+	// Exec processes run as the container process
+	assert.Equal(f.t, []string{"PATH=/bin"}, process.Env)
+	assert.Equal(f.t, 1000, process.User.UID)
+
+	// Opened before the process starts, as the shim does
+	open := func(path string, flag int) *os.File {
+		if path == "" {
+			return nil
+		}
+		file, err := os.OpenFile(path, flag, 0)
+		assert.NoError(f.t, err)
+		return file
+	}
+	stdin, stdout, stderr := open(exec.Stdin, os.O_RDONLY), open(exec.Stdout, os.O_WRONLY), open(exec.Stderr, os.O_WRONLY)
+	go func() {
+		var in io.Reader = strings.NewReader("")
+		var out, errOut io.Writer = io.Discard, io.Discard
+		for _, f := range []*os.File{stdin, stdout, stderr} {
+			if f != nil {
+				defer f.Close()
+			}
+		}
+		if stdin != nil {
+			in = stdin
+		}
+		if stdout != nil {
+			out = stdout
+		}
+		if stderr != nil {
+			errOut = stderr
+		}
+		exited <- uint32(f.run(process.Args, in, out, errOut))
+	}()
+	return &tasks.StartResponse{Pid: 7}, nil
+}
+
+func (f *fakeTasks) Wait(ctx context.Context, req *tasks.WaitRequest) (*tasks.WaitResponse, error) {
+	f.mu.Lock()
+	exited := f.exited[req.ExecID]
+	f.mu.Unlock()
+	return &tasks.WaitResponse{ExitStatus: <-exited}, nil
+}
+
+func (f *fakeTasks) DeleteProcess(ctx context.Context, req *tasks.DeleteProcessRequest) (*tasks.DeleteResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, req.ExecID)
+	return &tasks.DeleteResponse{}, nil
+}
+
+func TestContainerdEndpoint(t *testing.T) {
+	defer func(sockets []string) { containerdSockets = sockets }(containerdSockets)
+	t.Setenv("CONTAINERD_ADDRESS", "")
+	t.Setenv("CONTAINERD_NAMESPACE", "")
+	// Docker settings don't apply
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+
+	k3s := filepath.Join(t.TempDir(), "containerd.sock")
+	assert.NoError(t, os.WriteFile(k3s, nil, 0600))
+	containerdSockets = []string{filepath.Join(t.TempDir(), "containerd.sock"), k3s}
+	address, namespace := containerdEndpoint(ContainerdConfig{})
+	assert.Equal(t, k3s, address)
+	assert.Equal(t, DefaultContainerdNamespace, namespace)
+
+	t.Setenv("CONTAINERD_ADDRESS", "/run/other.sock")
+	t.Setenv("CONTAINERD_NAMESPACE", "k8s.io")
+	address, namespace = containerdEndpoint(ContainerdConfig{})
+	assert.Equal(t, "/run/other.sock", address)
+	assert.Equal(t, "k8s.io", namespace)
+	address, namespace = containerdEndpoint(ContainerdConfig{Address: "unix:///run/mine.sock", Namespace: "buildkit"})
+	assert.Equal(t, "unix:///run/mine.sock", address)
+	assert.Equal(t, "buildkit", namespace)
+}
+
+func TestContainerdClient(t *testing.T) {
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = t.TempDir()
+	root := filepath.Join(procDir, "42", "root")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "tmp"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("web\n"), 0644))
+	// Absolute symlinks resolve in the container
+	assert.NoError(t, os.Symlink("/", filepath.Join(root, "escape")))
+	exe, err := os.Executable()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Symlink(exe, filepath.Join(procDir, "42", "exe")))
+
+	spec, _ := json.Marshal(map[string]any{"process": map[string]any{
+		"args": []string{"/bin/web", "-port", "80"}, "env": []string{"PATH=/bin"}, "cwd": "/srv", "user": map[string]int{"uid": 1000},
+	}})
+	ctr := &containers.Container{
+		ID:     "c0ffee0123",
+		Image:  "docker.io/library/web:1",
+		Labels: map[string]string{nerdctlNameLabel: "web"},
+		Spec:   &anypb.Any{TypeUrl: "types.containerd.io/opencontainers/runtime-spec/1/Spec", Value: spec},
+	}
+	tk := &fakeTasks{t: t, pid: 42, run: func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+		switch args[0] {
+		case "/tmp/satellite":
+			// Echoes its input, as a session the client ends by closing it
+			io.Copy(stdout, stdin)
+			return 3
+		case "sh":
+			io.WriteString(stdout, "out")
+			io.WriteString(stderr, "err")
+			return 0
+		}
+		return 127
+	}}
+	address := fakeContainerd(t, "k8s.io", &fakeContainers{containers: map[string]*containers.Container{ctr.ID: ctr}}, tk)
+
+	// Containers are found by nerdctl name, or ID prefix
+	for _, ref := range []string{"web", "c0ffee"} {
+		c, err := newContainerdBackend(address, "k8s.io", ref, BackendConfig{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, ctr.ID, c.id)
+		}
+	}
+	_, err = newContainerdBackend(address, "k8s.io", "db", BackendConfig{})
+	assert.True(t, errdefs.IsNotFound(err))
+	fdc, err := newClient("web", WithContainerd(ContainerdConfig{Address: address, Namespace: "k8s.io"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := fdc.backend.(*containerdBackend)
+	ctx := context.Background()
+
+	target, err := c.Resolve(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, ctr.ID, target.ID)
+	// The architecture is the one of the task executable
+	arch, _, err := c.Arch(ctx)
+	if assert.NoError(t, err) && runtime.GOARCH != "arm" {
+		assert.Equal(t, runtime.GOARCH, arch)
+	}
+
+	// Files are accessed in the root of the task
+	stat, err := c.statPath(ctx, "/etc/hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), stat.Size)
+	assert.Equal(t, os.FileMode(0644), stat.Mode)
+	stat, err = c.statPath(ctx, "/escape")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", stat.LinkTarget)
+	_, err = c.statPath(ctx, "/missing")
+	assert.True(t, errdefs.IsNotFound(err))
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dockerfuse/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dockerfuse/satellite", Mode: 0700, Size: 9})
+	tw.Write([]byte("satellite"))
+	tw.Close()
+	assert.NoError(t, c.extract(ctx, "/escape/tmp", &archive))
+	info, err := os.Stat(filepath.Join(root, "tmp", "dockerfuse", "satellite"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), info.Mode())
+	}
+
+	// Exec processes run as the init process, and only their stdout is read
+	out, err := c.output(ctx, "sh", "-c", "true")
+	assert.NoError(t, err)
+	assert.Equal(t, "out", out)
+
+	// The RPC stream is carried over FIFOs, and stopped by closing stdin
+	conn, err := c.start(ctx, []string{"/tmp/satellite"})
+	if assert.NoError(t, err) {
+		io.WriteString(conn, "ping")
+		echoed := make([]byte, 4)
+		_, err = io.ReadFull(conn, echoed)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+		assert.NoError(t, conn.Stop(ctx))
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool {
+		tk.mu.Lock()
+		defer tk.mu.Unlock()
+		return len(tk.deleted) == 2
+	}, time.Second, 10*time.Millisecond)
+}
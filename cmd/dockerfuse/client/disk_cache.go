@@ -0,0 +1,342 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// diskCacheChunkSize is the size of file chunks stored in the on-disk cache
+const diskCacheChunkSize = 256 * 1024
+
+// DefaultDiskCacheLimit is the default size limit of cached chunks, across the containers sharing
+// a cache directory
+const DefaultDiskCacheLimit = 1024 * 1024 * 1024
+
+// diskCache persists file chunks, attributes and directory listings across mount sessions.
+//
+// Layout, below the directory of each container:
+//
+//	chunks/<ino>-<size>-<mtime ns>/<chunk index>
+//	attrs/<sha256 of path>.json
+//	dirs/<sha256 of path>.json
+type diskCache struct {
+	root string
+	// Size limit of the chunks below the cache directory, for every container: least recently
+	// used chunks are evicted beyond it, in the background. No limit when 0.
+	limit int64
+
+	mu        sync.Mutex
+	persisted map[string]statAttr // Attributes known to be on disk already
+	paths     map[string]struct{} // Paths with attributes or listings on disk, nil until removeTree
+	used      int64               // Size of the chunks below the cache directory, -1 until measured
+	evicting  bool                // Set while evict walks the cache
+	written   int64               // Size of the chunks written while evict walks the cache
+	evictions sync.WaitGroup
+}
+
+type diskAttr struct {
+	Path string
+	statAttr
+}
+
+type diskDirListing struct {
+	Path    string
+	Key     string // contentKey of the directory when listed
+	Entries []fuse.DirEntry
+}
+
+// newDiskCache opens (creating it if needed) the cache of containerID below dir, keeping the chunks
+// of all the containers below dir within limit bytes (no limit when 0). If alias (e.g., the
+// container name) is not empty, it can be used in place of the ID by openDiskCache.
+func newDiskCache(dir string, containerID string, alias string, limit int64) (*diskCache, error) {
+	root := filepath.Join(dir, containerID)
+	for _, sub := range []string{"chunks", "attrs", "dirs"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if alias != "" && alias != containerID && filepath.Base(alias) == alias {
+		link := filepath.Join(dir, alias)
+		os.Remove(link)
+		if err := os.Symlink(containerID, link); err != nil {
+			return nil, err
+		}
+	}
+	return &diskCache{root: root, limit: limit, persisted: make(map[string]statAttr), used: -1}, nil
+}
+
+// openDiskCache opens the existing cache of a container, by ID or alias
+func openDiskCache(dir string, containerIDOrAlias string) (*diskCache, error) {
+	root, err := filepath.EvalSymlinks(filepath.Join(dir, containerIDOrAlias))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(root, "attrs")); err != nil {
+		return nil, fmt.Errorf("no cached content for %s: %w", containerIDOrAlias, err)
+	}
+	return &diskCache{root: root, persisted: make(map[string]statAttr), used: -1}, nil
+}
+
+// contentKey identifies a version of a file: it changes whenever the file is modified
+func contentKey(attr *fuse.Attr) string {
+	return fmt.Sprintf("%d-%d-%d", attr.Ino, attr.Size, int64(attr.Mtime)*1e9+int64(attr.Mtimensec))
+}
+
+func pathHash(fullPath string) string {
+	h := sha256.Sum256([]byte(fullPath))
+	return hex.EncodeToString(h[:])
+}
+
+// writeFileAtomic writes a file so that readers never see partial content
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (c *diskCache) chunkPath(key string, index int64) string {
+	return filepath.Join(c.root, "chunks", key, fmt.Sprint(index))
+}
+
+// readChunk returns a cached chunk of the file version identified by key
+func (c *diskCache) readChunk(key string, index int64) (data []byte, ok bool) {
+	name := c.chunkPath(key, index)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	// The modification time orders chunks for eviction
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return data, true
+}
+
+// writeChunk stores a complete chunk (i.e., not truncated, unless at EOF). Beyond the size limit,
+// least recently used chunks are evicted in the background.
+func (c *diskCache) writeChunk(key string, index int64, data []byte) error {
+	name := c.chunkPath(key, index)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(name, data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limit <= 0 {
+		return nil
+	}
+	if c.evicting {
+		c.written += int64(len(data))
+		return nil
+	}
+	if c.used >= 0 {
+		c.used += int64(len(data))
+		if c.used <= c.limit {
+			return nil
+		}
+	}
+	// Measures the cache first, then evicts a bit more than needed not to walk it on every write
+	c.evicting = true
+	c.written = 0
+	c.evictions.Add(1)
+	go func() {
+		defer c.evictions.Done()
+		used := c.evict(c.limit - c.limit/10)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.used = used + c.written
+		c.evicting = false
+	}()
+	return nil
+}
+
+// diskChunk is a cached chunk, for eviction
+type diskChunk struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+// evict removes the least recently used chunks of every container below the cache directory,
+// once their size exceeds the limit, until it is at most target. It returns the size of the
+// remaining chunks.
+func (c *diskCache) evict(target int64) (used int64) {
+	var chunks []diskChunk
+	dir := filepath.Dir(c.root)
+	containers, _ := os.ReadDir(dir)
+	for _, container := range containers {
+		// Aliases are symlinks to the directories of containers
+		if !container.IsDir() {
+			continue
+		}
+		keys, _ := os.ReadDir(filepath.Join(dir, container.Name(), "chunks"))
+		for _, key := range keys {
+			keyDir := filepath.Join(dir, container.Name(), "chunks", key.Name())
+			entries, _ := os.ReadDir(keyDir)
+			for _, e := range entries {
+				info, err := e.Info()
+				// Skips chunks being written
+				if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".tmp-") {
+					continue
+				}
+				chunks = append(chunks, diskChunk{name: filepath.Join(keyDir, e.Name()), size: info.Size(), mtime: info.ModTime()})
+				used += info.Size()
+			}
+		}
+	}
+	if used <= c.limit {
+		return used
+	}
+
+	slices.SortFunc(chunks, func(a, b diskChunk) int { return a.mtime.Compare(b.mtime) })
+	for _, chunk := range chunks {
+		if used <= target {
+			break
+		}
+		if os.Remove(chunk.name) == nil {
+			used -= chunk.size
+			// Removes the directory of the file version once empty
+			os.Remove(filepath.Dir(chunk.name))
+		}
+	}
+	return used
+}
+
+// putAttr stores attributes of fullPath, unless they are on disk already
+func (c *diskCache) putAttr(fullPath string, attr *statAttr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.persisted[fullPath]; ok && old == *attr {
+		return nil
+	}
+	data, err := json.Marshal(diskAttr{Path: fullPath, statAttr: *attr})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.root, "attrs", pathHash(fullPath)+".json"), data); err != nil {
+		return err
+	}
+	c.persisted[fullPath] = *attr
+	if c.paths != nil {
+		c.paths[fullPath] = struct{}{}
+	}
+	return nil
+}
+
+// getAttr returns the last known attributes of fullPath
+func (c *diskCache) getAttr(fullPath string, attr *statAttr) (ok bool) {
+	data, err := os.ReadFile(filepath.Join(c.root, "attrs", pathHash(fullPath)+".json"))
+	if err != nil {
+		return false
+	}
+	var stored diskAttr
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Path != fullPath {
+		return false
+	}
+	*attr = stored.statAttr
+	return true
+}
+
+// removeAttr forgets fullPath, e.g. after it has been removed
+func (c *diskCache) removeAttr(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.persisted, fullPath)
+	os.Remove(filepath.Join(c.root, "attrs", pathHash(fullPath)+".json"))
+}
+
+// putDir stores the listing of fullPath, for the directory version identified by key
+func (c *diskCache) putDir(fullPath string, key string, entries []fuse.DirEntry) error {
+	data, err := json.Marshal(diskDirListing{Path: fullPath, Key: key, Entries: entries})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.root, "dirs", pathHash(fullPath)+".json"), data); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.paths != nil {
+		c.paths[fullPath] = struct{}{}
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// getDir returns the last known listing of fullPath, and the version of the directory it refers to
+func (c *diskCache) getDir(fullPath string) (key string, entries []fuse.DirEntry, ok bool) {
+	data, err := os.ReadFile(filepath.Join(c.root, "dirs", pathHash(fullPath)+".json"))
+	if err != nil {
+		return "", nil, false
+	}
+	var listing diskDirListing
+	if err := json.Unmarshal(data, &listing); err != nil || listing.Path != fullPath {
+		return "", nil, false
+	}
+	return listing.Key, listing.Entries, true
+}
+
+// removeTree forgets attributes and listings of fullPath and its descendants, e.g. after it has
+// been renamed. File names are hashes, so the paths on disk are loaded from the entries once.
+func (c *diskCache) removeTree(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paths == nil {
+		c.paths = c.loadPaths()
+	}
+	fullPath = filepath.Clean(fullPath)
+	prefix := strings.TrimSuffix(fullPath, "/") + "/"
+	for p := range c.paths {
+		if p != fullPath && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		delete(c.paths, p)
+		delete(c.persisted, p)
+		os.Remove(filepath.Join(c.root, "attrs", pathHash(p)+".json"))
+		os.Remove(filepath.Join(c.root, "dirs", pathHash(p)+".json"))
+	}
+}
+
+// loadPaths reads the paths of the attributes and listings on disk
+func (c *diskCache) loadPaths() map[string]struct{} {
+	paths := make(map[string]struct{})
+	for _, sub := range []string{"attrs", "dirs"} {
+		files, _ := filepath.Glob(filepath.Join(c.root, sub, "*.json"))
+		for _, name := range files {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				continue
+			}
+			var entry struct{ Path string }
+			if json.Unmarshal(data, &entry) == nil && entry.Path != "" {
+				paths[entry.Path] = struct{}{}
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheChunks(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), "0123abcd", "", 0)
+	assert.NoError(t, err)
+
+	key := contentKey(&fuse.Attr{Ino: 3, Size: 5, Mtime: 10, Mtimensec: 20})
+	assert.Equal(t, "3-5-10000000020", key)
+
+	_, ok := c.readChunk(key, 0)
+	assert.False(t, ok)
+	assert.NoError(t, c.writeChunk(key, 0, []byte("hello")))
+	data, ok := c.readChunk(key, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), data)
+
+	// A different version of the file does not hit
+	_, ok = c.readChunk(contentKey(&fuse.Attr{Ino: 3, Size: 5, Mtime: 11}), 0)
+	assert.False(t, ok)
+}
+
+func TestDiskCacheAttrsAndDirs(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, "0123abcd", "web", 0)
+	assert.NoError(t, err)
+
+	var attr statAttr
+	assert.False(t, c.getAttr("/l", &attr))
+	assert.NoError(t, c.putAttr("/l", &statAttr{FuseAttr: fuse.Attr{Ino: 4}, LinkTarget: "/t"}))
+	assert.True(t, c.getAttr("/l", &attr))
+	assert.Equal(t, statAttr{FuseAttr: fuse.Attr{Ino: 4}, LinkTarget: "/t"}, attr)
+	c.removeAttr("/l")
+	assert.False(t, c.getAttr("/l", &attr))
+
+	entries := []fuse.DirEntry{{Ino: 4, Name: "l", Mode: fuse.S_IFLNK}}
+	assert.NoError(t, c.putDir("/", "2-0-1", entries))
+	key, got, ok := c.getDir("/")
+	assert.True(t, ok)
+	assert.Equal(t, "2-0-1", key)
+	assert.Equal(t, entries, got)
+
+	// The cache can be reopened later through the container name
+	reopened, err := openDiskCache(dir, "web")
+	assert.NoError(t, err)
+	_, got, ok = reopened.getDir("/")
+	assert.True(t, ok)
+	assert.Equal(t, entries, got)
+
+	_, err = openDiskCache(dir, "other")
+	assert.Error(t, err)
+}
+
+func TestDiskCacheRemoveTree(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, "0123abcd", "", 0)
+	assert.NoError(t, err)
+	for _, p := range []string{"/d", "/d/f", "/d/sub/g", "/dd"} {
+		assert.NoError(t, c.putAttr(p, &statAttr{}))
+	}
+	assert.NoError(t, c.putDir("/d/sub", "1-0-1", nil))
+
+	// Entries written by a previous session are found as well
+	c, err = openDiskCache(dir, "0123abcd")
+	assert.NoError(t, err)
+	c.removeTree("/d")
+
+	var attr statAttr
+	for _, p := range []string{"/d", "/d/f", "/d/sub/g"} {
+		assert.False(t, c.getAttr(p, &attr), p)
+	}
+	_, _, ok := c.getDir("/d/sub")
+	assert.False(t, ok)
+	assert.True(t, c.getAttr("/dd", &attr))
+
+	// Entries written after the paths were loaded are tracked too
+	assert.NoError(t, c.putAttr("/d/h", &statAttr{}))
+	c.removeTree("/d")
+	assert.False(t, c.getAttr("/d/h", &attr))
+}
+
+func TestDiskCachePutAttrSkipsUnchanged(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), "0123abcd", "", 0)
+	assert.NoError(t, err)
+
+	attrFile := filepath.Join(c.root, "attrs", pathHash("/f")+".json")
+	assert.NoError(t, c.putAttr("/f", &statAttr{FuseAttr: fuse.Attr{Ino: 1}}))
+	assert.NoError(t, os.Remove(attrFile))
+
+	// Unchanged attributes are not written again
+	assert.NoError(t, c.putAttr("/f", &statAttr{FuseAttr: fuse.Attr{Ino: 1}}))
+	assert.NoFileExists(t, attrFile)
+	assert.NoError(t, c.putAttr("/f", &statAttr{FuseAttr: fuse.Attr{Ino: 2}}))
+	assert.FileExists(t, attrFile)
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, "0123abcd", "", 10)
+	assert.NoError(t, err)
+	other, err := newDiskCache(dir, "4567ef01", "", 0)
+	assert.NoError(t, err)
+
+	// Chunks of every container sharing the directory count towards the limit
+	assert.NoError(t, other.writeChunk("1-4-0", 0, []byte("aaaa")))
+	assert.NoError(t, c.writeChunk("2-4-0", 0, []byte("bbbb")))
+	c.evictions.Wait() // The first write measures the cache
+	assert.Equal(t, int64(8), c.used)
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(other.chunkPath("1-4-0", 0), old, old))
+	assert.NoError(t, os.Chtimes(c.chunkPath("2-4-0", 0), old.Add(time.Minute), old.Add(time.Minute)))
+
+	// Eviction runs in the background
+	assert.NoError(t, c.writeChunk("3-4-0", 0, []byte("cccc")))
+	c.evictions.Wait()
+	assert.Equal(t, int64(8), c.used)
+	_, ok := other.readChunk("1-4-0", 0)
+	assert.False(t, ok)
+	assert.NoDirExists(t, filepath.Dir(other.chunkPath("1-4-0", 0)))
+	_, ok = c.readChunk("2-4-0", 0)
+	assert.True(t, ok)
+	_, ok = c.readChunk("3-4-0", 0)
+	assert.True(t, ok)
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// dockerBackend runs the satellite through the Docker API: it is copied in the container (or
+// loaded in memory) and runs as an exec process, whose hijacked stream carries RPCs. Podman serves
+// it through its compatible API.
+type dockerBackend struct {
+	satellitePlacement
+	dockerClient dockerClient
+	containerID  string
+	// Check the architecture of the running container, rather than trusting image metadata
+	archDetection bool
+
+	// Set by Resolve
+	inspect container.InspectResponse
+}
+
+// dockerSatellite is a satellite running as an exec process
+type dockerSatellite struct {
+	types.HijackedResponse
+	dockerClient dockerClient
+	execID       string
+}
+
+// newDockerBackend returns the backend of the docker runtime, for the daemon (or engine) config
+// selects
+func newDockerBackend(containerID string, config BackendConfig) (Backend, error) {
+	endpoint, err := resolveDockerEndpoint(config.Docker)
+	if err != nil {
+		return nil, err
+	}
+	docker, err := newDockerAPIClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return newDockerAPIBackend(docker, containerID, config), nil
+}
+
+// newDockerAPIBackend returns the backend serving containerID through docker
+func newDockerAPIBackend(docker dockerClient, containerID string, config BackendConfig) *dockerBackend {
+	d := &dockerBackend{dockerClient: docker, containerID: containerID, archDetection: config.ArchDetection}
+	d.satellitePlacement = newSatellitePlacement(d, containerID, config)
+	return d
+}
+
+// newDockerAPIClient connects to the Docker daemon (or podman) at endpoint
+func newDockerAPIClient(endpoint dockerEndpoint) (dockerClient, error) {
+	clientOpts, err := dockerClientOpts(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	version := os.Getenv("DOCKER_API_VERSION")
+	if version != "" {
+		clientOpts = append(clientOpts, client.WithVersion(version))
+	} else {
+		clientOpts = append(clientOpts, client.WithAPIVersionNegotiation())
+	}
+	docker, err := dockerCF.NewClientWithOpts(clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.podman {
+		slog.Debug("using the podman API", "host", endpoint.host)
+		return newPodmanClient(docker, endpoint.host)
+	}
+	return docker, nil
+}
+
+// Resolve inspects the container
+func (d *dockerBackend) Resolve(ctx context.Context) (Target, error) {
+	inspect, err := d.dockerClient.ContainerInspect(ctx, d.containerID)
+	if err != nil {
+		return Target{}, err
+	}
+	d.inspect = inspect
+	return Target{ID: inspect.ID}, nil
+}
+
+// Arch returns the architecture of the image, or with archDetection the one the container actually
+// runs on
+func (d *dockerBackend) Arch(ctx context.Context) (arch string, variant string, err error) {
+	imageInspect, _, err := d.dockerClient.ImageInspectWithRaw(ctx, d.inspect.Image)
+	if err != nil {
+		return "", "", err
+	}
+	arch, variant = imageInspect.Architecture, imageInspect.Variant
+	if !d.archDetection {
+		return arch, variant, nil
+	}
+	entrypoint := d.inspect.Path
+	if !filepath.IsAbs(entrypoint) {
+		entrypoint = "/bin/sh"
+	}
+	detected, detectedVariant, err := d.detectArch(ctx, entrypoint)
+	switch {
+	case err != nil:
+		slog.Warn("cannot detect container architecture, using image metadata", "error", err)
+	case detected == "arm" && detectedVariant == "" && arch == "arm":
+		// The ELF header doesn't tell ARM variants apart: keep the one from the image
+	case detected != arch || detectedVariant != variant:
+		slog.Info("container architecture differs from image metadata",
+			"image", strings.TrimSuffix(arch+"/"+variant, "/"), "detected", strings.TrimSuffix(detected+"/"+detectedVariant, "/"))
+		arch, variant = detected, detectedVariant
+	}
+	return arch, variant, nil
+}
+
+// PlaceSatellite copies the satellite in the first usable candidate directory, then in a writable
+// volume. As a last resort, containers shipping python3 have it loaded in memory.
+func (d *dockerBackend) PlaceSatellite(ctx context.Context, satellite Satellite) error {
+	var volumes []string
+	for _, m := range d.inspect.Mounts {
+		// Bind mounts are host directories, possibly the user's: the satellite is not left there
+		if m.RW && m.Type != mount.TypeBind {
+			volumes = append(volumes, m.Destination)
+		}
+	}
+	if err := d.place(ctx, satellite, volumes); err != nil {
+		return fmt.Errorf("%w, or use -access archive for read-only access", err)
+	}
+	return nil
+}
+
+// statPath stats fullPath in the container
+func (d *dockerBackend) statPath(ctx context.Context, fullPath string) (container.PathStat, error) {
+	return d.dockerClient.ContainerStatPath(ctx, d.containerID, fullPath)
+}
+
+// extract unpacks archive in dir, in the container
+func (d *dockerBackend) extract(ctx context.Context, dir string, archive io.Reader) error {
+	return d.dockerClient.CopyToContainer(ctx, d.containerID, dir, archive, container.CopyToContainerOptions{})
+}
+
+// output runs a command in the container and returns its standard output
+func (d *dockerBackend) output(ctx context.Context, cmd ...string) (stdout string, err error) {
+	config := container.ExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	}
+	execID, err := d.dockerClient.ContainerExecCreate(ctx, d.containerID, config)
+	if err != nil {
+		return
+	}
+	hl, err := d.dockerClient.ContainerExecAttach(ctx, execID.ID, container.ExecStartOptions{})
+	if err != nil {
+		return
+	}
+	defer hl.Close()
+
+	var buf bytes.Buffer
+	if _, err = stdcopy.StdCopy(&buf, io.Discard, hl.Reader); err != nil {
+		return
+	}
+	return buf.String(), nil
+}
+
+// start runs cmd as an exec process, attached raw
+func (d *dockerBackend) start(ctx context.Context, cmd []string) (SatelliteConn, error) {
+	config := container.ExecOptions{
+		AttachStderr: false,
+		AttachStdout: true,
+		AttachStdin:  true,
+		Tty:          false,
+		Cmd:          cmd,
+	}
+	execID, err := d.dockerClient.ContainerExecCreate(ctx, d.containerID, config)
+	if err != nil {
+		return nil, err
+	}
+	hl, err := d.dockerClient.ContainerExecAttach(ctx, execID.ID, container.ExecStartOptions{Tty: true})
+	if err != nil {
+		return nil, err
+	}
+	return &dockerSatellite{HijackedResponse: hl, dockerClient: d.dockerClient, execID: execID.ID}, nil
+}
+
+// Events returns Docker events, for WatchLifecycle
+func (d *dockerBackend) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	return d.dockerClient.Events(ctx, options)
+}
+
+func (s *dockerSatellite) Read(p []byte) (int, error)  { return s.Conn.Read(p) }
+func (s *dockerSatellite) Write(p []byte) (int, error) { return s.Conn.Write(p) }
+func (s *dockerSatellite) Close() error                { return s.Conn.Close() }
+
+// Stop closes the satellite input and waits for it to exit, up to ctx. Without half-close,
+// closing the connection is the best that can be done.
+func (s *dockerSatellite) Stop(ctx context.Context) error {
+	if _, ok := s.Conn.(types.CloseWriter); !ok {
+		return nil
+	}
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("cannot close the satellite input: %w", err)
+	}
+	for {
+		inspect, err := s.dockerClient.ContainerExecInspect(ctx, s.execID)
+		if err != nil {
+			return fmt.Errorf("satellite did not exit: %w", err)
+		}
+		if !inspect.Running {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("satellite did not exit: %w", ctx.Err())
+		case <-time.After(satelliteExitPoll):
+		}
+	}
+}
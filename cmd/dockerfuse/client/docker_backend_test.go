@@ -0,0 +1,165 @@
+package client
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+)
+
+// dockerAPIVersion matches the API version prefix of Docker API paths
+var dockerAPIVersion = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// fakeDockerExec is an exec process of the fake Docker API
+type fakeDockerExec struct {
+	options container.ExecOptions
+	running bool
+	exit    int
+}
+
+// fakeDockerAPI serves the running container id on a unix socket, as dockerd does, and returns the
+// host to connect to. Its filesystem is the local one, where exec processes are run with run.
+func fakeDockerAPI(t *testing.T, id string, run func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int) string {
+	var (
+		mu    sync.Mutex
+		execs = make(map[string]*fakeDockerExec)
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.47")
+		io.WriteString(w, "OK")
+	})
+	mux.HandleFunc("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != id {
+			http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"Id":%q,"Image":"sha256:5e5e","Path":"/bin/sh","State":{"Status":"running","Running":true}}`, id)
+	})
+	mux.HandleFunc("GET /images/sha256:5e5e/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Id":"sha256:5e5e","Architecture":%q,"Os":"linux"}`, runtime.GOARCH)
+	})
+	mux.HandleFunc("HEAD /containers/{id}/archive", func(w http.ResponseWriter, r *http.Request) {
+		info, err := os.Lstat(r.URL.Query().Get("path"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		libpodStat(w, container.PathStat{Name: info.Name(), Size: info.Size(), Mode: info.Mode(), Mtime: info.ModTime()})
+	})
+	mux.HandleFunc("PUT /containers/{id}/archive", func(w http.ResponseWriter, r *http.Request) {
+		if err := untar(r.Body, r.URL.Query().Get("path")); err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, err), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("POST /containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		var options container.ExecOptions
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&options))
+		mu.Lock()
+		execID := fmt.Sprintf("exec%d", len(execs))
+		execs[execID] = &fakeDockerExec{options: options}
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, execID)
+	})
+	mux.HandleFunc("POST /exec/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		var start container.ExecStartOptions
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&start))
+		mu.Lock()
+		e := execs[r.PathValue("id")]
+		e.running = true
+		mu.Unlock()
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		// As dockerd does, the stream is raw when the client asks for a TTY, else multiplexed
+		contentType := "application/vnd.docker.multiplexed-stream"
+		if start.Tty {
+			contentType = "application/vnd.docker.raw-stream"
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: %s\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n", contentType)
+		var stdin io.Reader = strings.NewReader("")
+		if e.options.AttachStdin {
+			stdin = rw.Reader
+		}
+		var stdout, stderr io.Writer = conn, io.Discard
+		if !start.Tty {
+			stdout, stderr = stdcopy.NewStdWriter(conn, stdcopy.Stdout), stdcopy.NewStdWriter(conn, stdcopy.Stderr)
+		}
+		if !e.options.AttachStdout {
+			stdout = io.Discard
+		}
+		if !e.options.AttachStderr {
+			stderr = io.Discard
+		}
+		exit := run(e.options.Cmd, stdin, stdout, stderr)
+		mu.Lock()
+		e.running, e.exit = false, exit
+		mu.Unlock()
+	})
+	mux.HandleFunc("GET /exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		e := execs[r.PathValue("id")]
+		fmt.Fprintf(w, `{"ID":%q,"Running":%t,"ExitCode":%d}`, r.PathValue("id"), e.running, e.exit)
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = dockerAPIVersion.ReplaceAllString(r.URL.Path, "/")
+		mux.ServeHTTP(w, r)
+	}))
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+	return "unix://" + socket
+}
+
+// untar unpacks the directories and regular files of archive in dir, as copies to containers do
+func untar(archive io.Reader, dir string) error {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, fs.FileMode(hdr.Mode))
+		case tar.TypeReg:
+			var f *os.File
+			if f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(hdr.Mode)); err == nil {
+				_, err = io.Copy(f, tr)
+				f.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// DefaultDockerContext is the context of the Docker CLI using DOCKER_HOST, or the local daemon
+const DefaultDockerContext = "default"
+
+// DockerConfig selects the Docker daemon, as the docker CLI flags do. Unset fields are resolved as
+// the docker CLI does: from DOCKER_HOST, DOCKER_CONTEXT, and the current context of the docker CLI
+// configuration (DOCKER_CONFIG, or ~/.docker).
+type DockerConfig struct {
+	// Daemon address (e.g. tcp://build:2376, ssh://user@build), overriding contexts
+	Host string
+	// Docker CLI context
+	Context string
+	// EngineDocker or EnginePodman. By default, Podman is used when its socket is found, the Docker
+	// one is not, and no other daemon is selected.
+	Engine string
+	// Use TLS and verify the daemon certificate
+	TLSVerify bool
+	// TLS files, by default ca.pem, cert.pem and key.pem in DOCKER_CERT_PATH, or in the docker CLI
+	// configuration directory. Setting any of them enables TLS.
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+}
+
+// dockerEndpoint is a Docker daemon resolved from DockerConfig
+type dockerEndpoint struct {
+	// Empty for the local daemon
+	host          string
+	tls           bool
+	caCert        string
+	cert          string
+	key           string
+	skipTLSVerify bool
+	// Served by Podman
+	podman bool
+}
+
+// contextMeta is the part of the metadata of a docker CLI context used here
+type contextMeta struct {
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+}
+
+// WithDocker selects the Docker daemon
+func WithDocker(config DockerConfig) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendConfig.Docker = config
+	}
+}
+
+// dockerConfigDir returns the directory of the docker CLI configuration
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// dockerContextName returns the docker CLI context to use, in the same order as the docker CLI
+func dockerContextName(config DockerConfig) (string, error) {
+	switch {
+	case config.Context != "" && config.Host != "":
+		return "", errors.New("conflicting options: either specify a host or a context, not both")
+	case config.Context != "":
+		return config.Context, nil
+	case config.Host != "" || os.Getenv(client.EnvOverrideHost) != "":
+		return DefaultDockerContext, nil
+	case os.Getenv("DOCKER_CONTEXT") != "":
+		return os.Getenv("DOCKER_CONTEXT"), nil
+	}
+	data, err := os.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return DefaultDockerContext, nil
+	} else if err != nil {
+		return "", err
+	}
+	var cliConfig struct{ CurrentContext string }
+	if err := json.Unmarshal(data, &cliConfig); err != nil {
+		return "", fmt.Errorf("cannot read the docker CLI configuration: %s", err)
+	}
+	if cliConfig.CurrentContext == "" {
+		return DefaultDockerContext, nil
+	}
+	return cliConfig.CurrentContext, nil
+}
+
+// resolveDockerEndpoint returns the Docker daemon selected by config
+func resolveDockerEndpoint(config DockerConfig) (endpoint dockerEndpoint, err error) {
+	name, err := dockerContextName(config)
+	if err != nil {
+		return endpoint, err
+	}
+	certDir := os.Getenv(client.EnvOverrideCertPath)
+	if certDir == "" {
+		certDir = dockerConfigDir()
+	}
+	switch config.Engine {
+	case "", EngineDocker, EnginePodman:
+	default:
+		return endpoint, fmt.Errorf("unknown engine %q (supported: %s, %s)", config.Engine, EngineDocker, EnginePodman)
+	}
+	endpoint.podman = config.Engine == EnginePodman
+	if name == DefaultDockerContext {
+		endpoint.host = config.Host
+		if endpoint.host == "" {
+			endpoint.host = os.Getenv(client.EnvOverrideHost)
+		}
+		if socket := podmanSocket(); endpoint.host == "" && socket != "" &&
+			(endpoint.podman || (config.Engine == "" && !fileExists(dockerSocket))) {
+			endpoint.host = "unix://" + socket
+			endpoint.podman = true
+		}
+	} else {
+		// Contexts are stored by the digest of their name
+		digest := sha256.Sum256([]byte(name))
+		id := hex.EncodeToString(digest[:])
+		data, err := os.ReadFile(filepath.Join(dockerConfigDir(), "contexts", "meta", id, "meta.json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return endpoint, fmt.Errorf("docker context %q not found", name)
+		} else if err != nil {
+			return endpoint, err
+		}
+		var meta contextMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return endpoint, fmt.Errorf("cannot read docker context %q: %s", name, err)
+		}
+		docker, ok := meta.Endpoints["docker"]
+		if !ok {
+			return endpoint, fmt.Errorf("docker context %q has no docker endpoint", name)
+		}
+		endpoint.host = docker.Host
+		endpoint.skipTLSVerify = docker.SkipTLSVerify
+		certDir = filepath.Join(dockerConfigDir(), "contexts", "tls", id, "docker")
+		endpoint.tls = fileExists(filepath.Join(certDir, "ca.pem")) || fileExists(filepath.Join(certDir, "cert.pem"))
+	}
+
+	if config.TLSVerify || config.TLSCACert != "" || config.TLSCert != "" || config.TLSKey != "" {
+		endpoint.tls = true
+		endpoint.skipTLSVerify = !config.TLSVerify
+	}
+	if !endpoint.tls {
+		return endpoint, nil
+	}
+	// Missing files are looked for in the certificate directory, as the docker CLI does
+	endpoint.caCert = certFile(config.TLSCACert, certDir, "ca.pem")
+	endpoint.cert = certFile(config.TLSCert, certDir, "cert.pem")
+	endpoint.key = certFile(config.TLSKey, certDir, "key.pem")
+	return endpoint, nil
+}
+
+// certFile returns path, or name in dir if it exists
+func certFile(path string, dir string, name string) string {
+	if path != "" || !fileExists(filepath.Join(dir, name)) {
+		return path
+	}
+	return filepath.Join(dir, name)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// dockerClientOpts returns the options of the Docker API client connecting to endpoint
+func dockerClientOpts(endpoint dockerEndpoint) ([]client.Opt, error) {
+	// The environment also sets TLS for the local daemon, and the API version
+	opts := []client.Opt{client.FromEnv}
+	if strings.HasPrefix(endpoint.host, "ssh://") {
+		helper, err := connhelper.GetConnectionHelper(endpoint.host)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				DialContext: helper.Dialer,
+			},
+		}
+
+		return append(opts,
+			client.WithHTTPClient(httpClient),
+			client.WithHost(helper.Host),
+			client.WithDialContext(helper.Dialer),
+		), nil
+	}
+	if endpoint.tls {
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             endpoint.caCert,
+			CertFile:           endpoint.cert,
+			KeyFile:            endpoint.key,
+			InsecureSkipVerify: endpoint.skipTLSVerify,
+			ExclusiveRootPools: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot configure TLS: %s", err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			// Redirects are not followed, as in the default client
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	if endpoint.host != "" {
+		opts = append(opts, client.WithHost(endpoint.host))
+	}
+	return opts, nil
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeDockerContext stores a docker CLI context below configDir, with TLS files if tls is set
+func writeDockerContext(t *testing.T, configDir string, name string, host string, tls bool) string {
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+	metaDir := filepath.Join(configDir, "contexts", "meta", id)
+	assert.NoError(t, os.MkdirAll(metaDir, 0755))
+	meta := `{"Name":"` + name + `","Endpoints":{"docker":{"Host":"` + host + `","SkipTLSVerify":false}}}`
+	assert.NoError(t, os.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0644))
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if tls {
+		assert.NoError(t, os.MkdirAll(tlsDir, 0755))
+		for _, f := range []string{"ca.pem", "cert.pem", "key.pem"} {
+			assert.NoError(t, os.WriteFile(filepath.Join(tlsDir, f), nil, 0600))
+		}
+	}
+	return tlsDir
+}
+
+func TestResolveDockerEndpoint(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	// Without configuration, the local daemon is used
+	endpoint, err := resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{}, endpoint)
+
+	// The current context of the docker CLI is used
+	tlsDir := writeDockerContext(t, configDir, "build", "tcp://build:2376", true)
+	writeDockerContext(t, configDir, "staging", "ssh://deploy@staging", false)
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"build"}`), 0644))
+	endpoint, err = resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{
+		host: "tcp://build:2376", tls: true,
+		caCert: filepath.Join(tlsDir, "ca.pem"), cert: filepath.Join(tlsDir, "cert.pem"), key: filepath.Join(tlsDir, "key.pem"),
+	}, endpoint)
+
+	// DOCKER_CONTEXT overrides the current context, and the context option overrides both
+	t.Setenv("DOCKER_CONTEXT", "staging")
+	endpoint, err = resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "ssh://deploy@staging"}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Context: "build"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://build:2376", endpoint.host)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Context: DefaultDockerContext})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{}, endpoint)
+
+	// DOCKER_HOST and the host option override contexts
+	t.Setenv("DOCKER_HOST", "unix:///run/user/1000/docker.sock")
+	endpoint, err = resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "unix:///run/user/1000/docker.sock"}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Host: "tcp://other:2375"})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "tcp://other:2375"}, endpoint)
+
+	// TLS files are looked for in DOCKER_CERT_PATH, unless given
+	certDir := t.TempDir()
+	t.Setenv("DOCKER_CERT_PATH", certDir)
+	assert.NoError(t, os.WriteFile(filepath.Join(certDir, "ca.pem"), nil, 0644))
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Host: "tcp://other:2376", TLSVerify: true, TLSCert: "/certs/me.pem", TLSKey: "/certs/me.key"})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{
+		host: "tcp://other:2376", tls: true, caCert: filepath.Join(certDir, "ca.pem"), cert: "/certs/me.pem", key: "/certs/me.key",
+	}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Host: "tcp://other:2376", TLSCACert: "/certs/ca.pem"})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "tcp://other:2376", tls: true, caCert: "/certs/ca.pem", skipTLSVerify: true}, endpoint)
+
+	_, err = resolveDockerEndpoint(DockerConfig{Context: "build", Host: "tcp://other:2375"})
+	assert.EqualError(t, err, "conflicting options: either specify a host or a context, not both")
+	_, err = resolveDockerEndpoint(DockerConfig{Context: "missing"})
+	assert.EqualError(t, err, `docker context "missing" not found`)
+	_, err = resolveDockerEndpoint(DockerConfig{Engine: "lxc"})
+	assert.EqualError(t, err, `unknown engine "lxc" (supported: docker, podman)`)
+}
+
+func TestResolvePodmanEndpoint(t *testing.T) {
+	defer func(socket string) { dockerSocket = socket }(dockerSocket)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	socket := filepath.Join(runtimeDir, "podman", "podman.sock")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(socket), 0755))
+	assert.NoError(t, os.WriteFile(socket, nil, 0600))
+
+	// The rootless Podman socket is used when Docker is not there
+	dockerSocket = filepath.Join(t.TempDir(), "docker.sock")
+	endpoint, err := resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "unix://" + socket, podman: true}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Engine: EngineDocker})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{}, endpoint)
+
+	// Docker wins, unless Podman is asked for
+	assert.NoError(t, os.WriteFile(dockerSocket, nil, 0600))
+	endpoint, err = resolveDockerEndpoint(DockerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Engine: EnginePodman})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "unix://" + socket, podman: true}, endpoint)
+	endpoint, err = resolveDockerEndpoint(DockerConfig{Engine: EnginePodman, Host: "tcp://podman:8080"})
+	assert.NoError(t, err)
+	assert.Equal(t, dockerEndpoint{host: "tcp://podman:8080", podman: true}, endpoint)
+}
+
+func TestDockerClientOpts(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+
+	for _, host := range []string{"tcp://build:2375", "ssh://deploy@staging"} {
+		opts, err := dockerClientOpts(dockerEndpoint{host: host})
+		assert.NoError(t, err)
+		docker, err := client.NewClientWithOpts(opts...)
+		if assert.NoError(t, err) {
+			assert.NotEqual(t, client.DefaultDockerHost, docker.DaemonHost())
+		}
+	}
+
+	opts, err := dockerClientOpts(dockerEndpoint{host: "tcp://build:2376", tls: true, skipTLSVerify: true})
+	assert.NoError(t, err)
+	docker, err := client.NewClientWithOpts(opts...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tcp://build:2376", docker.DaemonHost())
+	}
+
+	_, err = dockerClientOpts(dockerEndpoint{host: "tcp://build:2376", tls: true, caCert: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.ErrorContains(t, err, "cannot configure TLS")
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// WatchChanges listens for changes made inside the container and invalidates the related
+// kernel caches, so that they are visible on the host immediately. It blocks until ctx is
+// done or the satellite stops sending changes.
+func (node *Node) WatchChanges(ctx context.Context) error {
+	return node.fuseDockerClient.watchChanges(ctx, node.applyChanges)
+}
+
+// applyChanges turns container-side changes into kernel notifications on known inodes
+func (node *Node) applyChanges(events []rpccommon.ChangeEvent, overflow bool) {
+	if overflow {
+		slog.Warn("change events lost, invalidating all cached entries")
+		invalidateInodeTree(node.EmbeddedInode())
+	}
+
+	for _, event := range events {
+		rel, err := filepath.Rel(node.fullPath, event.FullPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue // Outside of the mounted path
+		}
+		if rel == "." {
+			kernelNotifier.NotifyContent(node.EmbeddedInode(), 0, 0)
+			continue
+		}
+
+		// Only inodes the kernel knows about need invalidation
+		parent := node.EmbeddedInode()
+		dir, name := filepath.Split(rel)
+		for _, component := range strings.Split(filepath.Clean(dir), "/") {
+			if component == "." {
+				continue
+			}
+			if parent = parent.GetChild(component); parent == nil {
+				break
+			}
+		}
+		if parent == nil {
+			continue
+		}
+
+		slog.Debug("container-side change", "path", event.FullPath, "op", event.Op)
+		child := parent.GetChild(name)
+		switch {
+		case event.Op&rpccommon.CHANGE_DELETE != 0:
+			if child != nil {
+				kernelNotifier.NotifyDelete(parent, name, child)
+				parent.RmChild(name)
+			} else {
+				kernelNotifier.NotifyEntry(parent, name)
+			}
+		case event.Op&rpccommon.CHANGE_CREATE != 0:
+			// Drops negative entries and entries replaced by a rename
+			kernelNotifier.NotifyEntry(parent, name)
+		case child != nil:
+			kernelNotifier.NotifyContent(child, 0, 0)
+		}
+	}
+}
+
+// invalidateInodeTree drops kernel entries and cached content below inode
+func invalidateInodeTree(inode *fusefs.Inode) {
+	kernelNotifier.NotifyContent(inode, 0, 0)
+	for name, child := range inode.Children() {
+		invalidateInodeTree(child)
+		kernelNotifier.NotifyEntry(inode, name)
+	}
+}
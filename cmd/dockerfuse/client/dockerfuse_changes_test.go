@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// addTestChild attaches a child node to parent, as Lookup would
+func addTestChild(parent *Node, name string, mode uint32, ino uint64) *Node {
+	child := parent.newChild(parent.fullPath+"/"+name, "")
+	inode := parent.NewPersistentInode(context.Background(), child, fusefs.StableAttr{Mode: mode, Ino: ino})
+	parent.AddChild(name, inode, true)
+	return child
+}
+
+func TestNodeWatchChanges(t *testing.T) {
+	var m mockFuseDockerClient
+	root := NewNode(&m, "/root", "")
+	m.On("watchChanges", mock.Anything, mock.Anything).Return(context.Canceled)
+	assert.Equal(t, context.Canceled, root.WatchChanges(context.Background()))
+	m.AssertExpectations(t)
+}
+
+func TestNodeApplyChanges(t *testing.T) {
+	var (
+		m  mockFuseDockerClient
+		mN mockNotifier
+	)
+	kernelNotifier = &mN
+	defer func() { kernelNotifier = &fuseNotifier{} }()
+
+	root := NewNode(&m, "/app", "")
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	dir := addTestChild(root, "dir", fuse.S_IFDIR, 2)
+	file := addTestChild(dir, "file", fuse.S_IFREG, 3)
+	gone := addTestChild(dir, "gone", fuse.S_IFREG, 4)
+
+	mN.On("NotifyContent", file.EmbeddedInode(), int64(0), int64(0)).Return(syscall.Errno(0)).Once()
+	mN.On("NotifyEntry", dir.EmbeddedInode(), "new").Return(syscall.Errno(0)).Once()
+	mN.On("NotifyDelete", dir.EmbeddedInode(), "gone", gone.EmbeddedInode()).Return(syscall.Errno(0)).Once()
+	mN.On("NotifyContent", root.EmbeddedInode(), int64(0), int64(0)).Return(syscall.Errno(0)).Once()
+
+	root.applyChanges([]rpccommon.ChangeEvent{
+		{FullPath: "/app/dir/file", Op: rpccommon.CHANGE_MODIFY},
+		{FullPath: "/app/dir/new", Op: rpccommon.CHANGE_CREATE},
+		{FullPath: "/app/dir/gone", Op: rpccommon.CHANGE_DELETE},
+		{FullPath: "/app", Op: rpccommon.CHANGE_ATTRIB},
+		// Ignored: unknown to the kernel, or outside of the mount
+		{FullPath: "/app/unknown/file", Op: rpccommon.CHANGE_DELETE},
+		{FullPath: "/app/dir/unknown", Op: rpccommon.CHANGE_MODIFY},
+		{FullPath: "/other/file", Op: rpccommon.CHANGE_MODIFY},
+	}, false)
+
+	assert.Nil(t, dir.GetChild("gone"))
+	mN.AssertExpectations(t)
+}
+
+func TestNodeApplyChangesOverflow(t *testing.T) {
+	var (
+		m  mockFuseDockerClient
+		mN mockNotifier
+	)
+	kernelNotifier = &mN
+	defer func() { kernelNotifier = &fuseNotifier{} }()
+
+	root := NewNode(&m, "/", "")
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	dir := addTestChild(root, "dir", fuse.S_IFDIR, 2)
+
+	mN.On("NotifyContent", root.EmbeddedInode(), int64(0), int64(0)).Return(syscall.Errno(0)).Once()
+	mN.On("NotifyContent", dir.EmbeddedInode(), int64(0), int64(0)).Return(syscall.Errno(0)).Once()
+	mN.On("NotifyEntry", root.EmbeddedInode(), "dir").Return(syscall.Errno(0)).Once()
+
+	root.applyChanges(nil, true)
+	mN.AssertExpectations(t)
+}
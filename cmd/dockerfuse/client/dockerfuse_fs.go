@@ -4,7 +4,12 @@ import (
 	"context"
 	"io/fs"
 	"log/slog"
+	"maps"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -15,7 +20,9 @@ var _ = (fusefs.NodeCreater)((*Node)(nil))
 var _ = (fusefs.NodeFlusher)((*Node)(nil))
 var _ = (fusefs.NodeFsyncer)((*Node)(nil))
 var _ = (fusefs.NodeGetattrer)((*Node)(nil))
+var _ = (fusefs.NodeGetxattrer)((*Node)(nil))
 var _ = (fusefs.NodeLinker)((*Node)(nil))
+var _ = (fusefs.NodeListxattrer)((*Node)(nil))
 var _ = (fusefs.NodeLookuper)((*Node)(nil))
 var _ = (fusefs.NodeLseeker)((*Node)(nil))
 var _ = (fusefs.NodeMkdirer)((*Node)(nil))
@@ -31,6 +38,17 @@ var _ = (fusefs.NodeSymlinker)((*Node)(nil))
 var _ = (fusefs.NodeUnlinker)((*Node)(nil))
 var _ = (fusefs.NodeWriter)((*Node)(nil))
 
+// NodeOptions holds settings shared by all the nodes of a mounted filesystem
+type NodeOptions struct {
+	// KernelCache lets the kernel page cache hold file contents (needed for mmap).
+	// When false, files are always opened with direct I/O.
+	KernelCache bool
+	// DirectIOPaths lists container paths (e.g., /proc) that always use direct I/O,
+	// as their size and mtime do not reflect their content. Paths may have wildcards, as in
+	// path.Match.
+	DirectIOPaths []string
+}
+
 // Node is a filesystem node used by dockerfuse to represent directories, files or links
 type Node struct {
 	fusefs.Inode
@@ -38,14 +56,88 @@ type Node struct {
 	Data             []byte
 	fullPath         string
 	fuseDockerClient DockerFuseClientInterface
+	opts             *NodeOptions
+
+	// Attributes seen the last time the node content was validated against the container
+	mu           sync.Mutex
+	cachedAttr   fuse.Attr
+	hasCacheAttr bool
 }
 
 // NewNode creates a new Node
 func NewNode(fuseDockerClient DockerFuseClientInterface, fullPath string, linkTarget string) *Node {
+	return NewNodeWithOptions(fuseDockerClient, fullPath, linkTarget, NodeOptions{})
+}
+
+// NewNodeWithOptions creates a new Node whose children share the given options
+func NewNodeWithOptions(fuseDockerClient DockerFuseClientInterface, fullPath string, linkTarget string, opts NodeOptions) *Node {
 	return &Node{
 		Data:             []byte(linkTarget),
 		fullPath:         fullPath,
 		fuseDockerClient: fuseDockerClient,
+		opts:             &opts,
+	}
+}
+
+// newChild creates a Node sharing client and options with node
+func (node *Node) newChild(fullPath string, linkTarget string) *Node {
+	return &Node{
+		Data:             []byte(linkTarget),
+		fullPath:         fullPath,
+		fuseDockerClient: node.fuseDockerClient,
+		opts:             node.opts,
+	}
+}
+
+// directIO tells whether the node content must bypass the kernel page cache
+func (node *Node) directIO() bool {
+	if !node.opts.KernelCache {
+		return true
+	}
+	for _, p := range node.opts.DirectIOPaths {
+		if underPath(node.fullPath, filepath.Clean(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// underPath tells whether fullPath is p, or below it. p may have wildcards, as in path.Match.
+func underPath(fullPath string, p string) bool {
+	for {
+		if matched, _ := path.Match(p, fullPath); matched {
+			return true
+		}
+		if fullPath == "/" || fullPath == "." {
+			return false
+		}
+		fullPath = path.Dir(fullPath)
+	}
+}
+
+// updateCacheAttr records attr, reporting whether attributes were known and if size or mtime changed
+func (node *Node) updateCacheAttr(attr *fuse.Attr) (known bool, changed bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	known = node.hasCacheAttr
+	changed = node.cachedAttr.Size != attr.Size ||
+		node.cachedAttr.Mtime != attr.Mtime ||
+		node.cachedAttr.Mtimensec != attr.Mtimensec
+	node.cachedAttr = *attr
+	node.hasCacheAttr = true
+	return
+}
+
+// invalidateOnChange drops cached pages if attr shows the file changed in the container
+func (node *Node) invalidateOnChange(attr *fuse.Attr) {
+	if node.directIO() {
+		return
+	}
+	if known, changed := node.updateCacheAttr(attr); known && changed {
+		slog.Debug("content changed, invalidating kernel cache", "path", node.fullPath)
+		// Don't block the current FUSE operation waiting for the kernel
+		go kernelNotifier.NotifyContent(node.EmbeddedInode(), 0, 0)
 	}
 }
 
@@ -62,7 +154,7 @@ func (node *Node) Create(ctx context.Context, name string, flags uint32, mode ui
 	}
 	fuseFlags = flags
 	out.Attr = fuseAttr.FuseAttr
-	newNode = node.NewPersistentInode(ctx, NewNode(node.fuseDockerClient, fullPath, ""), fusefs.StableAttr{Ino: out.Ino})
+	newNode = node.NewPersistentInode(ctx, node.newChild(fullPath, ""), fusefs.StableAttr{Ino: out.Ino})
 	return
 }
 
@@ -100,9 +192,59 @@ func (node *Node) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.A
 	}
 
 	out.Attr = fuseAttr.FuseAttr
+	node.invalidateOnChange(&out.Attr)
 	return
 }
 
+// xattrs returns the extended attributes of the node, for clients serving them
+func (node *Node) xattrs(ctx context.Context) (map[string]string, syscall.Errno) {
+	source, ok := node.fuseDockerClient.(XattrSource)
+	if !ok {
+		return nil, 0
+	}
+	return source.xattrs(ctx, node.fullPath)
+}
+
+// Getxattr reads the extended attribute attr into dest.
+func (node *Node) Getxattr(ctx context.Context, attr string, dest []byte) (sz uint32, errno syscall.Errno) {
+	slog.Debug("Getxattr() called", "path", node.fullPath, "attr", attr)
+
+	// Others (e.g., security.capability, ACLs) are asked for all the time, and never served
+	if !strings.HasPrefix(attr, XattrPrefix) {
+		return 0, syscall.ENODATA
+	}
+	xattrs, errno := node.xattrs(ctx)
+	if errno != 0 {
+		return 0, errno
+	}
+	value, ok := xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// Listxattr lists the names of extended attributes into dest, NUL separated.
+func (node *Node) Listxattr(ctx context.Context, dest []byte) (sz uint32, errno syscall.Errno) {
+	slog.Debug("Listxattr() called", "path", node.fullPath)
+
+	xattrs, errno := node.xattrs(ctx)
+	if errno != 0 {
+		return 0, errno
+	}
+	var names []byte
+	for _, name := range slices.Sorted(maps.Keys(xattrs)) {
+		names = append(append(names, name...), 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
+}
+
 // Link creates a hard link named name pointing to target.
 func (node *Node) Link(ctx context.Context, target fusefs.InodeEmbedder, name string, out *fuse.EntryOut) (newNode *fusefs.Inode, errno syscall.Errno) {
 	slog.Debug("Link() called", "path", node.fullPath, "target", target, "name", name)
@@ -124,7 +266,7 @@ func (node *Node) Link(ctx context.Context, target fusefs.InodeEmbedder, name st
 	}
 	out.Attr = fuseAttr.FuseAttr
 
-	newNode = node.NewPersistentInode(ctx, NewNode(node.fuseDockerClient, newFullPath, fuseAttr.LinkTarget), fusefs.StableAttr{Mode: target.EmbeddedInode().Mode(), Ino: fuseAttr.FuseAttr.Ino})
+	newNode = node.NewPersistentInode(ctx, node.newChild(newFullPath, fuseAttr.LinkTarget), fusefs.StableAttr{Mode: target.EmbeddedInode().Mode(), Ino: fuseAttr.FuseAttr.Ino})
 	return
 }
 
@@ -159,7 +301,7 @@ func (node *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 		stableAttr.Mode = fuse.S_IFREG
 	}
 
-	return node.NewPersistentInode(ctx, NewNode(node.fuseDockerClient, fullPath, fuseAttr.LinkTarget), stableAttr), 0
+	return node.NewPersistentInode(ctx, node.newChild(fullPath, fuseAttr.LinkTarget), stableAttr), 0
 }
 
 // Lseek changes the read/write offset of a file handle.
@@ -182,18 +324,27 @@ func (node *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse
 		return nil, errno
 	}
 	out.Attr = fuseAttr.FuseAttr
-	newNode = node.NewPersistentInode(ctx, NewNode(node.fuseDockerClient, fullPath, ""), fusefs.StableAttr{Mode: fuse.S_IFDIR, Ino: out.Ino})
+	newNode = node.NewPersistentInode(ctx, node.newChild(fullPath, ""), fusefs.StableAttr{Mode: fuse.S_IFDIR, Ino: out.Ino})
 	return
 }
 
 // Open opens the current path and returns a handle.
 func (node *Node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, syserr syscall.Errno) {
 	slog.Debug("Open() called", "path", node.fullPath, "flags", flags)
-	fh, _, syserr = node.fuseDockerClient.open(ctx, node.fullPath, int(flags), fs.FileMode(flags))
+	var fuseAttr statAttr
+	fh, _, syserr = node.fuseDockerClient.open(ctx, node.fullPath, int(flags), fs.FileMode(flags), &fuseAttr)
 	if syserr != 0 {
 		slog.Error("remote error in open()", "path", node.fullPath, "errno", syserr)
+		return
+	}
+	if node.directIO() {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+		return
+	}
+	// Keep cached pages only if the file hasn't changed since the last time we saw it
+	if known, changed := node.updateCacheAttr(&fuseAttr.FuseAttr); known && !changed {
+		fuseFlags = fuse.FOPEN_KEEP_CACHE
 	}
-	fuseFlags = fuse.FOPEN_DIRECT_IO
 	return
 }
 
@@ -272,6 +423,10 @@ func (node *Node) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.Set
 		return errno
 	}
 	out.Attr = fuseAttr.FuseAttr
+	if !node.directIO() {
+		// The kernel already knows about changes it requested
+		node.updateCacheAttr(&out.Attr)
+	}
 	return
 }
 
@@ -285,7 +440,7 @@ func (node *Node) Symlink(ctx context.Context, target, name string, out *fuse.En
 		slog.Error("remote error in symlink()", "path", node.fullPath, "errno", errno)
 		return nil, errno
 	}
-	newNode = node.NewPersistentInode(ctx, NewNode(node.fuseDockerClient, newFullPath, node.fullPath), fusefs.StableAttr{Mode: fuse.S_IFLNK})
+	newNode = node.NewPersistentInode(ctx, node.newChild(newFullPath, node.fullPath), fusefs.StableAttr{Mode: fuse.S_IFLNK})
 	return
 }
 
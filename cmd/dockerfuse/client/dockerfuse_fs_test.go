@@ -6,6 +6,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/stretchr/testify/assert"
@@ -14,6 +15,14 @@ import (
 
 type mockFuseDockerClient struct{ mock.Mock }
 
+func (m *mockFuseDockerClient) Close() {
+	m.Called()
+}
+
+func (m *mockFuseDockerClient) CacheStats() CacheStats {
+	return CacheStats{}
+}
+
 func (m *mockFuseDockerClient) disconnect() {
 	m.Called()
 }
@@ -51,8 +60,8 @@ func (m *mockFuseDockerClient) mkdir(ctx context.Context, fullPath string, mode
 	return args.Get(0).(syscall.Errno)
 }
 
-func (m *mockFuseDockerClient) open(ctx context.Context, fullPath string, flags int, mode fs.FileMode) (fusefs.FileHandle, fs.FileMode, syscall.Errno) {
-	args := m.Called(ctx, fullPath, flags, mode)
+func (m *mockFuseDockerClient) open(ctx context.Context, fullPath string, flags int, mode fs.FileMode, attr *statAttr) (fusefs.FileHandle, fs.FileMode, syscall.Errno) {
+	args := m.Called(ctx, fullPath, flags, mode, attr)
 	return args.Get(0).(fusefs.FileHandle), args.Get(1).(fs.FileMode), args.Get(2).(syscall.Errno)
 }
 
@@ -111,6 +120,11 @@ func (m *mockFuseDockerClient) write(ctx context.Context, fh fusefs.FileHandle,
 	return args.Int(0), args.Get(1).(syscall.Errno)
 }
 
+func (m *mockFuseDockerClient) watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) error {
+	args := m.Called(ctx, handler)
+	return args.Error(0)
+}
+
 func TestNodeGetattrSuccess(t *testing.T) {
 	var m mockFuseDockerClient
 	n := NewNode(&m, "/path", "")
@@ -142,7 +156,7 @@ func TestNodeOpenAndRead(t *testing.T) {
 	var m mockFuseDockerClient
 	n := NewNode(&m, "/file", "")
 	handle := fusefs.FileHandle(uintptr(1))
-	m.On("open", mock.Anything, "/file", 0, fs.FileMode(0)).Return(handle, fs.FileMode(0644), syscall.Errno(0))
+	m.On("open", mock.Anything, "/file", 0, fs.FileMode(0), mock.Anything).Return(handle, fs.FileMode(0644), syscall.Errno(0))
 	fh, fuseFlags, err := n.Open(context.Background(), 0)
 	assert.Equal(t, syscall.Errno(0), err)
 	assert.Equal(t, handle, fh)
@@ -158,6 +172,96 @@ func TestNodeOpenAndRead(t *testing.T) {
 	m.AssertExpectations(t)
 }
 
+type mockNotifier struct{ mock.Mock }
+
+func (m *mockNotifier) NotifyContent(i *fusefs.Inode, off, sz int64) syscall.Errno {
+	args := m.Called(i, off, sz)
+	return args.Get(0).(syscall.Errno)
+}
+
+func (m *mockNotifier) NotifyDelete(p *fusefs.Inode, name string, c *fusefs.Inode) syscall.Errno {
+	args := m.Called(p, name, c)
+	return args.Get(0).(syscall.Errno)
+}
+
+func (m *mockNotifier) NotifyEntry(p *fusefs.Inode, name string) syscall.Errno {
+	args := m.Called(p, name)
+	return args.Get(0).(syscall.Errno)
+}
+
+func TestUnderPath(t *testing.T) {
+	assert.True(t, underPath("/proc", "/proc"))
+	assert.True(t, underPath("/proc/1/status", "/proc"))
+	assert.False(t, underPath("/procfs", "/proc"))
+	assert.True(t, underPath("/etc", "/"))
+	assert.True(t, underPath("/web/proc/1", "/*/proc"))
+	assert.False(t, underPath("/web/etc", "/*/proc"))
+}
+
+func TestNodeOpenKernelCache(t *testing.T) {
+	var m mockFuseDockerClient
+	opts := NodeOptions{KernelCache: true, DirectIOPaths: []string{"/proc"}}
+	n := NewNodeWithOptions(&m, "/file", "", opts)
+	handle := fusefs.FileHandle(uintptr(1))
+	attr := fuse.Attr{Size: 10, Mtime: 100, Mtimensec: 5}
+	setAttr := func(args mock.Arguments) { args.Get(4).(*statAttr).FuseAttr = attr }
+	m.On("open", mock.Anything, "/file", 0, fs.FileMode(0), mock.Anything).Run(setAttr).Return(handle, fs.FileMode(0644), syscall.Errno(0))
+
+	// First open: nothing is cached yet
+	_, fuseFlags, err := n.Open(context.Background(), 0)
+	assert.Equal(t, syscall.Errno(0), err)
+	assert.Equal(t, uint32(0), fuseFlags)
+
+	// Unchanged file: keep cache
+	_, fuseFlags, err = n.Open(context.Background(), 0)
+	assert.Equal(t, syscall.Errno(0), err)
+	assert.Equal(t, uint32(fuse.FOPEN_KEEP_CACHE), fuseFlags)
+
+	// Changed mtime: drop cache
+	attr.Mtimensec = 6
+	_, fuseFlags, err = n.Open(context.Background(), 0)
+	assert.Equal(t, syscall.Errno(0), err)
+	assert.Equal(t, uint32(0), fuseFlags)
+
+	// Pseudo filesystems always use direct I/O
+	p := NewNodeWithOptions(&m, "/proc/self/status", "", opts)
+	m.On("open", mock.Anything, "/proc/self/status", 0, fs.FileMode(0), mock.Anything).Run(setAttr).Return(handle, fs.FileMode(0644), syscall.Errno(0))
+	_, fuseFlags, err = p.Open(context.Background(), 0)
+	assert.Equal(t, syscall.Errno(0), err)
+	assert.Equal(t, uint32(fuse.FOPEN_DIRECT_IO), fuseFlags)
+
+	m.AssertExpectations(t)
+}
+
+func TestNodeGetattrInvalidatesKernelCache(t *testing.T) {
+	var (
+		m  mockFuseDockerClient
+		mN mockNotifier
+	)
+	kernelNotifier = &mN
+	defer func() { kernelNotifier = &fuseNotifier{} }()
+
+	n := NewNodeWithOptions(&m, "/file", "", NodeOptions{KernelCache: true})
+	attr := fuse.Attr{Size: 10, Mtime: 100}
+	m.On("stat", mock.Anything, "/file", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*statAttr).FuseAttr = attr
+	}).Return(syscall.Errno(0))
+
+	var out fuse.AttrOut
+	assert.Equal(t, syscall.Errno(0), n.Getattr(context.Background(), nil, &out))
+	assert.Equal(t, syscall.Errno(0), n.Getattr(context.Background(), nil, &out))
+	mN.AssertNotCalled(t, "NotifyContent", mock.Anything, mock.Anything, mock.Anything)
+
+	notified := make(chan struct{})
+	mN.On("NotifyContent", n.EmbeddedInode(), int64(0), int64(0)).Run(func(mock.Arguments) {
+		close(notified)
+	}).Return(syscall.Errno(0)).Once()
+	attr.Size = 20
+	assert.Equal(t, syscall.Errno(0), n.Getattr(context.Background(), nil, &out))
+	<-notified
+	mN.AssertExpectations(t)
+}
+
 func TestNodeReadlinkReaddir(t *testing.T) {
 	var m mockFuseDockerClient
 	n := NewNode(&m, "/dir", "")
@@ -195,6 +299,8 @@ func TestNewNode(t *testing.T) {
 	assert.Equal(t, "/a", n.fullPath)
 	assert.Equal(t, []byte("b"), n.Data)
 	assert.Equal(t, &m, n.fuseDockerClient)
+	assert.False(t, n.opts.KernelCache)
+	assert.Same(t, n.opts, n.newChild("/a/c", "").opts)
 }
 
 func TestNodeCreateMkdirAndMore(t *testing.T) {
@@ -350,3 +456,53 @@ func TestNodeFsync(t *testing.T) {
 	assert.Equal(t, syscall.Errno(0), fsyncErr)
 	m.AssertExpectations(t)
 }
+
+// failingXattrs fails to serve extended attributes
+type failingXattrs struct{}
+
+func (failingXattrs) xattrs(ctx context.Context, fullPath string) (map[string]string, syscall.Errno) {
+	return nil, syscall.EIO
+}
+
+func TestNodeXattrs(t *testing.T) {
+	var m mockFuseDockerClient
+	ctx := context.Background()
+
+	// Clients without extended attributes
+	n := NewNode(&m, "/file", "")
+	_, errno := n.Getxattr(ctx, "user.a", make([]byte, 10))
+	assert.Equal(t, syscall.ENODATA, errno)
+	sz, errno := n.Listxattr(ctx, make([]byte, 10))
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uint32(0), sz)
+
+	c := NewViewClient(&m, "/")
+	c.AddXattrs(xattrMap{"/file": {XattrPrefix + "b": "value", XattrPrefix + "a": "1"}})
+	n = NewNode(c, "/file", "")
+	dest := make([]byte, 10)
+	sz, errno = n.Getxattr(ctx, XattrPrefix+"b", dest)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "value", string(dest[:sz]))
+	_, errno = n.Getxattr(ctx, XattrPrefix+"c", dest)
+	assert.Equal(t, syscall.ENODATA, errno)
+	sz, errno = n.Listxattr(ctx, make([]byte, 64))
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uint32(2*len(XattrPrefix+"a\x00")), sz)
+
+	// Sizes are returned when buffers are too small
+	sz, errno = n.Getxattr(ctx, XattrPrefix+"b", nil)
+	assert.Equal(t, syscall.ERANGE, errno)
+	assert.Equal(t, uint32(5), sz)
+	sz, errno = n.Listxattr(ctx, nil)
+	assert.Equal(t, syscall.ERANGE, errno)
+	assert.Equal(t, uint32(2*len(XattrPrefix+"a\x00")), sz)
+
+	// Other attributes are not looked up, so failing sources don't affect them
+	c = NewViewClient(&m, "/")
+	c.AddXattrs(failingXattrs{})
+	n = NewNode(c, "/file", "")
+	_, errno = n.Getxattr(ctx, "security.capability", dest)
+	assert.Equal(t, syscall.ENODATA, errno)
+	_, errno = n.Getxattr(ctx, XattrLayer, dest)
+	assert.Equal(t, syscall.EIO, errno)
+}
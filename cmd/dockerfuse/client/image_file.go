@@ -0,0 +1,673 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Whiteout files, marking removals in image layers
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// OCI and Docker media types of image indexes (manifest lists)
+var indexMediaTypes = []string{
+	ocispec.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// ImageFileClient serves the filesystem of an image saved to disk, by `docker save` or as an OCI
+// layout (a directory, or a tarball of it), merging its layers. It doesn't need a Docker daemon,
+// and it is read-only.
+type ImageFileClient struct {
+	readOnlyClient
+
+	// Layers, from the bottom one
+	layers []imageLayer
+	// Merged filesystem
+	entries  map[string]*imageEntry
+	children map[string]map[string]bool
+
+	closers []io.Closer
+	temps   []string
+
+	handlesMu sync.Mutex
+	handles   map[fusefs.FileHandle]*imageEntry
+	nextFH    uintptr
+}
+
+// imageLayer is a layer of the image
+type imageLayer struct {
+	digest    string
+	createdBy string
+	tar       *io.SectionReader // Uncompressed layer
+}
+
+// imageEntry is a file of the merged filesystem
+type imageEntry struct {
+	attr  statAttr
+	layer int               // Index of the layer providing the file
+	data  *io.SectionReader // Content of regular files
+}
+
+// dockerSaveManifest is an entry of manifest.json in `docker save` archives
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageSource gives access to the files of a directory or of a tarball
+type imageSource interface {
+	open(name string) (*io.SectionReader, error)
+	io.Closer
+}
+
+type dirSource struct {
+	root  string
+	files []*os.File
+}
+
+func (s *dirSource) open(name string) (*io.SectionReader, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.files = append(s.files, f)
+	return io.NewSectionReader(f, 0, info.Size()), nil
+}
+
+func (s *dirSource) Close() error {
+	for _, f := range s.files {
+		f.Close()
+	}
+	return nil
+}
+
+// tarSource accesses members of an uncompressed tarball in place
+type tarSource struct {
+	f       *os.File
+	members map[string]*io.SectionReader
+}
+
+func newTarSource(f *os.File) (*tarSource, error) {
+	s := &tarSource{f: f, members: make(map[string]*io.SectionReader)}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	links := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "./"))
+		switch h.Typeflag {
+		case tar.TypeReg:
+			s.members[name] = io.NewSectionReader(f, cr.n, h.Size)
+		case tar.TypeSymlink:
+			// docker save links layers shared by several images
+			links[name] = path.Join(path.Dir(name), h.Linkname)
+		}
+	}
+	for name, target := range links {
+		if m, ok := s.members[target]; ok {
+			s.members[name] = m
+		}
+	}
+	return s, nil
+}
+
+func (s *tarSource) open(name string) (*io.SectionReader, error) {
+	if m, ok := s.members[path.Clean(name)]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
+
+func (s *tarSource) Close() error { return s.f.Close() }
+
+// countingReader counts bytes read, to locate file contents in tar streams
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+func openImageSource(file string) (imageSource, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirSource{root: file}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newTarSource(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a tarball: %s", file, err)
+	}
+	return s, nil
+}
+
+func readJSON(src imageSource, name string, v any) error {
+	r, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	if err = json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// blobPath returns the path of a blob in an OCI layout
+func blobPath(d ocispec.Descriptor) string {
+	return path.Join("blobs", d.Digest.Algorithm().String(), d.Digest.Encoded())
+}
+
+// imageBlobs locates the parts of an image in an image source
+type imageBlobs struct {
+	config  string
+	layers  []string
+	digests []string
+}
+
+// findImage returns the blobs of the image called ref (or of the only image, when ref is empty)
+func findImage(src imageSource, ref string) (b imageBlobs, err error) {
+	var manifests []dockerSaveManifest
+	if err = readJSON(src, "manifest.json", &manifests); err == nil {
+		return dockerSaveImage(manifests, ref)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return b, err
+	}
+
+	var index ocispec.Index
+	if err = readJSON(src, ocispec.ImageIndexFile, &index); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return b, fmt.Errorf("neither a docker save archive nor an OCI layout")
+		}
+		return b, err
+	}
+	desc, err := selectManifest(index.Manifests, ref)
+	if err != nil {
+		return b, err
+	}
+	// Indexes may be nested, e.g. multi-platform images
+	for slices.Contains(indexMediaTypes, desc.MediaType) {
+		var nested ocispec.Index
+		if err = readJSON(src, blobPath(desc), &nested); err != nil {
+			return b, err
+		}
+		if desc, err = selectPlatform(nested.Manifests); err != nil {
+			return b, err
+		}
+	}
+	var manifest ocispec.Manifest
+	if err = readJSON(src, blobPath(desc), &manifest); err != nil {
+		return b, err
+	}
+	b.config = blobPath(manifest.Config)
+	for _, l := range manifest.Layers {
+		b.layers = append(b.layers, blobPath(l))
+		b.digests = append(b.digests, l.Digest.String())
+	}
+	return b, nil
+}
+
+func dockerSaveImage(manifests []dockerSaveManifest, ref string) (b imageBlobs, err error) {
+	if len(manifests) == 0 {
+		return b, fmt.Errorf("no image in the archive")
+	}
+	m := manifests[0]
+	if ref != "" {
+		i := slices.IndexFunc(manifests, func(m dockerSaveManifest) bool { return slices.Contains(m.RepoTags, ref) })
+		if i < 0 {
+			return b, fmt.Errorf("image %s not in the archive", ref)
+		}
+		m = manifests[i]
+	} else if len(manifests) > 1 {
+		slog.Warn("several images in the archive, using the first one", "tags", m.RepoTags)
+	}
+	b.config = m.Config
+	for _, l := range m.Layers {
+		b.layers = append(b.layers, l)
+		// Layers are named after their digest, either as <id>/layer.tar or blobs/sha256/<digest>
+		if strings.HasPrefix(l, "blobs/") {
+			b.digests = append(b.digests, path.Base(path.Dir(l))+":"+path.Base(l))
+		} else {
+			b.digests = append(b.digests, path.Dir(l))
+		}
+	}
+	return b, nil
+}
+
+// selectManifest picks the image called ref (matching the OCI ref name annotation) from an index
+func selectManifest(manifests []ocispec.Descriptor, ref string) (ocispec.Descriptor, error) {
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no image in the OCI layout")
+	}
+	if ref == "" {
+		if len(manifests) > 1 {
+			slog.Warn("several images in the OCI layout, using the first one")
+		}
+		return manifests[0], nil
+	}
+	for _, m := range manifests {
+		name := m.Annotations[ocispec.AnnotationRefName]
+		if name == ref || strings.HasSuffix(ref, ":"+name) {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image %s not in the OCI layout", ref)
+}
+
+// selectPlatform picks the manifest for Linux on the current architecture, or the first one
+func selectPlatform(manifests []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("empty image index")
+	}
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return manifests[0], nil
+}
+
+// NewImageFileClient returns a client for the image saved in file, which can be a `docker save`
+// tarball or an OCI layout. ref selects the image, when file holds several of them.
+func NewImageFileClient(file string, ref string) (*ImageFileClient, error) {
+	src, err := openImageSource(file)
+	if err != nil {
+		return nil, err
+	}
+	c := newImageTree()
+	c.closers = append(c.closers, src)
+	if err = c.load(src, ref); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	slog.Info("image loaded", "file", file, "layers", len(c.layers), "files", len(c.entries))
+	return c, nil
+}
+
+// newImageTree returns a client serving an empty root directory
+func newImageTree() *ImageFileClient {
+	c := &ImageFileClient{
+		entries:  make(map[string]*imageEntry),
+		children: make(map[string]map[string]bool),
+		handles:  make(map[fusefs.FileHandle]*imageEntry),
+	}
+	c.add("/", &imageEntry{attr: dirAttr("/")})
+	return c
+}
+
+// load merges the layers of the image called ref
+func (c *ImageFileClient) load(src imageSource, ref string) error {
+	b, err := findImage(src, ref)
+	if err != nil {
+		return err
+	}
+	// Layers are better known by the digests of their uncompressed content, and by the commands
+	// that built them: take both from the image configuration, when it matches
+	var config ocispec.Image
+	if err = readJSON(src, b.config, &config); err != nil {
+		slog.Warn("cannot read the image configuration", "error", err)
+	}
+	if len(config.RootFS.DiffIDs) == len(b.layers) {
+		for i, d := range config.RootFS.DiffIDs {
+			b.digests[i] = d.String()
+		}
+	}
+	var createdBy []string
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	if len(createdBy) != len(b.layers) {
+		createdBy = make([]string, len(b.layers))
+	}
+
+	for i, blob := range b.layers {
+		r, err := src.open(blob)
+		if err != nil {
+			return err
+		}
+		layer, err := c.uncompressed(r)
+		if err != nil {
+			return fmt.Errorf("layer %s: %s", b.digests[i], err)
+		}
+		c.layers = append(c.layers, imageLayer{digest: b.digests[i], createdBy: createdBy[i], tar: layer})
+		if err = c.merge(i, "", false); err != nil {
+			return fmt.Errorf("layer %s: %s", b.digests[i], err)
+		}
+	}
+	return nil
+}
+
+// uncompressed returns the uncompressed content of a layer, decompressing it to a temporary file
+// if needed
+func (c *ImageFileClient) uncompressed(r *io.SectionReader) (*io.SectionReader, error) {
+	magic := make([]byte, 4)
+	n, _ := r.ReadAt(magic, 0)
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte{0x1f, 0x8b}):
+	case bytes.Equal(magic[:n], []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("zstd compressed layers are not supported")
+	default:
+		return r, nil
+	}
+
+	zr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "dockerfuse-layer-*")
+	if err != nil {
+		return nil, err
+	}
+	c.closers = append(c.closers, tmp)
+	c.temps = append(c.temps, tmp.Name())
+	size, err := io.Copy(tmp, zr)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(tmp, 0, size), nil
+}
+
+// dirAttr returns attributes of directories missing from layers
+func dirAttr(fullPath string) (attr statAttr) {
+	attr.FuseAttr.Mode = syscall.S_IFDIR | 0755
+	attr.FuseAttr.Nlink = 2
+	attr.FuseAttr.Ino = archiveIno(fullPath)
+	return
+}
+
+// add puts e at fullPath, creating missing parents
+func (c *ImageFileClient) add(fullPath string, e *imageEntry) {
+	if old, ok := c.entries[fullPath]; ok && (!isDir(old) || !isDir(e)) {
+		c.remove(fullPath)
+	}
+	c.entries[fullPath] = e
+	if isDir(e) && c.children[fullPath] == nil {
+		c.children[fullPath] = make(map[string]bool)
+	}
+	if fullPath == "/" {
+		return
+	}
+	parent := path.Dir(fullPath)
+	if p, ok := c.entries[parent]; !ok || !isDir(p) {
+		c.add(parent, &imageEntry{attr: dirAttr(parent), layer: e.layer})
+	}
+	c.children[parent][path.Base(fullPath)] = true
+}
+
+// remove deletes fullPath and what is below it
+func (c *ImageFileClient) remove(fullPath string) {
+	c.removeChildren(fullPath)
+	delete(c.children, fullPath)
+	delete(c.entries, fullPath)
+	if siblings, ok := c.children[path.Dir(fullPath)]; ok && fullPath != "/" {
+		delete(siblings, path.Base(fullPath))
+	}
+}
+
+func (c *ImageFileClient) removeChildren(dir string) {
+	for name := range c.children[dir] {
+		c.remove(path.Join(dir, name))
+	}
+}
+
+func isDir(e *imageEntry) bool {
+	return e.attr.FuseAttr.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// merge stacks layer i on the filesystem merged so far. With raw, the layer is put below prefix as
+// it is stored, keeping whiteouts as files.
+func (c *ImageFileClient) merge(i int, prefix string, raw bool) error {
+	layer := c.layers[i].tar
+	cr := &countingReader{r: io.NewSectionReader(layer, 0, layer.Size())}
+	tr := tar.NewReader(cr)
+
+	// Whiteouts apply to lower layers only, wherever they are in the layer
+	var (
+		opaque, whiteouts []string
+		added             []string
+		entries           = make(map[string]*imageEntry)
+	)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := path.Clean("/" + h.Name)
+		dir, base := path.Split(p)
+		switch {
+		case raw:
+		case base == whiteoutOpaque:
+			opaque = append(opaque, path.Clean(dir))
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		e := &imageEntry{attr: headerAttr(h, path.Join(prefix, p)), layer: i}
+		switch h.Typeflag {
+		case tar.TypeLink:
+			target := path.Clean("/" + h.Linkname)
+			t, ok := entries[target]
+			if !ok {
+				t, ok = c.entries[target]
+			}
+			if !ok {
+				slog.Warn("hard link to a missing file", "path", p, "target", target)
+				continue
+			}
+			e.attr, e.data = t.attr, t.data
+		case tar.TypeReg:
+			e.data = io.NewSectionReader(layer, cr.n, h.Size)
+		}
+		if _, ok := entries[p]; !ok {
+			added = append(added, p)
+		}
+		entries[p] = e
+	}
+
+	for _, d := range opaque {
+		c.removeChildren(d)
+	}
+	for _, w := range whiteouts {
+		c.remove(w)
+	}
+	for _, p := range added {
+		c.add(path.Join(prefix, p), entries[p])
+	}
+	return nil
+}
+
+// layerName names layer i after its position and digest
+func (c *ImageFileClient) layerName(i int) string {
+	d := c.layers[i].digest
+	if _, encoded, ok := strings.Cut(d, ":"); ok {
+		d = encoded
+	}
+	return fmt.Sprintf("%d-%s", i, d[:min(len(d), 12)])
+}
+
+// layerView returns a client serving every layer in its own directory, as stored in the image,
+// with a history file describing them
+func (c *ImageFileClient) layerView() (*ImageFileClient, error) {
+	v := newImageTree()
+	v.layers = c.layers
+	var history strings.Builder
+	for i, l := range c.layers {
+		dir := "/" + c.layerName(i)
+		v.add(dir, &imageEntry{attr: dirAttr(dir), layer: i})
+		if err := v.merge(i, dir, true); err != nil {
+			return nil, fmt.Errorf("layer %s: %s", l.digest, err)
+		}
+		fmt.Fprintf(&history, "%s\t%s\t%d\t%s\n", c.layerName(i), l.digest, l.tar.Size(), l.createdBy)
+	}
+	var attr statAttr
+	attr.FuseAttr.Mode = syscall.S_IFREG | 0444
+	attr.FuseAttr.Size = uint64(history.Len())
+	attr.FuseAttr.Nlink = 1
+	attr.FuseAttr.Ino = archiveIno("/history")
+	v.add("/history", &imageEntry{attr: attr, data: io.NewSectionReader(strings.NewReader(history.String()), 0, int64(history.Len()))})
+	return v, nil
+}
+
+// Close releases the image files
+func (c *ImageFileClient) Close() {
+	for _, cl := range c.closers {
+		cl.Close()
+	}
+	for _, t := range c.temps {
+		os.Remove(t)
+	}
+	c.closers, c.temps = nil, nil
+}
+
+func (c *ImageFileClient) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	e, ok := c.entries[fullPath]
+	if !ok {
+		return syscall.ENOENT
+	}
+	*attr = e.attr
+	return 0
+}
+
+func (c *ImageFileClient) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	e, ok := c.entries[fullPath]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if !isDir(e) {
+		return nil, syscall.ENOTDIR
+	}
+	names := make([]string, 0, len(c.children[fullPath]))
+	for name := range c.children[fullPath] {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	dirEntries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		child := c.entries[path.Join(fullPath, name)]
+		dirEntries = append(dirEntries, fuse.DirEntry{Name: name, Mode: child.attr.FuseAttr.Mode, Ino: child.attr.FuseAttr.Ino})
+	}
+	return fusefs.NewListDirStream(dirEntries), 0
+}
+
+func (c *ImageFileClient) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	e, ok := c.entries[fullPath]
+	if !ok {
+		return []byte{}, syscall.ENOENT
+	}
+	if e.attr.FuseAttr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return []byte{}, syscall.EINVAL
+	}
+	return []byte(e.attr.LinkTarget), 0
+}
+
+func (c *ImageFileClient) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	e, ok := c.entries[fullPath]
+	if !ok {
+		return nil, 0, syscall.ENOENT
+	}
+	if e.data == nil {
+		return nil, 0, syscall.EOPNOTSUPP
+	}
+	c.handlesMu.Lock()
+	defer c.handlesMu.Unlock()
+	c.nextFH++
+	c.handles[c.nextFH] = e
+	*attr = e.attr
+	return c.nextFH, fs.FileMode(e.attr.FuseAttr.Mode), 0
+}
+
+func (c *ImageFileClient) handle(fh fusefs.FileHandle) (*imageEntry, bool) {
+	c.handlesMu.Lock()
+	defer c.handlesMu.Unlock()
+	e, ok := c.handles[fh]
+	return e, ok
+}
+
+func (c *ImageFileClient) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	e, ok := c.handle(fh)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	data = make([]byte, n)
+	n, err := e.data.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		slog.Warn("error reading image layer", "error", err)
+		return nil, syscall.EIO
+	}
+	return data[:n], 0
+}
+
+func (c *ImageFileClient) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	e, ok := c.handle(fh)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	size := e.data.Size()
+	return seekWithin(size, offset, whence)
+}
+
+func (c *ImageFileClient) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	c.handlesMu.Lock()
+	defer c.handlesMu.Unlock()
+	if _, ok := c.handles[fh]; !ok {
+		return syscall.EBADF
+	}
+	delete(c.handles, fh)
+	return 0
+}
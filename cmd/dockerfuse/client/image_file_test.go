@@ -0,0 +1,273 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// tarOf returns a tarball of files
+func tarOf(t *testing.T, files ...archiveFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		f.header.Size = int64(len(f.content))
+		if f.header.Mode == 0 {
+			f.header.Mode = 0644
+		}
+		assert.NoError(t, tw.WriteHeader(&f.header))
+		_, err := tw.Write([]byte(f.content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func regFile(name, content string) archiveFile {
+	return archiveFile{header: tar.Header{Name: name, Typeflag: tar.TypeReg}, content: content}
+}
+
+func dirFile(name string) archiveFile {
+	return archiveFile{header: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+// testLayers returns layers exercising whiteouts, opaque directories and hard links
+func testLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		tarOf(t,
+			dirFile("etc/"),
+			regFile("etc/hostname", "base"),
+			regFile("etc/removed", "gone"),
+			dirFile("opt/"),
+			regFile("opt/old", "old"),
+			dirFile("opt/sub/"),
+			regFile("opt/sub/deep", "deep"),
+			// Parent directories may be missing
+			regFile("usr/bin/tool", "tool"),
+			archiveFile{header: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+		),
+		gzipped(t, tarOf(t,
+			regFile("etc/hostname", "layer1"),
+			regFile("etc/.wh.removed", ""),
+			regFile("opt/new", "new"),
+			regFile("opt/.wh..wh..opq", ""),
+			archiveFile{header: tar.Header{Name: "usr/bin/alias", Typeflag: tar.TypeLink, Linkname: "usr/bin/tool"}},
+			// A file replacing a directory
+			regFile("usr/bin/tool", "tool2"),
+		)),
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	assert.NoError(t, os.WriteFile(name, data, 0644))
+}
+
+// dockerSaveFixture writes a `docker save` tarball holding an image with layers
+func dockerSaveFixture(t *testing.T, layers [][]byte) string {
+	file := filepath.Join(t.TempDir(), "image.tar")
+	writeFile(t, file, dockerSaveTar(t, layers, "{}"))
+	return file
+}
+
+// dockerSaveTar returns a `docker save` tarball holding an image with layers and config
+func dockerSaveTar(t *testing.T, layers [][]byte, config string) []byte {
+	var files []archiveFile
+	manifest := dockerSaveManifest{Config: "config.json", RepoTags: []string{"test:latest"}}
+	for i, l := range layers {
+		name := []string{"aaa/layer.tar", "bbb/layer.tar"}[i]
+		manifest.Layers = append(manifest.Layers, name)
+		files = append(files, archiveFile{header: tar.Header{Name: "blobs/" + name, Typeflag: tar.TypeReg}, content: string(l)})
+		// Layers may be links to blobs
+		files = append(files, archiveFile{header: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: "../blobs/" + name}})
+	}
+	data, _ := json.Marshal([]dockerSaveManifest{manifest})
+	files = append(files, regFile("manifest.json", string(data)), regFile("config.json", config))
+	return tarOf(t, files...)
+}
+
+// ociFixture writes an OCI layout directory holding a multi-platform image with layers
+func ociFixture(t *testing.T, layers [][]byte) string {
+	dir := t.TempDir()
+	blob := func(mediaType string, data []byte) ocispec.Descriptor {
+		sum := sha256.Sum256(data)
+		writeFile(t, filepath.Join(dir, "blobs", "sha256", hex.EncodeToString(sum[:])), data)
+		return ocispec.Descriptor{MediaType: mediaType, Digest: digest.NewDigestFromBytes(digest.SHA256, sum[:]), Size: int64(len(data))}
+	}
+	manifest := ocispec.Manifest{Config: blob(ocispec.MediaTypeImageConfig, []byte("{}"))}
+	for _, l := range layers {
+		manifest.Layers = append(manifest.Layers, blob(ocispec.MediaTypeImageLayerGzip, l))
+	}
+	data, _ := json.Marshal(manifest)
+	desc := blob(ocispec.MediaTypeImageManifest, data)
+	desc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	data, _ = json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{desc}})
+	nested := blob(ocispec.MediaTypeImageIndex, data)
+	nested.Annotations = map[string]string{ocispec.AnnotationRefName: "latest"}
+	data, _ = json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{nested}})
+	writeFile(t, filepath.Join(dir, ocispec.ImageIndexFile), data)
+	writeFile(t, filepath.Join(dir, ocispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	return dir
+}
+
+func readImageFile(t *testing.T, c DockerFuseClientInterface, fullPath string) string {
+	var attr statAttr
+	fh, _, errno := c.open(context.Background(), fullPath, syscall.O_RDONLY, 0, &attr)
+	if !assert.Equal(t, syscall.Errno(0), errno, fullPath) {
+		return ""
+	}
+	defer c.close(context.Background(), fh)
+	data, errno := c.read(context.Background(), fh, 0, 4096)
+	assert.Equal(t, syscall.Errno(0), errno)
+	return string(data)
+}
+
+func dirNames(t *testing.T, c DockerFuseClientInterface, fullPath string) (names []string) {
+	ds, errno := c.readDir(context.Background(), fullPath)
+	if !assert.Equal(t, syscall.Errno(0), errno, fullPath) {
+		return nil
+	}
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names = append(names, e.Name)
+	}
+	return
+}
+
+func checkMergedImage(t *testing.T, c *ImageFileClient) {
+	ctx := context.Background()
+	var attr statAttr
+
+	assert.Equal(t, []string{"bin", "etc", "opt", "usr"}, dirNames(t, c, "/"))
+	// Upper layers win, whiteouts remove files
+	assert.Equal(t, "layer1", readImageFile(t, c, "/etc/hostname"))
+	assert.Equal(t, []string{"hostname"}, dirNames(t, c, "/etc"))
+	assert.Equal(t, syscall.ENOENT, c.stat(ctx, "/etc/removed", &attr))
+	// Opaque directories hide lower layers, not their own
+	assert.Equal(t, []string{"new"}, dirNames(t, c, "/opt"))
+	assert.Equal(t, syscall.ENOENT, c.stat(ctx, "/opt/sub/deep", &attr))
+	// Missing parents are created, hard links get the content of their target
+	assert.Equal(t, syscall.Errno(0), c.stat(ctx, "/usr", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR|0755), attr.FuseAttr.Mode)
+	assert.Equal(t, "tool", readImageFile(t, c, "/usr/bin/alias"))
+	assert.Equal(t, "tool2", readImageFile(t, c, "/usr/bin/tool"))
+	target, errno := c.readlink(ctx, "/bin")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "usr/bin", string(target))
+	// Files know the layer they come from
+	assert.Equal(t, 1, c.entries["/etc/hostname"].layer)
+	assert.Equal(t, 0, c.entries["/usr"].layer)
+}
+
+func TestNewImageFileClient(t *testing.T) {
+	layers := testLayers(t)
+
+	c, err := NewImageFileClient(dockerSaveFixture(t, layers), "")
+	if assert.NoError(t, err) {
+		checkMergedImage(t, c)
+		assert.Equal(t, []string{"aaa", "bbb"}, []string{c.layers[0].digest, c.layers[1].digest})
+		c.Close()
+	}
+	c, err = NewImageFileClient(ociFixture(t, layers), "")
+	if assert.NoError(t, err) {
+		checkMergedImage(t, c)
+		assert.Len(t, c.temps, 1)
+		temp := c.temps[0]
+		c.Close()
+		_, err = os.Stat(temp)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Images are selected by reference
+	_, err = NewImageFileClient(dockerSaveFixture(t, layers), "test:latest")
+	assert.NoError(t, err)
+	_, err = NewImageFileClient(dockerSaveFixture(t, layers), "other:latest")
+	assert.ErrorContains(t, err, "image other:latest not in the archive")
+	_, err = NewImageFileClient(ociFixture(t, layers), "example.com/test:latest")
+	assert.NoError(t, err)
+	_, err = NewImageFileClient(ociFixture(t, layers), "test:v2")
+	assert.ErrorContains(t, err, "image test:v2 not in the OCI layout")
+
+	// Not images
+	_, err = NewImageFileClient(t.TempDir(), "")
+	assert.ErrorContains(t, err, "neither a docker save archive nor an OCI layout")
+	notTar := filepath.Join(t.TempDir(), "file")
+	writeFile(t, notTar, bytes.Repeat([]byte("x"), 1024))
+	_, err = NewImageFileClient(notTar, "")
+	assert.ErrorContains(t, err, "not a tarball")
+	_, err = NewImageFileClient(filepath.Join(t.TempDir(), "missing"), "")
+	assert.Error(t, err)
+
+	// zstd layers are not supported
+	_, err = NewImageFileClient(dockerSaveFixture(t, [][]byte{{0x28, 0xb5, 0x2f, 0xfd, 0}}), "")
+	assert.ErrorContains(t, err, "zstd compressed layers are not supported")
+}
+
+func TestImageFileClientReadOnly(t *testing.T) {
+	c, err := NewImageFileClient(dockerSaveFixture(t, testLayers(t)), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	ctx := context.Background()
+	var attr statAttr
+
+	_, _, errno := c.open(ctx, "/etc/hostname", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	_, errno = c.create(ctx, "/etc/new", syscall.O_WRONLY, 0644, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	assert.Equal(t, syscall.EROFS, c.unlink(ctx, "/etc/hostname"))
+	assert.Equal(t, syscall.EROFS, c.mkdir(ctx, "/new", 0755, &attr))
+	assert.Equal(t, syscall.EROFS, c.rename(ctx, "/etc", "/etc2", 0))
+	assert.Equal(t, syscall.EROFS, c.setAttr(ctx, "/etc", nil, &attr))
+	assert.Error(t, c.watchChanges(ctx, nil))
+
+	// Reads, seeks and handles
+	fh, _, errno := c.open(ctx, "/etc/hostname", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uint64(6), attr.FuseAttr.Size)
+	data, errno := c.read(ctx, fh, 2, 2)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "ye", string(data))
+	data, _ = c.read(ctx, fh, 4, 10)
+	assert.Equal(t, "r1", string(data))
+	n, errno := c.seek(ctx, fh, 0, seekHole)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, int64(6), n)
+	_, errno = c.seek(ctx, fh, 6, seekData)
+	assert.Equal(t, syscall.ENXIO, errno)
+	assert.Equal(t, syscall.Errno(0), c.close(ctx, fh))
+	_, errno = c.read(ctx, fh, 0, 1)
+	assert.Equal(t, syscall.EBADF, errno)
+	assert.Equal(t, syscall.EBADF, c.close(ctx, fh))
+
+	_, _, errno = c.open(ctx, "/etc", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.EOPNOTSUPP, errno)
+	_, _, errno = c.open(ctx, "/missing", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.ENOENT, errno)
+	_, errno = c.readDir(ctx, "/etc/hostname")
+	assert.Equal(t, syscall.ENOTDIR, errno)
+	_, errno = c.readlink(ctx, "/etc/hostname")
+	assert.Equal(t, syscall.EINVAL, errno)
+}
@@ -0,0 +1,397 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/net/websocket"
+)
+
+// Channels of Kubernetes exec streams
+const (
+	kubeStdin  = 0
+	kubeStdout = 1
+	kubeStderr = 2
+	kubeError  = 3
+	// Closes the stream given in the next byte, with the v5 protocol
+	kubeClose = 255
+)
+
+// kubeDefaultContainerAnnotation names the container kubectl uses by default
+const kubeDefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// kubePod is the part of a pod object used here
+type kubePod struct {
+	Metadata struct {
+		Name        string
+		Namespace   string
+		UID         string
+		Annotations map[string]string
+	}
+	Spec struct {
+		NodeName   string
+		Containers []struct{ Name string }
+	}
+	Status struct {
+		ContainerStatuses []struct{ Name, ContainerID string }
+	}
+}
+
+// kubeNode is the part of a node object used here
+type kubeNode struct {
+	Status struct {
+		NodeInfo struct {
+			Architecture    string
+			OperatingSystem string
+		}
+	}
+}
+
+// kubeBackend serves a container of a Kubernetes pod. Commands (the satellite included) run
+// through the exec subresource, and files are copied with tar, as kubectl cp does.
+type kubeBackend struct {
+	satellitePlacement
+	api       *kubeAPI
+	namespace string
+	pod       string
+	container string
+}
+
+// kubeExec is the outcome of an exec session
+type kubeExec struct {
+	mu       sync.Mutex
+	done     bool
+	exitCode int
+	// Set when the command could not run, or failed
+	err error
+}
+
+// kubeStream is the stream of an exec session, carrying the satellite. Stdin goes to channel 0;
+// stdout comes from channel 1, stderr from channel 2, and the outcome of the command from channel 3.
+type kubeStream struct {
+	*websocket.Conn
+	exec    *kubeExec
+	v5      bool
+	writeMu sync.Mutex
+	// Stdout received and not read yet
+	pending []byte
+	// Stderr, when strict
+	stderr bytes.Buffer
+	// Fail reads at the end of the stream if the command failed
+	strict bool
+}
+
+// WithKubernetes serves a container of a Kubernetes pod, named pod[/namespace[/container]] instead
+// of a Docker container: it selects BackendKubernetes
+func WithKubernetes(config KubeConfig) ClientOption {
+	return func(d *DockerFuseClient) {
+		d.backendName = BackendKubernetes
+		d.backendConfig.Kube = config
+	}
+}
+
+// parseKubeTarget parses pod/namespace[/container]
+func parseKubeTarget(target string) (pod string, namespace string, containerName string, err error) {
+	parts := strings.Split(target, "/")
+	if len(parts) > 3 || slices.Contains(parts, "") {
+		return "", "", "", fmt.Errorf("invalid pod %q (expected pod[/namespace[/container]])", target)
+	}
+	parts = append(parts, "", "")
+	return parts[0], parts[1], parts[2], nil
+}
+
+// newKubeBackend returns the backend serving the pod named by target, pod[/namespace[/container]].
+// The namespace defaults to the one of the kubeconfig context, and the container to the default
+// one of the pod.
+func newKubeBackend(target string, config BackendConfig) (Backend, error) {
+	podName, namespace, containerName, err := parseKubeTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	api, err := loadKubeConfig(config.Kube)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = api.namespace
+	}
+	k := &kubeBackend{api: api, namespace: namespace, pod: podName, container: containerName}
+	pod, err := k.getPod(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if k.container == "" {
+		k.container = pod.Metadata.Annotations[kubeDefaultContainerAnnotation]
+	}
+	if k.container == "" && len(pod.Spec.Containers) > 0 {
+		k.container = pod.Spec.Containers[0].Name
+	}
+	k.satellitePlacement = newSatellitePlacement(k, namespace+"/"+podName+"/"+k.container, config)
+	slog.Debug("using the kubernetes API", "server", api.server, "pod", namespace+"/"+podName, "container", k.container)
+	return k, nil
+}
+
+func (k *kubeBackend) getPod(ctx context.Context) (pod kubePod, err error) {
+	err = k.api.get(ctx, path.Join("/api/v1/namespaces", k.namespace, "pods", k.pod), &pod)
+	return
+}
+
+// Resolve identifies the container of the pod, whose ID changes when it restarts
+func (k *kubeBackend) Resolve(ctx context.Context) (Target, error) {
+	pod, err := k.getPod(ctx)
+	if err != nil {
+		return Target{}, err
+	}
+	found := false
+	for _, c := range pod.Spec.Containers {
+		found = found || c.Name == k.container
+	}
+	if !found {
+		return Target{}, fmt.Errorf("container %q not found in pod %s/%s", k.container, k.namespace, k.pod)
+	}
+	target := Target{ID: pod.Metadata.UID}
+	for _, s := range pod.Status.ContainerStatuses {
+		if _, id, ok := strings.Cut(s.ContainerID, "://"); ok && s.Name == k.container {
+			target.ID = id
+		}
+	}
+	return target, nil
+}
+
+// Arch returns the architecture of the node running the pod, or if the node cannot be read (e.g.,
+// for lack of permissions), the one `uname -m` reports in the container
+func (k *kubeBackend) Arch(ctx context.Context) (arch string, variant string, err error) {
+	pod, err := k.getPod(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	var node kubeNode
+	err = k.api.get(ctx, path.Join("/api/v1/nodes", pod.Spec.NodeName), &node)
+	if err == nil && node.Status.NodeInfo.Architecture != "" {
+		return node.Status.NodeInfo.Architecture, "", nil
+	}
+	slog.Warn("cannot read the node of the pod, asking the container for its architecture", "node", pod.Spec.NodeName, "error", err)
+	out, runErr := k.run(ctx, []string{"uname", "-m"}, nil)
+	if runErr != nil {
+		return "", "", fmt.Errorf("cannot tell the architecture of the pod: %s", runErr)
+	}
+	a, ok := unameArchs[strings.TrimSpace(string(out))]
+	if !ok {
+		return "", "", fmt.Errorf("unknown machine: %s", strings.TrimSpace(string(out)))
+	}
+	return a[0], a[1], nil
+}
+
+// output runs cmd in the container, and returns its standard output
+func (k *kubeBackend) output(ctx context.Context, cmd ...string) (string, error) {
+	out, err := k.run(ctx, cmd, nil)
+	return string(out), err
+}
+
+// start runs cmd in the container, carrying its stdin and stdout
+func (k *kubeBackend) start(ctx context.Context, cmd []string) (SatelliteConn, error) {
+	return k.exec(ctx, cmd, true, false)
+}
+
+// exec starts cmd in the container, attaching its stdout, and its stdin and stderr if asked
+func (k *kubeBackend) exec(ctx context.Context, cmd []string, stdin bool, stderr bool) (*kubeStream, error) {
+	query := url.Values{
+		"container": {k.container},
+		"command":   cmd,
+		"stdin":     {strconv.FormatBool(stdin)},
+		"stdout":    {"true"},
+		"stderr":    {strconv.FormatBool(stderr)},
+		"tty":       {"false"},
+	}
+	ws, err := k.api.dial(ctx, path.Join("/api/v1/namespaces", k.namespace, "pods", k.pod, "exec"), query)
+	if err != nil {
+		return nil, fmt.Errorf("cannot exec in pod %s/%s: %s", k.namespace, k.pod, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &kubeStream{Conn: ws, exec: &kubeExec{}, v5: slices.Equal(ws.Config().Protocol, kubeExecProtocols[:1])}, nil
+}
+
+// run runs cmd in the container, with stdin as input, and returns its output
+func (k *kubeBackend) run(ctx context.Context, cmd []string, stdin io.Reader) ([]byte, error) {
+	stream, err := k.exec(ctx, cmd, stdin != nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.strict = true
+	if stdin != nil {
+		if _, err := io.Copy(stream, stdin); err != nil {
+			return nil, err
+		}
+		// Without v5, commands reading stdin must stop by themselves (tar stops at the end of the archive)
+		if stream.v5 {
+			if err := stream.CloseWrite(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return io.ReadAll(stream)
+}
+
+func (s *kubeStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := websocket.Message.Send(s.Conn, append([]byte{kubeStdin}, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite closes stdin, which only the v5 protocol can do
+func (s *kubeStream) CloseWrite() error {
+	if !s.v5 {
+		return errors.New("closing stdin needs the v5.channel.k8s.io protocol")
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return websocket.Message.Send(s.Conn, []byte{kubeClose, kubeStdin})
+}
+
+func (s *kubeStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(s.Conn, &msg); err != nil {
+			return 0, s.end(err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		channel, data := msg[0], msg[1:]
+		switch {
+		case channel == kubeError:
+			s.exec.finish(data)
+		case channel == kubeStderr && s.strict:
+			s.stderr.Write(data)
+		case channel == kubeStdout:
+			s.pending = data
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Stop closes the satellite input and waits for it to exit, up to ctx. Without the v5 protocol,
+// closing the connection is the best that can be done.
+func (s *kubeStream) Stop(ctx context.Context) error {
+	if !s.v5 {
+		return nil
+	}
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("cannot close the satellite input: %w", err)
+	}
+	for {
+		s.exec.mu.Lock()
+		done := s.exec.done
+		s.exec.mu.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("satellite did not exit: %w", ctx.Err())
+		case <-time.After(satelliteExitPoll):
+		}
+	}
+}
+
+// end records the end of the stream, and returns the error reads should return
+func (s *kubeStream) end(err error) error {
+	e := s.exec
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.done {
+		e.done = true
+		if err != io.EOF {
+			e.exitCode, e.err = -1, err
+		}
+	}
+	if s.strict && e.err != nil {
+		if stderr := strings.TrimSpace(s.stderr.String()); stderr != "" {
+			return fmt.Errorf("%s: %s", e.err, stderr)
+		}
+		return e.err
+	}
+	return io.EOF
+}
+
+// finish records the outcome of the command, sent as a status object
+func (e *kubeExec) finish(data []byte) {
+	var status kubeStatus
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done = true
+	if err := json.Unmarshal(data, &status); err != nil {
+		e.exitCode, e.err = -1, fmt.Errorf("invalid exec status: %s", err)
+		return
+	}
+	if status.Status == "Success" {
+		return
+	}
+	e.exitCode, e.err = -1, fmt.Errorf("command failed: %s", status.Message)
+	for _, c := range status.Details.Causes {
+		if c.Reason == "ExitCode" {
+			e.exitCode, _ = strconv.Atoi(c.Message)
+		}
+	}
+}
+
+// statPath stats fullPath with stat(1), which the container must provide
+func (k *kubeBackend) statPath(ctx context.Context, fullPath string) (container.PathStat, error) {
+	out, err := k.run(ctx, []string{"stat", "-c", "%s %f", "--", fullPath}, nil)
+	if err != nil {
+		return container.PathStat{}, err
+	}
+	var size int64
+	var mode uint32
+	if _, err := fmt.Sscanf(string(out), "%d %x", &size, &mode); err != nil {
+		return container.PathStat{}, fmt.Errorf("unexpected stat output %q", out)
+	}
+	return container.PathStat{Name: path.Base(fullPath), Size: size, Mode: unixFileMode(mode)}, nil
+}
+
+// unixFileMode converts a unix file mode to a fs.FileMode
+func unixFileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= fs.ModeDir
+	case syscall.S_IFLNK:
+		m |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= fs.ModeDevice
+	}
+	return m
+}
+
+// extract unpacks archive in dir with tar, in the container
+func (k *kubeBackend) extract(ctx context.Context, dir string, archive io.Reader) error {
+	_, err := k.run(ctx, []string{"tar", "-xmf", "-", "-C", dir}, archive)
+	return err
+}
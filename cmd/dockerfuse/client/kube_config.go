@@ -0,0 +1,385 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/net/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// KubeConfig selects the Kubernetes cluster and credentials, as kubectl does
+type KubeConfig struct {
+	// Kubeconfig file, by default the files listed in KUBECONFIG, or ~/.kube/config
+	Path string
+	// Kubeconfig context, by default the current one
+	Context string
+}
+
+// kubeConfigFile is the part of a kubeconfig file used here
+type kubeConfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster kubeCluster
+	}
+	Users []struct {
+		Name string
+		User kubeUser
+	}
+	Contexts []struct {
+		Name    string
+		Context kubeContext
+	}
+}
+
+type kubeCluster struct {
+	Server                   string
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	TLSServerName            string `yaml:"tls-server-name"`
+}
+
+type kubeUser struct {
+	Token                 string
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Username              string
+	Password              string
+	// Credential plugin, as used by managed clusters (e.g. aws eks get-token)
+	Exec *struct {
+		APIVersion string `yaml:"apiVersion"`
+		Command    string
+		Args       []string
+		Env        []struct{ Name, Value string }
+	}
+}
+
+type kubeContext struct {
+	Cluster   string
+	User      string
+	Namespace string
+}
+
+// kubeAPI is a client of the Kubernetes API
+type kubeAPI struct {
+	server    *url.URL
+	tlsConfig *tls.Config
+	http      *http.Client
+	user      kubeUser
+	// Default namespace of the context
+	namespace string
+
+	// Token of the credential plugin
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// kubeStatus is an error, or the outcome of a command, returned by the Kubernetes API
+type kubeStatus struct {
+	Status  string
+	Message string
+	Reason  string
+	Code    int
+	Details struct {
+		Causes []struct{ Reason, Message string }
+	}
+}
+
+// kubeConfigPaths returns the kubeconfig files to read, in order of precedence
+func kubeConfigPaths(config KubeConfig) []string {
+	if config.Path != "" {
+		return []string{config.Path}
+	}
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)
+	}
+	home, _ := os.UserHomeDir()
+	return []string{filepath.Join(home, ".kube", "config")}
+}
+
+// loadKubeConfig reads the kubeconfig files selected by config, and returns a client of the
+// cluster of the selected context. As with kubectl, the first file defining an entry wins.
+func loadKubeConfig(config KubeConfig) (*kubeAPI, error) {
+	var (
+		current  string
+		clusters = make(map[string]kubeCluster)
+		users    = make(map[string]kubeUser)
+		contexts = make(map[string]kubeContext)
+	)
+	found := false
+	for _, p := range kubeConfigPaths(config) {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) && config.Path == "" {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		var f kubeConfigFile
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("cannot read kubeconfig %s: %s", p, err)
+		}
+		// Relative paths are relative to the file
+		dir := filepath.Dir(p)
+		if current == "" {
+			current = f.CurrentContext
+		}
+		for _, c := range f.Clusters {
+			if _, ok := clusters[c.Name]; !ok {
+				c.Cluster.CertificateAuthority = kubeConfigRel(dir, c.Cluster.CertificateAuthority)
+				clusters[c.Name] = c.Cluster
+			}
+		}
+		for _, u := range f.Users {
+			if _, ok := users[u.Name]; !ok {
+				u.User.TokenFile = kubeConfigRel(dir, u.User.TokenFile)
+				u.User.ClientCertificate = kubeConfigRel(dir, u.User.ClientCertificate)
+				u.User.ClientKey = kubeConfigRel(dir, u.User.ClientKey)
+				users[u.Name] = u.User
+			}
+		}
+		for _, c := range f.Contexts {
+			if _, ok := contexts[c.Name]; !ok {
+				contexts[c.Name] = c.Context
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no kubeconfig found (set KUBECONFIG or -kubeconfig)")
+	}
+
+	name := config.Context
+	if name == "" {
+		name = current
+	}
+	if name == "" {
+		return nil, errors.New("no current context in kubeconfig")
+	}
+	selected, ok := contexts[name]
+	if !ok {
+		return nil, fmt.Errorf("kubeconfig context %q not found", name)
+	}
+	cluster, ok := clusters[selected.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("kubeconfig cluster %q not found", selected.Cluster)
+	}
+	k, err := newKubeAPI(cluster, users[selected.User])
+	if err != nil {
+		return nil, err
+	}
+	k.namespace = selected.Namespace
+	if k.namespace == "" {
+		k.namespace = "default"
+	}
+	return k, nil
+}
+
+func kubeConfigRel(dir string, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// kubeConfigData returns inline data, decoded, or the content of file
+func kubeConfigData(data string, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func newKubeAPI(cluster kubeCluster, user kubeUser) (*kubeAPI, error) {
+	server, err := url.Parse(cluster.Server)
+	if err != nil || (server.Scheme != "https" && server.Scheme != "http") {
+		return nil, fmt.Errorf("invalid kubernetes server %q", cluster.Server)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+		ServerName:         cluster.TLSServerName,
+	}
+	ca, err := kubeConfigData(cluster.CertificateAuthorityData, cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the certificate authority: %s", err)
+	}
+	if ca != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid certificate authority")
+		}
+	}
+	cert, err := kubeConfigData(user.ClientCertificateData, user.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the client certificate: %s", err)
+	}
+	key, err := kubeConfigData(user.ClientKeyData, user.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the client key: %s", err)
+	}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return &kubeAPI{
+		server:    server,
+		tlsConfig: tlsConfig,
+		http: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}},
+		user: user,
+	}, nil
+}
+
+// authorization returns the Authorization header for the user, if any
+func (k *kubeAPI) authorization() (string, error) {
+	u := k.user
+	switch {
+	case u.Token != "":
+		return "Bearer " + u.Token, nil
+	case u.TokenFile != "":
+		// Token files are rotated
+		token, err := os.ReadFile(u.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + strings.TrimSpace(string(token)), nil
+	case u.Username != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username+":"+u.Password)), nil
+	case u.Exec != nil:
+		token, err := k.execToken()
+		if err != nil {
+			return "", fmt.Errorf("cannot get credentials from %s: %s", u.Exec.Command, err)
+		}
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+// execToken runs the credential plugin, unless the token it returned last is still valid
+func (k *kubeAPI) execToken() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.token != "" && (k.tokenExpiry.IsZero() || time.Now().Add(time.Minute).Before(k.tokenExpiry)) {
+		return k.token, nil
+	}
+	plugin := k.user.Exec
+	cmd := exec.Command(plugin.Command, plugin.Args...)
+	cmd.Env = os.Environ()
+	for _, e := range plugin.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf(`KUBERNETES_EXEC_INFO={"apiVersion":%q,"kind":"ExecCredential","spec":{"interactive":false}}`, plugin.APIVersion))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	var credential struct {
+		Status struct {
+			Token               string
+			ExpirationTimestamp time.Time
+		}
+	}
+	if err := json.Unmarshal(out, &credential); err != nil {
+		return "", err
+	}
+	if credential.Status.Token == "" {
+		return "", errors.New("no token returned (client certificates from plugins are not supported)")
+	}
+	k.token, k.tokenExpiry = credential.Status.Token, credential.Status.ExpirationTimestamp
+	return k.token, nil
+}
+
+// get decodes the object at path into out
+func (k *kubeAPI) get(ctx context.Context, path string, out any) error {
+	u := *k.server
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	auth, err := k.authorization()
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		var status kubeStatus
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(resp.Status + " " + string(bytes.TrimSpace(data)))
+		}
+		err := fmt.Errorf("kubernetes: %s", status.Message)
+		if resp.StatusCode == http.StatusNotFound {
+			return errdefs.NotFound(err)
+		}
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// kubeExecProtocols are the channel protocols of exec streams, preferred first. Only v5 can close
+// stdin.
+var kubeExecProtocols = []string{"v5.channel.k8s.io", "v4.channel.k8s.io"}
+
+// dial opens a WebSocket stream to path, e.g. the exec subresource of a pod
+func (k *kubeAPI) dial(ctx context.Context, path string, query url.Values) (*websocket.Conn, error) {
+	u := *k.server
+	u.Scheme = map[string]string{"https": "wss", "http": "ws"}[u.Scheme]
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	config, err := websocket.NewConfig(u.String(), k.server.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = kubeExecProtocols
+	config.TlsConfig = k.tlsConfig
+	auth, err := k.authorization()
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		config.Header = http.Header{"Authorization": {auth}}
+	}
+	return config.DialContext(ctx)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadKubeConfig(t *testing.T) {
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home.yaml")
+	assert.NoError(t, os.WriteFile(home, []byte(`
+current-context: dev
+clusters:
+- name: dev
+  cluster: {server: "https://dev:6443", insecure-skip-tls-verify: true}
+- name: prod
+  cluster: {server: "https://ignored:6443"}
+users:
+- name: dev
+  user: {tokenFile: token}
+- name: basic
+  user: {username: admin, password: pw}
+contexts:
+- name: dev
+  context: {cluster: dev, user: dev}
+- name: basic
+  context: {cluster: dev, user: basic, namespace: ops}
+- name: broken
+  context: {cluster: missing}
+`), 0600))
+	prod := filepath.Join(dir, "prod.yaml")
+	assert.NoError(t, os.WriteFile(prod, []byte(`
+current-context: prod
+clusters:
+- name: prod
+  cluster: {server: "https://prod:6443/k8s"}
+users:
+- name: plugin
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: sh
+      args: ["-c", "echo '{\"status\":{\"token\":\"'$TOKEN'\"}}'"]
+      env: [{name: TOKEN, value: fr0m-plugin}]
+contexts:
+- name: prod
+  context: {cluster: prod, user: plugin, namespace: shop}
+`), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("t0ken\n"), 0600))
+
+	// Files are merged, the first one defining an entry winning
+	t.Setenv("KUBECONFIG", prod+string(filepath.ListSeparator)+home)
+	k, err := loadKubeConfig(KubeConfig{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://prod:6443/k8s", k.server.String())
+		assert.Equal(t, "shop", k.namespace)
+		auth, err := k.authorization()
+		assert.NoError(t, err)
+		assert.Equal(t, "Bearer fr0m-plugin", auth)
+	}
+
+	// Token files are relative to their kubeconfig
+	k, err = loadKubeConfig(KubeConfig{Context: "dev"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "default", k.namespace)
+		assert.True(t, k.tlsConfig.InsecureSkipVerify)
+		auth, err := k.authorization()
+		assert.NoError(t, err)
+		assert.Equal(t, "Bearer t0ken", auth)
+	}
+	k, err = loadKubeConfig(KubeConfig{Path: home, Context: "basic"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ops", k.namespace)
+		auth, err := k.authorization()
+		assert.NoError(t, err)
+		assert.Equal(t, "Basic YWRtaW46cHc=", auth)
+	}
+
+	_, err = loadKubeConfig(KubeConfig{Context: "staging"})
+	assert.EqualError(t, err, `kubeconfig context "staging" not found`)
+	_, err = loadKubeConfig(KubeConfig{Context: "broken"})
+	assert.EqualError(t, err, `kubeconfig cluster "missing" not found`)
+	t.Setenv("KUBECONFIG", filepath.Join(dir, "missing.yaml"))
+	_, err = loadKubeConfig(KubeConfig{})
+	assert.EqualError(t, err, "no kubeconfig found (set KUBECONFIG or -kubeconfig)")
+}
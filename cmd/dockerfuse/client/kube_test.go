@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+const kubeTestPod = `{"metadata":{"name":"web-0","namespace":"shop","uid":"b1e55ed","labels":{"app":"web"},
+	"annotations":{"kubectl.kubernetes.io/default-container":"app"}},
+	"spec":{"nodeName":"node-1","containers":[{"name":"sidecar","image":"envoy"},
+		{"name":"app","image":"alpine:3","command":["/bin/sh","-c"],"args":["sleep infinity"],"env":[{"name":"A","value":"1"}]}]},
+	"status":{"phase":"Running","containerStatuses":[{"name":"app","containerID":"containerd://c0ffee","state":{"running":{"startedAt":"2024-01-02T03:04:05Z"}}}]}}`
+
+// fakeKubeExec runs a command of the fake API server, given its stdin. It returns its stdout,
+// stderr and exit code.
+type fakeKubeExec func(cmd []string, stdin io.Reader) (stdout string, stderr string, exitCode int)
+
+// fakeKubeAPI serves a pod and its node over TLS, and runs exec sessions with run. It returns a
+// kubeconfig selecting it.
+func fakeKubeAPI(t *testing.T, nodeReadable bool, run fakeKubeExec) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/namespaces/shop/pods/web-0", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer s3cr3t", r.Header.Get("Authorization"))
+		io.WriteString(w, kubeTestPod)
+	})
+	mux.HandleFunc("GET /api/v1/namespaces/shop/pods/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"kind":"Status","status":"Failure","message":"pods \"missing\" not found","reason":"NotFound","code":404}`)
+	})
+	mux.HandleFunc("GET /api/v1/nodes/node-1", func(w http.ResponseWriter, r *http.Request) {
+		if !nodeReadable {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"kind":"Status","status":"Failure","message":"nodes \"node-1\" is forbidden","code":403}`)
+			return
+		}
+		io.WriteString(w, `{"status":{"nodeInfo":{"architecture":"arm64","operatingSystem":"linux"}}}`)
+	})
+	mux.Handle("GET /api/v1/namespaces/shop/pods/web-0/exec", websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			assert.Equal(t, kubeExecProtocols, config.Protocol)
+			config.Protocol = kubeExecProtocols[:1]
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			query := ws.Request().URL.Query()
+			assert.Equal(t, "app", query.Get("container"))
+			stdin, stdinW := io.Pipe()
+			go func() {
+				for {
+					var msg []byte
+					if err := websocket.Message.Receive(ws, &msg); err != nil {
+						stdinW.CloseWithError(err)
+						return
+					}
+					switch msg[0] {
+					case kubeStdin:
+						stdinW.Write(msg[1:])
+					case kubeClose:
+						stdinW.Close()
+					}
+				}
+			}()
+			if query.Get("stdin") != "true" {
+				stdinW.Close()
+			}
+			stdout, stderr, exitCode := run(query["command"], stdin)
+			send := func(channel byte, data string) {
+				if data != "" {
+					websocket.Message.Send(ws, append([]byte{channel}, data...))
+				}
+			}
+			send(kubeStdout, stdout)
+			send(kubeStderr, stderr)
+			if exitCode == 0 {
+				send(kubeError, `{"metadata":{},"status":"Success"}`)
+			} else {
+				send(kubeError, fmt.Sprintf(`{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: exit status %d",
+					"reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"%d"}]}}`, exitCode, exitCode))
+			}
+			ws.Close()
+		},
+	})
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	assert.NoError(t, os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: shop
+clusters:
+- name: test
+  cluster:
+    server: `+server.URL+`
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+- name: admin
+  user:
+    token: s3cr3t
+contexts:
+- name: shop
+  context:
+    cluster: test
+    user: admin
+    namespace: shop
+`), 0600))
+	return kubeconfig
+}
+
+func TestParseKubeTarget(t *testing.T) {
+	for target, expected := range map[string][3]string{
+		"web-0":              {"web-0", "", ""},
+		"web-0/shop":         {"web-0", "shop", ""},
+		"web-0/shop/sidecar": {"web-0", "shop", "sidecar"},
+	} {
+		pod, namespace, containerName, err := parseKubeTarget(target)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, [3]string{pod, namespace, containerName}, target)
+	}
+	for _, target := range []string{"", "web-0/", "/shop", "a/b/c/d"} {
+		_, _, _, err := parseKubeTarget(target)
+		assert.ErrorContains(t, err, "invalid pod", target)
+	}
+}
+
+func TestKubeClient(t *testing.T) {
+	var (
+		filesMu sync.Mutex
+		files   = map[string]string{"/etc/hostname": "web-0\n"}
+	)
+	kubeconfig := fakeKubeAPI(t, true, func(cmd []string, stdin io.Reader) (string, string, int) {
+		filesMu.Lock()
+		defer filesMu.Unlock()
+		switch {
+		case slicesHasPrefix(cmd, "stat", "-c", "%s %f", "--"):
+			if content, ok := files[cmd[4]]; ok {
+				return fmt.Sprintf("%d 81a4\n", len(content)), "", 0
+			}
+			if cmd[4] == "/tmp" {
+				return "4096 43ff\n", "", 0
+			}
+			return "", "stat: cannot statx '" + cmd[4] + "': No such file or directory\n", 1
+		case slicesHasPrefix(cmd, "tar", "-xmf", "-", "-C"):
+			data, err := io.ReadAll(stdin)
+			assert.NoError(t, err)
+			files[cmd[4]+"/upload.tar"] = string(data)
+			return "", "", 0
+		case slicesHasPrefix(cmd, "tar", "-cf", "-", "-C"):
+			if cmd[5] != "hostname" {
+				return "", "tar: " + cmd[5] + ": Cannot stat: No such file or directory\n", 2
+			}
+			return "tar!", "", 0
+		case slicesHasPrefix(cmd, "/tmp/satellite"):
+			// Echoes its input, as a session the client ends by closing it
+			data, _ := io.ReadAll(stdin)
+			return string(data), "", 3
+		case slicesHasPrefix(cmd, "sh", "-c"):
+			return "out", "err", 0
+		}
+		return "", "unexpected command " + strings.Join(cmd, " "), 127
+	})
+	backend, err := newKubeBackend("web-0", BackendConfig{Kube: KubeConfig{Path: kubeconfig}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	k := backend.(*kubeBackend)
+	ctx := context.Background()
+
+	// The namespace is the one of the context, and the container the default one of the pod
+	assert.Equal(t, "shop", k.namespace)
+	assert.Equal(t, "app", k.container)
+	target, err := k.Resolve(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "c0ffee", target.ID)
+	arch, _, err := k.Arch(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "arm64", arch)
+
+	// Files are stat'ed and copied with commands in the container
+	stat, err := k.statPath(ctx, "/etc/hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, container.PathStat{Name: "hostname", Size: 6, Mode: 0644}, stat)
+	stat, err = k.statPath(ctx, "/tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0777, stat.Mode)
+	_, err = k.statPath(ctx, "/missing")
+	assert.ErrorContains(t, err, "No such file or directory")
+	assert.NoError(t, k.extract(ctx, "/tmp", strings.NewReader("satellite")))
+	assert.Equal(t, "satellite", files["/tmp/upload.tar"])
+
+	// Output is the standard output, without a TTY
+	out, err := k.output(ctx, "sh", "-c", "true")
+	assert.NoError(t, err)
+	assert.Equal(t, "out", out)
+	_, err = k.output(ctx, "sh")
+	assert.ErrorContains(t, err, "unexpected command sh")
+
+	// Sessions are stopped by closing their input
+	conn, err := k.start(ctx, []string{"/tmp/satellite"})
+	if assert.NoError(t, err) {
+		io.WriteString(conn, "ping")
+		stopped := make(chan error)
+		go func() { stopped <- conn.Stop(ctx) }()
+		echoed, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+		assert.NoError(t, <-stopped)
+		exec := conn.(*kubeStream).exec
+		assert.True(t, exec.done)
+		assert.Equal(t, 3, exec.exitCode)
+		conn.Close()
+	}
+
+	_, err = newKubeBackend("missing", BackendConfig{Kube: KubeConfig{Path: kubeconfig}})
+	assert.True(t, errdefs.IsNotFound(err))
+	assert.EqualError(t, err, `kubernetes: pods "missing" not found`)
+}
+
+func TestKubeClientArchFallback(t *testing.T) {
+	// Nodes can be out of reach of the user: the container is asked instead
+	kubeconfig := fakeKubeAPI(t, false, func(cmd []string, stdin io.Reader) (string, string, int) {
+		assert.Equal(t, []string{"uname", "-m"}, cmd)
+		return "armv7l\n", "", 0
+	})
+	fdc, err := newClient("web-0/shop/app", WithKubernetes(KubeConfig{Path: kubeconfig}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	arch, variant, err := fdc.backend.Arch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "arm", arch)
+	assert.Equal(t, "v7", variant)
+}
+
+// slicesHasPrefix tells whether s starts with prefix
+func slicesHasPrefix(s []string, prefix ...string) bool {
+	return len(s) >= len(prefix) && slices.Equal(s[:len(prefix)], prefix)
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Extended attributes telling where container paths come from
+const (
+	// XattrPrefix starts the names of the extended attributes served by dockerfuse
+	XattrPrefix = "user.dockerfuse."
+	// XattrLayer names the image layer providing the path, as in the layer view
+	XattrLayer = XattrPrefix + "layer"
+	// XattrContainer is "added" or "modified" for paths changed in the writable layer of the
+	// container
+	XattrContainer = XattrPrefix + "container"
+)
+
+// How long changes of the writable layer are reused for extended attributes
+const containerDiffTTL = 2 * time.Second
+
+// Layers serves the layers of an image, each in its own directory named "<n>-<digest>" as stored
+// in the image, with a history file describing them. As an XattrSource, it tells which layer
+// provides each path of the merged filesystem, and whether the container changed it.
+type Layers struct {
+	readOnlyClient
+
+	docker      dockerClient
+	containerID string
+
+	mu sync.Mutex
+	// Loads the image on first use, nil once loaded
+	load  func() (*ImageFileClient, error)
+	image *ImageFileClient
+	view  *ImageFileClient
+
+	diffMu   sync.Mutex
+	diff     map[string]container.ChangeType
+	diffTime time.Time
+}
+
+// NewImageFileLayers returns the layers of an image file client
+func NewImageFileLayers(image *ImageFileClient) (*Layers, error) {
+	l := &Layers{}
+	if err := l.setImage(image); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewContainerLayers returns the layers of the image of a container. The image is saved to a
+// temporary file, removed on Close, the first time the layers or their extended attributes are
+// accessed, as saving big images takes a while.
+func NewContainerLayers(containerID string, opts ...ClientOption) (*Layers, error) {
+	docker, err := newDockerAPI(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	info, err := docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+	if info.ContainerJSONBase == nil {
+		return nil, fmt.Errorf("cannot find the image of container %s", containerID)
+	}
+	return &Layers{
+		docker:      docker,
+		containerID: containerID,
+		load: func() (*ImageFileClient, error) {
+			return saveImage(context.Background(), docker, info.Image)
+		},
+	}, nil
+}
+
+// NewImageLayers returns the layers of the image ref. The image is saved to a temporary file,
+// removed on Close.
+func NewImageLayers(ref string, opts ...ClientOption) (*Layers, error) {
+	docker, err := newDockerAPI("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	image, err := saveImage(context.Background(), docker, ref)
+	if err != nil {
+		return nil, err
+	}
+	l := &Layers{docker: docker}
+	if err := l.setImage(image); err != nil {
+		image.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// saveImage saves the image ref to a temporary file, and returns a client serving it
+func saveImage(ctx context.Context, docker dockerClient, ref string) (*ImageFileClient, error) {
+	slog.Info("saving image to read its layers", "image", ref)
+	saved, err := docker.ImageSave(ctx, []string{ref})
+	if err != nil {
+		return nil, fmt.Errorf("cannot save image %s: %s", ref, err)
+	}
+	defer saved.Close()
+	tmp, err := os.CreateTemp("", "dockerfuse-image-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, saved)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot save image %s: %s", ref, err)
+	}
+
+	image, err := NewImageFileClient(tmp.Name(), "")
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	image.temps = append(image.temps, tmp.Name())
+	return image, nil
+}
+
+// setImage serves the layers of image
+func (l *Layers) setImage(image *ImageFileClient) error {
+	view, err := image.layerView()
+	if err != nil {
+		return err
+	}
+	l.image, l.view = image, view
+	return nil
+}
+
+// loaded returns the image and its layer view, loading the image if needed. Failed loads are
+// tried again on the next access.
+func (l *Layers) loaded() (image *ImageFileClient, view *ImageFileClient, syserr syscall.Errno) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.load != nil {
+		image, err := l.load()
+		if err == nil {
+			if err = l.setImage(image); err != nil {
+				image.Close()
+			}
+		}
+		if err != nil {
+			slog.Error("cannot load the image layers", "error", err)
+			return nil, nil, syscall.EIO
+		}
+		l.load = nil
+	}
+	return l.image, l.view, 0
+}
+
+// Close releases the image, if it was loaded
+func (l *Layers) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.view != nil {
+		l.view.Close()
+		l.image.Close()
+	}
+	l.load = nil
+}
+
+func (l *Layers) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return
+	}
+	return view.stat(ctx, fullPath, attr)
+}
+
+func (l *Layers) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return nil, syserr
+	}
+	return view.readDir(ctx, fullPath)
+}
+
+func (l *Layers) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return []byte{}, syserr
+	}
+	return view.readlink(ctx, fullPath)
+}
+
+func (l *Layers) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return nil, 0, syserr
+	}
+	return view.open(ctx, fullPath, flags, modeIn, attr)
+}
+
+func (l *Layers) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return nil, syserr
+	}
+	return view.read(ctx, fh, offset, n)
+}
+
+func (l *Layers) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return 0, syserr
+	}
+	return view.seek(ctx, fh, offset, whence)
+}
+
+func (l *Layers) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	_, view, syserr := l.loaded()
+	if syserr != 0 {
+		return syserr
+	}
+	return view.close(ctx, fh)
+}
+
+// containerDiff returns the paths changed in the writable layer of the container
+func (l *Layers) containerDiff(ctx context.Context) (map[string]container.ChangeType, error) {
+	l.diffMu.Lock()
+	defer l.diffMu.Unlock()
+	if l.diff != nil && time.Since(l.diffTime) < containerDiffTTL {
+		return l.diff, nil
+	}
+	changes, err := l.docker.ContainerDiff(ctx, l.containerID)
+	if err != nil {
+		return nil, err
+	}
+	l.diff = make(map[string]container.ChangeType, len(changes))
+	for _, c := range changes {
+		l.diff[path.Clean(c.Path)] = c.Kind
+	}
+	l.diffTime = time.Now()
+	return l.diff, nil
+}
+
+func (l *Layers) xattrs(ctx context.Context, fullPath string) (map[string]string, syscall.Errno) {
+	image, _, syserr := l.loaded()
+	if syserr != 0 {
+		return nil, syserr
+	}
+	attrs := make(map[string]string)
+	if e, ok := image.entries[fullPath]; ok {
+		attrs[XattrLayer] = image.layerName(e.layer)
+	}
+	if l.containerID == "" {
+		return attrs, 0
+	}
+	diff, err := l.containerDiff(ctx)
+	if err != nil {
+		slog.Warn("cannot list the changes of the container", "error", err)
+		return nil, syscall.EIO
+	}
+	kind, changed := diff[fullPath]
+	if !changed {
+		return attrs, 0
+	}
+	_, inImage := attrs[XattrLayer]
+	if kind == container.ChangeModify && inImage {
+		attrs[XattrContainer] = "modified"
+	} else if kind != container.ChangeDelete {
+		// Anything the image had there was deleted first
+		attrs[XattrContainer] = "added"
+		delete(attrs, XattrLayer)
+	}
+	return attrs, 0
+}
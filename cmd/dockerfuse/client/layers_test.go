@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testConfig is an image configuration matching testLayers, with an empty layer in the history
+const testConfig = `{
+	"rootfs": {"type": "layers", "diff_ids": [
+		"sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	]},
+	"history": [
+		{"created_by": "ADD rootfs.tar /"},
+		{"created_by": "ENV A=b", "empty_layer": true},
+		{"created_by": "RUN update"}
+	]
+}`
+
+func TestImageFileLayers(t *testing.T) {
+	c, err := NewImageFileClient(dockerSaveFixture(t, testLayers(t)), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := NewImageFileLayers(c)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	ctx := context.Background()
+
+	// Layers are named after digests in the archive, without a usable configuration
+	assert.Equal(t, []string{"0-aaa", "1-bbb", "history"}, dirNames(t, l, "/"))
+	assert.Equal(t, "0-aaa\taaa\t"+fmt.Sprint(c.layers[0].tar.Size())+"\t\n1-bbb\tbbb\t"+fmt.Sprint(c.layers[1].tar.Size())+"\t\n",
+		readImageFile(t, l, "/history"))
+
+	// Layers are shown as stored, whiteouts included
+	assert.Equal(t, []string{".wh.removed", "hostname"}, dirNames(t, l, "/1-bbb/etc"))
+	assert.Equal(t, "base", readImageFile(t, l, "/0-aaa/etc/hostname"))
+	assert.Equal(t, "layer1", readImageFile(t, l, "/1-bbb/etc/hostname"))
+	assert.Equal(t, []string{".wh..wh..opq", "new"}, dirNames(t, l, "/1-bbb/opt"))
+
+	// Paths of the merged filesystem tell their layer
+	attrs, errno := l.xattrs(ctx, "/etc/hostname")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, map[string]string{XattrLayer: "1-bbb"}, attrs)
+	attrs, _ = l.xattrs(ctx, "/opt/sub/deep")
+	assert.Empty(t, attrs)
+}
+
+func TestNewContainerLayers(t *testing.T) {
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "sha256:image"},
+	}, nil)
+	mDC.On("ImageSave", mock.Anything, []string{"sha256:image"}).Return(
+		io.NopCloser(bytes.NewReader(dockerSaveTar(t, testLayers(t), testConfig))), nil)
+	mDC.On("ContainerDiff", mock.Anything, "c").Return([]container.FilesystemChange{
+		{Path: "/etc", Kind: container.ChangeModify},
+		{Path: "/etc/hostname", Kind: container.ChangeModify},
+		{Path: "/etc/removed", Kind: container.ChangeAdd},
+		{Path: "/opt/new", Kind: container.ChangeDelete},
+		{Path: "/tmp/x", Kind: container.ChangeAdd},
+	}, nil).Once()
+
+	l, err := NewContainerLayers("c")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+
+	// The image is only saved when the layers are accessed
+	mDC.AssertNotCalled(t, "ImageSave", mock.Anything, mock.Anything)
+
+	// Layers are named after their diff ID, with the command that built them
+	assert.Equal(t, []string{"0-0123456789ab", "1-fedcba987654", "history"}, dirNames(t, l, "/"))
+	assert.Contains(t, readImageFile(t, l, "/history"),
+		"1-fedcba987654\tsha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210\t")
+	assert.Contains(t, readImageFile(t, l, "/history"), "\tRUN update\n")
+
+	// Changes in the container are reported, and reused for a while
+	for p, expected := range map[string]map[string]string{
+		"/etc":          {XattrLayer: "0-0123456789ab", XattrContainer: "modified"},
+		"/etc/hostname": {XattrLayer: "1-fedcba987654", XattrContainer: "modified"},
+		"/etc/removed":  {XattrContainer: "added"},
+		"/tmp/x":        {XattrContainer: "added"},
+		"/usr/bin/tool": {XattrLayer: "1-fedcba987654"},
+	} {
+		attrs, errno := l.xattrs(ctx, p)
+		assert.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, expected, attrs, p)
+	}
+	mDC.AssertExpectations(t)
+
+	// The saved image is removed on Close
+	saved := l.image.temps[0]
+	l.Close()
+	_, err = os.Stat(saved)
+	assert.True(t, os.IsNotExist(err))
+
+	// Docker errors
+	l.diff = nil
+	mDC.On("ContainerDiff", mock.Anything, "c").Return([]container.FilesystemChange{}, fmt.Errorf("gone")).Once()
+	_, errno := l.xattrs(ctx, "/etc")
+	assert.Equal(t, syscall.EIO, errno)
+
+	mDC.On("ImageSave", mock.Anything, []string{"missing"}).Return(io.NopCloser(&bytes.Buffer{}), fmt.Errorf("no such image"))
+	_, err = NewImageLayers("missing")
+	assert.EqualError(t, err, "cannot save image missing: no such image")
+}
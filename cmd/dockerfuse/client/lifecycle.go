@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Policies applied when the container stops for good
+const (
+	// ExitUnmount unmounts the filesystem
+	ExitUnmount = "unmount"
+	// ExitStale keeps serving cached content read-only, as in offline mode
+	ExitStale = "stale"
+)
+
+const (
+	// DefaultLifecycleTimeout is how long I/O waits for a paused or restarting container
+	DefaultLifecycleTimeout = 10 * time.Second
+	// DefaultRestartGrace is how long a stopped container may take to start again
+	DefaultRestartGrace = 10 * time.Second
+)
+
+// Handles carry the satellite generation that opened them in their upper bits, so that handles
+// opened before a restart are not mistaken for descriptors of the new satellite
+const handleGenerationShift = 32
+
+var (
+	errContainerUnavailable = errors.New("errno: EAGAIN")
+	errContainerGone        = errors.New("errno: EIO")
+)
+
+// ErrNoLifecycleEvents is returned by WatchLifecycle for backends without events about their target
+// (pods, containerd tasks, processes and SSH hosts)
+var ErrNoLifecycleEvents = errors.New("does not report lifecycle events")
+
+// containerState tracks the container, as told by Docker events
+type containerState int
+
+const (
+	containerRunning containerState = iota
+	containerPaused
+	// Stopped, possibly restarting
+	containerStopped
+	// Stopped for good, the exit policy applies
+	containerGone
+)
+
+// LifecycleConfig tells how the client follows the container when it is paused, restarted or stopped
+type LifecycleConfig struct {
+	// How long I/O waits for a paused or restarting container, before failing with EAGAIN
+	Timeout time.Duration
+	// How long a stopped container may take to start again, before OnExit applies
+	RestartGrace time.Duration
+	// ExitUnmount or ExitStale
+	OnExit string
+	// Unmount unmounts the filesystem, for ExitUnmount
+	Unmount func()
+}
+
+// WatchLifecycle follows Docker events about the container, until ctx is done or the container is
+// destroyed. I/O waits while the container is paused or restarting, the satellite is started again
+// after restarts, and config.OnExit applies when the container stops for good.
+func (d *DockerFuseClient) WatchLifecycle(ctx context.Context, config LifecycleConfig) error {
+	if config.OnExit != ExitUnmount && config.OnExit != ExitStale {
+		return fmt.Errorf("unknown exit policy %q (supported: %s, %s)", config.OnExit, ExitUnmount, ExitStale)
+	}
+	watcher, ok := d.backend.(lifecycleBackend)
+	if !ok {
+		return fmt.Errorf("the %s backend %w", d.backendName, ErrNoLifecycleEvents)
+	}
+	d.lifecycleMu.Lock()
+	d.lifecycleTimeout = config.Timeout
+	d.lifecycleMu.Unlock()
+	d.followingLifecycle.Store(true)
+	defer d.followingLifecycle.Store(false)
+
+	options := events.ListOptions{Filters: filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("container", d.containerID),
+	)}
+	var grace <-chan time.Time
+	for {
+		subCtx, cancel := context.WithCancel(ctx)
+		messages, errs := watcher.Events(subCtx, options)
+		for subscribed := true; subscribed; {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return nil
+			case err := <-errs:
+				slog.Warn("error following container events, subscribing again", "error", err)
+				subscribed = false
+			case <-grace:
+				grace = nil
+				d.containerExited(config, "container did not start again")
+			case m := <-messages:
+				options.Since = fmt.Sprintf("%d.%09d", m.TimeNano/int64(time.Second), m.TimeNano%int64(time.Second))
+				switch m.Action {
+				case events.ActionPause:
+					d.setContainerState(containerPaused)
+					slog.Info("container paused, holding I/O", "container", d.containerID)
+				case events.ActionUnPause:
+					d.setContainerState(containerRunning)
+					slog.Info("container unpaused, resuming I/O", "container", d.containerID)
+				case events.ActionDie:
+					d.setContainerState(containerStopped)
+					d.disconnect()
+					slog.Warn("container stopped, waiting for it to start again", "container", d.containerID, "grace", config.RestartGrace)
+					grace = time.After(config.RestartGrace)
+				case events.ActionStart:
+					if d.getContainerState() == containerRunning {
+						continue
+					}
+					grace = nil
+					slog.Info("container started, reconnecting", "container", d.containerID)
+					if err := d.reconnect(ctx); err != nil {
+						slog.Error("cannot reconnect to the container", "container", d.containerID, "error", err)
+						d.containerExited(config, "cannot reconnect")
+					} else {
+						slog.Info("reconnected to the container", "container", d.containerID)
+					}
+				case events.ActionDestroy:
+					cancel()
+					d.containerExited(config, "container removed")
+					return nil
+				}
+			}
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+// setContainerState records a container state. I/O waits until the container runs again, or
+// is gone.
+func (d *DockerFuseClient) setContainerState(state containerState) {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	d.containerState = state
+	switch {
+	case (state == containerRunning || state == containerGone) && d.containerReady != nil:
+		close(d.containerReady)
+		d.containerReady = nil
+	case (state == containerPaused || state == containerStopped) && d.containerReady == nil:
+		d.containerReady = make(chan struct{})
+	}
+}
+
+func (d *DockerFuseClient) getContainerState() containerState {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	return d.containerState
+}
+
+// reconnect starts the satellite again in the restarted container. Handles opened before are stale.
+func (d *DockerFuseClient) reconnect(ctx context.Context) error {
+	d.disconnect()
+	d.satelliteGeneration.Add(1)
+	d.invalidateTree("/")
+	if err := d.uploadSatellite(ctx); err != nil {
+		return fmt.Errorf("error copying docker-fuse satellite to remote container: %s", err)
+	}
+	if err := d.connectSatellite(ctx); err != nil {
+		return fmt.Errorf("error connecting to docker-fuse satellite: %s", err)
+	}
+	d.offline.Store(false)
+	d.setContainerState(containerRunning)
+	return nil
+}
+
+// containerExited applies the exit policy
+func (d *DockerFuseClient) containerExited(config LifecycleConfig, reason string) {
+	switch {
+	case config.OnExit == ExitStale && d.goOffline(errors.New(reason)):
+		slog.Warn("container stopped for good, serving cached content read-only", "container", d.containerID, "reason", reason)
+	case config.OnExit == ExitStale:
+		slog.Warn("container stopped for good, nothing cached to serve", "container", d.containerID, "reason", reason)
+	default:
+		slog.Warn("container stopped for good, unmounting", "container", d.containerID, "reason", reason)
+	}
+	d.setContainerState(containerGone)
+	if config.OnExit == ExitUnmount && config.Unmount != nil {
+		config.Unmount()
+	}
+}
+
+// satelliteClient returns the RPC client to the satellite, waiting for paused or restarting
+// containers for a while
+func (d *DockerFuseClient) satelliteClient() (rpcClient, error) {
+	var timeout <-chan time.Time
+	for {
+		d.lifecycleMu.Lock()
+		state, ready, wait := d.containerState, d.containerReady, d.lifecycleTimeout
+		// rpcClient is only replaced while the container is not running
+		var client rpcClient
+		if state == containerRunning {
+			client = d.rpcClient
+		}
+		d.lifecycleMu.Unlock()
+		switch state {
+		case containerRunning:
+			return client, nil
+		case containerGone:
+			return nil, errContainerGone
+		}
+		if timeout == nil {
+			timeout = time.After(wait)
+		}
+		select {
+		case <-ready:
+		case <-timeout:
+			return nil, errContainerUnavailable
+		}
+	}
+}
+
+// satelliteHandle returns the handle for a descriptor opened by the current satellite
+func (d *DockerFuseClient) satelliteHandle(fd uintptr) fusefs.FileHandle {
+	return fd | uintptr(d.satelliteGeneration.Load())<<handleGenerationShift
+}
+
+// satelliteFD returns the descriptor behind fh, unless it was opened by a previous satellite
+func (d *DockerFuseClient) satelliteFD(fh fusefs.FileHandle) (fd uintptr, syserr syscall.Errno) {
+	h := fh.(uintptr)
+	if uint32(h>>handleGenerationShift) != d.satelliteGeneration.Load() {
+		return 0, syscall.ESTALE
+	}
+	return h & (1<<handleGenerationShift - 1), 0
+}
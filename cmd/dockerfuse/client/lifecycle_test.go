@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func inState(d *DockerFuseClient, state containerState) func() bool {
+	return func() bool { return d.getContainerState() == state }
+}
+
+func TestSatelliteHandles(t *testing.T) {
+	d := &DockerFuseClient{}
+
+	// Handles of the first satellite are its descriptors
+	fh := d.satelliteHandle(3)
+	assert.Equal(t, uintptr(3), fh)
+	fd, errno := d.satelliteFD(fh)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uintptr(3), fd)
+
+	// Handles of previous satellites are stale
+	d.satelliteGeneration.Add(1)
+	_, errno = d.satelliteFD(fh)
+	assert.Equal(t, syscall.ESTALE, errno)
+	fd, errno = d.satelliteFD(d.satelliteHandle(3))
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uintptr(3), fd)
+}
+
+// expectSatelliteRestart sets up the upload and start of the satellite in a restarted container
+func expectSatelliteRestart(t *testing.T, mDC *mockDockerClient, mFS *mockFS, mRPCCF *mockRPCClientFactory, client *mockRPCClient) {
+	satelliteBinName := fmt.Sprintf("%s_%s", satelliteBinPrefix, "arm64")
+	remotePath := filepath.Join("/tmp", satelliteBinName)
+	mFS.On("Executable").Return("/test/pos/executable", nil)
+	mFS.On("ReadFile", filepath.Join("/test/pos/", satelliteBinName)).Return([]byte("satellite"), nil)
+	mDC.On("ContainerInspect", context.Background(), "test_container").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_container_image"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", context.Background(), "test_container_image").Return(
+		image.InspectResponse{Architecture: "arm64"}, []byte{}, nil)
+	expectSatelliteVerification(t, mDC, remotePath, []byte("satellite"))
+	mDC.On("CopyToContainer", context.Background(), "test_container", "/tmp",
+		mock.AnythingOfType("*bufio.Reader"), container.CopyToContainerOptions{}).Return(nil)
+	mDC.On("ContainerExecCreate", context.Background(), "test_container", container.ExecOptions{
+		AttachStdout: true, AttachStdin: true, Cmd: []string{remotePath, "-session", "host:1:abcd"},
+	}).Return(common.IDResponse{ID: "new_execid"}, nil)
+	mDC.On("ContainerExecAttach", context.Background(), "new_execid", container.ExecStartOptions{Tty: true}).Return(
+		types.HijackedResponse{}, nil)
+	mRPCCF.On("NewClient", &dockerSatellite{dockerClient: mDC, execID: "new_execid"}).Return(client)
+}
+
+func TestWatchLifecycle(t *testing.T) {
+	var (
+		mDC          mockDockerClient
+		mFS          mockFS
+		mRPCC, newRC mockRPCClient
+		mRPCCF       mockRPCClientFactory
+	)
+	dfFS = &mFS
+	rpcCF = &mRPCCF
+	messages, errs := make(chan events.Message), make(chan error)
+	mDC.On("Events", mock.Anything, mock.Anything).Return(messages, errs)
+	d := &DockerFuseClient{backend: newDockerAPIBackend(&mDC, "test_container", BackendConfig{}), rpcClient: &mRPCC, containerID: "test_container", session: "host:1:abcd"}
+	unmounted := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- d.WatchLifecycle(context.Background(), LifecycleConfig{
+			Timeout: 50 * time.Millisecond, RestartGrace: time.Hour, OnExit: ExitUnmount,
+			Unmount: func() { close(unmounted) },
+		})
+	}()
+	ctx := context.Background()
+	var attr statAttr
+
+	// I/O waits while the container is paused
+	messages <- events.Message{Action: events.ActionPause}
+	assert.Eventually(t, inState(d, containerPaused), time.Second, time.Millisecond)
+	assert.Equal(t, syscall.EAGAIN, d.stat(ctx, "/file", &attr))
+	mRPCC.On("Call", "DockerFuseFSOps.Stat", mock.Anything, mock.Anything).Return(nil).Once()
+	messages <- events.Message{Action: events.ActionUnPause}
+	assert.Eventually(t, inState(d, containerRunning), time.Second, time.Millisecond)
+	assert.Equal(t, syscall.Errno(0), d.stat(ctx, "/file", &attr))
+
+	// The satellite is started again after a restart, and old handles are stale
+	fh := d.satelliteHandle(3)
+	mRPCC.On("Close").Return(nil).Once()
+	messages <- events.Message{Action: events.ActionDie}
+	assert.Eventually(t, inState(d, containerStopped), time.Second, time.Millisecond)
+	assert.Equal(t, syscall.EAGAIN, d.stat(ctx, "/file", &attr))
+	expectSatelliteRestart(t, &mDC, &mFS, &mRPCCF, &newRC)
+	messages <- events.Message{Action: events.ActionStart}
+	assert.Eventually(t, inState(d, containerRunning), time.Second, time.Millisecond)
+	_, errno := d.read(ctx, fh, 0, 10)
+	assert.Equal(t, syscall.ESTALE, errno)
+	newRC.On("Call", "DockerFuseFSOps.Stat", mock.Anything, mock.Anything).Return(nil).Once()
+	assert.Equal(t, syscall.Errno(0), d.stat(ctx, "/file", &attr))
+	mRPCC.AssertExpectations(t)
+	newRC.AssertExpectations(t)
+
+	// Removed containers are unmounted
+	messages <- events.Message{Action: events.ActionDestroy}
+	<-unmounted
+	assert.NoError(t, <-done)
+	assert.Equal(t, syscall.EIO, d.stat(ctx, "/file", &attr))
+}
+
+func TestWatchLifecycleStale(t *testing.T) {
+	var (
+		mDC   mockDockerClient
+		mRPCC mockRPCClient
+	)
+	messages, errs := make(chan events.Message), make(chan error)
+	mDC.On("Events", mock.Anything, mock.Anything).Return(messages, errs)
+	mRPCC.On("Close").Return(nil)
+	d := &DockerFuseClient{backend: newDockerAPIBackend(&mDC, "c", BackendConfig{}), rpcClient: &mRPCC, containerID: "c"}
+	d.disk, _ = newDiskCache(t.TempDir(), "c0ffee", "c", 0)
+	var attr statAttr
+	attr.FuseAttr.Size = 3
+	d.disk.putAttr("/file", &attr)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.WatchLifecycle(ctx, LifecycleConfig{Timeout: time.Second, RestartGrace: 10 * time.Millisecond, OnExit: ExitStale})
+	}()
+
+	// Event stream errors are survived
+	errs <- fmt.Errorf("connection reset")
+
+	// Containers not starting again are served from the cache
+	messages <- events.Message{Action: events.ActionDie}
+	assert.Eventually(t, inState(d, containerGone), time.Second, time.Millisecond)
+	assert.True(t, d.isOffline())
+	assert.Equal(t, syscall.Errno(0), d.stat(context.Background(), "/file", &attr))
+	assert.Equal(t, uint64(3), attr.FuseAttr.Size)
+	_, errno := d.create(context.Background(), "/new", syscall.O_WRONLY, 0644, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+
+	cancel()
+	assert.NoError(t, <-done)
+	mDC.AssertExpectations(t)
+
+	assert.EqualError(t, d.WatchLifecycle(ctx, LifecycleConfig{OnExit: "bogus"}),
+		`unknown exit policy "bogus" (supported: unmount, stale)`)
+}
@@ -0,0 +1,396 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// How long generated metadata files are reused, and how often logs are followed again once
+// their stream ends (e.g., when the container stops)
+const metaTTL = 2 * time.Second
+
+// Log streams, below the logs directory
+var logStreams = []string{"stdout", "stderr"}
+
+// Meta serves the metadata of a container from the Docker API, never from the satellite:
+// inspect.json, env, labels, mounts, top, and logs/stdout and logs/stderr, which grow as the
+// container logs.
+type Meta struct {
+	readOnlyClient
+
+	docker      dockerClient
+	containerID string
+	tty         bool
+	generators  map[string]func(ctx context.Context) ([]byte, error)
+
+	mu        sync.Mutex
+	files     map[string]*metaFile
+	logs      map[string]*logFile
+	following bool
+	logsEnd   time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// metaFile is a generated file
+type metaFile struct {
+	data  []byte
+	mtime time.Time
+}
+
+// logFile holds a log stream of the container, in a temporary file growing as logs are followed
+type logFile struct {
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	mtime time.Time
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.f.WriteAt(p, l.size)
+	l.size += int64(n)
+	l.mtime = time.Now()
+	return n, err
+}
+
+func (l *logFile) attr() (size int64, mtime time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size, l.mtime
+}
+
+// NewContainerMeta returns the metadata of a container
+func NewContainerMeta(containerID string, opts ...ClientOption) (*Meta, error) {
+	docker, err := newDockerAPI(containerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newMeta(docker, containerID)
+}
+
+func newMeta(docker dockerClient, containerID string) (*Meta, error) {
+	info, err := docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+	m := &Meta{
+		docker:      docker,
+		containerID: containerID,
+		tty:         info.Config != nil && info.Config.Tty,
+		files:       make(map[string]*metaFile),
+		logs:        make(map[string]*logFile),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.generators = map[string]func(ctx context.Context) ([]byte, error){
+		"inspect.json": m.inspectJSON,
+		"env":          m.env,
+		"labels":       m.labels,
+		"mounts":       m.mounts,
+		"top":          m.top,
+	}
+	for _, s := range logStreams {
+		f, err := os.CreateTemp("", "dockerfuse-"+s+"-*")
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.logs[s] = &logFile{f: f, mtime: time.Now()}
+	}
+	return m, nil
+}
+
+// Close stops following logs, and removes them
+func (m *Meta) Close() {
+	m.cancel()
+	for _, l := range m.logs {
+		l.f.Close()
+		os.Remove(l.f.Name())
+	}
+}
+
+func (m *Meta) inspect(ctx context.Context) (container.InspectResponse, error) {
+	info, err := m.docker.ContainerInspect(ctx, m.containerID)
+	if err == nil && (info.ContainerJSONBase == nil || info.Config == nil) {
+		err = fmt.Errorf("incomplete inspect response")
+	}
+	return info, err
+}
+
+func (m *Meta) inspectJSON(ctx context.Context) ([]byte, error) {
+	info, err := m.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	return append(data, '\n'), err
+}
+
+func (m *Meta) env(ctx context.Context) ([]byte, error) {
+	info, err := m.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, e := range info.Config.Env {
+		b.WriteString(e + "\n")
+	}
+	return []byte(b.String()), nil
+}
+
+func (m *Meta) labels(ctx context.Context) ([]byte, error) {
+	info, err := m.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(info.Config.Labels)) {
+		fmt.Fprintf(&b, "%s=%s\n", k, info.Config.Labels[k])
+	}
+	return []byte(b.String()), nil
+}
+
+func (m *Meta) mounts(ctx context.Context) ([]byte, error) {
+	info, err := m.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tSOURCE\tDESTINATION\tMODE")
+	for _, mp := range info.Mounts {
+		mode := "ro"
+		if mp.RW {
+			mode = "rw"
+		}
+		source := mp.Source
+		if mp.Name != "" {
+			source = mp.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mp.Type, source, mp.Destination, mode)
+	}
+	w.Flush()
+	return []byte(b.String()), nil
+}
+
+func (m *Meta) top(ctx context.Context) ([]byte, error) {
+	top, err := m.docker.ContainerTop(ctx, m.containerID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(top.Titles, "\t"))
+	for _, p := range top.Processes {
+		fmt.Fprintln(w, strings.Join(p, "\t"))
+	}
+	w.Flush()
+	return []byte(b.String()), nil
+}
+
+// generated returns the content of a generated file, generating it again once stale
+func (m *Meta) generated(ctx context.Context, name string) (*metaFile, syscall.Errno) {
+	m.mu.Lock()
+	f, ok := m.files[name]
+	m.mu.Unlock()
+	if ok && time.Since(f.mtime) < metaTTL {
+		return f, 0
+	}
+	data, err := m.generators[name](ctx)
+	if err != nil {
+		slog.Warn("cannot read container metadata", "file", name, "error", err)
+		return nil, syscall.EIO
+	}
+	f = &metaFile{data: data, mtime: time.Now()}
+	m.mu.Lock()
+	m.files[name] = f
+	m.mu.Unlock()
+	return f, 0
+}
+
+// followLogs starts following the logs of the container, unless it is already doing so. Logs
+// are followed again from where they ended, after a while.
+func (m *Meta) followLogs() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.following || time.Since(m.logsEnd) < metaTTL {
+		return
+	}
+	m.following = true
+	var since string
+	if !m.logsEnd.IsZero() {
+		since = fmt.Sprintf("%d.%09d", m.logsEnd.Unix(), m.logsEnd.Nanosecond())
+	}
+	go m.copyLogs(since)
+}
+
+func (m *Meta) copyLogs(since string) {
+	logs, err := m.docker.ContainerLogs(m.ctx, m.containerID, container.LogsOptions{
+		ShowStdout: true, ShowStderr: true, Follow: true, Since: since,
+	})
+	if err == nil {
+		// Containers with a terminal have a single, raw, stream
+		if m.tty {
+			_, err = io.Copy(m.logs["stdout"], logs)
+		} else {
+			_, err = stdcopy.StdCopy(m.logs["stdout"], m.logs["stderr"], logs)
+		}
+		logs.Close()
+	}
+	if err != nil && m.ctx.Err() == nil {
+		slog.Warn("error following container logs", "error", err)
+	}
+	m.mu.Lock()
+	m.following = false
+	m.logsEnd = time.Now()
+	m.mu.Unlock()
+}
+
+// metaAttr returns attributes of read-only files
+func metaAttr(fullPath string, size int64, mtime time.Time) (attr statAttr) {
+	attr.FuseAttr.Mode = syscall.S_IFREG | 0444
+	attr.FuseAttr.Size = uint64(size)
+	attr.FuseAttr.Nlink = 1
+	attr.FuseAttr.Ino = archiveIno(fullPath)
+	attr.FuseAttr.SetTimes(nil, &mtime, &mtime)
+	return
+}
+
+// logFile returns the log stream at fullPath, if any
+func (m *Meta) logFile(fullPath string) (*logFile, bool) {
+	dir, name := path.Split(fullPath)
+	if dir != "/logs/" {
+		return nil, false
+	}
+	l, ok := m.logs[name]
+	return l, ok
+}
+
+func (m *Meta) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	if fullPath == "/" || fullPath == "/logs" {
+		*attr = dirAttr(fullPath)
+		attr.FuseAttr.Mode = syscall.S_IFDIR | 0555
+		return 0
+	}
+	if l, ok := m.logFile(fullPath); ok {
+		m.followLogs()
+		size, mtime := l.attr()
+		*attr = metaAttr(fullPath, size, mtime)
+		return 0
+	}
+	name := strings.TrimPrefix(fullPath, "/")
+	if _, ok := m.generators[name]; !ok {
+		return syscall.ENOENT
+	}
+	f, syserr := m.generated(ctx, name)
+	if syserr != 0 {
+		return syserr
+	}
+	*attr = metaAttr(fullPath, int64(len(f.data)), f.mtime)
+	return 0
+}
+
+func (m *Meta) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	var entries []fuse.DirEntry
+	switch fullPath {
+	case "/":
+		for _, name := range slices.Sorted(maps.Keys(m.generators)) {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFREG})
+		}
+		entries = append(entries, fuse.DirEntry{Name: "logs", Mode: syscall.S_IFDIR})
+	case "/logs":
+		for _, s := range logStreams {
+			entries = append(entries, fuse.DirEntry{Name: s, Mode: syscall.S_IFREG})
+		}
+	default:
+		var attr statAttr
+		if syserr = m.stat(ctx, fullPath, &attr); syserr != 0 {
+			return nil, syserr
+		}
+		return nil, syscall.ENOTDIR
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (m *Meta) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	return []byte{}, syscall.EINVAL
+}
+
+func (m *Meta) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if syserr = m.stat(ctx, fullPath, attr); syserr != 0 {
+		return nil, 0, syserr
+	}
+	if attr.FuseAttr.Mode&syscall.S_IFDIR != 0 {
+		return nil, 0, syscall.EISDIR
+	}
+	if l, ok := m.logFile(fullPath); ok {
+		return l, fs.FileMode(attr.FuseAttr.Mode), 0
+	}
+	// Opened files keep the content they had when opened
+	f, syserr := m.generated(ctx, strings.TrimPrefix(fullPath, "/"))
+	if syserr != 0 {
+		return nil, 0, syserr
+	}
+	return f, fs.FileMode(attr.FuseAttr.Mode), 0
+}
+
+func (m *Meta) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	switch h := fh.(type) {
+	case *metaFile:
+		if offset >= int64(len(h.data)) {
+			return []byte{}, 0
+		}
+		return h.data[offset:min(offset+int64(n), int64(len(h.data)))], 0
+	case *logFile:
+		data = make([]byte, n)
+		n, err := h.f.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			slog.Warn("error reading container logs", "error", err)
+			return nil, syscall.EIO
+		}
+		return data[:n], 0
+	}
+	return nil, syscall.EBADF
+}
+
+func (m *Meta) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	switch h := fh.(type) {
+	case *metaFile:
+		return seekWithin(int64(len(h.data)), offset, whence)
+	case *logFile:
+		size, _ := h.attr()
+		return seekWithin(size, offset, whence)
+	}
+	return 0, syscall.EBADF
+}
+
+func (m *Meta) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	switch fh.(type) {
+	case *metaFile, *logFile:
+		return 0
+	}
+	return syscall.EBADF
+}
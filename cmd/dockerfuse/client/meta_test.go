@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// multiplexed returns logs as streamed by Docker for containers without a terminal
+func multiplexed(stdout, stderr string) io.ReadCloser {
+	var b bytes.Buffer
+	stdcopy.NewStdWriter(&b, stdcopy.Stdout).Write([]byte(stdout))
+	stdcopy.NewStdWriter(&b, stdcopy.Stderr).Write([]byte(stderr))
+	return io.NopCloser(&b)
+}
+
+func readMeta(t *testing.T, m *Meta, fullPath string) string {
+	var attr statAttr
+	fh, _, errno := m.open(context.Background(), fullPath, syscall.O_RDONLY, 0, &attr)
+	if !assert.Equal(t, syscall.Errno(0), errno, fullPath) {
+		return ""
+	}
+	defer m.close(context.Background(), fh)
+	data, errno := m.read(context.Background(), fh, 0, 4096)
+	assert.Equal(t, syscall.Errno(0), errno, fullPath)
+	return string(data)
+}
+
+func TestContainerMeta(t *testing.T) {
+	var (
+		mDC  mockDockerClient
+		mDCF mockDockerClientFactory
+	)
+	dockerCF = &mDCF
+	mDCF.On("NewClientWithOpts", mock.Anything).Return(&mDC, nil)
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{ID: "c0ffee"},
+		Config: &container.Config{
+			Env:    []string{"PATH=/bin", "A=b"},
+			Labels: map[string]string{"z": "1", "a": "2"},
+		},
+		Mounts: []container.MountPoint{
+			{Type: "bind", Source: "/host", Destination: "/data", RW: true},
+			{Type: "volume", Name: "cache", Source: "/var/lib/docker/volumes/cache", Destination: "/cache"},
+		},
+	}, nil)
+	mDC.On("ContainerTop", mock.Anything, "c", []string(nil)).Return(container.TopResponse{
+		Titles:    []string{"PID", "CMD"},
+		Processes: [][]string{{"1", "sleep infinity"}},
+	}, nil).Once()
+	mDC.On("ContainerLogs", mock.Anything, "c", container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true}).Return(
+		multiplexed("out\n", "err\n"), nil).Once()
+
+	m, err := NewContainerMeta("c")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	var attr statAttr
+
+	assert.Equal(t, []string{"env", "inspect.json", "labels", "mounts", "top", "logs"}, dirNames(t, m, "/"))
+	assert.Equal(t, []string{"stdout", "stderr"}, dirNames(t, m, "/logs"))
+	assert.Equal(t, syscall.Errno(0), m.stat(ctx, "/logs", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), attr.FuseAttr.Mode)
+	assert.Equal(t, syscall.ENOENT, m.stat(ctx, "/missing", &attr))
+	_, errno := m.readDir(ctx, "/env")
+	assert.Equal(t, syscall.ENOTDIR, errno)
+
+	// Generated files have their actual size, and are reused for a while
+	assert.Equal(t, syscall.Errno(0), m.stat(ctx, "/env", &attr))
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), attr.FuseAttr.Mode)
+	assert.Equal(t, uint64(len("PATH=/bin\nA=b\n")), attr.FuseAttr.Size)
+	assert.Equal(t, "PATH=/bin\nA=b\n", readMeta(t, m, "/env"))
+	assert.Equal(t, "a=2\nz=1\n", readMeta(t, m, "/labels"))
+	assert.Equal(t, "TYPE    SOURCE  DESTINATION  MODE\n"+
+		"bind    /host   /data        rw\n"+
+		"volume  cache   /cache       ro\n", readMeta(t, m, "/mounts"))
+	assert.Equal(t, "PID  CMD\n1    sleep infinity\n", readMeta(t, m, "/top"))
+	assert.Equal(t, "PID  CMD\n1    sleep infinity\n", readMeta(t, m, "/top"))
+	assert.Contains(t, readMeta(t, m, "/inspect.json"), `"Id": "c0ffee"`)
+
+	// Logs are followed once looked at
+	m.stat(ctx, "/logs/stdout", &attr)
+	assert.Eventually(t, func() bool {
+		m.stat(ctx, "/logs/stderr", &attr)
+		return attr.FuseAttr.Size == 4
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "out\n", readMeta(t, m, "/logs/stdout"))
+	assert.Equal(t, "err\n", readMeta(t, m, "/logs/stderr"))
+	fh, _, _ := m.open(ctx, "/logs/stdout", syscall.O_RDONLY, 0, &attr)
+	n, errno := m.seek(ctx, fh, 0, seekHole)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, int64(4), n)
+	data, _ := m.read(ctx, fh, 10, 10)
+	assert.Empty(t, data)
+
+	// Ended logs are followed again from where they ended
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.following {
+			return false
+		}
+		m.logsEnd = time.Now().Add(-metaTTL)
+		return true
+	}, time.Second, 10*time.Millisecond)
+	mDC.On("ContainerLogs", mock.Anything, "c", mock.MatchedBy(func(o container.LogsOptions) bool {
+		return o.Follow && o.Since != ""
+	})).Return(multiplexed("more\n", ""), nil).Once()
+	assert.Eventually(t, func() bool {
+		m.stat(ctx, "/logs/stdout", &attr)
+		return attr.FuseAttr.Size == 9
+	}, time.Second, 10*time.Millisecond)
+	data, _ = m.read(ctx, fh, 0, 100)
+	assert.Equal(t, "out\nmore\n", string(data))
+	assert.Equal(t, syscall.Errno(0), m.close(ctx, fh))
+	mDC.AssertExpectations(t)
+
+	// Nothing changes
+	_, _, errno = m.open(ctx, "/env", syscall.O_WRONLY, 0, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	_, _, errno = m.open(ctx, "/logs", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.EISDIR, errno)
+	assert.Equal(t, syscall.EROFS, m.unlink(ctx, "/env"))
+	_, errno = m.read(ctx, "bogus", 0, 10)
+	assert.Equal(t, syscall.EBADF, errno)
+
+	// Docker errors
+	m.files = make(map[string]*metaFile)
+	mDC.On("ContainerTop", mock.Anything, "c", []string(nil)).Return(container.TopResponse{}, fmt.Errorf("not running")).Once()
+	assert.Equal(t, syscall.EIO, m.stat(ctx, "/top", &attr))
+
+	// Logs are removed on Close
+	logs := m.logs["stdout"].f.Name()
+	m.Close()
+	_, err = os.Stat(logs)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// CacheConfig holds the time-to-live of each class of cached metadata. A zero TTL disables that class.
+type CacheConfig struct {
+	AttrTTL     time.Duration // Attributes of existing paths
+	DirTTL      time.Duration // Directory listings
+	NegativeTTL time.Duration // Non-existent paths (ENOENT)
+}
+
+// CacheStats reports metadata cache hits and misses
+type CacheStats struct {
+	AttrHits       uint64
+	AttrMisses     uint64
+	DirHits        uint64
+	DirMisses      uint64
+	NegativeHits   uint64
+	NegativeMisses uint64
+}
+
+type attrCacheEntry struct {
+	attr    statAttr
+	expires time.Time
+}
+
+type dirCacheEntry struct {
+	entries []fuse.DirEntry
+	expires time.Time
+}
+
+// metadataCache caches remote metadata to save round trips to the satellite
+type metadataCache struct {
+	config CacheConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	attrs    map[string]attrCacheEntry
+	dirs     map[string]dirCacheEntry
+	negative map[string]time.Time
+
+	attrHits, attrMisses         atomic.Uint64
+	dirHits, dirMisses           atomic.Uint64
+	negativeHits, negativeMisses atomic.Uint64
+}
+
+func newMetadataCache(config CacheConfig) *metadataCache {
+	return &metadataCache{
+		config:   config,
+		now:      time.Now,
+		attrs:    make(map[string]attrCacheEntry),
+		dirs:     make(map[string]dirCacheEntry),
+		negative: make(map[string]time.Time),
+	}
+}
+
+// getAttr looks up fullPath, returning ENOENT for paths known not to exist
+func (c *metadataCache) getAttr(fullPath string, attr *statAttr) (found bool, enoent bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if e, ok := c.attrs[fullPath]; ok && now.Before(e.expires) {
+		c.attrHits.Add(1)
+		*attr = e.attr
+		return true, false
+	}
+	c.attrMisses.Add(1)
+	if c.config.NegativeTTL > 0 {
+		if expires, ok := c.negative[fullPath]; ok && now.Before(expires) {
+			c.negativeHits.Add(1)
+			return true, true
+		}
+		c.negativeMisses.Add(1)
+	}
+	return false, false
+}
+
+func (c *metadataCache) putAttr(fullPath string, attr *statAttr) {
+	if c.config.AttrTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.negative, fullPath)
+	c.attrs[fullPath] = attrCacheEntry{attr: *attr, expires: c.now().Add(c.config.AttrTTL)}
+}
+
+func (c *metadataCache) putNegative(fullPath string) {
+	if c.config.NegativeTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.attrs, fullPath)
+	c.negative[fullPath] = c.now().Add(c.config.NegativeTTL)
+}
+
+func (c *metadataCache) getDir(fullPath string) (entries []fuse.DirEntry, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.dirs[fullPath]; ok && c.now().Before(e.expires) {
+		c.dirHits.Add(1)
+		return append([]fuse.DirEntry(nil), e.entries...), true
+	}
+	c.dirMisses.Add(1)
+	return nil, false
+}
+
+func (c *metadataCache) putDir(fullPath string, entries []fuse.DirEntry) {
+	if c.config.DirTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dirs[fullPath] = dirCacheEntry{
+		entries: append([]fuse.DirEntry(nil), entries...),
+		expires: c.now().Add(c.config.DirTTL),
+	}
+}
+
+// invalidate drops everything cached about fullPath and its parent directory
+func (c *metadataCache) invalidate(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fullPath = filepath.Clean(fullPath)
+	delete(c.attrs, fullPath)
+	delete(c.dirs, fullPath)
+	delete(c.negative, fullPath)
+	c.invalidateParent(fullPath)
+}
+
+// invalidateTree is like invalidate, but it also drops everything cached below fullPath
+func (c *metadataCache) invalidateTree(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fullPath = filepath.Clean(fullPath)
+	prefix := strings.TrimSuffix(fullPath, "/") + "/"
+	for p := range c.attrs {
+		if p == fullPath || strings.HasPrefix(p, prefix) {
+			delete(c.attrs, p)
+		}
+	}
+	for p := range c.dirs {
+		if p == fullPath || strings.HasPrefix(p, prefix) {
+			delete(c.dirs, p)
+		}
+	}
+	for p := range c.negative {
+		if p == fullPath || strings.HasPrefix(p, prefix) {
+			delete(c.negative, p)
+		}
+	}
+	c.invalidateParent(fullPath)
+}
+
+// invalidateParent drops the parent directory, whose mtime, nlink and listing change with its children
+func (c *metadataCache) invalidateParent(fullPath string) {
+	delete(c.attrs, filepath.Dir(fullPath))
+	delete(c.dirs, filepath.Dir(fullPath))
+}
+
+func (c *metadataCache) stats() CacheStats {
+	return CacheStats{
+		AttrHits:       c.attrHits.Load(),
+		AttrMisses:     c.attrMisses.Load(),
+		DirHits:        c.dirHits.Load(),
+		DirMisses:      c.dirMisses.Load(),
+		NegativeHits:   c.negativeHits.Load(),
+		NegativeMisses: c.negativeMisses.Load(),
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMetadataCache(now *time.Time) *metadataCache {
+	c := newMetadataCache(CacheConfig{AttrTTL: time.Second, DirTTL: time.Second, NegativeTTL: time.Second})
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestMetadataCacheAttrExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newTestMetadataCache(&now)
+
+	var attr statAttr
+	found, _ := c.getAttr("/a", &attr)
+	assert.False(t, found)
+
+	c.putAttr("/a", &statAttr{FuseAttr: fuse.Attr{Ino: 7}, LinkTarget: "t"})
+	found, enoent := c.getAttr("/a", &attr)
+	assert.True(t, found)
+	assert.False(t, enoent)
+	assert.Equal(t, uint64(7), attr.FuseAttr.Ino)
+	assert.Equal(t, "t", attr.LinkTarget)
+
+	now = now.Add(time.Second)
+	found, _ = c.getAttr("/a", &attr)
+	assert.False(t, found)
+
+	assert.Equal(t, CacheStats{AttrHits: 1, AttrMisses: 2, NegativeMisses: 2}, c.stats())
+}
+
+func TestMetadataCacheNegative(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newTestMetadataCache(&now)
+
+	var attr statAttr
+	c.putNegative("/missing")
+	found, enoent := c.getAttr("/missing", &attr)
+	assert.True(t, found)
+	assert.True(t, enoent)
+
+	// A later positive result replaces the negative one
+	c.putAttr("/missing", &statAttr{FuseAttr: fuse.Attr{Ino: 1}})
+	found, enoent = c.getAttr("/missing", &attr)
+	assert.True(t, found)
+	assert.False(t, enoent)
+
+	c.putNegative("/missing")
+	now = now.Add(2 * time.Second)
+	found, _ = c.getAttr("/missing", &attr)
+	assert.False(t, found)
+}
+
+func TestMetadataCacheDisabledClasses(t *testing.T) {
+	c := newMetadataCache(CacheConfig{})
+
+	var attr statAttr
+	c.putAttr("/a", &statAttr{})
+	c.putNegative("/b")
+	c.putDir("/c", []fuse.DirEntry{{Name: "x"}})
+
+	found, _ := c.getAttr("/a", &attr)
+	assert.False(t, found)
+	found, _ = c.getAttr("/b", &attr)
+	assert.False(t, found)
+	_, found = c.getDir("/c")
+	assert.False(t, found)
+}
+
+func TestMetadataCacheDir(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newTestMetadataCache(&now)
+
+	entries := []fuse.DirEntry{{Name: "x"}, {Name: "y"}}
+	c.putDir("/d", entries)
+	entries[0].Name = "changed"
+
+	got, found := c.getDir("/d")
+	assert.True(t, found)
+	assert.Equal(t, []fuse.DirEntry{{Name: "x"}, {Name: "y"}}, got)
+
+	now = now.Add(time.Second)
+	_, found = c.getDir("/d")
+	assert.False(t, found)
+	assert.Equal(t, uint64(1), c.stats().DirHits)
+	assert.Equal(t, uint64(1), c.stats().DirMisses)
+}
+
+func TestMetadataCacheInvalidate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newTestMetadataCache(&now)
+
+	var attr statAttr
+	for _, p := range []string{"/", "/d", "/d/f", "/d/sub/g", "/dd"} {
+		c.putAttr(p, &statAttr{})
+	}
+	c.putDir("/", nil)
+	c.putDir("/d", nil)
+	c.putDir("/d/sub", nil)
+	c.putNegative("/d/sub/missing")
+
+	c.invalidate("/d/f")
+	found, _ := c.getAttr("/d/f", &attr)
+	assert.False(t, found)
+	found, _ = c.getAttr("/d", &attr)
+	assert.False(t, found, "parent attributes should be dropped")
+	_, found = c.getDir("/d")
+	assert.False(t, found, "parent listing should be dropped")
+	found, _ = c.getAttr("/d/sub/g", &attr)
+	assert.True(t, found)
+
+	c.invalidateTree("/d")
+	found, _ = c.getAttr("/d/sub/g", &attr)
+	assert.False(t, found)
+	found, _ = c.getAttr("/d/sub/missing", &attr)
+	assert.False(t, found)
+	_, found = c.getDir("/d/sub")
+	assert.False(t, found)
+	_, found = c.getDir("/")
+	assert.False(t, found)
+	found, _ = c.getAttr("/dd", &attr)
+	assert.True(t, found, "siblings sharing a prefix should be kept")
+}
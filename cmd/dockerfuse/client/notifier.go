@@ -0,0 +1,26 @@
+package client
+
+import (
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+var kernelNotifier notifier = &fuseNotifier{}
+
+type notifier interface {
+	NotifyContent(inode *fusefs.Inode, off, sz int64) syscall.Errno
+	NotifyDelete(parent *fusefs.Inode, name string, child *fusefs.Inode) syscall.Errno
+	NotifyEntry(parent *fusefs.Inode, name string) syscall.Errno
+}
+
+// fuseNotifier implements notifier forwarding invalidations to the FUSE kernel module
+type fuseNotifier struct{}
+
+func (*fuseNotifier) NotifyContent(i *fusefs.Inode, o, s int64) syscall.Errno {
+	return i.NotifyContent(o, s)
+}
+func (*fuseNotifier) NotifyDelete(p *fusefs.Inode, n string, c *fusefs.Inode) syscall.Errno {
+	return p.NotifyDelete(n, c)
+}
+func (*fuseNotifier) NotifyEntry(p *fusefs.Inode, n string) syscall.Errno { return p.NotifyEntry(n) }
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/rpc"
+	"strings"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Handles opened while offline are numbered from offlineHandleBase, to avoid clashing with
+// file descriptors returned by the satellite
+const offlineHandleBase = 1 << 30
+
+// Whence values for SEEK_DATA and SEEK_HOLE, as passed by the kernel
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// seekWithin computes seeks in files of the given size, known without asking the container
+func seekWithin(size int64, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	switch whence {
+	case io.SeekStart, io.SeekCurrent:
+		return offset, 0
+	case io.SeekEnd:
+		return size + offset, 0
+	case seekData:
+		if offset >= size {
+			return 0, syscall.ENXIO
+		}
+		return offset, 0
+	case seekHole:
+		if offset >= size {
+			return 0, syscall.ENXIO
+		}
+		return size, 0
+	}
+	return 0, syscall.EINVAL
+}
+
+// errOffline is returned for operations that need the satellite while in offline mode
+var errOffline = errors.New("errno: EROFS")
+
+// call performs an RPC call to the satellite. When the satellite cannot be reached and a disk
+// cache is available, the client switches to offline mode.
+func (d *DockerFuseClient) call(serviceMethod string, args any, reply any) error {
+	if d.isOffline() {
+		return errOffline
+	}
+	client, err := d.satelliteClient()
+	if err != nil {
+		return err
+	}
+	if d.isOffline() {
+		return errOffline // The container stopped while waiting
+	}
+	err = client.Call(serviceMethod, args, reply)
+	if err != nil && isConnectionError(err) && d.goOffline(err) {
+		return errOffline
+	}
+	return err
+}
+
+// isConnectionError tells transport errors apart from errors returned by the satellite
+func isConnectionError(err error) bool {
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		return false
+	}
+	return !strings.HasPrefix(err.Error(), "errno: ") && err.Error() != io.EOF.Error()
+}
+
+func (d *DockerFuseClient) isOffline() bool {
+	return d.offline.Load()
+}
+
+// goOffline switches to offline mode, if a disk cache is available
+func (d *DockerFuseClient) goOffline(cause error) bool {
+	if d.disk == nil {
+		return false
+	}
+	if d.offline.CompareAndSwap(false, true) {
+		slog.Warn("satellite unreachable: switching to offline mode, serving cached content read-only",
+			"container", d.containerID, "error", cause)
+	}
+	return true
+}
+
+// offlineFallback returns an offline client if cached content exists, or err otherwise
+func (d *DockerFuseClient) offlineFallback(err error) (*DockerFuseClient, error) {
+	if d.diskCacheDir == "" {
+		return nil, err
+	}
+	if d.disk == nil {
+		disk, derr := openDiskCache(d.diskCacheDir, d.containerID)
+		if derr != nil {
+			return nil, err
+		}
+		d.disk = disk
+	}
+	d.disconnect()
+	d.goOffline(err)
+	return d, nil
+}
+
+// cachedRead serves reads of unmodified files from the disk cache, filling it on misses
+func (d *DockerFuseClient) cachedRead(fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	h, ok := d.handle(fh)
+	if !ok || h.dirty || offset >= int64(h.attr.Size) {
+		if d.isOffline() {
+			if ok && !h.dirty {
+				return []byte{}, 0 // EOF
+			}
+			return nil, syscall.EIO
+		}
+		return d.remoteRead(fh, offset, n)
+	}
+
+	key := contentKey(&h.attr)
+	size := int64(h.attr.Size)
+	data = make([]byte, 0, n)
+	for offset < size && len(data) < n {
+		index := offset / diskCacheChunkSize
+		chunkStart := index * diskCacheChunkSize
+		chunk, ok := d.disk.readChunk(key, index)
+		if !ok {
+			if d.isOffline() {
+				return nil, syscall.EIO
+			}
+			chunk, syserr = d.remoteRead(fh, chunkStart, diskCacheChunkSize)
+			if syserr != 0 {
+				if d.isOffline() {
+					return nil, syscall.EIO
+				}
+				return nil, syserr
+			}
+			// Only store complete chunks, so that hits never return truncated data
+			if len(chunk) == diskCacheChunkSize || chunkStart+int64(len(chunk)) == size {
+				if err := d.disk.writeChunk(key, index, chunk); err != nil {
+					slog.Debug("error caching content on disk", "path", h.fullPath, "error", err)
+				}
+			}
+		}
+		skip := offset - chunkStart
+		if skip >= int64(len(chunk)) {
+			break // The file is shorter than when opened
+		}
+		chunk = chunk[skip:]
+		if len(chunk) > n-len(data) {
+			chunk = chunk[:n-len(data)]
+		}
+		data = append(data, chunk...)
+		offset += int64(len(chunk))
+	}
+	return data, 0
+}
+
+func (d *DockerFuseClient) offlineStat(fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	if !d.disk.getAttr(fullPath, attr) {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+func (d *DockerFuseClient) offlineOpen(fullPath string, flags int, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !d.disk.getAttr(fullPath, attr) {
+		return nil, 0, syscall.ENOENT
+	}
+	fh = uintptr(offlineHandleBase) + d.nextOfflineFH.Add(1)
+	mode = fs.FileMode(attr.FuseAttr.Mode)
+	d.trackHandle(fh, fullPath, attr)
+	return
+}
+
+func (d *DockerFuseClient) offlineSeek(fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	h, ok := d.handle(fh)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	switch whence {
+	case io.SeekStart, seekData:
+		return offset, 0
+	case io.SeekEnd:
+		return int64(h.attr.Size) + offset, 0
+	case seekHole:
+		return int64(h.attr.Size), 0
+	}
+	return 0, syscall.EINVAL
+}
+
+func (d *DockerFuseClient) offlineReadlink(fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	var attr statAttr
+	if !d.disk.getAttr(fullPath, &attr) {
+		return []byte{}, syscall.ENOENT
+	}
+	if attr.LinkTarget == "" {
+		return []byte{}, syscall.EINVAL
+	}
+	return []byte(attr.LinkTarget), 0
+}
@@ -0,0 +1,398 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/errdefs"
+)
+
+// Engines serving the Docker API
+const (
+	// EngineDocker is the Docker engine
+	EngineDocker = "docker"
+	// EnginePodman is Podman, accessed through its libpod API where it differs from Docker
+	EnginePodman = "podman"
+)
+
+// libpodPrefix prefixes libpod endpoints. Podman serves any API version from 4.0 on.
+const libpodPrefix = "/v4.0.0/libpod"
+
+// dockerSocket is where the local Docker daemon listens by default
+var dockerSocket = "/var/run/docker.sock"
+
+// podmanSocket returns the socket of the local Podman service, rootless first, or "" if none runs
+func podmanSocket() string {
+	var candidates []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates, "/run/podman/podman.sock")
+	for _, c := range candidates {
+		if fileExists(c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// podmanClient speaks the libpod API of Podman for exec, copy and inspect, where the Docker
+// compatible API of Podman behaves differently. Other calls go through the compatible API.
+type podmanClient struct {
+	dockerClient
+	network string
+	address string
+	http    *http.Client
+}
+
+// libpodContainer is the part of the libpod container inspect output used here
+type libpodContainer struct {
+	ID      string `json:"Id"`
+	Created time.Time
+	Path    string
+	Args    []string
+	State   struct {
+		Status     string
+		Running    bool
+		Paused     bool
+		Restarting bool
+		OOMKilled  bool
+		Dead       bool
+		Pid        int
+		ExitCode   int32
+		Error      string
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	Image        string
+	ImageName    string
+	Name         string
+	RestartCount int32
+	Driver       string
+	Mounts       []struct {
+		Type        string
+		Name        string
+		Source      string
+		Destination string
+		Driver      string
+		Mode        string
+		RW          bool
+		Propagation string
+	}
+	Config struct {
+		Hostname   string
+		User       string
+		Env        []string
+		Cmd        []string
+		WorkingDir string
+		Labels     map[string]string
+		Tty        bool
+		OpenStdin  bool
+	}
+}
+
+// libpodImage is the part of the libpod image inspect output used here
+type libpodImage struct {
+	ID           string `json:"Id"`
+	RepoTags     []string
+	Created      time.Time
+	Architecture string
+	Os           string
+	Variant      string
+	Size         int64
+}
+
+func newPodmanClient(compat dockerClient, host string) (*podmanClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	p := &podmanClient{dockerClient: compat, network: u.Scheme, address: u.Host}
+	switch u.Scheme {
+	case "unix":
+		p.address = u.Path
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported podman host %q (expected unix:// or tcp://)", host)
+	}
+	p.http = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return p.dial(ctx) },
+	}}
+	return p, nil
+}
+
+func (p *podmanClient) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, p.network, p.address)
+}
+
+// request returns a request to a libpod endpoint
+func (p *podmanClient) request(ctx context.Context, method string, endpoint string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := url.URL{Scheme: "http", Host: "podman", Path: libpodPrefix + endpoint, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// do sends req, turning error responses into errors
+func (p *podmanClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, libpodError(resp)
+	}
+	return resp, nil
+}
+
+// call sends in, as JSON, to a libpod endpoint and decodes the response into out, if any
+func (p *podmanClient) call(ctx context.Context, method string, endpoint string, query url.Values, in any, out any) (raw []byte, err error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := p.request(ctx, method, endpoint, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if raw, err = io.ReadAll(resp.Body); err != nil || out == nil {
+		return raw, err
+	}
+	return raw, json.Unmarshal(raw, out)
+}
+
+// libpodError returns the error of a libpod response. Missing objects are errdefs.NotFound, as with
+// the Docker client.
+func libpodError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+	if body.Message == "" {
+		body.Message = resp.Status
+	}
+	err := fmt.Errorf("podman: %s", body.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		return errdefs.NotFound(err)
+	}
+	return err
+}
+
+// ContainerInspect returns the libpod inspect output, in the Docker format
+func (p *podmanClient) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	var c libpodContainer
+	if _, err := p.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(containerID)+"/json", nil, nil, &c); err != nil {
+		return container.InspectResponse{}, err
+	}
+	status := c.State.Status
+	switch status {
+	case "configured":
+		status = "created"
+	case "stopped":
+		status = "exited"
+	}
+	inspect := container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{
+			ID:      c.ID,
+			Created: c.Created.Format(time.RFC3339Nano),
+			Path:    c.Path,
+			Args:    c.Args,
+			State: &container.State{
+				Status:     status,
+				Running:    c.State.Running,
+				Paused:     c.State.Paused,
+				Restarting: c.State.Restarting,
+				OOMKilled:  c.State.OOMKilled,
+				Dead:       c.State.Dead,
+				Pid:        c.State.Pid,
+				ExitCode:   int(c.State.ExitCode),
+				Error:      c.State.Error,
+				StartedAt:  c.State.StartedAt.Format(time.RFC3339Nano),
+				FinishedAt: c.State.FinishedAt.Format(time.RFC3339Nano),
+			},
+			Image:        c.Image,
+			Name:         "/" + c.Name,
+			RestartCount: int(c.RestartCount),
+			Driver:       c.Driver,
+		},
+		Config: &container.Config{
+			Hostname:   c.Config.Hostname,
+			User:       c.Config.User,
+			Env:        c.Config.Env,
+			Cmd:        c.Config.Cmd,
+			WorkingDir: c.Config.WorkingDir,
+			Labels:     c.Config.Labels,
+			Tty:        c.Config.Tty,
+			OpenStdin:  c.Config.OpenStdin,
+			Image:      c.ImageName,
+		},
+	}
+	for _, m := range c.Mounts {
+		inspect.Mounts = append(inspect.Mounts, container.MountPoint{
+			Type:        mount.Type(m.Type),
+			Name:        m.Name,
+			Source:      m.Source,
+			Destination: m.Destination,
+			Driver:      m.Driver,
+			Mode:        m.Mode,
+			RW:          m.RW,
+			Propagation: mount.Propagation(m.Propagation),
+		})
+	}
+	return inspect, nil
+}
+
+// ImageInspectWithRaw returns the libpod inspect output, in the Docker format, and as returned
+func (p *podmanClient) ImageInspectWithRaw(ctx context.Context, imageID string) (image.InspectResponse, []byte, error) {
+	var i libpodImage
+	raw, err := p.call(ctx, http.MethodGet, "/images/"+url.PathEscape(imageID)+"/json", nil, nil, &i)
+	if err != nil {
+		return image.InspectResponse{}, nil, err
+	}
+	return image.InspectResponse{
+		ID:           i.ID,
+		RepoTags:     i.RepoTags,
+		Created:      i.Created.Format(time.RFC3339Nano),
+		Architecture: i.Architecture,
+		Os:           i.Os,
+		Variant:      i.Variant,
+		Size:         i.Size,
+	}, raw, nil
+}
+
+func (p *podmanClient) ContainerExecCreate(ctx context.Context, containerID string, config container.ExecOptions) (common.IDResponse, error) {
+	var id common.IDResponse
+	_, err := p.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(containerID)+"/exec", nil, config, &id)
+	return id, err
+}
+
+// ContainerExecAttach starts the exec session, and hijacks the connection to stream its input and
+// output
+func (p *podmanClient) ContainerExecAttach(ctx context.Context, execID string, config container.ExecStartOptions) (types.HijackedResponse, error) {
+	data, err := json.Marshal(struct{ Detach, Tty bool }{config.Detach, config.Tty})
+	if err != nil {
+		return types.HijackedResponse{}, err
+	}
+	req, err := p.request(ctx, http.MethodPost, "/exec/"+url.PathEscape(execID)+"/start", nil, bytes.NewReader(data))
+	if err != nil {
+		return types.HijackedResponse{}, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return types.HijackedResponse{}, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return types.HijackedResponse{}, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return types.HijackedResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return types.HijackedResponse{}, libpodError(resp)
+	}
+	return types.HijackedResponse{Conn: conn, Reader: br}, nil
+}
+
+func (p *podmanClient) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	var inspect container.ExecInspect
+	_, err := p.call(ctx, http.MethodGet, "/exec/"+url.PathEscape(execID)+"/json", nil, nil, &inspect)
+	return inspect, err
+}
+
+// archive sends a request to the archive endpoint of a container
+func (p *podmanClient) archive(ctx context.Context, method string, containerID string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := p.request(ctx, method, "/containers/"+url.PathEscape(containerID)+"/archive", query, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-tar")
+	}
+	return p.do(req)
+}
+
+// pathStat decodes the stat of a path, sent along archives
+func pathStat(resp *http.Response) (stat container.PathStat, err error) {
+	data, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Docker-Container-Path-Stat"))
+	if err != nil {
+		return stat, fmt.Errorf("invalid path stat: %s", err)
+	}
+	err = json.Unmarshal(data, &stat)
+	return stat, err
+}
+
+func (p *podmanClient) ContainerStatPath(ctx context.Context, containerID, path string) (container.PathStat, error) {
+	resp, err := p.archive(ctx, http.MethodHead, containerID, url.Values{"path": {path}}, nil)
+	if err != nil {
+		return container.PathStat{}, err
+	}
+	resp.Body.Close()
+	return pathStat(resp)
+}
+
+func (p *podmanClient) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	resp, err := p.archive(ctx, http.MethodGet, containerID, url.Values{"path": {srcPath}}, nil)
+	if err != nil {
+		return nil, container.PathStat{}, err
+	}
+	stat, err := pathStat(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, stat, err
+	}
+	return resp.Body, stat, nil
+}
+
+// CopyToContainer extracts content in the container, without pausing it as Podman does by default,
+// which would freeze the satellite
+func (p *podmanClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options container.CopyToContainerOptions) error {
+	resp, err := p.archive(ctx, http.MethodPut, containerID, url.Values{"path": {dstPath}, "pause": {"false"}}, content)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLibpod serves handler on a unix socket, as Podman does, and returns the host to connect to
+func fakeLibpod(t *testing.T, handler http.Handler) string {
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	l, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+	return "unix://" + socket
+}
+
+// libpodStat sets the header with the stat of a path, as sent along archives
+func libpodStat(w http.ResponseWriter, stat container.PathStat) {
+	data, _ := json.Marshal(stat)
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(data))
+}
+
+func TestPodmanClient(t *testing.T) {
+	var mDC mockDockerClient
+	stat := container.PathStat{Name: "hostname", Size: 4, Mode: 0644}
+	var uploaded []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v4.0.0/libpod/containers/web/json", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"Id":"c0ffee","Created":"2024-01-02T03:04:05Z","Path":"/bin/sh","State":{"Status":"running","Running":true,"Pid":42},
+			"Image":"5e5e","ImageName":"docker.io/library/alpine:latest","Name":"web","Config":{"Tty":true,"Env":["A=1"],"Labels":{"k":"v"}},
+			"Mounts":[{"Type":"bind","Source":"/src","Destination":"/dst","RW":true}]}`)
+	})
+	mux.HandleFunc("GET /v4.0.0/libpod/containers/missing/json", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"cause":"no such container","message":"no container with name or ID \"missing\" found: no such container","response":404}`)
+	})
+	mux.HandleFunc("GET /v4.0.0/libpod/images/5e5e/json", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"Id":"5e5e","RepoTags":["docker.io/library/alpine:latest"],"Architecture":"arm64","Os":"linux"}`)
+	})
+	mux.HandleFunc("POST /v4.0.0/libpod/containers/web/exec", func(w http.ResponseWriter, r *http.Request) {
+		var config container.ExecOptions
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&config))
+		assert.Equal(t, []string{"/tmp/satellite"}, config.Cmd)
+		assert.True(t, config.AttachStdin)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"Id":"e1"}`)
+	})
+	mux.HandleFunc("POST /v4.0.0/libpod/exec/e1/start", func(w http.ResponseWriter, r *http.Request) {
+		var start struct{ Detach, Tty bool }
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&start))
+		assert.True(t, start.Tty)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+		io.Copy(conn, rw)
+	})
+	mux.HandleFunc("GET /v4.0.0/libpod/exec/e1/json", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ID":"e1","ContainerID":"c0ffee","Running":false,"ExitCode":3,"Pid":7}`)
+	})
+	mux.HandleFunc("HEAD /v4.0.0/libpod/containers/web/archive", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("path") != "/etc/hostname" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		libpodStat(w, stat)
+	})
+	mux.HandleFunc("GET /v4.0.0/libpod/containers/web/archive", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/etc/hostname", r.URL.Query().Get("path"))
+		libpodStat(w, stat)
+		io.WriteString(w, "tar!")
+	})
+	mux.HandleFunc("PUT /v4.0.0/libpod/containers/web/archive", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tmp", r.URL.Query().Get("path"))
+		assert.Equal(t, "false", r.URL.Query().Get("pause"))
+		assert.Equal(t, "application/x-tar", r.Header.Get("Content-Type"))
+		uploaded, _ = io.ReadAll(r.Body)
+	})
+	p, err := newPodmanClient(&mDC, fakeLibpod(t, mux))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+
+	// Inspect output is converted to the Docker format
+	inspect, err := p.ContainerInspect(ctx, "web")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "c0ffee", inspect.ID)
+		assert.Equal(t, "/web", inspect.Name)
+		assert.Equal(t, "5e5e", inspect.Image)
+		assert.Equal(t, "running", inspect.State.Status)
+		assert.True(t, inspect.State.Running)
+		assert.True(t, inspect.Config.Tty)
+		assert.Equal(t, []string{"A=1"}, inspect.Config.Env)
+		assert.Equal(t, "v", inspect.Config.Labels["k"])
+		assert.Equal(t, "/dst", inspect.Mounts[0].Destination)
+	}
+	_, err = p.ContainerInspect(ctx, "missing")
+	assert.True(t, errdefs.IsNotFound(err))
+	assert.ErrorContains(t, err, `podman: no container with name or ID "missing" found`)
+	image, raw, err := p.ImageInspectWithRaw(ctx, "5e5e")
+	assert.NoError(t, err)
+	assert.Equal(t, "arm64", image.Architecture)
+	assert.Contains(t, string(raw), `"Os":"linux"`)
+
+	// Exec sessions are hijacked
+	id, err := p.ContainerExecCreate(ctx, "web", container.ExecOptions{AttachStdin: true, AttachStdout: true, Cmd: []string{"/tmp/satellite"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "e1", id.ID)
+	hijacked, err := p.ContainerExecAttach(ctx, id.ID, container.ExecStartOptions{Tty: true})
+	if assert.NoError(t, err) {
+		io.WriteString(hijacked.Conn, "ping")
+		assert.NoError(t, hijacked.CloseWrite())
+		echoed, err := io.ReadAll(hijacked.Reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+		hijacked.Close()
+	}
+	exec, err := p.ContainerExecInspect(ctx, id.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, container.ExecInspect{ExecID: "e1", ContainerID: "c0ffee", ExitCode: 3, Pid: 7}, exec)
+
+	// Archives carry the stat of their path
+	pathStat, err := p.ContainerStatPath(ctx, "web", "/etc/hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, stat.Size, pathStat.Size)
+	_, err = p.ContainerStatPath(ctx, "web", "/missing")
+	assert.True(t, errdefs.IsNotFound(err))
+	rc, pathStat, err := p.CopyFromContainer(ctx, "web", "/etc/hostname")
+	if assert.NoError(t, err) {
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "tar!", string(data))
+		assert.Equal(t, stat.Name, pathStat.Name)
+	}
+	assert.NoError(t, p.CopyToContainer(ctx, "web", "/tmp", bytes.NewReader([]byte("satellite")), container.CopyToContainerOptions{}))
+	assert.Equal(t, "satellite", string(uploaded))
+
+	// Other calls go through the Docker compatible API
+	mDC.On("ContainerDiff", ctx, "web").Return([]container.FilesystemChange{{Path: "/tmp"}}, nil)
+	changes, err := p.ContainerDiff(ctx, "web")
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	mDC.AssertExpectations(t)
+
+	_, err = newPodmanClient(&mDC, "ssh://user@host")
+	assert.EqualError(t, err, `unsupported podman host "ssh://user@host" (expected unix:// or tcp://)`)
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+)
+
+// procDir is where the processes of this host are seen
+var procDir = "/proc"
+
+// nsenterPath is the nsenter(1) of util-linux, which runs commands in the namespaces of processes
+var nsenterPath = "nsenter"
+
+// processBackend serves the root filesystem of a local process: commands (the satellite included)
+// run in its mount namespace, chrooted to its root (as nsenter -m -r does), and files are accessed
+// through /proc/<pid>/root. This covers LXC/LXD and systemd-nspawn containers, as well as bare
+// namespaces, but needs privileges over the process.
+type processBackend struct {
+	satellitePlacement
+	pid int
+}
+
+// WithProcess serves the root filesystem of a local Linux process, whose PID is given as
+// container ID, instead of a Docker container: it selects BackendProcess
+func WithProcess() ClientOption {
+	return WithBackend(BackendProcess)
+}
+
+// newProcessBackend returns the backend serving the process pid, given in decimal
+func newProcessBackend(pid string, config BackendConfig) (Backend, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("mounting processes is only supported on Linux")
+	}
+	n, err := strconv.Atoi(pid)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid PID: %q", pid)
+	}
+	b := &processBackend{pid: n}
+	if _, err := b.stat(); err != nil {
+		return nil, err
+	}
+	b.satellitePlacement = newSatellitePlacement(b, "pid "+pid, config)
+	slog.Debug("using nsenter", "pid", n)
+	return b, nil
+}
+
+// procFile reads the file name of /proc/<pid>
+func (b *processBackend) procFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%d/%s", procDir, b.pid, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errdefs.NotFound(fmt.Errorf("no such process: %d", b.pid))
+	}
+	return data, err
+}
+
+// stat returns the fields of /proc/<pid>/stat, the command name (field 2) first
+func (b *processBackend) stat() ([]string, error) {
+	data, err := b.procFile("stat")
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses, and may contain anything
+	open, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("%s/%d/stat: unexpected format", procDir, b.pid)
+	}
+	return append([]string{string(data[open+1 : end])}, strings.Fields(string(data[end+1:]))...), nil
+}
+
+// nulList splits a NUL-terminated list, as /proc/<pid>/cmdline
+func nulList(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// environ returns the environment of the process
+func (b *processBackend) environ() ([]string, error) {
+	data, err := b.procFile("environ")
+	return nulList(data), err
+}
+
+// Resolve identifies the process by its PID and start time, so that a recycled PID is another
+// target
+func (b *processBackend) Resolve(ctx context.Context) (Target, error) {
+	stat, err := b.stat()
+	if err != nil {
+		return Target{}, err
+	}
+	if len(stat) < 21 {
+		return Target{}, fmt.Errorf("%s/%d/stat: unexpected format", procDir, b.pid)
+	}
+	// Zombies, whose root is gone
+	if state := stat[1]; state == "Z" || state == "X" {
+		return Target{}, errdefs.NotFound(fmt.Errorf("process %d exited", b.pid))
+	}
+	return Target{ID: fmt.Sprintf("%d-%s", b.pid, stat[20])}, nil
+}
+
+// procArch returns the architecture of the executable of pid
+func procArch(pid int) (arch, variant string, err error) {
+	exe := fmt.Sprintf("%s/%d/exe", procDir, pid)
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	return elfMachine(f, exe)
+}
+
+// Arch returns the architecture of the process, read from its executable
+func (b *processBackend) Arch(ctx context.Context) (arch string, variant string, err error) {
+	return procArch(b.pid)
+}
+
+// statPath stats fullPath in the root of the process
+func (b *processBackend) statPath(ctx context.Context, fullPath string) (container.PathStat, error) {
+	return procStatPath(b.pid, fullPath)
+}
+
+// extract unpacks archive in dir, in the root of the process. Only directories and files can be
+// extracted.
+func (b *processBackend) extract(ctx context.Context, dir string, archive io.Reader) error {
+	return procCopyTo(b.pid, dir, archive)
+}
+
+// command returns the nsenter command running cmd in the process root, with its environment
+func (b *processBackend) command(ctx context.Context, cmd []string) (*exec.Cmd, error) {
+	env, err := b.environ()
+	if err != nil {
+		return nil, err
+	}
+	nsenter := exec.CommandContext(ctx, nsenterPath, append([]string{"--target", strconv.Itoa(b.pid), "--mount", "--root", "--"}, cmd...)...)
+	nsenter.Env = env
+	return nsenter, nil
+}
+
+// output runs cmd in the root of the process, and returns its standard output
+func (b *processBackend) output(ctx context.Context, cmd ...string) (string, error) {
+	nsenter, err := b.command(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	out, err := commandOutput(nsenter, cmd[0])
+	return string(out), err
+}
+
+// start runs cmd in the root of the process, with its stdin and stdout on pipes
+func (b *processBackend) start(ctx context.Context, cmd []string) (SatelliteConn, error) {
+	// Not bound to ctx: the satellite outlives the request starting it
+	nsenter, err := b.command(context.Background(), cmd)
+	if err != nil {
+		return nil, err
+	}
+	satellite, err := startCommand(nsenter)
+	if err != nil {
+		return nil, fmt.Errorf("running nsenter (util-linux): %w", err)
+	}
+	return satellite, nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessClient(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("processes are only mounted on Linux")
+	}
+	_, err := newProcessBackend("web", BackendConfig{})
+	assert.EqualError(t, err, `invalid PID: "web"`)
+	_, err = newProcessBackend("999999999", BackendConfig{})
+	assert.True(t, errdefs.IsNotFound(err))
+
+	fdc, err := newClient(strconv.Itoa(os.Getpid()), WithProcess())
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	target, err := fdc.backend.Resolve(ctx)
+	if assert.NoError(t, err) {
+		assert.Regexp(t, "^"+strconv.Itoa(os.Getpid())+"-[0-9]+$", target.ID)
+	}
+	arch, _, err := fdc.backend.Arch(ctx)
+	if assert.NoError(t, err) && runtime.GOARCH != "arm" {
+		assert.Equal(t, runtime.GOARCH, arch)
+	}
+}
+
+// TestProcessClientNamespace mounts a process in a mount namespace of its own, as unshare creates
+func TestProcessClientNamespace(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("entering mount namespaces needs root on Linux")
+	}
+	for _, tool := range []string{"unshare", nsenterPath} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s (util-linux) not found", tool)
+		}
+	}
+	// A tmpfs only seen in the namespace
+	dir := t.TempDir()
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "sh", "-c",
+		`mount -t tmpfs none "$0" && echo inside > "$0/marker" && exec sleep 60`, dir)
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	marker := filepath.Join(dir, "marker")
+	ready := func() bool {
+		_, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid), "root", marker))
+		return err == nil
+	}
+	for deadline := time.Now().Add(5 * time.Second); !ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Skip("mount namespaces can't be created here")
+		}
+	}
+	assert.NoFileExists(t, marker)
+
+	backend, err := newProcessBackend(strconv.Itoa(pid), BackendConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := backend.(*processBackend)
+	ctx := context.Background()
+	stat, err := c.statPath(ctx, marker)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), stat.Size)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "satellite", Mode: 0700, Size: 9})
+	tw.Write([]byte("satellite"))
+	tw.Close()
+	assert.NoError(t, c.extract(ctx, dir, &archive))
+	assert.NoFileExists(t, filepath.Join(dir, "satellite"))
+
+	// Commands see the namespace
+	out, err := c.output(ctx, "cat", marker, filepath.Join(dir, "satellite"))
+	assert.NoError(t, err)
+	assert.Equal(t, "inside\nsatellite", out)
+	_, err = c.output(ctx, "cat", filepath.Join(dir, "missing"))
+	assert.ErrorContains(t, err, "No such file or directory")
+
+	// The satellite talks over pipes, and is stopped by closing its input
+	conn, err := c.start(ctx, []string{"cat"})
+	if assert.NoError(t, err) {
+		io.WriteString(conn, "pong")
+		stopped := make(chan error)
+		go func() { stopped <- conn.Stop(ctx) }()
+		echoed, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(echoed))
+		assert.NoError(t, <-stopped)
+		conn.Close()
+	}
+}
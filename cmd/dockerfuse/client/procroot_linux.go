@@ -0,0 +1,176 @@
+package client
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// openProcRoot opens the root directory of pid, as it sees it
+func openProcRoot(pid int) (int, error) {
+	return unix.Open(fmt.Sprintf("%s/%d/root", procDir, pid), unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+}
+
+// openInRoot opens fullPath below root, resolving symlinks as if root was /, so that paths never
+// escape it
+func openInRoot(root int, fullPath string, flags int) (int, error) {
+	fd, err := unix.Openat2(root, fullPath, &unix.OpenHow{Flags: uint64(flags | unix.O_CLOEXEC), Resolve: unix.RESOLVE_IN_ROOT})
+	switch {
+	case errors.Is(err, unix.ENOSYS):
+		return -1, errors.New("accessing files through /proc/<pid>/root needs Linux 5.6 or later")
+	case errors.Is(err, unix.ENOENT):
+		return -1, errdefs.NotFound(fmt.Errorf("no such file or directory: %s", fullPath))
+	case err != nil:
+		return -1, fmt.Errorf("%s: %w", fullPath, err)
+	}
+	return fd, nil
+}
+
+// statInRoot returns the stat of fullPath below root, without following a final symlink
+func statInRoot(root int, fullPath string) (stat container.PathStat, err error) {
+	fd, err := openInRoot(root, fullPath, unix.O_PATH|unix.O_NOFOLLOW)
+	if err != nil {
+		return stat, err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return stat, err
+	}
+	stat = container.PathStat{
+		Name:  path.Base(fullPath),
+		Size:  st.Size,
+		Mode:  unixFileMode(st.Mode),
+		Mtime: time.Unix(st.Mtim.Unix()),
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(fd, "", buf)
+		if err != nil {
+			return stat, err
+		}
+		stat.LinkTarget = string(buf[:n])
+	}
+	return stat, nil
+}
+
+// procStatPath stats fullPath in the root of pid
+func procStatPath(pid int, fullPath string) (container.PathStat, error) {
+	root, err := openProcRoot(pid)
+	if err != nil {
+		return container.PathStat{}, err
+	}
+	defer unix.Close(root)
+	return statInRoot(root, fullPath)
+}
+
+// procCopyFrom streams srcPath from the root of pid as a tar archive. Only files and symlinks can be
+// copied.
+func procCopyFrom(pid int, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	root, err := openProcRoot(pid)
+	if err != nil {
+		return nil, container.PathStat{}, err
+	}
+	defer unix.Close(root)
+	stat, err := statInRoot(root, srcPath)
+	if err != nil {
+		return nil, stat, err
+	}
+	header := &tar.Header{Name: stat.Name, Mode: int64(stat.Mode.Perm()), ModTime: stat.Mtime}
+	var content *os.File
+	switch {
+	case stat.Mode.IsRegular():
+		fd, err := openInRoot(root, srcPath, unix.O_RDONLY|unix.O_NOFOLLOW)
+		if err != nil {
+			return nil, stat, err
+		}
+		content = os.NewFile(uintptr(fd), srcPath)
+		header.Typeflag, header.Size = tar.TypeReg, stat.Size
+	case stat.Mode&os.ModeSymlink != 0:
+		header.Typeflag, header.Linkname = tar.TypeSymlink, stat.LinkTarget
+	default:
+		return nil, stat, fmt.Errorf("%s: copying directories and special files is not supported", srcPath)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(header)
+		if err == nil && content != nil {
+			_, err = io.Copy(tw, content)
+		}
+		if content != nil {
+			content.Close()
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, stat, nil
+}
+
+// procCopyTo extracts content in dstPath, in the root of pid. This works without a shell or tar in
+// the root, but only directories and files can be extracted.
+func procCopyTo(pid int, dstPath string, content io.Reader) error {
+	root, err := openProcRoot(pid)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := extractInRoot(root, path.Join(dstPath, header.Name), header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractInRoot creates the entry of header at fullPath below root, with content read from r
+func extractInRoot(root int, fullPath string, header *tar.Header, r io.Reader) error {
+	dir, err := openInRoot(root, path.Dir(fullPath), unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	name := path.Base(fullPath)
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(dir, name, mode); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("%s: %w", fullPath, err)
+		}
+		return nil
+	case tar.TypeReg:
+		// Replaced rather than truncated, as it may be running (e.g. an older satellite)
+		if err := unix.Unlinkat(dir, name, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("%s: %w", fullPath, err)
+		}
+		fd, err := unix.Openat(dir, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fullPath, err)
+		}
+		f := os.NewFile(uintptr(fd), fullPath)
+		defer f.Close()
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		// Not limited by the umask
+		return f.Chmod(os.FileMode(mode).Perm())
+	}
+	return fmt.Errorf("%s: extracting tar entries of type %q is not supported", fullPath, header.Typeflag)
+}
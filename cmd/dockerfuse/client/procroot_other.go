@@ -0,0 +1,25 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// errProcRootUnsupported is returned when accessing files through /proc/<pid>/root
+var errProcRootUnsupported = errors.New("accessing files of processes is only supported on Linux")
+
+func procStatPath(pid int, fullPath string) (container.PathStat, error) {
+	return container.PathStat{}, errProcRootUnsupported
+}
+
+func procCopyFrom(pid int, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	return nil, container.PathStat{}, errProcRootUnsupported
+}
+
+func procCopyTo(pid int, dstPath string, content io.Reader) error {
+	return errProcRootUnsupported
+}
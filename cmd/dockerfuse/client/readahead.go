@@ -0,0 +1,271 @@
+package client
+
+import (
+	"container/list"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Readahead defaults
+const (
+	DefaultReadaheadBlockSize = 128 * 1024
+	DefaultReadaheadMaxBlocks = 8
+	DefaultReadaheadMemory    = 64 * 1024 * 1024
+)
+
+// ReadaheadConfig configures the per-handle block cache
+type ReadaheadConfig struct {
+	BlockSize   int   // Size of each cached block
+	MaxBlocks   int   // Maximum number of blocks prefetched ahead of a sequential reader
+	MemoryLimit int64 // Maximum memory used by cached blocks, across all handles
+}
+
+// fetchFunc reads n bytes at offset from the remote file
+type fetchFunc func(offset int64, n int) ([]byte, syscall.Errno)
+
+// cacheBlock holds a block of file content, which may still be in flight
+type cacheBlock struct {
+	handle *handleCache
+	index  int64
+	ready  chan struct{}
+	data   []byte
+	errno  syscall.Errno
+	lru    *list.Element
+}
+
+// handleCache tracks cached blocks and access pattern of an open file handle
+type handleCache struct {
+	fullPath string
+	attr     fuse.Attr // Size and mtime of the file when blocks were cached
+	blocks   map[int64]*cacheBlock
+	lastEnd  int64          // End offset of the last read, to detect sequential access
+	window   int            // Current readahead window, in blocks
+	eofBlock int64          // Index of the block known to contain EOF, or -1
+	fetches  sync.WaitGroup // Prefetches in flight
+}
+
+// readaheadCache is a block cache with adaptive readahead for sequential reads
+type readaheadCache struct {
+	config ReadaheadConfig
+
+	mu      sync.Mutex
+	handles map[fusefs.FileHandle]*handleCache
+	lru     *list.List // Of *cacheBlock, least recently used at the front
+	used    int64
+}
+
+func newReadaheadCache(config ReadaheadConfig) *readaheadCache {
+	if config.BlockSize <= 0 {
+		config.BlockSize = DefaultReadaheadBlockSize
+	}
+	if config.MaxBlocks <= 0 {
+		config.MaxBlocks = DefaultReadaheadMaxBlocks
+	}
+	if config.MemoryLimit <= 0 {
+		config.MemoryLimit = DefaultReadaheadMemory
+	}
+	return &readaheadCache{
+		config:  config,
+		handles: make(map[fusefs.FileHandle]*handleCache),
+		lru:     list.New(),
+	}
+}
+
+// open starts tracking fh, which refers to fullPath
+func (c *readaheadCache) open(fh fusefs.FileHandle, fullPath string, attr *fuse.Attr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropHandle(fh)
+	c.handles[fh] = &handleCache{fullPath: fullPath, attr: *attr, blocks: make(map[int64]*cacheBlock), eofBlock: -1}
+}
+
+// checkAttr drops cached blocks of fullPath if attr shows that its content changed
+func (c *readaheadCache) checkAttr(fullPath string, attr *fuse.Attr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, h := range c.handles {
+		if h.fullPath != fullPath {
+			continue
+		}
+		if h.attr.Size != attr.Size || h.attr.Mtime != attr.Mtime || h.attr.Mtimensec != attr.Mtimensec {
+			c.dropBlocks(h)
+			h.attr = *attr
+		}
+	}
+}
+
+// close stops tracking fh and frees its blocks. It returns once prefetches of fh are done, so that
+// none reaches the satellite after the file is closed.
+func (c *readaheadCache) close(fh fusefs.FileHandle) {
+	c.mu.Lock()
+	h := c.handles[fh]
+	c.dropHandle(fh)
+	c.mu.Unlock()
+
+	if h != nil {
+		h.fetches.Wait()
+	}
+}
+
+// invalidate drops cached blocks of every handle referring to fullPath
+func (c *readaheadCache) invalidate(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, h := range c.handles {
+		if h.fullPath == fullPath {
+			c.dropBlocks(h)
+		}
+	}
+}
+
+// invalidateTree drops cached blocks of every handle referring to fullPath or its descendants
+func (c *readaheadCache) invalidateTree(fullPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fullPath = filepath.Clean(fullPath)
+	prefix := strings.TrimSuffix(fullPath, "/") + "/"
+	for _, h := range c.handles {
+		if h.fullPath == fullPath || strings.HasPrefix(h.fullPath, prefix) {
+			c.dropBlocks(h)
+		}
+	}
+}
+
+func (c *readaheadCache) dropHandle(fh fusefs.FileHandle) {
+	if h, ok := c.handles[fh]; ok {
+		c.dropBlocks(h)
+		delete(c.handles, fh)
+	}
+}
+
+func (c *readaheadCache) dropBlocks(h *handleCache) {
+	for _, b := range h.blocks {
+		c.removeBlock(b)
+	}
+	h.window = 0
+	h.eofBlock = -1
+}
+
+func (c *readaheadCache) removeBlock(b *cacheBlock) {
+	c.lru.Remove(b.lru)
+	delete(b.handle.blocks, b.index)
+	c.used -= int64(c.config.BlockSize)
+}
+
+// read returns up to n bytes at offset, serving them from cached blocks when the handle is
+// read sequentially. Blocks ahead of sequential readers are prefetched concurrently.
+func (c *readaheadCache) read(fh fusefs.FileHandle, offset int64, n int, fetch fetchFunc) ([]byte, syscall.Errno) {
+	bs := int64(c.config.BlockSize)
+	first := offset / bs
+	last := (offset + int64(n) - 1) / bs
+
+	c.mu.Lock()
+	h, ok := c.handles[fh]
+	if !ok || n <= 0 {
+		c.mu.Unlock()
+		return fetch(offset, n)
+	}
+
+	// Grow the readahead window on sequential access, reset it on random access
+	if offset == h.lastEnd {
+		h.window = min(max(2*h.window, 1), c.config.MaxBlocks)
+	} else {
+		h.window = 0
+	}
+	h.lastEnd = offset + int64(n)
+
+	if h.window == 0 && !h.cached(first, last) {
+		// Random access: don't pollute the cache
+		c.mu.Unlock()
+		return fetch(offset, n)
+	}
+
+	blocks := make([]*cacheBlock, 0, last-first+1)
+	for i := first; i <= last+int64(h.window); i++ {
+		if h.eofBlock >= 0 && i > h.eofBlock {
+			break
+		}
+		b, ok := h.blocks[i]
+		if !ok {
+			b = c.startFetch(h, i, fetch)
+		}
+		c.lru.MoveToBack(b.lru)
+		if i <= last {
+			blocks = append(blocks, b)
+		}
+	}
+	c.evict()
+	c.mu.Unlock()
+
+	// Assemble the result from the blocks covering the requested range
+	data := make([]byte, 0, n)
+	for _, b := range blocks {
+		<-b.ready
+		if b.errno != 0 {
+			return nil, b.errno
+		}
+		start := max(offset-b.index*bs, 0)
+		if start >= int64(len(b.data)) {
+			break
+		}
+		end := min(int64(len(b.data)), offset+int64(n)-b.index*bs)
+		data = append(data, b.data[start:end]...)
+		if len(b.data) < int(bs) {
+			break // EOF
+		}
+	}
+	return data, 0
+}
+
+// cached tells whether blocks from first to last are all cached or in flight
+func (h *handleCache) cached(first, last int64) bool {
+	for i := first; i <= last; i++ {
+		if _, ok := h.blocks[i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// startFetch adds an in-flight block to the cache and fetches it in background
+func (c *readaheadCache) startFetch(h *handleCache, index int64, fetch fetchFunc) *cacheBlock {
+	b := &cacheBlock{handle: h, index: index, ready: make(chan struct{})}
+	b.lru = c.lru.PushBack(b)
+	h.blocks[index] = b
+	c.used += int64(c.config.BlockSize)
+
+	h.fetches.Add(1)
+	go func() {
+		defer h.fetches.Done()
+		data, errno := fetch(index*int64(c.config.BlockSize), c.config.BlockSize)
+		c.mu.Lock()
+		b.data, b.errno = data, errno
+		if h.blocks[index] == b {
+			if errno != 0 {
+				// Don't cache errors
+				c.removeBlock(b)
+			} else if len(data) < c.config.BlockSize && (h.eofBlock < 0 || index < h.eofBlock) {
+				h.eofBlock = index
+			}
+		}
+		c.mu.Unlock()
+		close(b.ready)
+	}()
+	return b
+}
+
+// evict frees least recently used blocks until memory usage is within the limit
+func (c *readaheadCache) evict() {
+	for c.used > c.config.MemoryLimit && c.lru.Len() > 0 {
+		c.removeBlock(c.lru.Front().Value.(*cacheBlock))
+	}
+}
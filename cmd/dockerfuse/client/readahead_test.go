@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRemoteFile serves reads from content, recording the offsets requested
+type fakeRemoteFile struct {
+	mu      sync.Mutex
+	content []byte
+	latency time.Duration
+	reads   []int64
+}
+
+func (f *fakeRemoteFile) fetch(offset int64, n int) ([]byte, syscall.Errno) {
+	time.Sleep(f.latency)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads = append(f.reads, offset)
+	if offset >= int64(len(f.content)) {
+		return []byte{}, 0
+	}
+	end := min(offset+int64(n), int64(len(f.content)))
+	return append([]byte(nil), f.content[offset:end]...), 0
+}
+
+func (f *fakeRemoteFile) readCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.reads)
+}
+
+func testContent(n int) []byte {
+	content := make([]byte, n)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestReadaheadSequential(t *testing.T) {
+	f := &fakeRemoteFile{content: testContent(10*1024 + 100)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 4, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	var got []byte
+	for off := int64(0); ; off += 512 {
+		data, errno := c.read(fh, off, 512, f.fetch)
+		assert.Equal(t, syscall.Errno(0), errno)
+		if len(data) == 0 {
+			break
+		}
+		got = append(got, data...)
+	}
+	assert.Equal(t, f.content, got)
+	// Each block is fetched once (plus a readahead window past EOF), instead of a fetch per read
+	assert.LessOrEqual(t, f.readCount(), 11+4)
+}
+
+func TestReadaheadUnalignedAcrossBlocks(t *testing.T) {
+	f := &fakeRemoteFile{content: testContent(4096)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1000, MaxBlocks: 2, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	data, errno := c.read(fh, 0, 10, f.fetch)
+	assert.Equal(t, syscall.Errno(0), errno)
+	data, errno = c.read(fh, 10, 2500, f.fetch)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, f.content[10:2510], data)
+
+	// Reads past EOF return the available bytes
+	data, errno = c.read(fh, 2510, 5000, f.fetch)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, f.content[2510:], data)
+}
+
+func TestReadaheadRandomAccessBypassesCache(t *testing.T) {
+	f := &fakeRemoteFile{content: testContent(8192)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 4, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	data, _ := c.read(fh, 5000, 10, f.fetch)
+	assert.Equal(t, f.content[5000:5010], data)
+	data, _ = c.read(fh, 100, 10, f.fetch)
+	assert.Equal(t, f.content[100:110], data)
+	assert.Equal(t, []int64{5000, 100}, f.reads)
+	assert.Equal(t, int64(0), c.used)
+
+	// Unknown handles are always forwarded
+	data, _ = c.read(fusefs.FileHandle(uintptr(2)), 0, 10, f.fetch)
+	assert.Equal(t, f.content[0:10], data)
+}
+
+func TestReadaheadInvalidation(t *testing.T) {
+	f := &fakeRemoteFile{content: bytes.Repeat([]byte("a"), 4096)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 2, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{Size: 4096, Mtime: 1})
+
+	data, _ := c.read(fh, 0, 1024, f.fetch)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 1024), data)
+
+	// Same attributes: blocks are kept
+	c.checkAttr("/f", &fuse.Attr{Size: 4096, Mtime: 1})
+	assert.NotZero(t, c.used)
+
+	f.mu.Lock()
+	f.content = bytes.Repeat([]byte("b"), 4096)
+	f.mu.Unlock()
+	c.checkAttr("/f", &fuse.Attr{Size: 4096, Mtime: 2})
+	assert.Zero(t, c.used)
+
+	data, _ = c.read(fh, 0, 1024, f.fetch)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 1024), data)
+	data, _ = c.read(fh, 1024, 1024, f.fetch)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 1024), data)
+
+	c.invalidate("/f")
+	assert.Zero(t, c.used)
+	c.close(fh)
+	assert.Empty(t, c.handles)
+}
+
+func TestReadaheadInvalidateTree(t *testing.T) {
+	f := &fakeRemoteFile{content: bytes.Repeat([]byte("a"), 4096)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 1, MemoryLimit: 1 << 20})
+	inside, outside := fusefs.FileHandle(uintptr(1)), fusefs.FileHandle(uintptr(2))
+	c.open(inside, "/d/sub/f", &fuse.Attr{Size: 4096, Mtime: 1})
+	c.open(outside, "/dd/f", &fuse.Attr{Size: 4096, Mtime: 1})
+	c.read(inside, 0, 1024, f.fetch)
+	c.read(outside, 0, 1024, f.fetch)
+
+	c.invalidateTree("/d")
+	assert.Empty(t, c.handles[inside].blocks)
+	assert.NotEmpty(t, c.handles[outside].blocks)
+}
+
+func TestReadaheadMemoryLimit(t *testing.T) {
+	f := &fakeRemoteFile{content: testContent(64 * 1024)}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 8, MemoryLimit: 4 * 1024})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	for off := int64(0); off < 64*1024; off += 1024 {
+		data, errno := c.read(fh, off, 1024, f.fetch)
+		assert.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, f.content[off:off+1024], data)
+		assert.LessOrEqual(t, c.used, int64(4*1024))
+	}
+}
+
+func TestReadaheadErrorsNotCached(t *testing.T) {
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 1, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	failing := func(int64, int) ([]byte, syscall.Errno) { return nil, syscall.EIO }
+	_, errno := c.read(fh, 0, 10, failing)
+	assert.Equal(t, syscall.EIO, errno)
+
+	f := &fakeRemoteFile{content: testContent(100)}
+	data, errno := c.read(fh, 0, 10, f.fetch)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, f.content[:10], data)
+}
+
+func TestReadaheadCloseWaitsForPrefetches(t *testing.T) {
+	f := &fakeRemoteFile{content: testContent(64 * 1024), latency: 20 * time.Millisecond}
+	c := newReadaheadCache(ReadaheadConfig{BlockSize: 1024, MaxBlocks: 8, MemoryLimit: 1 << 20})
+	fh := fusefs.FileHandle(uintptr(1))
+	c.open(fh, "/f", &fuse.Attr{})
+
+	var (
+		closedMu sync.Mutex
+		closed   bool
+	)
+	fetch := func(offset int64, n int) ([]byte, syscall.Errno) {
+		data, errno := f.fetch(offset, n)
+		closedMu.Lock()
+		defer closedMu.Unlock()
+		assert.False(t, closed, "prefetch after close")
+		return data, errno
+	}
+	for off := int64(0); off < 4096; off += 1024 {
+		_, errno := c.read(fh, off, 1024, fetch)
+		assert.Equal(t, syscall.Errno(0), errno)
+	}
+	c.close(fh)
+	closedMu.Lock()
+	closed = true
+	closedMu.Unlock()
+}
+
+// benchmarkSequentialRead streams a 4 MiB file in 4 KiB reads over a link with 100µs latency
+func benchmarkSequentialRead(b *testing.B, readahead bool) {
+	f := &fakeRemoteFile{content: testContent(4 * 1024 * 1024), latency: 100 * time.Microsecond}
+	fh := fusefs.FileHandle(uintptr(1))
+	b.SetBytes(int64(len(f.content)))
+	for range b.N {
+		c := newReadaheadCache(ReadaheadConfig{})
+		if readahead {
+			c.open(fh, "/f", &fuse.Attr{})
+		}
+		for off := int64(0); off < int64(len(f.content)); off += 4096 {
+			if _, errno := c.read(fh, off, 4096, f.fetch); errno != 0 {
+				b.Fatal(errno)
+			}
+		}
+	}
+}
+
+func BenchmarkSequentialReadDirect(b *testing.B)    { benchmarkSequentialRead(b, false) }
+func BenchmarkSequentialReadReadahead(b *testing.B) { benchmarkSequentialRead(b, true) }
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Satellites are built into the satellites directory by the Makefile, before building dockerfuse.
+// Builds from a checkout not going through make run go generate first. go install of a module
+// version cannot, and gets no satellites: it is not supported.
+//
+//go:generate make -C ../../.. dockerfuse_satellite
+//go:embed satellites
+var satellitesFS embed.FS
+
+// embeddedSatellites holds the satellites embedded in the dockerfuse executable
+var embeddedSatellites fs.FS = satellitesFS
+
+// satelliteBinary returns the satellite for the given binary name. A file next to the dockerfuse
+// executable takes precedence over the embedded one.
+func satelliteBinary(satelliteBinName string) (satelliteBin []byte, source string, err error) {
+	ex, err := dfFS.Executable()
+	if err == nil {
+		source = filepath.Clean(filepath.Join(filepath.Dir(ex), satelliteBinName))
+		satelliteBin, err = dfFS.ReadFile(source)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+	}
+
+	embedded, embedErr := fs.ReadFile(embeddedSatellites, "satellites/"+satelliteBinName)
+	if embedErr != nil {
+		if len(embeddedSatelliteNames()) == 0 {
+			return nil, "", fmt.Errorf("%s not found next to the dockerfuse executable, and this dockerfuse "+
+				"was built without embedded satellites (go install is not supported: build it with make, or run "+
+				"go generate ./... before go build): %w", satelliteBinName, err)
+		}
+		return nil, "", fmt.Errorf("%s is neither embedded nor next to the dockerfuse executable: %w", satelliteBinName, err)
+	}
+	return embedded, "embedded:" + satelliteBinName, nil
+}
+
+// embeddedSatelliteNames returns the names of the satellites embedded in the dockerfuse executable
+func embeddedSatelliteNames() (names []string) {
+	entries, _ := fs.ReadDir(embeddedSatellites, "satellites")
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), satelliteBinPrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// satelliteHost is what placing and running the satellite needs from a target. Backends implement
+// it over their own transport, and embed a satellitePlacement driving it.
+type satelliteHost interface {
+	// statPath stats fullPath, failing with a not found error when it doesn't exist
+	statPath(ctx context.Context, fullPath string) (container.PathStat, error)
+	// extract unpacks the tar archive in dir, replacing existing files
+	extract(ctx context.Context, dir string, archive io.Reader) error
+	// output runs cmd and returns its standard output
+	output(ctx context.Context, cmd ...string) (string, error)
+	// start runs cmd, carrying its standard input and output over the returned stream
+	start(ctx context.Context, cmd []string) (SatelliteConn, error)
+}
+
+// satellitePlacement places the satellite in the first usable directory of a satelliteHost, or
+// has python3 load it in memory, and runs it. It provides the PlaceSatellite, Start and Run methods
+// of backends embedding it.
+type satellitePlacement struct {
+	host satelliteHost
+	// Names the target in logs
+	target string
+	// Candidate directories for the satellite, DefaultSatelliteDirs when nil
+	satelliteDirs []string
+	// Let the satellite remove its executable when the session ends
+	removeSatellite bool
+
+	// Set by PlaceSatellite
+	satelliteFullRemotePath string
+	// Satellite loaded in memory by the python3 bootstrap, when no directory is usable
+	satelliteInMemory []byte
+}
+
+// newSatellitePlacement returns the placement of the satellite on host, configured by config
+func newSatellitePlacement(host satelliteHost, target string, config BackendConfig) satellitePlacement {
+	return satellitePlacement{
+		host:            host,
+		target:          target,
+		satelliteDirs:   config.SatelliteDirs,
+		removeSatellite: config.RemoveSatellite,
+	}
+}
+
+// PlaceSatellite copies the satellite in the first usable candidate directory
+func (p *satellitePlacement) PlaceSatellite(ctx context.Context, satellite Satellite) error {
+	return p.place(ctx, satellite, nil)
+}
+
+// place copies the satellite in the first usable candidate directory, then in one of extraDirs. As
+// a last resort, targets shipping python3 have it loaded in memory.
+func (p *satellitePlacement) place(ctx context.Context, satellite Satellite, extraDirs []string) (err error) {
+	dirs := slices.Clone(p.satelliteDirs)
+	if dirs == nil {
+		dirs = slices.Clone(DefaultSatelliteDirs)
+	}
+	for _, dir := range extraDirs {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	var failures []string
+	for _, dir := range dirs {
+		err = p.placeSatellite(ctx, dir, satellite.Name, satellite.Binary, satellite.Source)
+		if err == nil {
+			p.satelliteInMemory = nil
+			return nil
+		}
+		slog.Warn("cannot use directory for the satellite", "dir", dir, "error", err)
+		failures = append(failures, fmt.Sprintf("%s: %s", dir, err))
+	}
+
+	if err = p.probeMemfd(ctx); err != nil {
+		failures = append(failures, fmt.Sprintf("in-memory loader, which requires python3: %s", err))
+		return fmt.Errorf("cannot place the satellite in %s (%s): pass a writable and executable "+
+			"directory with -satellite-dirs, as there is no in-memory fallback without python3",
+			p.target, strings.Join(failures, "; "))
+	}
+	slog.Info("no usable directory for the satellite, loading it in memory with python3")
+	p.satelliteFullRemotePath = ""
+	p.satelliteInMemory = satellite.Binary
+	return nil
+}
+
+// Start runs the placed satellite. The satellite loaded in memory is sent first, to the bootstrap.
+func (p *satellitePlacement) Start(ctx context.Context, args []string) (SatelliteConn, error) {
+	conn, err := p.host.start(ctx, p.satelliteCmd(args))
+	if err != nil {
+		return nil, err
+	}
+	if p.satelliteInMemory != nil {
+		if _, err = conn.Write(p.satelliteInMemory); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Run runs the satellite, which must have been copied in a directory
+func (p *satellitePlacement) Run(ctx context.Context, args ...string) (string, error) {
+	if p.satelliteInMemory != nil {
+		return "", errors.New("needs a writable directory in the container for the satellite")
+	}
+	return p.host.output(ctx, append([]string{p.satelliteFullRemotePath}, args...)...)
+}
+
+// satelliteChecksum runs the placed satellite, returning the SHA-256 of its
+// executable as computed by the satellite itself. This also makes sure that it can run at all, as
+// directories can be mounted noexec.
+func (p *satellitePlacement) satelliteChecksum(ctx context.Context) (sum string, err error) {
+	stdout, err := p.host.output(ctx, p.satelliteFullRemotePath, "-version")
+	if err != nil {
+		return "", fmt.Errorf("cannot run the satellite: %s", err)
+	}
+	if !strings.Contains(stdout, "DockerFuse Satellite") {
+		return "", fmt.Errorf("cannot run the satellite (noexec mount?)")
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		if sum, ok := strings.CutPrefix(line, "SHA256: "); ok {
+			return strings.TrimSpace(sum), nil
+		}
+	}
+	// Satellites predating checksums
+	return "", nil
+}
+
+// placeSatellite makes the satellite available in dir, unless dir is not writable or executable
+func (p *satellitePlacement) placeSatellite(ctx context.Context, dir string, satelliteBinName string, satelliteBin []byte, source string) error {
+	p.satelliteFullRemotePath = filepath.Join(dir, satelliteBinName)
+	destination := fmt.Sprintf("%s:%s", p.target, p.satelliteFullRemotePath)
+	expected := sha256Hex(satelliteBin)
+
+	// A satellite of the same size is already there: ask it for its checksum
+	stat, err := p.host.statPath(ctx, p.satelliteFullRemotePath)
+	if err == nil && stat.Size == int64(len(satelliteBin)) {
+		if sum, err := p.satelliteChecksum(ctx); err == nil && sum == expected {
+			slog.Info("satellite already up to date", "destination", destination)
+			return nil
+		}
+	}
+
+	slog.Info("copying", "source", source, "destination", destination)
+	if err := p.copySatellite(ctx, dir, satelliteBinName, satelliteBin); err != nil {
+		return err
+	}
+	sum, err := p.satelliteChecksum(ctx)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("uploaded satellite is corrupted (sha256 %s, expected %s)", sum, expected)
+	}
+	return nil
+}
+
+// copySatellite copies the satellite into dir, creating dir (and its missing parents) if needed
+func (p *satellitePlacement) copySatellite(ctx context.Context, dir string, satelliteBinName string, satelliteBin []byte) (err error) {
+	// Directories are created through the tar stream, rooted at the closest existing ancestor
+	base := filepath.Clean(dir)
+	var missing []string
+	for base != "/" {
+		if _, err := p.host.statPath(ctx, base); err == nil {
+			break
+		}
+		missing = append([]string{filepath.Base(base)}, missing...)
+		base = filepath.Dir(base)
+	}
+
+	// Create tar archive in memory
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := range missing {
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     path.Join(missing[:i+1]...) + "/",
+			Mode:     0755,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name: path.Join(append(missing, satelliteBinName)...),
+		Mode: 0700,
+		Size: int64(len(satelliteBin)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(satelliteBin)
+	if err != nil {
+		return err
+	}
+	tw.Close()
+
+	tr := bufio.NewReader(&buf)
+	return p.host.extract(ctx, base, tr)
+}
+
+// memfdBootstrap loads the satellite, sent on stdin, into an anonymous memory file and runs it.
+// The rest of stdin is left to the satellite, as well as arguments after the size. Loading a
+// binary in memory needs some program already in the container: this is python3, so the
+// bootstrap only helps read-only containers shipping it (not distroless or scratch ones).
+const memfdBootstrap = `import os, sys
+n = int(sys.argv[1])
+fd = os.memfd_create("dockerfuse_satellite", 0)
+while n > 0:
+    b = os.read(0, min(n, 65536))
+    if not b:
+        sys.exit(1)
+    n -= len(b)
+    while b:
+        b = b[os.write(fd, b):]
+os.execv("/proc/self/fd/%d" % fd, ["dockerfuse_satellite"] + sys.argv[2:])
+`
+
+// probeMemfd checks whether the satellite can be loaded in memory with python3, for targets
+// without writable and executable directories
+func (p *satellitePlacement) probeMemfd(ctx context.Context) error {
+	stdout, err := p.host.output(ctx, "python3", "-c", `import os; os.memfd_create("probe"); print("ok")`)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(stdout) != "ok" {
+		return fmt.Errorf("python3 is required, with memfd_create support")
+	}
+	return nil
+}
+
+// satelliteCmd returns the command running the satellite, with args
+func (p *satellitePlacement) satelliteCmd(args []string) []string {
+	if p.satelliteInMemory != nil {
+		return append([]string{"python3", "-c", memfdBootstrap, strconv.Itoa(len(p.satelliteInMemory))}, args...)
+	}
+	if p.removeSatellite {
+		args = append(slices.Clone(args), "-remove")
+	}
+	return append([]string{p.satelliteFullRemotePath}, args...)
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/common"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// execOutput returns an attached exec printing stdout, multiplexed as docker does without TTY
+func execOutput(t *testing.T, stdout string) types.HijackedResponse {
+	var stream bytes.Buffer
+	stdcopy.NewStdWriter(&stream, stdcopy.Stdout).Write([]byte(stdout))
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(&stream)}
+}
+
+// satelliteVersion returns the output of -version for a satellite executable with content
+func satelliteVersion(content []byte) string {
+	return "DockerFuse Satellite\nVersion: test\nGit commmit: test\nSHA256: " + sha256Hex(content) + "\n"
+}
+
+func TestSatelliteBinary(t *testing.T) {
+	var mFS mockFS
+	dfFS = &mFS
+
+	// Files next to the executable override embedded satellites
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/README.md").Return([]byte("override"), nil).Once()
+	bin, source, err := satelliteBinary("README.md")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("override"), bin)
+	assert.Equal(t, "/opt/bin/README.md", source)
+
+	// Otherwise the embedded one is used
+	mFS.On("ReadFile", "/opt/bin/README.md").Return([]byte{}, fs.ErrNotExist).Once()
+	bin, source, err = satelliteBinary("README.md")
+	assert.NoError(t, err)
+	assert.Contains(t, string(bin), "Embedded satellites")
+	assert.Equal(t, "embedded:README.md", source)
+
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_none").Return([]byte{}, fs.ErrNotExist)
+	_, _, err = satelliteBinary("dockerfuse_satellite_none")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	mFS.AssertExpectations(t)
+}
+
+func TestUploadSatelliteSkipsIdenticalBinary(t *testing.T) {
+	var (
+		mFS mockFS
+		mDC mockDockerClient
+	)
+	dfFS = &mFS
+	content := []byte("test executable content")
+	remotePath := "/tmp/dockerfuse_satellite_amd64"
+
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_amd64").Return(content, nil)
+	mDC.On("ContainerInspect", mock.Anything, "test_container").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+		image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "test_container", remotePath).Return(
+		container.PathStat{Size: int64(len(content))}, nil)
+
+	mDC.On("ContainerExecCreate", mock.Anything, "test_container", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-version"},
+	}).Return(common.IDResponse{ID: "probe_exec"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe_exec", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion(content)), nil)
+
+	fdc := &DockerFuseClient{backend: newDockerAPIBackend(&mDC, "test_container", BackendConfig{}), containerID: "test_container"}
+	assert.NoError(t, fdc.uploadSatellite(context.Background()))
+	mDC.AssertNotCalled(t, "CopyToContainer", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mDC.AssertExpectations(t)
+}
+
+func TestUploadSatelliteVerifiesCopy(t *testing.T) {
+	var (
+		mFS mockFS
+		mDC mockDockerClient
+	)
+	dfFS = &mFS
+	remotePath := "/tmp/dockerfuse_satellite_amd64"
+
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_amd64").Return([]byte("test executable content"), nil)
+	mDC.On("ContainerInspect", mock.Anything, "test_container").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+		image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "test_container", remotePath).Return(
+		container.PathStat{}, fmt.Errorf("no such file"))
+	mDC.On("ContainerStatPath", mock.Anything, "test_container", "/tmp").Return(
+		container.PathStat{Mode: fs.ModeDir}, nil)
+	mDC.On("CopyToContainer", mock.Anything, "test_container", "/tmp", mock.Anything, mock.Anything).Return(nil)
+	// The placed satellite is truncated: the checksum it reports differs
+	mDC.On("ContainerExecCreate", mock.Anything, "test_container", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{remotePath, "-version"},
+	}).Return(common.IDResponse{ID: "probe_exec"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe_exec", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion([]byte("truncated"))), nil)
+	mDC.On("ContainerExecCreate", mock.Anything, "test_container", mock.Anything).Return(
+		common.IDResponse{}, fmt.Errorf("exec failed"))
+
+	fdc := &DockerFuseClient{backend: newDockerAPIBackend(&mDC, "test_container", BackendConfig{SatelliteDirs: []string{"/tmp"}}), containerID: "test_container"}
+	err := fdc.uploadSatellite(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "uploaded satellite is corrupted")
+	}
+	mDC.AssertExpectations(t)
+}
+
+func TestUploadSatellitePlacementFallbacks(t *testing.T) {
+	var (
+		mFS mockFS
+		mDC mockDockerClient
+	)
+	dfFS = &mFS
+	content := []byte("test executable content")
+	name := "dockerfuse_satellite_amd64"
+
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/"+name).Return(content, nil)
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+		image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+	for _, dir := range []string{"/tmp", "/dev/shm", "/run"} {
+		mDC.On("ContainerStatPath", mock.Anything, "c", dir+"/"+name).Return(container.PathStat{}, fmt.Errorf("no such file"))
+	}
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/tmp").Return(container.PathStat{Mode: fs.ModeDir}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/dev/shm").Return(container.PathStat{Mode: fs.ModeDir}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/run").Return(container.PathStat{}, fmt.Errorf("no such file"))
+
+	// /tmp is read-only
+	mDC.On("CopyToContainer", mock.Anything, "c", "/tmp", mock.Anything, mock.Anything).Return(fmt.Errorf("read-only file system"))
+
+	// /dev/shm is noexec
+	mDC.On("CopyToContainer", mock.Anything, "c", "/dev/shm", mock.Anything, mock.Anything).Return(nil)
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{"/dev/shm/" + name, "-version"},
+	}).Return(common.IDResponse{ID: "probe_shm"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe_shm", container.ExecStartOptions{}).Return(
+		execOutput(t, "exec /dev/shm/"+name+": permission denied\n"), nil)
+
+	// /run doesn't exist, and is created through the tar stream
+	var archive bytes.Buffer
+	mDC.On("CopyToContainer", mock.Anything, "c", "/", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		archive.ReadFrom(args.Get(3).(io.Reader))
+	}).Return(nil)
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{"/run/" + name, "-version"},
+	}).Return(common.IDResponse{ID: "probe_run"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe_run", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion(content)), nil)
+
+	b := newDockerAPIBackend(&mDC, "c", BackendConfig{})
+	fdc := &DockerFuseClient{backend: b, containerID: "c"}
+	assert.NoError(t, fdc.uploadSatellite(context.Background()))
+	assert.Equal(t, "/run/"+name, b.satelliteFullRemotePath)
+	assert.Equal(t, []string{"/run/" + name}, b.satelliteCmd(nil))
+
+	tr := tar.NewReader(&archive)
+	var entries []string
+	for h, err := tr.Next(); err == nil; h, err = tr.Next() {
+		entries = append(entries, h.Name)
+	}
+	assert.Equal(t, []string{"run/", "run/" + name}, entries)
+	mDC.AssertExpectations(t)
+}
+
+func TestPlaceSatelliteSkipsBindMounts(t *testing.T) {
+	var mDC mockDockerClient
+	content := []byte("test executable content")
+	name := "dockerfuse_satellite_amd64"
+
+	// Only the volume is tried: the bind mount is a host directory
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/data/"+name).Return(container.PathStat{}, fmt.Errorf("no such file"))
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/data").Return(container.PathStat{Mode: fs.ModeDir}, nil)
+	mDC.On("CopyToContainer", mock.Anything, "c", "/data", mock.Anything, mock.Anything).Return(nil)
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{"/data/" + name, "-version"},
+	}).Return(common.IDResponse{ID: "probe"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe", container.ExecStartOptions{}).Return(
+		execOutput(t, satelliteVersion(content)), nil)
+
+	b := newDockerAPIBackend(&mDC, "c", BackendConfig{SatelliteDirs: []string{}})
+	b.inspect.Mounts = []container.MountPoint{
+		{Type: "bind", Source: "/home/user", Destination: "/src", RW: true},
+		{Type: "volume", Name: "data", Destination: "/data", RW: true},
+	}
+	assert.NoError(t, b.PlaceSatellite(context.Background(), Satellite{Name: name, Binary: content, Source: "test"}))
+	assert.Equal(t, "/data/"+name, b.satelliteFullRemotePath)
+	mDC.AssertExpectations(t)
+}
+
+func TestUploadSatelliteInMemory(t *testing.T) {
+	var (
+		mFS    mockFS
+		mDC    mockDockerClient
+		mRPCC  mockRPCClient
+		mRPCCF mockRPCClientFactory
+	)
+	dfFS = &mFS
+	rpcCF = &mRPCCF
+	content := []byte("test executable content")
+
+	mFS.On("Executable").Return("/opt/bin/dockerfuse", nil)
+	mFS.On("ReadFile", "/opt/bin/dockerfuse_satellite_amd64").Return(content, nil)
+	mDC.On("ContainerInspect", mock.Anything, "c").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Image: "test_image"},
+	}, nil)
+	mDC.On("ImageInspectWithRaw", mock.Anything, "test_image").Return(
+		image.InspectResponse{Architecture: "amd64"}, []byte{}, nil)
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/tmp/dockerfuse_satellite_amd64").Return(container.PathStat{}, fmt.Errorf("no such file"))
+	mDC.On("ContainerStatPath", mock.Anything, "c", "/tmp").Return(container.PathStat{Mode: fs.ModeDir}, nil)
+	mDC.On("CopyToContainer", mock.Anything, "c", "/tmp", mock.Anything, mock.Anything).Return(fmt.Errorf("read-only file system"))
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStderr: true, Cmd: []string{"python3", "-c", `import os; os.memfd_create("probe"); print("ok")`},
+	}).Return(common.IDResponse{ID: "probe"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "probe", container.ExecStartOptions{}).Return(execOutput(t, "ok\n"), nil)
+
+	fdc := &DockerFuseClient{backend: newDockerAPIBackend(&mDC, "c", BackendConfig{SatelliteDirs: []string{"/tmp"}}), containerID: "c"}
+	assert.NoError(t, fdc.uploadSatellite(context.Background()))
+
+	// The bootstrap receives the satellite on stdin, before RPC traffic
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, len(content))
+		io.ReadFull(peer, buf)
+		received <- buf
+	}()
+	mDC.On("ContainerExecCreate", mock.Anything, "c", container.ExecOptions{
+		AttachStdout: true, AttachStdin: true,
+		Cmd: []string{"python3", "-c", memfdBootstrap, fmt.Sprint(len(content))},
+	}).Return(common.IDResponse{ID: "satellite"}, nil)
+	mDC.On("ContainerExecAttach", mock.Anything, "satellite", container.ExecStartOptions{Tty: true}).Return(
+		types.HijackedResponse{Conn: conn}, nil)
+	mRPCCF.On("NewClient", &dockerSatellite{HijackedResponse: types.HijackedResponse{Conn: conn}, dockerClient: &mDC, execID: "satellite"}).Return(&mRPCC)
+
+	assert.NoError(t, fdc.connectSatellite(context.Background()))
+	assert.Equal(t, content, <-received)
+	mDC.AssertExpectations(t)
+	mRPCCF.AssertExpectations(t)
+}
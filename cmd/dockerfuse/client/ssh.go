@@ -0,0 +1,229 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+)
+
+// sshPath and scpPath are the OpenSSH clients, which read ~/.ssh/config, keys, agents and known
+// hosts as they do in a shell
+var (
+	sshPath = "ssh"
+	scpPath = "scp"
+)
+
+// shellSafe matches arguments the remote shell takes as they are
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// sshBackend serves a Linux host over SSH: commands (the satellite included) run through ssh(1),
+// with their stdio on pipes, and files are uploaded with scp(1). The host needs a POSIX shell and
+// stat.
+type sshBackend struct {
+	satellitePlacement
+	// [user@]host, or a Host of ~/.ssh/config
+	destination string
+}
+
+// WithSSH serves a host reached over SSH, whose destination ([user@]host) is given as container ID,
+// instead of a Docker container: it selects BackendSSH
+func WithSSH() ClientOption {
+	return WithBackend(BackendSSH)
+}
+
+// SplitSSHTarget splits [user@]host[:path] into an SSH destination and an absolute path, / by
+// default
+func SplitSSHTarget(target string) (destination string, fullPath string, err error) {
+	destination, fullPath, _ = strings.Cut(target, ":")
+	if fullPath == "" {
+		fullPath = "/"
+	}
+	if destination == "" || strings.HasPrefix(destination, "-") {
+		return "", "", fmt.Errorf("invalid SSH destination: %q", destination)
+	}
+	if !path.IsAbs(fullPath) {
+		return "", "", fmt.Errorf("SSH paths must be absolute: %q", fullPath)
+	}
+	return destination, path.Clean(fullPath), nil
+}
+
+// newSSHBackend returns the backend serving the host destination
+func newSSHBackend(destination string, config BackendConfig) (Backend, error) {
+	// Not to be taken for an option by ssh
+	if destination == "" || strings.HasPrefix(destination, "-") {
+		return nil, fmt.Errorf("invalid SSH destination: %q", destination)
+	}
+	b := &sshBackend{destination: destination}
+	b.satellitePlacement = newSatellitePlacement(b, destination, config)
+	slog.Debug("using ssh", "destination", destination)
+	return b, nil
+}
+
+// shellQuote returns args as a command line for the remote shell
+func shellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// command returns the ssh command running the remote command line
+func (b *sshBackend) command(ctx context.Context, commandLine string) *exec.Cmd {
+	return exec.CommandContext(ctx, sshPath, "-T", "--", b.destination, commandLine)
+}
+
+// run runs cmd on the host, with stdin as input, and returns its output. Errors include what the
+// command wrote on stderr.
+func (b *sshBackend) run(ctx context.Context, cmd []string, stdin io.Reader) ([]byte, error) {
+	ssh := b.command(ctx, shellQuote(cmd...))
+	ssh.Stdin = stdin
+	return commandOutput(ssh, cmd[0])
+}
+
+// Resolve identifies the host by its destination
+func (b *sshBackend) Resolve(ctx context.Context) (Target, error) {
+	return Target{ID: "ssh-" + b.destination}, nil
+}
+
+// Arch returns the architecture `uname -m` reports on the host, which must run Linux
+func (b *sshBackend) Arch(ctx context.Context) (arch string, variant string, err error) {
+	out, err := b.run(ctx, []string{"uname", "-sm"}, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot tell the architecture of %s: %s", b.destination, err)
+	}
+	system, machine, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	if system != "Linux" {
+		return "", "", fmt.Errorf("%s runs %s: only Linux hosts are supported", b.destination, system)
+	}
+	a, ok := unameArchs[machine]
+	if !ok {
+		return "", "", fmt.Errorf("unknown machine: %s", machine)
+	}
+	return a[0], a[1], nil
+}
+
+// statPath stats fullPath with stat(1), on the host
+func (b *sshBackend) statPath(ctx context.Context, fullPath string) (container.PathStat, error) {
+	out, err := b.run(ctx, []string{"stat", "-c", "%s %f %Y", "--", fullPath}, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return container.PathStat{}, errdefs.NotFound(err)
+		}
+		return container.PathStat{}, err
+	}
+	var size, mtime int64
+	var mode uint32
+	if _, err := fmt.Sscanf(string(out), "%d %x %d", &size, &mode, &mtime); err != nil {
+		return container.PathStat{}, fmt.Errorf("unexpected stat output %q", out)
+	}
+	return container.PathStat{Name: path.Base(fullPath), Size: size, Mode: unixFileMode(mode), Mtime: time.Unix(mtime, 0)}, nil
+}
+
+// extract unpacks archive locally, and uploads it in dstPath with scp. Files are removed first, as
+// they may be running (e.g. an older satellite). Only directories and files can be copied.
+func (b *sshBackend) extract(ctx context.Context, dstPath string, archive io.Reader) error {
+	dir, err := os.MkdirTemp("", "dockerfuse-scp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var top, files []string
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: invalid tar entry", header.Name)
+		}
+		local := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(local, os.FileMode(header.Mode).Perm())
+		case tar.TypeReg:
+			files = append(files, path.Join(dstPath, name))
+			err = writeFileFrom(local, os.FileMode(header.Mode).Perm(), tr)
+		default:
+			return fmt.Errorf("%s: copying tar entries of type %q is not supported over SSH", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(name, "/") {
+			top = append(top, local)
+		}
+	}
+	if len(top) == 0 {
+		return nil
+	}
+	if len(files) > 0 {
+		if _, err := b.run(ctx, append([]string{"rm", "-f", "--"}, files...), nil); err != nil {
+			return err
+		}
+	}
+	var stderr bytes.Buffer
+	scp := exec.CommandContext(ctx, scpPath, append(append([]string{"-p", "-q", "-r", "--"}, top...), b.destination+":"+dstPath+"/")...)
+	scp.Stderr = &stderr
+	if err := scp.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("scp: %s", msg)
+		}
+		return fmt.Errorf("scp: %w", err)
+	}
+	return nil
+}
+
+// writeFileFrom writes the content of r in a new file, with mode perm
+func writeFileFrom(name string, perm os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Not limited by the umask, as scp -p preserves it
+	return os.Chmod(name, perm)
+}
+
+// output runs cmd on the host, and returns its standard output
+func (b *sshBackend) output(ctx context.Context, cmd ...string) (string, error) {
+	out, err := b.run(ctx, cmd, nil)
+	return string(out), err
+}
+
+// start runs cmd on the host through ssh, with its stdin and stdout on pipes
+func (b *sshBackend) start(ctx context.Context, cmd []string) (SatelliteConn, error) {
+	// Not bound to ctx: the satellite outlives the request starting it
+	satellite, err := startCommand(b.command(context.Background(), "exec "+shellQuote(cmd...)))
+	if err != nil {
+		return nil, fmt.Errorf("running ssh: %w", err)
+	}
+	return satellite, nil
+}
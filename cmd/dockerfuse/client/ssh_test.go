@@ -0,0 +1,142 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSSH replaces ssh and scp by scripts running commands and copies locally, as if the host was
+// this one. Destinations are logged to the returned file.
+func fakeSSH(t *testing.T) (log string) {
+	dir := t.TempDir()
+	log = filepath.Join(dir, "log")
+	sshPath, scpPath = filepath.Join(dir, "ssh"), filepath.Join(dir, "scp")
+	t.Cleanup(func() { sshPath, scpPath = "ssh", "scp" })
+	// ssh -T -- destination command
+	assert.NoError(t, os.WriteFile(sshPath, []byte(`#!/bin/sh
+[ "$1 $2" = "-T --" ] || exit 255
+echo "$3" >> `+log+`
+exec sh -c "$4"
+`), 0755))
+	// scp -p -q -r -- sources... destination:dir
+	assert.NoError(t, os.WriteFile(scpPath, []byte(`#!/bin/sh
+[ "$1 $2 $3 $4" = "-p -q -r --" ] || exit 1
+shift 4
+for a; do dst=$a; done
+echo "${dst%%:*}" >> `+log+`
+i=1
+for a; do
+	[ $i -lt $# ] && { cp -pR "$a" "${dst#*:}" || exit 1; }
+	i=$((i+1))
+done
+`), 0755))
+	return log
+}
+
+func TestSplitSSHTarget(t *testing.T) {
+	for target, want := range map[string][2]string{
+		"web":                 {"web", "/"},
+		"admin@web:/srv/app/": {"admin@web", "/srv/app"},
+		"admin@web:":          {"admin@web", "/"},
+	} {
+		destination, fullPath, err := SplitSSHTarget(target)
+		assert.NoError(t, err)
+		assert.Equal(t, want, [2]string{destination, fullPath}, target)
+	}
+	_, _, err := SplitSSHTarget("web:srv")
+	assert.EqualError(t, err, `SSH paths must be absolute: "srv"`)
+	_, _, err = SplitSSHTarget("-oProxyCommand=sh:/")
+	assert.EqualError(t, err, `invalid SSH destination: "-oProxyCommand=sh"`)
+	_, err = newSSHBackend("", BackendConfig{})
+	assert.EqualError(t, err, `invalid SSH destination: ""`)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `/tmp/satellite -session a1 'it'\''s' '$HOME' ''`, shellQuote("/tmp/satellite", "-session", "a1", "it's", "$HOME", ""))
+}
+
+func TestSSHClient(t *testing.T) {
+	log := fakeSSH(t)
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "hostname"), []byte("web\n"), 0644))
+
+	fdc, err := newClient("admin@web", WithSSH())
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := fdc.backend.(*sshBackend)
+	ctx := context.Background()
+
+	target, err := c.Resolve(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-admin@web", target.ID)
+	arch, _, err := c.Arch(ctx)
+	if runtime.GOOS == "linux" && assert.NoError(t, err) && runtime.GOARCH != "arm" {
+		assert.Equal(t, runtime.GOARCH, arch)
+	}
+
+	stat, err := c.statPath(ctx, filepath.Join(root, "hostname"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(4), stat.Size)
+		assert.Equal(t, os.FileMode(0644), stat.Mode)
+	}
+	_, err = c.statPath(ctx, filepath.Join(root, "missing"))
+	assert.True(t, errdefs.IsNotFound(err))
+
+	// Uploads replace existing files
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "dockerfuse"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "dockerfuse", "satellite"), []byte("old"), 0500))
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dockerfuse/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dockerfuse/satellite", Mode: 0700, Size: 9})
+	tw.Write([]byte("satellite"))
+	tw.Close()
+	assert.NoError(t, c.extract(ctx, root, &archive))
+	data, err := os.ReadFile(filepath.Join(root, "dockerfuse", "satellite"))
+	assert.NoError(t, err)
+	assert.Equal(t, "satellite", string(data))
+	info, err := os.Stat(filepath.Join(root, "dockerfuse", "satellite"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), info.Mode())
+	}
+	archive.Reset()
+	tw = tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0700})
+	tw.Close()
+	assert.EqualError(t, c.extract(ctx, root, &archive), "../escape: invalid tar entry")
+
+	// Arguments survive the remote shell
+	out, err := c.output(ctx, "sh", "-c", `printf "%s %s" "$0" "$1"`, "it's", "$HOME")
+	assert.NoError(t, err)
+	assert.Equal(t, "it's $HOME", out)
+
+	// The RPC stream is carried over the pipes of ssh, and stopped by closing its input
+	conn, err := c.start(ctx, []string{"cat"})
+	if assert.NoError(t, err) {
+		io.WriteString(conn, "pong")
+		stopped := make(chan error)
+		go func() { stopped <- conn.Stop(ctx) }()
+		echoed, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(echoed))
+		assert.NoError(t, <-stopped)
+		conn.Close()
+	}
+
+	logged, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	for _, destination := range strings.Fields(string(logged)) {
+		assert.Equal(t, "admin@web", destination)
+	}
+}
@@ -0,0 +1,340 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ControlDir is the virtual directory, at the root of mounts, holding dockerfuse views. It is
+// reachable by name only: listings don't show it, so that tools walking the mount skip it.
+const ControlDir = ".dockerfuse"
+
+// XattrSource serves extended attributes of container paths
+type XattrSource interface {
+	xattrs(ctx context.Context, fullPath string) (map[string]string, syscall.Errno)
+}
+
+// ViewClient adds read-only views, each served by its own client, below the control directory
+// of the mount
+type ViewClient struct {
+	DockerFuseClientInterface
+
+	root    string
+	views   map[string]DockerFuseClientInterface
+	sources []XattrSource
+}
+
+// viewHandle is a file handle of a view
+type viewHandle struct {
+	view DockerFuseClientInterface
+	fh   fusefs.FileHandle
+}
+
+// NewViewClient wraps client, serving views below ControlDir in mountPath (the container path
+// mounted)
+func NewViewClient(client DockerFuseClientInterface, mountPath string) *ViewClient {
+	return &ViewClient{
+		DockerFuseClientInterface: client,
+		root:                      path.Join(mountPath, ControlDir),
+		views:                     make(map[string]DockerFuseClientInterface),
+	}
+}
+
+// AddView serves view in the control directory, as name
+func (c *ViewClient) AddView(name string, view DockerFuseClientInterface) {
+	c.views[name] = view
+}
+
+// AddXattrs serves extended attributes of container paths from source
+func (c *ViewClient) AddXattrs(source XattrSource) {
+	c.sources = append(c.sources, source)
+}
+
+// Close releases views and the wrapped client
+func (c *ViewClient) Close() {
+	for _, v := range c.views {
+		v.Close()
+	}
+	c.DockerFuseClientInterface.Close()
+}
+
+// route tells whether fullPath is in the control directory, and which view serves it, as which
+// path. view is nil for the control directory itself, and for unknown views.
+func (c *ViewClient) route(fullPath string) (view DockerFuseClientInterface, viewPath string, control bool) {
+	if fullPath == c.root {
+		return nil, "", true
+	}
+	rest, ok := strings.CutPrefix(fullPath, c.root+"/")
+	if !ok {
+		return nil, "", false
+	}
+	name, sub, _ := strings.Cut(rest, "/")
+	return c.views[name], "/" + sub, true
+}
+
+// viewIno returns inode numbers for view files, apart from those of the container
+func viewIno(fullPath string) uint64 {
+	return archiveIno(fullPath) | 1<<63
+}
+
+func (c *ViewClient) stat(ctx context.Context, fullPath string, attr *statAttr) (syserr syscall.Errno) {
+	view, viewPath, control := c.route(fullPath)
+	switch {
+	case !control:
+		return c.DockerFuseClientInterface.stat(ctx, fullPath, attr)
+	case fullPath == c.root:
+		*attr = dirAttr(fullPath)
+		attr.FuseAttr.Mode = syscall.S_IFDIR | 0555
+	case view == nil:
+		return syscall.ENOENT
+	default:
+		if syserr = view.stat(ctx, viewPath, attr); syserr != 0 {
+			return
+		}
+	}
+	attr.FuseAttr.Ino = viewIno(fullPath)
+	return 0
+}
+
+func (c *ViewClient) readDir(ctx context.Context, fullPath string) (ds fusefs.DirStream, syserr syscall.Errno) {
+	view, viewPath, control := c.route(fullPath)
+	var entries []fuse.DirEntry
+	switch {
+	case !control:
+		return c.DockerFuseClientInterface.readDir(ctx, fullPath)
+	case fullPath == c.root:
+		for name := range c.views {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+		}
+		slices.SortFunc(entries, func(a, b fuse.DirEntry) int { return strings.Compare(a.Name, b.Name) })
+	case view == nil:
+		return nil, syscall.ENOENT
+	default:
+		if ds, syserr = view.readDir(ctx, viewPath); syserr != 0 {
+			return nil, syserr
+		}
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				return nil, errno
+			}
+			entries = append(entries, e)
+		}
+		ds.Close()
+	}
+	for i := range entries {
+		entries[i].Ino = viewIno(path.Join(fullPath, entries[i].Name))
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (c *ViewClient) readlink(ctx context.Context, fullPath string) (linkTarget []byte, syserr syscall.Errno) {
+	view, viewPath, control := c.route(fullPath)
+	switch {
+	case !control:
+		return c.DockerFuseClientInterface.readlink(ctx, fullPath)
+	case view == nil:
+		return []byte{}, syscall.EINVAL
+	}
+	return view.readlink(ctx, viewPath)
+}
+
+func (c *ViewClient) open(ctx context.Context, fullPath string, flags int, modeIn fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, mode fs.FileMode, syserr syscall.Errno) {
+	view, viewPath, control := c.route(fullPath)
+	switch {
+	case !control:
+		return c.DockerFuseClientInterface.open(ctx, fullPath, flags, modeIn, attr)
+	case view == nil:
+		return nil, 0, syscall.EISDIR
+	}
+	fh, mode, syserr = view.open(ctx, viewPath, flags, modeIn, attr)
+	if syserr != 0 {
+		return nil, 0, syserr
+	}
+	attr.FuseAttr.Ino = viewIno(fullPath)
+	return &viewHandle{view: view, fh: fh}, mode, 0
+}
+
+func (c *ViewClient) read(ctx context.Context, fh fusefs.FileHandle, offset int64, n int) (data []byte, syserr syscall.Errno) {
+	if vh, ok := fh.(*viewHandle); ok {
+		return vh.view.read(ctx, vh.fh, offset, n)
+	}
+	return c.DockerFuseClientInterface.read(ctx, fh, offset, n)
+}
+
+func (c *ViewClient) write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno) {
+	if _, ok := fh.(*viewHandle); ok {
+		return 0, syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.write(ctx, fh, offset, data)
+}
+
+func (c *ViewClient) seek(ctx context.Context, fh fusefs.FileHandle, offset int64, whence int) (n int64, syserr syscall.Errno) {
+	if vh, ok := fh.(*viewHandle); ok {
+		return vh.view.seek(ctx, vh.fh, offset, whence)
+	}
+	return c.DockerFuseClientInterface.seek(ctx, fh, offset, whence)
+}
+
+func (c *ViewClient) fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno) {
+	if _, ok := fh.(*viewHandle); ok {
+		return 0
+	}
+	return c.DockerFuseClientInterface.fsync(ctx, fh, flags)
+}
+
+func (c *ViewClient) close(ctx context.Context, fh fusefs.FileHandle) (syserr syscall.Errno) {
+	if vh, ok := fh.(*viewHandle); ok {
+		return vh.view.close(ctx, vh.fh)
+	}
+	return c.DockerFuseClientInterface.close(ctx, fh)
+}
+
+// inControl tells whether any of paths is in the control directory, which can't be changed
+func (c *ViewClient) inControl(paths ...string) bool {
+	return slices.ContainsFunc(paths, func(p string) bool {
+		_, _, control := c.route(p)
+		return control
+	})
+}
+
+func (c *ViewClient) create(ctx context.Context, fullPath string, flags int, mode fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, syserr syscall.Errno) {
+	if c.inControl(fullPath) {
+		return nil, syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.create(ctx, fullPath, flags, mode, attr)
+}
+
+func (c *ViewClient) link(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	if c.inControl(oldFullPath, newFullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.link(ctx, oldFullPath, newFullPath)
+}
+
+func (c *ViewClient) mkdir(ctx context.Context, fullPath string, mode fs.FileMode, attr *statAttr) (syserr syscall.Errno) {
+	if c.inControl(fullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.mkdir(ctx, fullPath, mode, attr)
+}
+
+func (c *ViewClient) rename(ctx context.Context, fullPath string, fullNewPath string, flags uint32) (syserr syscall.Errno) {
+	if c.inControl(fullPath, fullNewPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.rename(ctx, fullPath, fullNewPath, flags)
+}
+
+func (c *ViewClient) rmdir(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	if c.inControl(fullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.rmdir(ctx, fullPath)
+}
+
+func (c *ViewClient) setAttr(ctx context.Context, fullPath string, in *fuse.SetAttrIn, out *statAttr) (syserr syscall.Errno) {
+	if c.inControl(fullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.setAttr(ctx, fullPath, in, out)
+}
+
+func (c *ViewClient) symlink(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	if c.inControl(newFullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.symlink(ctx, oldFullPath, newFullPath)
+}
+
+func (c *ViewClient) unlink(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	if c.inControl(fullPath) {
+		return syscall.EROFS
+	}
+	return c.DockerFuseClientInterface.unlink(ctx, fullPath)
+}
+
+// xattrs merges the extended attributes of container paths from all sources
+func (c *ViewClient) xattrs(ctx context.Context, fullPath string) (map[string]string, syscall.Errno) {
+	if c.inControl(fullPath) {
+		return nil, 0
+	}
+	attrs := make(map[string]string)
+	for _, s := range c.sources {
+		more, errno := s.xattrs(ctx, fullPath)
+		if errno != 0 {
+			return nil, errno
+		}
+		for name, value := range more {
+			attrs[name] = value
+		}
+	}
+	return attrs, 0
+}
+
+// readOnlyClient implements the operations of read-only clients that change nothing, and don't
+// need a connection
+type readOnlyClient struct{}
+
+// Close does nothing
+func (readOnlyClient) Close() {}
+
+// CacheStats returns zeroes: there is nothing to cache
+func (readOnlyClient) CacheStats() CacheStats { return CacheStats{} }
+
+func (readOnlyClient) disconnect() {}
+
+func (readOnlyClient) connectSatellite(ctx context.Context) error { return nil }
+
+func (readOnlyClient) fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) (syserr syscall.Errno) {
+	return 0
+}
+
+func (readOnlyClient) create(ctx context.Context, fullPath string, flags int, mode fs.FileMode, attr *statAttr) (fh fusefs.FileHandle, syserr syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+func (readOnlyClient) link(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) mkdir(ctx context.Context, fullPath string, mode fs.FileMode, attr *statAttr) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) rename(ctx context.Context, fullPath string, fullNewPath string, flags uint32) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) rmdir(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) setAttr(ctx context.Context, fullPath string, in *fuse.SetAttrIn, out *statAttr) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) symlink(ctx context.Context, oldFullPath string, newFullPath string) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) unlink(ctx context.Context, fullPath string) (syserr syscall.Errno) {
+	return syscall.EROFS
+}
+
+func (readOnlyClient) write(ctx context.Context, fh fusefs.FileHandle, offset int64, data []byte) (n int, syserr syscall.Errno) {
+	return 0, syscall.EROFS
+}
+
+func (readOnlyClient) watchChanges(ctx context.Context, handler func(events []rpccommon.ChangeEvent, overflow bool)) (err error) {
+	return fmt.Errorf("change notifications not supported")
+}
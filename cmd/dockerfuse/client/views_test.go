@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// xattrMap serves fixed extended attributes
+type xattrMap map[string]map[string]string
+
+func (x xattrMap) xattrs(ctx context.Context, fullPath string) (map[string]string, syscall.Errno) {
+	return x[fullPath], 0
+}
+
+func viewNames(t *testing.T, c *ViewClient, fullPath string) (names []string) {
+	ds, errno := c.readDir(context.Background(), fullPath)
+	if !assert.Equal(t, syscall.Errno(0), errno, fullPath) {
+		return nil
+	}
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		assert.Equal(t, viewIno(fullPath+"/"+e.Name), e.Ino)
+		names = append(names, e.Name)
+	}
+	return
+}
+
+func TestViewClient(t *testing.T) {
+	var m mockFuseDockerClient
+	view, err := NewImageFileClient(dockerSaveFixture(t, testLayers(t)), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := NewViewClient(&m, "/app")
+	c.AddView("image", view)
+	c.AddXattrs(xattrMap{"/app/file": {"user.a": "1"}})
+	c.AddXattrs(xattrMap{"/app/file": {"user.b": "2"}})
+	ctx := context.Background()
+	var attr statAttr
+
+	// The control directory lists views
+	assert.Equal(t, syscall.Errno(0), c.stat(ctx, "/app/.dockerfuse", &attr))
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), attr.FuseAttr.Mode)
+	assert.Equal(t, viewIno("/app/.dockerfuse"), attr.FuseAttr.Ino)
+	assert.Equal(t, []string{"image"}, viewNames(t, c, "/app/.dockerfuse"))
+	assert.Equal(t, syscall.ENOENT, c.stat(ctx, "/app/.dockerfuse/missing", &attr))
+	_, errno := c.readDir(ctx, "/app/.dockerfuse/missing")
+	assert.Equal(t, syscall.ENOENT, errno)
+
+	// Views serve their files, with their own inode numbers
+	assert.Equal(t, syscall.Errno(0), c.stat(ctx, "/app/.dockerfuse/image/etc/hostname", &attr))
+	assert.Equal(t, viewIno("/app/.dockerfuse/image/etc/hostname"), attr.FuseAttr.Ino)
+	assert.Equal(t, []string{"hostname"}, viewNames(t, c, "/app/.dockerfuse/image/etc"))
+	target, errno := c.readlink(ctx, "/app/.dockerfuse/image/bin")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "usr/bin", string(target))
+	fh, _, errno := c.open(ctx, "/app/.dockerfuse/image/etc/hostname", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.Errno(0), errno)
+	data, errno := c.read(ctx, fh, 0, 10)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, "layer1", string(data))
+	n, _ := c.seek(ctx, fh, 0, seekHole)
+	assert.Equal(t, int64(6), n)
+	_, errno = c.write(ctx, fh, 0, []byte("x"))
+	assert.Equal(t, syscall.EROFS, errno)
+	assert.Equal(t, syscall.Errno(0), c.fsync(ctx, fh, 0))
+	assert.Equal(t, syscall.Errno(0), c.close(ctx, fh))
+
+	// Nothing changes in the control directory
+	_, errno = c.create(ctx, "/app/.dockerfuse/new", syscall.O_WRONLY, 0644, &attr)
+	assert.Equal(t, syscall.EROFS, errno)
+	assert.Equal(t, syscall.EROFS, c.mkdir(ctx, "/app/.dockerfuse/image/new", 0755, &attr))
+	assert.Equal(t, syscall.EROFS, c.unlink(ctx, "/app/.dockerfuse/image/etc/hostname"))
+	assert.Equal(t, syscall.EROFS, c.rmdir(ctx, "/app/.dockerfuse/image/etc"))
+	assert.Equal(t, syscall.EROFS, c.rename(ctx, "/app/file", "/app/.dockerfuse/file", 0))
+	assert.Equal(t, syscall.EROFS, c.link(ctx, "/app/.dockerfuse/image/etc/hostname", "/app/file"))
+	assert.Equal(t, syscall.EROFS, c.symlink(ctx, "/x", "/app/.dockerfuse/x"))
+	assert.Equal(t, syscall.EROFS, c.setAttr(ctx, "/app/.dockerfuse", &fuse.SetAttrIn{}, &attr))
+	_, _, errno = c.open(ctx, "/app/.dockerfuse", syscall.O_RDONLY, 0, &attr)
+	assert.Equal(t, syscall.EISDIR, errno)
+
+	// Everything else goes to the wrapped client
+	handle := fusefs.FileHandle(uintptr(1))
+	m.On("stat", mock.Anything, "/app/.dockerfuse2", mock.Anything).Return(syscall.ENOENT)
+	m.On("readDir", mock.Anything, "/app").Return(fusefs.NewListDirStream(nil), syscall.Errno(0))
+	m.On("readlink", mock.Anything, "/app/link").Return([]byte("x"), syscall.Errno(0))
+	m.On("open", mock.Anything, "/app/file", syscall.O_RDWR, fs.FileMode(0), mock.Anything).Return(handle, fs.FileMode(0644), syscall.Errno(0))
+	m.On("read", mock.Anything, handle, int64(0), 1).Return([]byte("a"), syscall.Errno(0))
+	m.On("write", mock.Anything, handle, int64(0), []byte("b")).Return(1, syscall.Errno(0))
+	m.On("seek", mock.Anything, handle, int64(0), 0).Return(int64(0), syscall.Errno(0))
+	m.On("fsync", mock.Anything, handle, uint32(0)).Return(syscall.Errno(0))
+	m.On("close", mock.Anything, handle).Return(syscall.Errno(0))
+	m.On("create", mock.Anything, "/app/new", syscall.O_WRONLY, fs.FileMode(0644), mock.Anything).Return(handle, syscall.Errno(0))
+	m.On("mkdir", mock.Anything, "/app/dir", fs.FileMode(0755), mock.Anything).Return(syscall.Errno(0))
+	m.On("unlink", mock.Anything, "/app/file").Return(syscall.Errno(0))
+	m.On("rmdir", mock.Anything, "/app/dir").Return(syscall.Errno(0))
+	m.On("rename", mock.Anything, "/app/a", "/app/b", uint32(0)).Return(syscall.Errno(0))
+	m.On("link", mock.Anything, "/app/a", "/app/b").Return(syscall.Errno(0))
+	m.On("symlink", mock.Anything, "/x", "/app/x").Return(syscall.Errno(0))
+	m.On("setAttr", mock.Anything, "/app/file", mock.Anything, mock.Anything).Return(syscall.Errno(0))
+	assert.Equal(t, syscall.ENOENT, c.stat(ctx, "/app/.dockerfuse2", &attr))
+	_, errno = c.readDir(ctx, "/app")
+	assert.Equal(t, syscall.Errno(0), errno)
+	_, errno = c.readlink(ctx, "/app/link")
+	assert.Equal(t, syscall.Errno(0), errno)
+	fh, _, _ = c.open(ctx, "/app/file", syscall.O_RDWR, 0, &attr)
+	assert.Equal(t, handle, fh)
+	data, _ = c.read(ctx, fh, 0, 1)
+	assert.Equal(t, "a", string(data))
+	written, _ := c.write(ctx, fh, 0, []byte("b"))
+	assert.Equal(t, 1, written)
+	c.seek(ctx, fh, 0, 0)
+	c.fsync(ctx, fh, 0)
+	c.close(ctx, fh)
+	c.create(ctx, "/app/new", syscall.O_WRONLY, 0644, &attr)
+	c.mkdir(ctx, "/app/dir", 0755, &attr)
+	c.unlink(ctx, "/app/file")
+	c.rmdir(ctx, "/app/dir")
+	c.rename(ctx, "/app/a", "/app/b", 0)
+	c.link(ctx, "/app/a", "/app/b")
+	c.symlink(ctx, "/x", "/app/x")
+	c.setAttr(ctx, "/app/file", &fuse.SetAttrIn{}, &attr)
+
+	// Extended attributes come from all sources, for container paths only
+	attrs, errno := c.xattrs(ctx, "/app/file")
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, map[string]string{"user.a": "1", "user.b": "2"}, attrs)
+	attrs, _ = c.xattrs(ctx, "/app/.dockerfuse/image/etc")
+	assert.Empty(t, attrs)
+
+	// Views are closed with the client
+	m.On("Close").Return()
+	c.Close()
+	assert.Nil(t, view.closers)
+	m.AssertExpectations(t)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -8,7 +10,10 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,8 +26,9 @@ import (
 )
 
 const (
-	attrTTL  = 1500 * time.Millisecond
-	entryTTL = 1500 * time.Millisecond
+	defaultAttrTTL     = 1500 * time.Millisecond
+	defaultEntryTTL    = 1500 * time.Millisecond
+	defaultNegativeTTL = 1500 * time.Millisecond
 )
 
 // Exit codes
@@ -35,6 +41,7 @@ const (
 	errorInvalidUIDGid    = 5
 	errorInitDockerClient = 6
 	errorMountUnmount     = 7
+	errorCleanup          = 8
 )
 
 var (
@@ -45,6 +52,45 @@ var (
 	debug        bool
 	jsonlog      bool
 	printVersion bool
+	kernelCache  bool
+	directIO     string
+	attrTTL      time.Duration
+	entryTTL     time.Duration
+	negativeTTL  time.Duration
+	cacheAttrTTL time.Duration
+	cacheDirTTL  time.Duration
+	cacheNegTTL  time.Duration
+	watch        bool
+	readahead    bool
+	raBlocks     int
+	raMemoryMiB  int64
+	cacheDir     string
+	cacheSizeMiB int64
+	detectArch   bool
+	satDirs      string
+	removeSat    bool
+	onExit       string
+	all          bool
+	filters      listFlag
+	idleTimeout  time.Duration
+	project      string
+	service      string
+	pauseTimeout time.Duration
+	access       string
+	backend      string
+	imageRef     string
+	pull         bool
+	imageFile    string
+	layers       bool
+	changes      bool
+	meta         bool
+	readOnly     bool
+	docker       client.DockerConfig
+	containerd   client.ContainerdConfig
+	pod          string
+	kube         client.KubeConfig
+	processPID   int
+	sshTarget    string
 	// Version holds the version tag, and it is set at build-time
 	Version string
 	// GitCommit holds the git commit used to build the binary. It is set at build-time
@@ -55,8 +101,26 @@ func init() {
 	flag.BoolVar(&printVersion, "version", false, "Print the version and exit")
 	flag.BoolVar(&printVersion, "v", false, "Print the version and exit")
 
-	flag.StringVar(&containerID, "id", "", "Docker container ID (or name)")
-	flag.StringVar(&containerID, "i", "", "Docker container ID (or name)")
+	flag.StringVar(&containerID, "id", "", "Docker container ID (or name), or target of -backend")
+	flag.StringVar(&containerID, "i", "", "Docker container ID (or name), or target of -backend")
+
+	addDockerFlags(flag.CommandLine, &docker)
+	addContainerdFlags(flag.CommandLine, &containerd)
+
+	flag.StringVar(&imageRef, "image", "", "Mount a Docker image (by reference) instead of a container, read-only unless -read-only=false")
+	flag.BoolVar(&pull, "pull", true, "Pull the image of -image when it is missing locally (public images only: registry credentials are not used)")
+	flag.BoolVar(&all, "all", false, "Mount all running containers, each in a directory named after it (and by ID in "+client.ByIDDir+"), connecting to them on first access")
+	flag.Var(&filters, "filter", "Only mount containers matching a Docker filter, with -all or -compose-project: label=<key>[=<value>] or name=<name> (can be repeated)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", client.DefaultIdleTimeout, "How long connections to unused containers are kept, with -all or -compose-project (0 keeps them)")
+	flag.StringVar(&project, "compose-project", "", "Mount the running containers of a Docker Compose project, each in a directory named <service>-<number>, following containers recreated by Compose")
+	flag.StringVar(&service, "service", "", "Only mount the replicas of a service, with -compose-project, each in a directory named after its number (or at the root, if it has a single replica)")
+	flag.StringVar(&backend, "backend", client.BackendDocker, fmt.Sprintf("Runtime backend the satellite is run through, with -id as target: %s. %s targets are containers of containerd, without dockerd (by ID, ID prefix or nerdctl name; must run on the containerd host); %s targets are <pod>[/<namespace>[/<container>]], run through the exec API (the namespace and container default to those of the kubeconfig context and of the pod); %s targets are PIDs of local processes (e.g. of LXC/LXD or systemd-nspawn containers), whose mount namespace is entered with nsenter (util-linux, needs root on Linux); %s targets are Linux hosts, as [user@]host[:path] (ssh and scp settings, e.g. ~/.ssh/config, apply)", strings.Join(client.Backends(), ", "), client.BackendContainerd, client.BackendKubernetes, client.BackendProcess, client.BackendSSH))
+	flag.StringVar(&pod, "k8s", "", "Mount a container of a Kubernetes pod: same as -backend "+client.BackendKubernetes+" -id <pod>[/<namespace>[/<container>]]")
+	flag.StringVar(&kube.Path, "kubeconfig", "", "Kubeconfig file, with -backend "+client.BackendKubernetes+" (default: KUBECONFIG, or ~/.kube/config)")
+	flag.StringVar(&kube.Context, "kube-context", "", "Kubeconfig context, with -backend "+client.BackendKubernetes+" (default: the current context)")
+	flag.IntVar(&processPID, "pid", 0, "Mount the root filesystem of a local process: same as -backend "+client.BackendProcess+" -id <pid>")
+	flag.StringVar(&sshTarget, "ssh", "", "Mount a Linux host over SSH: same as -backend "+client.BackendSSH+" -id [user@]host[:path]")
+	flag.StringVar(&imageFile, "image-file", "", "Mount an image saved by `docker save`, or an OCI layout (directory or tarball), read-only and without Docker. -image selects the image, if the file holds several")
 
 	flag.StringVar(&mountPoint, "mount", "", "Mount point for container FS")
 	flag.StringVar(&mountPoint, "m", "", "Mount point for container FS")
@@ -64,6 +128,14 @@ func init() {
 	flag.StringVar(&path, "path", "/", "Path inside the container")
 	flag.StringVar(&path, "p", "/", "Path inside the container")
 
+	flag.StringVar(&access, "access", client.AccessAuto, fmt.Sprintf("How to access the container: %s (satellite, falling back to archive with the Docker API), %s, or %s (Docker archive API, works on stopped containers)", client.AccessAuto, client.AccessSatellite, client.AccessArchive))
+
+	flag.BoolVar(&readOnly, "read-only", false, "Mount read-only")
+
+	flag.BoolVar(&layers, "layers", false, "Show the image layers in "+client.ControlDir+"/layers, and the layer providing each file as the "+client.XattrLayer+" extended attribute")
+	flag.BoolVar(&changes, "changes", false, "Show what the container changed in its image (as docker diff) in "+client.ControlDir+"/changes")
+	flag.BoolVar(&meta, "meta", false, "Show the container inspect output, environment, labels, mounts, processes and logs (growing as they are written) in "+client.ControlDir+"/meta")
+
 	flag.BoolVar(&daemonize, "daemonize", false, "Daemonize fuse process")
 	flag.BoolVar(&daemonize, "d", false, "Daemonize fuse process")
 
@@ -71,41 +143,167 @@ func init() {
 
 	flag.BoolVar(&jsonlog, "json", false, "Log with json format")
 	flag.BoolVar(&jsonlog, "j", false, "Log with json format")
+
+	flag.BoolVar(&kernelCache, "kernel-cache", false, "Use the kernel page cache for file contents (enables mmap)")
+	flag.StringVar(&directIO, "direct-io-paths", "/proc,/sys,/dev", "Comma separated container paths always accessed with direct I/O")
+
+	flag.DurationVar(&attrTTL, "attr-ttl", defaultAttrTTL, "How long the kernel caches file attributes (0 to disable)")
+	flag.DurationVar(&entryTTL, "entry-ttl", defaultEntryTTL, "How long the kernel caches directory entries (0 to disable)")
+	flag.DurationVar(&negativeTTL, "negative-ttl", defaultNegativeTTL, "How long the kernel caches non-existent paths (0 to disable)")
+	flag.DurationVar(&cacheAttrTTL, "client-attr-ttl", 0, "How long dockerfuse caches file attributes, on top of the kernel (0 to disable)")
+	flag.DurationVar(&cacheDirTTL, "client-dir-ttl", 0, "How long dockerfuse caches directory listings (0 to disable)")
+	flag.DurationVar(&cacheNegTTL, "client-negative-ttl", 0, "How long dockerfuse caches non-existent paths, on top of the kernel (0 to disable)")
+
+	flag.BoolVar(&watch, "watch", false, "Watch for changes made inside the container and show them immediately")
+
+	flag.BoolVar(&readahead, "readahead", false, "Cache file blocks and prefetch them ahead of sequential reads")
+	flag.IntVar(&raBlocks, "readahead-blocks", client.DefaultReadaheadMaxBlocks, "Maximum number of blocks prefetched ahead of sequential reads")
+	flag.Int64Var(&raMemoryMiB, "readahead-memory", client.DefaultReadaheadMemory/(1024*1024), "Maximum memory used by the block cache, in MiB")
+
+	flag.StringVar(&satDirs, "satellite-dirs", strings.Join(client.DefaultSatelliteDirs, ","), "Comma separated container directories where the satellite may be copied, in order of preference. If none is usable, the satellite is loaded in memory, which requires python3 in the container")
+	flag.BoolVar(&removeSat, "remove-satellite", false, "Remove the satellite from the container on unmount")
+	flag.BoolVar(&detectArch, "detect-arch", false, "Pick the satellite from the architecture the container runs on, rather than from image metadata")
+
+	flag.StringVar(&cacheDir, "cache-dir", "", "Directory where file contents are cached across mounts (also served read-only when the container is unreachable)")
+	flag.Int64Var(&cacheSizeMiB, "cache-size", client.DefaultDiskCacheLimit/(1024*1024), "Maximum size of the file contents cached in -cache-dir, in MiB (0 for no limit)")
+
+	flag.StringVar(&onExit, "on-exit", client.ExitUnmount, fmt.Sprintf("What to do when the container stops for good: %s, or %s (serve cached content read-only, needs -cache-dir)", client.ExitUnmount, client.ExitStale))
+	flag.DurationVar(&pauseTimeout, "pause-timeout", client.DefaultLifecycleTimeout, "How long I/O waits for a paused or restarting container, before failing with EAGAIN")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		os.Exit(cleanup(os.Args[2:]))
+	}
+
 	flag.Parse()
 	if printVersion {
 		fmt.Printf("DockerFuse\nVersion: %s\nGit commit: %s\n", Version, GitCommit)
 		os.Exit(errorNone)
 	}
 
-	// Setup logger
-	var (
-		logHandler slog.Handler
-		logLevel   slog.Leveler
-	)
-	if debug {
-		logLevel = slog.LevelDebug
-	} else {
-		logLevel = slog.LevelInfo
+	setupLogger(debug, jsonlog)
+
+	// Exactly one target: -k8s, -pid and -ssh are shorthands for -backend with -id
+	targets := []struct {
+		flag string
+		set  bool
+	}{
+		{"-id", containerID != ""},
+		{"-image", imageRef != "" && imageFile == ""},
+		{"-image-file", imageFile != ""},
+		{"-all", all},
+		{"-compose-project", project != ""},
+		{"-k8s", pod != ""},
+		{"-pid", processPID != 0},
+		{"-ssh", sshTarget != ""},
 	}
-	if jsonlog {
-		logHandler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-			Level: logLevel,
-		})
-	} else {
-		logHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: logLevel,
-		})
+	var given, names []string
+	for _, t := range targets {
+		names = append(names, t.flag)
+		if t.set {
+			given = append(given, t.flag)
+		}
 	}
-	slog.SetDefault(slog.New(logHandler))
-
-	if containerID == "" {
-		slog.Error("container id is not specified.\n")
+	if len(given) != 1 {
+		slog.Error(fmt.Sprintf("exactly one of %s is needed (given: %s).\n", strings.Join(names, ", "), strings.Join(given, ", ")))
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	var shorthand, target string
+	switch {
+	case pod != "":
+		shorthand, target = client.BackendKubernetes, pod
+	case processPID != 0:
+		shorthand, target = client.BackendProcess, strconv.Itoa(processPID)
+	case sshTarget != "":
+		shorthand, target = client.BackendSSH, sshTarget
+	}
+	if shorthand != "" {
+		if flagSet("backend") && backend != shorthand {
+			slog.Error(fmt.Sprintf("%s can't be combined with -backend %s.\n", given[0], backend))
+			flag.Usage()
+			os.Exit(errorArgs)
+		}
+		backend, containerID = shorthand, target
+	}
+	if !slices.Contains(client.Backends(), backend) {
+		slog.Error(fmt.Sprintf("unknown backend %q (supported: %s).\n", backend, strings.Join(client.Backends(), ", ")))
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	// Only Docker (or Podman) knows about images, projects, layers and changes, and has an archive API
+	if backend != client.BackendDocker && (all || project != "" || (imageRef != "" && imageFile == "") || (layers && imageFile == "") || changes || meta || access == client.AccessArchive) {
+		slog.Error("-all, -compose-project, -image, -layers, -changes, -meta and -access " + client.AccessArchive + " need the Docker API (-backend " + client.BackendDocker + ").\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if backend != client.BackendContainerd && containerd.Namespace != "" {
+		slog.Error("-namespace needs -backend " + client.BackendContainerd + ".\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if backend == client.BackendSSH {
+		destination, sshDir, err := client.SplitSSHTarget(containerID)
+		if err != nil {
+			slog.Error(err.Error() + ".\n")
+			flag.Usage()
+			os.Exit(errorArgs)
+		}
+		if sshDir != "/" && path != "/" {
+			slog.Error("SSH targets with a path can't be combined with -path.\n")
+			flag.Usage()
+			os.Exit(errorArgs)
+		}
+		if sshDir != "/" {
+			path = sshDir
+		}
+		containerID = destination
+	}
+	if backend != client.BackendKubernetes && (kube.Path != "" || kube.Context != "") {
+		slog.Error("-kubeconfig and -kube-context need -backend " + client.BackendKubernetes + ".\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if project == "" && service != "" {
+		slog.Error("-service needs -compose-project.\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if !all && project == "" && len(filters) > 0 {
+		slog.Error("filters are only used with -all or -compose-project.\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if changes && containerID == "" {
+		slog.Error("changes are only available for containers.\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if meta && containerID == "" {
+		slog.Error("metadata is only available for containers.\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if onExit != client.ExitUnmount && onExit != client.ExitStale {
+		slog.Error("unknown exit policy.\n", "policy", onExit)
 		flag.Usage()
 		os.Exit(errorArgs)
 	}
+	if onExit == client.ExitStale && cacheDir == "" {
+		slog.Error("the stale exit policy needs a cache directory.\n")
+		flag.Usage()
+		os.Exit(errorArgs)
+	}
+	if imageFile != "" {
+		readOnly = true
+		// Daemons run from /
+		if abs, err := filepath.Abs(imageFile); err == nil {
+			imageFile = abs
+		}
+	} else if imageRef != "" && !flagSet("read-only") {
+		readOnly = true
+	}
 	if mountPoint == "" {
 		slog.Error("mount point is not specified.\n")
 		flag.Usage()
@@ -155,48 +353,270 @@ func main() {
 		os.Exit(errorInvalidUIDGid)
 	}
 
-	fuseDockerClient, err := client.NewDockerFuseClient(containerID)
+	var clientOpts []client.ClientOption
+	if cacheAttrTTL > 0 || cacheDirTTL > 0 || cacheNegTTL > 0 {
+		clientOpts = append(clientOpts, client.WithMetadataCache(client.CacheConfig{
+			AttrTTL:     cacheAttrTTL,
+			DirTTL:      cacheDirTTL,
+			NegativeTTL: cacheNegTTL,
+		}))
+		// Entries cached by the client are served to the kernel, which caches them again: the
+		// kernel TTLs are shortened so that staleness stays within the larger of both TTLs
+		attrTTL = max(attrTTL-cacheAttrTTL, 0)
+		negativeTTL = max(negativeTTL-cacheNegTTL, 0)
+	}
+	if readahead {
+		clientOpts = append(clientOpts, client.WithReadahead(client.ReadaheadConfig{
+			BlockSize:   client.DefaultReadaheadBlockSize,
+			MaxBlocks:   raBlocks,
+			MemoryLimit: raMemoryMiB * 1024 * 1024,
+		}))
+	}
+	if cacheDir != "" {
+		clientOpts = append(clientOpts, client.WithDiskCache(cacheDir, cacheSizeMiB*1024*1024))
+	}
+	if detectArch {
+		clientOpts = append(clientOpts, client.WithArchDetection())
+	}
+	if removeSat {
+		clientOpts = append(clientOpts, client.WithSatelliteRemoval())
+	}
+	if watch {
+		clientOpts = append(clientOpts, client.WithChangeWatch())
+	}
+	clientOpts = append(clientOpts, client.WithSatelliteDirs(splitList(satDirs)), client.WithDocker(docker), client.WithBackend(backend))
+	switch backend {
+	case client.BackendContainerd:
+		// -host names the containerd socket
+		containerd.Address = docker.Host
+		clientOpts = append(clientOpts, client.WithContainerd(containerd))
+	case client.BackendKubernetes:
+		clientOpts = append(clientOpts, client.WithKubernetes(kube))
+	}
+	var fuseDockerClient client.DockerFuseClientInterface
+	// With -all and -compose-project, the path applies inside each container
+	var allContainers *client.AllContainers
+	nodePath := path
+	allConfig := client.AllConfig{
+		Access:      access,
+		Path:        path,
+		Filters:     filters,
+		IdleTimeout: idleTimeout,
+		Watch:       watch,
+	}
+	switch {
+	case all:
+		nodePath = "/"
+		allContainers, err = client.NewAllContainers(allConfig, clientOpts...)
+		fuseDockerClient = allContainers
+	case project != "":
+		nodePath = "/"
+		allContainers, err = client.NewComposeContainers(project, service, allConfig, clientOpts...)
+		fuseDockerClient = allContainers
+	case imageFile != "":
+		fuseDockerClient, err = client.NewImageFileClient(imageFile, imageRef)
+	case imageRef != "":
+		imageOpts := clientOpts
+		if pull {
+			imageOpts = append(imageOpts, client.WithImagePull())
+		}
+		fuseDockerClient, err = client.NewImageClient(imageRef, imageOpts...)
+	default:
+		fuseDockerClient, err = client.NewClient(containerID, access, clientOpts...)
+	}
 	if err != nil {
 		slog.Error("error initializing docker client", "error", err)
 		os.Exit(errorInitDockerClient)
 	} else {
 		slog.Debug("docker client created")
 	}
+	satelliteClient, _ := fuseDockerClient.(*client.DockerFuseClient)
+	withViewsClient, err := withViews(fuseDockerClient, clientOpts)
+	if err != nil {
+		slog.Error("error initializing views", "error", err)
+		fuseDockerClient.Close()
+		os.Exit(errorInitDockerClient)
+	}
+	fuseDockerClient = withViewsClient
 
 	slog.Info("mounting FS", "path", mountPoint)
 	vEntryTTL := entryTTL
 	vAttrTTL := attrTTL
-	server, err := fs.Mount(mountPoint, client.NewNode(fuseDockerClient, path, ""), &fs.Options{
+	vNegativeTTL := negativeTTL
+	nodeOpts := client.NodeOptions{KernelCache: kernelCache}
+	// Views change without the kernel knowing, e.g., logs grow
+	nodeOpts.DirectIOPaths = append(splitList(directIO), filepath.Join(path, client.ControlDir))
+	if allContainers != nil {
+		containerDir := "/*"
+		if allContainers.Single() {
+			containerDir = "/"
+		}
+		for i, p := range nodeOpts.DirectIOPaths {
+			if rel, err := filepath.Rel(path, p); err == nil && !strings.HasPrefix(rel, "..") {
+				nodeOpts.DirectIOPaths[i] = filepath.Join(containerDir, rel)
+			}
+		}
+	}
+	root := client.NewNodeWithOptions(fuseDockerClient, nodePath, "", nodeOpts)
+	mountOpts := fuse.MountOptions{
+		FsName: fmt.Sprintf("dockerfuse-%s", containerID),
+	}
+	if backend != client.BackendDocker {
+		mountOpts.FsName = fmt.Sprintf("dockerfuse-%s-%s", backend, containerID)
+	}
+	if all {
+		mountOpts.FsName = "dockerfuse-all"
+	} else if service != "" {
+		mountOpts.FsName = fmt.Sprintf("dockerfuse-%s-%s", project, service)
+	} else if project != "" {
+		mountOpts.FsName = fmt.Sprintf("dockerfuse-%s", project)
+	} else if imageRef != "" {
+		mountOpts.FsName = fmt.Sprintf("dockerfuse-%s", imageRef)
+	} else if imageFile != "" {
+		mountOpts.FsName = fmt.Sprintf("dockerfuse-%s", filepath.Base(imageFile))
+	}
+	if readOnly {
+		mountOpts.Options = append(mountOpts.Options, "ro")
+	}
+	server, err := fs.Mount(mountPoint, root, &fs.Options{
 		EntryTimeout:    &vEntryTTL,
 		AttrTimeout:     &vAttrTTL,
-		NegativeTimeout: &vEntryTTL,
-		MountOptions: fuse.MountOptions{
-			FsName: fmt.Sprintf("dockerfuse-%s", containerID),
-		},
-		UID: uint32(uid),
-		GID: uint32(gid),
+		NegativeTimeout: &vNegativeTTL,
+		MountOptions:    mountOpts,
+		UID:             uint32(uid),
+		GID:             uint32(gid),
 	})
 	if err != nil {
 		slog.Error("mount failed", "error", err)
+		fuseDockerClient.Close()
 		os.Exit(errorMountUnmount)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// With -all and -compose-project, the list of containers is also kept in sync with the kernel
+	if watch || allContainers != nil {
+		go func() {
+			slog.Debug("watching for changes in the container")
+			if err := root.WatchChanges(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("stopped watching for changes", "error", err)
+			}
+		}()
+	}
+
+	if satelliteClient != nil {
+		go func() {
+			err := satelliteClient.WatchLifecycle(ctx, client.LifecycleConfig{
+				Timeout:      pauseTimeout,
+				RestartGrace: client.DefaultRestartGrace,
+				OnExit:       onExit,
+				Unmount: func() {
+					if err := server.Unmount(); err != nil {
+						slog.Error("unmount failed", "error", err)
+					}
+				},
+			})
+			// Pods, containerd tasks, processes and SSH hosts have no events to follow their lifecycle with
+			if errors.Is(err, client.ErrNoLifecycleEvents) {
+				slog.Debug("not following the container lifecycle", "error", err)
+			} else if err != nil {
+				slog.Warn("stopped following the container lifecycle", "error", err)
+			}
+		}()
+	}
+
 	slog.Debug("setting up signal handler...")
 	osSignalChannel := make(chan os.Signal, 1)
 	signal.Notify(osSignalChannel, syscall.SIGTERM, syscall.SIGINT)
 	go shutdown(server, osSignalChannel)
 	defer close(osSignalChannel)
 
+	// Unmounted on SIGINT or SIGTERM, from outside (e.g. with umount), or after the container stopped
 	server.Wait()
+	cancel()
+	fuseDockerClient.Close()
+
+	stats := fuseDockerClient.CacheStats()
+	slog.Info("metadata cache statistics",
+		"attr_hits", stats.AttrHits, "attr_misses", stats.AttrMisses,
+		"dir_hits", stats.DirHits, "dir_misses", stats.DirMisses,
+		"negative_hits", stats.NegativeHits, "negative_misses", stats.NegativeMisses)
+	slog.Info("unmount successful")
 }
 
+// flagSet tells whether the named flag was given on the command line
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return
+}
+
+// listFlag collects the values of a repeated flag
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// addDockerFlags adds the flags selecting the Docker daemon, named as those of the docker CLI
+func addDockerFlags(flags *flag.FlagSet, config *client.DockerConfig) {
+	flags.StringVar(&config.Host, "host", "", "Docker daemon to connect to (default: DOCKER_HOST, or the docker CLI context), or containerd socket with -backend "+client.BackendContainerd+" (default: CONTAINERD_ADDRESS, or /run/containerd/containerd.sock)")
+	flags.StringVar(&config.Host, "H", "", "Docker daemon to connect to (default: DOCKER_HOST, or the docker CLI context), or containerd socket with -backend "+client.BackendContainerd+" (default: CONTAINERD_ADDRESS, or /run/containerd/containerd.sock)")
+	flags.StringVar(&config.Context, "context", "", "Docker CLI context to use (default: DOCKER_CONTEXT, or the current context of the docker CLI)")
+	flags.StringVar(&config.Engine, "engine", "", fmt.Sprintf("Container engine of -backend %s: %s, or %s (libpod API, at $XDG_RUNTIME_DIR/podman/podman.sock unless -host is set). By default, podman is used when its socket is found and the docker one is not", client.BackendDocker, client.EngineDocker, client.EnginePodman))
+	flags.BoolVar(&config.TLSVerify, "tlsverify", false, "Use TLS and verify the Docker daemon")
+	flags.StringVar(&config.TLSCACert, "tlscacert", "", "Trust certificates signed by this CA (default: ca.pem in DOCKER_CERT_PATH or ~/.docker)")
+	flags.StringVar(&config.TLSCert, "tlscert", "", "TLS certificate (default: cert.pem in DOCKER_CERT_PATH or ~/.docker)")
+	flags.StringVar(&config.TLSKey, "tlskey", "", "TLS key (default: key.pem in DOCKER_CERT_PATH or ~/.docker)")
+}
+
+// addContainerdFlags adds the flags selecting the containerd namespace, named as those of nerdctl.
+// The containerd socket is given with -host.
+func addContainerdFlags(flags *flag.FlagSet, config *client.ContainerdConfig) {
+	flags.StringVar(&config.Namespace, "namespace", "", "containerd namespace, with -backend "+client.BackendContainerd+" (default: CONTAINERD_NAMESPACE, or "+client.DefaultContainerdNamespace+"; Kubernetes uses k8s.io)")
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) (items []string) {
+	for _, i := range strings.Split(list, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return
+}
+
+func setupLogger(debug bool, jsonlog bool) {
+	var (
+		logHandler slog.Handler
+		logLevel   slog.Leveler
+	)
+	if debug {
+		logLevel = slog.LevelDebug
+	} else {
+		logLevel = slog.LevelInfo
+	}
+	if jsonlog {
+		logHandler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+			Level: logLevel,
+		})
+	} else {
+		logHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+			Level: logLevel,
+		})
+	}
+	slog.SetDefault(slog.New(logHandler))
+}
+
+// shutdown unmounts the filesystem on signals: main then releases the client, once server.Wait returns
 func shutdown(server *fuse.Server, signals <-chan os.Signal) {
-	<-signals
+	if _, ok := <-signals; !ok {
+		return
+	}
 	if err := server.Unmount(); err != nil {
 		slog.Error("unmount failed", "error", err)
 		os.Exit(errorMountUnmount)
 	}
-
-	slog.Info("unmount successful")
-	os.Exit(errorNone)
 }
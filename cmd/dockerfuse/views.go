@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/dguerri/dockerfuse/cmd/dockerfuse/client"
+)
+
+// withViews wraps fdc to serve the views enabled on the command line, in the control directory
+func withViews(fdc client.DockerFuseClientInterface, clientOpts []client.ClientOption) (client.DockerFuseClientInterface, error) {
+	if !layers && !changes && !meta {
+		return fdc, nil
+	}
+	views := client.NewViewClient(fdc, path)
+
+	// Views holding resources go last, and are released if the ones after them fail
+	if changes {
+		c, err := client.NewContainerChanges(containerID, path, clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		views.AddView("changes", c)
+	}
+
+	var m *client.Meta
+	if meta {
+		var err error
+		if m, err = client.NewContainerMeta(containerID, clientOpts...); err != nil {
+			return nil, err
+		}
+		views.AddView("meta", m)
+	}
+
+	if layers {
+		var (
+			l   *client.Layers
+			err error
+		)
+		switch {
+		case imageFile != "":
+			l, err = client.NewImageFileLayers(fdc.(*client.ImageFileClient))
+		case imageRef != "":
+			l, err = client.NewImageLayers(imageRef, clientOpts...)
+		default:
+			l, err = client.NewContainerLayers(containerID, clientOpts...)
+		}
+		if err != nil {
+			if m != nil {
+				m.Close()
+			}
+			return nil, err
+		}
+		views.AddView("layers", l)
+		views.AddXattrs(l)
+	}
+	return views, nil
+}
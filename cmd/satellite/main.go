@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +10,8 @@ import (
 	"net/rpc"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -29,6 +33,12 @@ func (rw RWCloser) Close() error {
 	return err
 }
 
+const (
+	// Time given to terminated satellites to exit, before removing the executable
+	killTimeout = 2 * time.Second
+	killPoll    = 50 * time.Millisecond
+)
+
 // Version and GitCommit are set at build-time
 var (
 	Version   string
@@ -38,14 +48,43 @@ var (
 func main() {
 	var printVersion bool
 	var persistentLog bool
+	var removeSelf bool
+	var listSatellites bool
+	var killPIDs string
+	var session string
+	var watch bool
 	flag.BoolVar(&persistentLog, "log", false, "Enable persistent debug log in /tmp/log.txt")
 	flag.BoolVar(&printVersion, "version", false, "Print the version and exit")
+	flag.BoolVar(&removeSelf, "remove", false, "Remove the satellite executable on exit, unless other satellites are running")
+	flag.BoolVar(&listSatellites, "list", false, "List running satellites (pid and session) and exit")
+	flag.StringVar(&killPIDs, "kill", "", "Terminate the satellites with the given comma separated pids (possibly none) and exit")
+	flag.StringVar(&session, "session", "", "Session identifier, set by the client")
+	flag.BoolVar(&watch, "watch", false, "Watch the directories looked up by the client for changes")
 	flag.Parse()
 
 	if printVersion {
 		fmt.Printf("DockerFuse Satellite\nVersion: %s\nGit commmit: %s\n", Version, GitCommit)
+		// Lets the client check the satellite it placed, without any tool in the container
+		if sum, err := executableSHA256(); err == nil {
+			fmt.Printf("SHA256: %s\n", sum)
+		}
 		os.Exit(0)
 	}
+	if listSatellites {
+		satellites, err := server.ListSatellites("/proc")
+		if err != nil {
+			log.Fatalf("error listing satellites: %v", err)
+		}
+		for _, s := range satellites {
+			fmt.Printf("%d %s\n", s.PID, s.Session)
+		}
+		os.Exit(0)
+	}
+	killMode := false
+	flag.Visit(func(f *flag.Flag) { killMode = killMode || f.Name == "kill" })
+	if killMode {
+		os.Exit(kill(killPIDs, removeSelf))
+	}
 
 	if persistentLog {
 		f, err := os.OpenFile("/tmp/log.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
@@ -57,13 +96,18 @@ func main() {
 		log.SetOutput(f)
 	}
 
-	log.Printf("(%v) Starting up", time.Now())
+	log.Printf("(%v) Starting up, session %q", time.Now(), session)
 
 	fsops := server.NewDockerFuseFSOps()
+	if watch {
+		if err := fsops.WatchChanges(); err != nil {
+			log.Printf("cannot watch changes: %v", err)
+		}
+	}
 	log.Printf("setting up signal handler...")
 	osSignalChannel := make(chan os.Signal, 1)
 	signal.Notify(osSignalChannel, syscall.SIGTERM, syscall.SIGINT)
-	go shutdown(fsops, osSignalChannel)
+	go shutdown(fsops, removeSelf, osSignalChannel)
 	defer close(osSignalChannel)
 
 	s := rpc.NewServer()
@@ -77,12 +121,95 @@ func main() {
 
 	log.Printf("Serving requests")
 	s.ServeConn(rwCloser)
+
+	// The client closed the session, or went away
+	log.Printf("end of input, cleaning up...")
+	cleanup(fsops, removeSelf)
 }
 
-func shutdown(server *server.DockerFuseFSOps, signals <-chan os.Signal) {
+func shutdown(server *server.DockerFuseFSOps, removeSelf bool, signals <-chan os.Signal) {
 	<-signals
 	log.Printf("cleaning up...")
-	server.CloseAllFDs()
+	cleanup(server, removeSelf)
 
 	os.Exit(0)
 }
+
+// cleanup releases resources held by the satellite and, if asked, removes its executable
+func cleanup(server *server.DockerFuseFSOps, removeSelf bool) {
+	server.CloseAllFDs()
+	if removeSelf {
+		removeUnusedExecutable(0)
+	}
+}
+
+// executableSHA256 returns the SHA-256 of the running satellite executable
+func executableSHA256() (string, error) {
+	f, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// removeUnusedExecutable removes the satellite executable, which is shared by the sessions in
+// the container, once no other satellite is running. It waits up to wait for them to exit.
+func removeUnusedExecutable(wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for {
+		satellites, err := server.ListSatellites("/proc")
+		if err != nil {
+			log.Printf("cannot list satellites, leaving the executable in place: %v", err)
+			return
+		}
+		if len(satellites) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("%d satellites still running, leaving the executable in place", len(satellites))
+			return
+		}
+		time.Sleep(killPoll)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("cannot find the satellite executable: %v", err)
+		return
+	}
+	// Satellites loaded in memory have nothing to remove
+	if strings.HasPrefix(exe, "/memfd:") || strings.HasSuffix(exe, " (deleted)") {
+		return
+	}
+	if err := os.Remove(exe); err != nil {
+		log.Printf("cannot remove %s: %v", exe, err)
+	}
+}
+
+// kill terminates the given satellites, returning the exit status. The executable is removed if
+// asked, once the satellites are gone and no other one is running.
+func kill(pids string, removeSelf bool) (status int) {
+	for _, p := range strings.FieldsFunc(pids, func(r rune) bool { return r == ',' }) {
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid pid %q\n", p)
+			status = 1
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			fmt.Fprintf(os.Stderr, "cannot terminate %d: %v\n", pid, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%d\n", pid)
+	}
+	if removeSelf {
+		removeUnusedExecutable(killTimeout)
+	}
+	return
+}
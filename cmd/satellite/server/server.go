@@ -5,6 +5,8 @@ import (
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/dguerri/dockerfuse/pkg/rpccommon"
@@ -13,8 +15,16 @@ import (
 
 // DockerFuseFSOps is used to interact with the filesystem
 type DockerFuseFSOps struct {
-	// Open file descriptors
-	fds map[uintptr]file
+	// Open file descriptors, keyed by their OS descriptor. RPCs of a connection run concurrently
+	// (e.g., WaitEvents long-polls and readahead), hence the lock.
+	fdsMu sync.Mutex
+	fds   map[uintptr]file
+
+	// Change watcher, started once the client opts in with WatchChanges or its first WaitEvents
+	// call. watcherErr is set when it can't be started.
+	watcherMu  sync.Mutex
+	watcher    changeWatcher
+	watcherErr error
 }
 
 // NewDockerFuseFSOps returns a new DockerFuseFSOps
@@ -26,10 +36,75 @@ func NewDockerFuseFSOps() (fso *DockerFuseFSOps) {
 
 // CloseAllFDs closes all file descriptors currently opened by the server.
 func (fso *DockerFuseFSOps) CloseAllFDs() {
+	fso.fdsMu.Lock()
 	for k, fd := range fso.fds {
 		fd.Close()
 		delete(fso.fds, k)
 	}
+	fso.fdsMu.Unlock()
+
+	fso.watcherMu.Lock()
+	defer fso.watcherMu.Unlock()
+	if fso.watcher != nil {
+		fso.watcher.Close()
+		fso.watcher = nil
+	}
+}
+
+// WatchChanges starts watching the directories the client looks up from now on, for clients
+// collecting changes with WaitEvents. Without it, lookups add no watches.
+func (fso *DockerFuseFSOps) WatchChanges() error {
+	_, err := fso.startWatcher()
+	return err
+}
+
+// startWatcher returns the change watcher, starting it if needed.
+func (fso *DockerFuseFSOps) startWatcher() (changeWatcher, error) {
+	fso.watcherMu.Lock()
+	defer fso.watcherMu.Unlock()
+
+	if fso.watcher == nil && fso.watcherErr == nil {
+		fso.watcher, fso.watcherErr = newChangeWatcher()
+		if fso.watcherErr != nil {
+			log.Printf("cannot watch changes: %v", fso.watcherErr)
+		}
+	}
+	return fso.watcher, fso.watcherErr
+}
+
+// watchDir watches dir for changes once the client looks it up, if the client watches changes:
+// events queue until the client collects them with WaitEvents.
+func (fso *DockerFuseFSOps) watchDir(dir string) {
+	fso.watcherMu.Lock()
+	w := fso.watcher
+	fso.watcherMu.Unlock()
+	if w == nil {
+		return
+	}
+	if err := w.Add(dir); err != nil {
+		log.Printf("cannot watch %s: %v", dir, err)
+	}
+}
+
+// WaitEvents returns changes made to directories looked up by the client, blocking until
+// some are available or the timeout expires.
+func (fso *DockerFuseFSOps) WaitEvents(request rpccommon.WaitEventsRequest, reply *rpccommon.WaitEventsReply) error {
+	log.Printf("WaitEvents called: %v", request)
+
+	w, err := fso.startWatcher()
+	if err != nil {
+		return rpccommon.ErrnoToRPCErrorString(err)
+	}
+	reply.Events, reply.Overflow = w.Wait(request.Timeout, request.MaxEvents)
+	return nil
+}
+
+// file returns the open file fd refers to
+func (fso *DockerFuseFSOps) file(fd uintptr) (f file, ok bool) {
+	fso.fdsMu.Lock()
+	defer fso.fdsMu.Unlock()
+	f, ok = fso.fds[fd]
+	return
 }
 
 // Stat returns file information about the requested path.
@@ -50,9 +125,12 @@ func (fso *DockerFuseFSOps) Stat(request rpccommon.StatRequest, reply *rpccommon
 	reply.Ino = sys.Ino
 	reply.UID = sys.Uid
 	reply.GID = sys.Gid
-	reply.Atime = csys.StatAtime(sys).Sec // Workaround for os specific naming differences in Stat_t
-	reply.Mtime = csys.StatMtime(sys).Sec
-	reply.Ctime = csys.StatCtime(sys).Sec
+	reply.Atime = int64(csys.StatAtime(sys).Sec) // Workaround for os specific naming differences in Stat_t
+	reply.Mtime = int64(csys.StatMtime(sys).Sec)
+	reply.Ctime = int64(csys.StatCtime(sys).Sec)
+	reply.AtimeNsec = int64(csys.StatAtime(sys).Nsec)
+	reply.MtimeNsec = int64(csys.StatMtime(sys).Nsec)
+	reply.CtimeNsec = int64(csys.StatCtime(sys).Nsec)
 	reply.Size = sys.Size
 	reply.Blocks = sys.Blocks
 	reply.Blksize = int32(sys.Blksize) // 64bit on amd64, 32bit on arm64
@@ -61,6 +139,8 @@ func (fso *DockerFuseFSOps) Stat(request rpccommon.StatRequest, reply *rpccommon
 		reply.LinkTarget = ""
 	}
 
+	// The client now knows about this entry: report changes to it
+	fso.watchDir(filepath.Dir(request.FullPath))
 	return nil
 }
 
@@ -92,6 +172,7 @@ func (fso *DockerFuseFSOps) ReadDir(request rpccommon.ReadDirRequest, reply *rpc
 		}
 		reply.DirEntries = append(reply.DirEntries, entry)
 	}
+	fso.watchDir(request.FullPath)
 	return nil
 }
 
@@ -105,10 +186,12 @@ func (fso *DockerFuseFSOps) Open(request rpccommon.OpenRequest, reply *rpccommon
 	}
 
 	uintptrFD := fd.Fd()
+	fso.fdsMu.Lock()
 	if fd, ok := fso.fds[uintptrFD]; ok {
 		fd.Close() // Make sure we don't leak stale FDs
 	}
 	fso.fds[uintptrFD] = fd
+	fso.fdsMu.Unlock()
 
 	info, err := fd.Stat()
 	if err != nil {
@@ -121,9 +204,12 @@ func (fso *DockerFuseFSOps) Open(request rpccommon.OpenRequest, reply *rpccommon
 	reply.Ino = sys.Ino
 	reply.UID = sys.Uid
 	reply.GID = sys.Gid
-	reply.Atime = csys.StatAtime(sys).Sec // Workaround for os specific naming differences in Stat_t
-	reply.Mtime = csys.StatMtime(sys).Sec
-	reply.Ctime = csys.StatCtime(sys).Sec
+	reply.Atime = int64(csys.StatAtime(sys).Sec) // Workaround for os specific naming differences in Stat_t
+	reply.Mtime = int64(csys.StatMtime(sys).Sec)
+	reply.Ctime = int64(csys.StatCtime(sys).Sec)
+	reply.AtimeNsec = int64(csys.StatAtime(sys).Nsec)
+	reply.MtimeNsec = int64(csys.StatMtime(sys).Nsec)
+	reply.CtimeNsec = int64(csys.StatCtime(sys).Nsec)
 	reply.Size = sys.Size
 	reply.Blocks = sys.Blocks
 	reply.Blksize = int32(sys.Blksize) // 64bit on amd64, 32bit on arm64
@@ -139,11 +225,13 @@ func (fso *DockerFuseFSOps) Open(request rpccommon.OpenRequest, reply *rpccommon
 func (fso *DockerFuseFSOps) Close(request rpccommon.CloseRequest, reply *rpccommon.CloseReply) error {
 	log.Printf("Close called: %v", request)
 
+	fso.fdsMu.Lock()
 	fd, ok := fso.fds[request.FD]
+	delete(fso.fds, request.FD)
+	fso.fdsMu.Unlock()
 	if !ok {
 		return rpccommon.ErrnoToRPCErrorString(syscall.EINVAL)
 	}
-	defer delete(fso.fds, request.FD)
 	err := fd.Close()
 	if err != nil {
 		return rpccommon.ErrnoToRPCErrorString(err)
@@ -156,7 +244,7 @@ func (fso *DockerFuseFSOps) Close(request rpccommon.CloseRequest, reply *rpccomm
 func (fso *DockerFuseFSOps) Read(request rpccommon.ReadRequest, reply *rpccommon.ReadReply) error {
 	log.Printf("Read called: %v", request)
 
-	file, ok := fso.fds[request.FD]
+	file, ok := fso.file(request.FD)
 	if !ok {
 		return rpccommon.ErrnoToRPCErrorString(syscall.EINVAL)
 	}
@@ -175,7 +263,7 @@ func (fso *DockerFuseFSOps) Read(request rpccommon.ReadRequest, reply *rpccommon
 func (fso *DockerFuseFSOps) Seek(request rpccommon.SeekRequest, reply *rpccommon.SeekReply) error {
 	log.Printf("Seek called: %v", request)
 
-	file, ok := fso.fds[request.FD]
+	file, ok := fso.file(request.FD)
 	if !ok {
 		return rpccommon.ErrnoToRPCErrorString(syscall.EINVAL)
 	}
@@ -193,7 +281,7 @@ func (fso *DockerFuseFSOps) Seek(request rpccommon.SeekRequest, reply *rpccommon
 func (fso *DockerFuseFSOps) Write(request rpccommon.WriteRequest, reply *rpccommon.WriteReply) error {
 	log.Printf("Write called: %v", request)
 
-	file, ok := fso.fds[request.FD]
+	file, ok := fso.file(request.FD)
 	if !ok {
 		return rpccommon.ErrnoToRPCErrorString(syscall.EINVAL)
 	}
@@ -222,7 +310,7 @@ func (fso *DockerFuseFSOps) Unlink(request rpccommon.UnlinkRequest, reply *rpcco
 func (fso *DockerFuseFSOps) Fsync(request rpccommon.FsyncRequest, reply *rpccommon.FsyncReply) error {
 	log.Printf("Fsync called: %v", request)
 
-	file, ok := fso.fds[request.FD]
+	file, ok := fso.file(request.FD)
 	if !ok {
 		return rpccommon.ErrnoToRPCErrorString(syscall.EINVAL)
 	}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -1556,3 +1558,140 @@ func TestCloseAllFDs(t *testing.T) {
 	f3.AssertExpectations(t)
 	assert.Equal(t, 0, len(dfFSOps.fds))
 }
+
+// mockWatcher implements mock changeWatcher for testing
+type mockWatcher struct{ mock.Mock }
+
+func (w *mockWatcher) Add(dir string) error { a := w.Called(dir); return a.Error(0) }
+func (w *mockWatcher) Close() error         { a := w.Called(); return a.Error(0) }
+func (w *mockWatcher) Wait(timeout time.Duration, maxEvents int) ([]rpccommon.ChangeEvent, bool) {
+	a := w.Called(timeout, maxEvents)
+	return a.Get(0).([]rpccommon.ChangeEvent), a.Bool(1)
+}
+
+func TestWaitEvents(t *testing.T) {
+	var (
+		mFS mockFS
+		mW  mockWatcher
+	)
+	dfFS = &mFS
+	newChangeWatcher = func() (changeWatcher, error) { return &mW, nil }
+	defer func() { newChangeWatcher = newPlatformWatcher }()
+	dfFSOps := NewDockerFuseFSOps()
+
+	// No directory is watched before the client opts in
+	mFS.On("ReadDir", "/dir").Return([]*mockDirEntry{}, nil)
+	assert.NoError(t, dfFSOps.ReadDir(rpccommon.ReadDirRequest{FullPath: "/dir"}, &rpccommon.ReadDirReply{}))
+	mW.AssertNotCalled(t, "Add", mock.Anything)
+
+	// Directories are watched from their first lookup once the client watches changes
+	assert.NoError(t, dfFSOps.WatchChanges())
+	mW.On("Add", "/dir").Return(nil).Once()
+	assert.NoError(t, dfFSOps.ReadDir(rpccommon.ReadDirRequest{FullPath: "/dir"}, &rpccommon.ReadDirReply{}))
+
+	events := []rpccommon.ChangeEvent{{FullPath: "/dir/f", Op: rpccommon.CHANGE_CREATE}}
+	mW.On("Wait", time.Second, 10).Return(events, true)
+	var reply rpccommon.WaitEventsReply
+	assert.NoError(t, dfFSOps.WaitEvents(rpccommon.WaitEventsRequest{Timeout: time.Second, MaxEvents: 10}, &reply))
+	assert.Equal(t, events, reply.Events)
+	assert.True(t, reply.Overflow)
+
+	// Listed directories and parents of stat'ed paths are watched
+	mW.On("Add", "/dir").Return(nil).Once()
+	assert.NoError(t, dfFSOps.ReadDir(rpccommon.ReadDirRequest{FullPath: "/dir"}, &rpccommon.ReadDirReply{}))
+	mFI := mockFileInfo{}
+	mFI.On("Sys").Return(&syscall.Stat_t{})
+	mFS.On("Lstat", "/other/f").Return(&mFI, nil)
+	mFS.On("Readlink", "/other/f").Return("", syscall.EINVAL)
+	mW.On("Add", "/other").Return(syscall.ENOSPC).Once()
+	assert.NoError(t, dfFSOps.Stat(rpccommon.StatRequest{FullPath: "/other/f"}, &rpccommon.StatReply{}))
+
+	mW.On("Close").Return(nil).Once()
+	dfFSOps.CloseAllFDs()
+	mW.AssertExpectations(t)
+}
+
+func TestWaitEventsUnsupported(t *testing.T) {
+	newChangeWatcher = func() (changeWatcher, error) { return nil, syscall.ENOSYS }
+	defer func() { newChangeWatcher = newPlatformWatcher }()
+	dfFSOps := NewDockerFuseFSOps()
+
+	err := dfFSOps.WaitEvents(rpccommon.WaitEventsRequest{}, &rpccommon.WaitEventsReply{})
+	assert.Equal(t, fmt.Errorf("errno: ENOSYS"), err)
+	assert.Equal(t, syscall.ENOSYS, dfFSOps.WatchChanges())
+}
+
+func TestWaitEventsStartsWatching(t *testing.T) {
+	var (
+		mFS mockFS
+		mW  mockWatcher
+	)
+	dfFS = &mFS
+	newChangeWatcher = func() (changeWatcher, error) { return &mW, nil }
+	defer func() { newChangeWatcher = newPlatformWatcher }()
+	dfFSOps := NewDockerFuseFSOps()
+
+	// Clients not passing -watch to the satellite opt in with their first WaitEvents call
+	mW.On("Wait", time.Millisecond, 0).Return([]rpccommon.ChangeEvent(nil), false)
+	assert.NoError(t, dfFSOps.WaitEvents(rpccommon.WaitEventsRequest{Timeout: time.Millisecond}, &rpccommon.WaitEventsReply{}))
+	mFS.On("ReadDir", "/dir").Return([]*mockDirEntry{}, nil)
+	mW.On("Add", "/dir").Return(nil).Once()
+	assert.NoError(t, dfFSOps.ReadDir(rpccommon.ReadDirRequest{FullPath: "/dir"}, &rpccommon.ReadDirReply{}))
+	mW.AssertExpectations(t)
+}
+
+// TestConcurrentRPCs runs file operations next to WaitEvents long-polls, as clients do on one
+// connection. Run with -race.
+func TestConcurrentRPCs(t *testing.T) {
+	dfFS = &osFS{}
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "f"), []byte("content"), 0644))
+	dfFSOps := NewDockerFuseFSOps()
+	defer dfFSOps.CloseAllFDs()
+
+	stop := make(chan struct{})
+	var polls sync.WaitGroup
+	polls.Add(1)
+	go func() {
+		defer polls.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			dfFSOps.WaitEvents(rpccommon.WaitEventsRequest{Timeout: time.Millisecond}, &rpccommon.WaitEventsReply{})
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for range 8 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for range 50 {
+				var open rpccommon.OpenReply
+				if !assert.NoError(t, dfFSOps.Open(rpccommon.OpenRequest{FullPath: filepath.Join(dir, "f"),
+					SAFlags: rpccommon.SystemToSAFlags(syscall.O_RDONLY)}, &open)) {
+					return
+				}
+				// Readahead prefetches race with closes of the same handle
+				var prefetch sync.WaitGroup
+				prefetch.Add(1)
+				go func() {
+					defer prefetch.Done()
+					dfFSOps.Read(rpccommon.ReadRequest{FD: open.FD, Offset: 0, Num: 4}, &rpccommon.ReadReply{})
+				}()
+				dfFSOps.Stat(rpccommon.StatRequest{FullPath: filepath.Join(dir, "f")}, &rpccommon.StatReply{})
+				dfFSOps.Close(rpccommon.CloseRequest{FD: open.FD}, &rpccommon.CloseReply{})
+				prefetch.Wait()
+			}
+		}()
+	}
+	workers.Wait()
+	close(stop)
+	polls.Wait()
+	dfFSOps.fdsMu.Lock()
+	assert.Empty(t, dfFSOps.fds)
+	dfFSOps.fdsMu.Unlock()
+}
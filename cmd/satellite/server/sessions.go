@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SatelliteBinPrefix is the name prefix of satellite executables
+const SatelliteBinPrefix = "dockerfuse_satellite"
+
+// Satellite is a satellite process running in the container
+type Satellite struct {
+	PID     int
+	Session string // Empty for satellites started without a session
+}
+
+// ListSatellites returns the satellites found in procDir (usually /proc), except the calling process
+func ListSatellites(procDir string) ([]Satellite, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var satellites []Satellite
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(procDir, e.Name(), "cmdline"))
+		if err != nil {
+			// The process is gone, or we are not allowed to look at it
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+		if !strings.HasPrefix(filepath.Base(args[0]), SatelliteBinPrefix) {
+			continue
+		}
+		s := Satellite{PID: pid}
+		for i, a := range args[1:] {
+			if a == "-session" && i+2 < len(args) {
+				s.Session = args[i+2]
+			} else if v, ok := strings.CutPrefix(a, "-session="); ok {
+				s.Session = v
+			}
+		}
+		satellites = append(satellites, s)
+	}
+	return satellites, nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListSatellites(t *testing.T) {
+	procDir := t.TempDir()
+	processes := map[string]string{
+		"10":                      "/tmp/dockerfuse_satellite_amd64\x00-session\x00host:42:abcd\x00",
+		"11":                      "/dev/shm/dockerfuse_satellite_arm64\x00-remove\x00-session=host:43:ef01\x00",
+		"12":                      "dockerfuse_satellite\x00",
+		"13":                      "/bin/sh\x00-c\x00dockerfuse_satellite_amd64\x00",
+		"self":                    "/tmp/dockerfuse_satellite_amd64\x00",
+		strconv.Itoa(os.Getpid()): "/tmp/dockerfuse_satellite_amd64\x00-list\x00",
+		"14":                      "", // Kernel thread
+	}
+	for pid, cmdline := range processes {
+		assert.NoError(t, os.Mkdir(filepath.Join(procDir, pid), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(procDir, pid, "cmdline"), []byte(cmdline), 0644))
+	}
+	// Process gone while listing
+	assert.NoError(t, os.Mkdir(filepath.Join(procDir, "15"), 0755))
+
+	satellites, err := ListSatellites(procDir)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Satellite{
+		{PID: 10, Session: "host:42:abcd"},
+		{PID: 11, Session: "host:43:ef01"},
+		{PID: 12},
+	}, satellites)
+
+	_, err = ListSatellites(filepath.Join(procDir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+)
+
+// maxQueuedEvents is the number of events kept before reporting an overflow
+const maxQueuedEvents = 4096
+
+var newChangeWatcher = newPlatformWatcher
+
+// changeWatcher reports changes made to the entries of watched directories
+type changeWatcher interface {
+	Add(dir string) error
+	Wait(timeout time.Duration, maxEvents int) (events []rpccommon.ChangeEvent, overflow bool)
+	Close() error
+}
+
+// eventQueue buffers change events until a client collects them
+type eventQueue struct {
+	mu       sync.Mutex
+	events   []rpccommon.ChangeEvent
+	overflow bool
+	ready    chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues an event, dropping consecutive duplicates (e.g., a burst of writes to a file)
+func (q *eventQueue) push(event rpccommon.ChangeEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+
+	if q.overflow {
+		return
+	}
+	if n := len(q.events); n > 0 && q.events[n-1] == event {
+		return
+	}
+	if len(q.events) >= maxQueuedEvents {
+		q.events = nil
+		q.overflow = true
+		return
+	}
+	q.events = append(q.events, event)
+}
+
+// setOverflow records that events have been lost
+func (q *eventQueue) setOverflow() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+
+	q.events = nil
+	q.overflow = true
+}
+
+// wait returns up to maxEvents queued events, waiting up to timeout for some to arrive
+func (q *eventQueue) wait(timeout time.Duration, maxEvents int) (events []rpccommon.ChangeEvent, overflow bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		if len(q.events) > 0 || q.overflow {
+			n := len(q.events)
+			if maxEvents > 0 && n > maxEvents {
+				n = maxEvents
+			}
+			events = append(events, q.events[:n]...)
+			q.events = q.events[n:]
+			overflow = q.overflow
+			q.overflow = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
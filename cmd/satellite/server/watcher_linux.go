@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"golang.org/x/sys/unix"
+)
+
+// maxWatches caps the number of watched directories, to play nice with fs.inotify.max_user_watches
+const maxWatches = 4096
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// inotifyWatcher implements changeWatcher using Linux inotify
+type inotifyWatcher struct {
+	fd    int
+	queue *eventQueue
+
+	// wake is a pipe used by Close to interrupt readEvents, which polls it along with fd
+	wake      [2]int
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	dirs map[int32]string // watch descriptor -> directory
+	wds  map[string]int32 // directory -> watch descriptor
+}
+
+func newPlatformWatcher() (changeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:    fd,
+		queue: newEventQueue(),
+		done:  make(chan struct{}),
+		dirs:  make(map[int32]string),
+		wds:   make(map[string]int32),
+	}
+	if err := unix.Pipe2(w.wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add starts watching dir, if it is not watched already
+func (w *inotifyWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.wds[dir]; ok {
+		return nil
+	}
+	if len(w.wds) >= maxWatches {
+		return syscall.ENOSPC
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[int32(wd)] = dir
+	w.wds[dir] = int32(wd)
+	return nil
+}
+
+// Wait returns the changes observed so far, waiting up to timeout for some
+func (w *inotifyWatcher) Wait(timeout time.Duration, maxEvents int) ([]rpccommon.ChangeEvent, bool) {
+	return w.queue.wait(timeout, maxEvents)
+}
+
+// Close stops watching all directories. The reader goroutine is woken up and waited for before
+// closing the inotify descriptor, so that it never reads from a closed (or reused) descriptor
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		if _, werr := unix.Write(w.wake[1], []byte{0}); werr != nil && !errors.Is(werr, unix.EAGAIN) {
+			log.Printf("cannot wake inotify watcher: %v", werr)
+		}
+		<-w.done
+		err = syscall.Close(w.fd)
+		unix.Close(w.wake[0])
+		unix.Close(w.wake[1])
+	})
+	return err
+}
+
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.done)
+
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.PathMax)]byte
+	fds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wake[0]), Events: unix.POLLIN},
+	}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			log.Printf("inotify watcher stopped: %v", err)
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		if fds[0].Revents == 0 {
+			continue
+		}
+
+		n, err := syscall.Read(w.fd, buf[:])
+		if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err != nil || n < syscall.SizeofInotifyEvent {
+			log.Printf("inotify watcher stopped: %v", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(raw.Len)], "\x00"))
+			offset = nameStart + int(raw.Len)
+			w.handleEvent(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.queue.setOverflow()
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if ok && mask&syscall.IN_IGNORED != 0 {
+		// The watch was removed, as the directory itself is gone
+		delete(w.dirs, wd)
+		if w.wds[dir] == wd {
+			delete(w.wds, dir)
+		}
+	}
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	event := rpccommon.ChangeEvent{
+		FullPath: filepath.Join(dir, name),
+		IsDir:    mask&syscall.IN_ISDIR != 0,
+	}
+	switch {
+	case mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+		event.FullPath = dir
+		event.IsDir = true
+		event.Op = rpccommon.CHANGE_DELETE
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		event.Op = rpccommon.CHANGE_CREATE
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		event.Op = rpccommon.CHANGE_DELETE
+	case mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+		event.Op = rpccommon.CHANGE_MODIFY
+	case mask&syscall.IN_ATTRIB != 0:
+		event.Op = rpccommon.CHANGE_ATTRIB
+	default:
+		return
+	}
+	w.queue.push(event)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFor collects events until one matches want, or the deadline expires
+func waitFor(t *testing.T, w changeWatcher, want rpccommon.ChangeEvent) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		events, _ := w.Wait(100*time.Millisecond, 0)
+		for _, e := range events {
+			if e == want {
+				return
+			}
+		}
+	}
+	t.Fatalf("event not received: %+v", want)
+}
+
+func TestInotifyWatcher(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newPlatformWatcher()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	assert.NoError(t, w.Add(dir))
+	assert.NoError(t, w.Add(dir)) // Already watched
+
+	f := filepath.Join(dir, "f")
+	assert.NoError(t, os.WriteFile(f, []byte("x"), 0600))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: f, Op: rpccommon.CHANGE_CREATE})
+
+	assert.NoError(t, os.WriteFile(f, []byte("yy"), 0600))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: f, Op: rpccommon.CHANGE_MODIFY})
+
+	assert.NoError(t, os.Chmod(f, 0644))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: f, Op: rpccommon.CHANGE_ATTRIB})
+
+	sub := filepath.Join(dir, "sub")
+	assert.NoError(t, os.Mkdir(sub, 0755))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: sub, Op: rpccommon.CHANGE_CREATE, IsDir: true})
+
+	assert.NoError(t, os.Rename(f, filepath.Join(sub, "g")))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: f, Op: rpccommon.CHANGE_DELETE})
+
+	assert.NoError(t, w.Add(sub))
+	assert.NoError(t, os.RemoveAll(sub))
+	waitFor(t, w, rpccommon.ChangeEvent{FullPath: sub, Op: rpccommon.CHANGE_DELETE, IsDir: true})
+
+	// Removed directories can be watched again
+	assert.NoError(t, os.Mkdir(sub, 0755))
+	assert.Eventually(t, func() bool { return w.Add(sub) == nil }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestInotifyWatcherClose(t *testing.T) {
+	w, err := newPlatformWatcher()
+	if !assert.NoError(t, err) {
+		return
+	}
+	iw := w.(*inotifyWatcher)
+
+	assert.NoError(t, w.Close())
+	select {
+	case <-iw.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader goroutine still running after Close")
+	}
+	assert.NoError(t, w.Close()) // Idempotent
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "syscall"
+
+// newPlatformWatcher reports that change notifications are only available on Linux
+func newPlatformWatcher() (changeWatcher, error) {
+	return nil, syscall.ENOSYS
+}
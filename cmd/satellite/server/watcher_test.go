@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dguerri/dockerfuse/pkg/rpccommon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueueWait(t *testing.T) {
+	q := newEventQueue()
+
+	events, overflow := q.wait(10*time.Millisecond, 0)
+	assert.Empty(t, events)
+	assert.False(t, overflow)
+
+	a := rpccommon.ChangeEvent{FullPath: "/a", Op: rpccommon.CHANGE_MODIFY}
+	b := rpccommon.ChangeEvent{FullPath: "/b", Op: rpccommon.CHANGE_CREATE}
+	q.push(a)
+	q.push(a) // Coalesced
+	q.push(b)
+
+	events, overflow = q.wait(time.Second, 1)
+	assert.Equal(t, []rpccommon.ChangeEvent{a}, events)
+	assert.False(t, overflow)
+	events, _ = q.wait(time.Second, 0)
+	assert.Equal(t, []rpccommon.ChangeEvent{b}, events)
+}
+
+func TestEventQueueWaitBlocks(t *testing.T) {
+	q := newEventQueue()
+	a := rpccommon.ChangeEvent{FullPath: "/a", Op: rpccommon.CHANGE_DELETE}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.push(a)
+	}()
+
+	events, _ := q.wait(10*time.Second, 0)
+	assert.Equal(t, []rpccommon.ChangeEvent{a}, events)
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	q := newEventQueue()
+	for i := 0; i <= maxQueuedEvents; i++ {
+		q.push(rpccommon.ChangeEvent{FullPath: "/f", Op: uint8(i%2 + 1)})
+	}
+
+	events, overflow := q.wait(time.Second, 0)
+	assert.Empty(t, events)
+	assert.True(t, overflow)
+
+	// Overflow is reported once
+	q.push(rpccommon.ChangeEvent{FullPath: "/f"})
+	events, overflow = q.wait(time.Second, 0)
+	assert.Len(t, events, 1)
+	assert.False(t, overflow)
+
+	q.setOverflow()
+	_, overflow = q.wait(time.Second, 0)
+	assert.True(t, overflow)
+}
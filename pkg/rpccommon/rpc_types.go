@@ -37,6 +37,9 @@ type StatReply struct {
 	Atime      int64
 	Mtime      int64
 	Ctime      int64
+	AtimeNsec  int64
+	MtimeNsec  int64
+	CtimeNsec  int64
 	Size       int64
 	Blocks     int64
 	Blksize    int32
@@ -271,3 +274,35 @@ func (r *SetAttrRequest) SetMTime(m time.Time) { r.MTime = m; r.ValidAttrs |= SA
 
 // SetSize marks Size as valid and sets it.
 func (r *SetAttrRequest) SetSize(s uint64) { r.Size = s; r.ValidAttrs |= SATTR_SIZE }
+
+// Change event kinds used by ChangeEvent.Op.
+const (
+	// CHANGE_CREATE indicates a new entry appeared in a directory.
+	CHANGE_CREATE = (1 << 0)
+	// CHANGE_DELETE indicates an entry was removed from a directory.
+	CHANGE_DELETE = (1 << 1)
+	// CHANGE_MODIFY indicates the content of a file changed.
+	CHANGE_MODIFY = (1 << 2)
+	// CHANGE_ATTRIB indicates the attributes of an entry changed.
+	CHANGE_ATTRIB = (1 << 3)
+)
+
+// ChangeEvent describes a change made to the filesystem.
+type ChangeEvent struct {
+	FullPath string
+	Op       uint8 // See CHANGE_* constants
+	IsDir    bool
+}
+
+// WaitEventsRequest asks for filesystem changes, blocking for up to Timeout.
+type WaitEventsRequest struct {
+	Timeout   time.Duration
+	MaxEvents int
+}
+
+// WaitEventsReply contains the filesystem changes observed since the previous request.
+type WaitEventsReply struct {
+	Events []ChangeEvent
+	// Overflow is set when events have been lost and all cached state should be dropped
+	Overflow bool
+}